@@ -0,0 +1,249 @@
+/*
+Package logging : write leveled and structured logs whose level and format are given by environment variables.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+LogLevel : LOG_LEVEL is an environment variable name to set the lowest level of the logs, which is "debug", "info" (default), "warn" or "error".
+*/
+const LogLevel = "LOG_LEVEL"
+
+/*
+LogFormat : LOG_FORMAT is an environment variable name to set the format of the logs, which is "text" (default) or "json".
+*/
+const LogFormat = "LOG_FORMAT"
+
+/*
+Level : the level of a log.
+*/
+type Level int
+
+/*
+LevelDebug : the level of the logs of each decision, which are too many for production.
+*/
+const LevelDebug Level = 0
+
+/*
+LevelInfo : the level of the logs of loading the configurations.
+*/
+const LevelInfo Level = 1
+
+/*
+LevelWarn : the level of the logs of the configurations ignored or kept.
+*/
+const LevelWarn Level = 2
+
+/*
+LevelError : the level of the logs of failures.
+*/
+const LevelError Level = 3
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+/*
+String : get the name of the level like "info".
+*/
+func (level Level) String() string {
+	if level < LevelDebug || level > LevelError {
+		return strconv.Itoa(int(level))
+	}
+	return levelNames[level]
+}
+
+type settings struct {
+	level Level
+	json  bool
+}
+
+var current atomic.Value
+
+var mutex sync.Mutex
+var output io.Writer = os.Stderr
+var now = time.Now
+
+func init() {
+	Configure()
+}
+
+/*
+Configure : read LOG_LEVEL and LOG_FORMAT again.
+*/
+func Configure() {
+	level, levelErr := getLevel()
+	json, formatErr := getJSON()
+	current.Store(settings{level: level, json: json})
+	// the unknown values are written after the settings are stored, in the format of the settings
+	for _, err := range []error{levelErr, formatErr} {
+		if err != nil {
+			Warn(err.Error())
+		}
+	}
+}
+
+/*
+SetOutput : set the destination of the logs, which is os.Stderr by default.
+*/
+func SetOutput(w io.Writer) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	output = w
+}
+
+/*
+Enabled : check whether the logs of the level are written, so that the arguments of a disabled log are not built.
+*/
+func Enabled(level Level) bool {
+	return level >= current.Load().(settings).level
+}
+
+/*
+Debug : write the log of the debug level with the pairs of the keys and the values.
+*/
+func Debug(msg string, keysAndValues ...interface{}) {
+	write(LevelDebug, msg, keysAndValues)
+}
+
+/*
+Info : write the log of the info level with the pairs of the keys and the values.
+*/
+func Info(msg string, keysAndValues ...interface{}) {
+	write(LevelInfo, msg, keysAndValues)
+}
+
+/*
+Warn : write the log of the warn level with the pairs of the keys and the values.
+*/
+func Warn(msg string, keysAndValues ...interface{}) {
+	write(LevelWarn, msg, keysAndValues)
+}
+
+/*
+Error : write the log of the error level with the pairs of the keys and the values.
+*/
+func Error(msg string, keysAndValues ...interface{}) {
+	write(LevelError, msg, keysAndValues)
+}
+
+func write(level Level, msg string, keysAndValues []interface{}) {
+	settings := current.Load().(settings)
+	if level < settings.level {
+		return
+	}
+	var line []byte
+	if settings.json {
+		line = formatJSON(now(), level, msg, keysAndValues)
+	} else {
+		line = formatText(now(), level, msg, keysAndValues)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	output.Write(line)
+}
+
+/*
+Access : write the access log of a request to w, which is never filtered by LOG_LEVEL.
+	The text is written as it is by default, and the keys and the values are written as a line of JSON with LOG_FORMAT=json.
+*/
+func Access(w io.Writer, text string, keysAndValues ...interface{}) {
+	if current.Load().(settings).json {
+		w.Write(formatJSON(now(), LevelInfo, "access", keysAndValues))
+		return
+	}
+	io.WriteString(w, text)
+}
+
+// formatJSON formats a log as a line of JSON, whose fields are "time", "level", "msg" and the keys in the order.
+func formatJSON(t time.Time, level Level, msg string, keysAndValues []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeJSON(&buf, t.UTC().Format(time.RFC3339Nano))
+	buf.WriteString(`,"level":`)
+	writeJSON(&buf, level.String())
+	buf.WriteString(`,"msg":`)
+	writeJSON(&buf, msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		buf.WriteByte(',')
+		writeJSON(&buf, fmt.Sprint(keysAndValues[i]))
+		buf.WriteByte(':')
+		writeJSON(&buf, value(keysAndValues, i+1))
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeJSON(buf *bytes.Buffer, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+	buf.Write(b)
+}
+
+// formatText formats a log like the standard logger with the level, and the message is followed by the pairs like key=value.
+// The message is not quoted so that it can be read as before, and a value is quoted when it has spaces or quotes.
+func formatText(t time.Time, level Level, msg string, keysAndValues []interface{}) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s [%s] %s", t.Format("2006/01/02 15:04:05"), strings.ToUpper(level.String()), strings.TrimRight(msg, "\n"))
+	for i := 0; i < len(keysAndValues); i += 2 {
+		text := fmt.Sprint(value(keysAndValues, i+1))
+		if len(text) == 0 || strings.ContainsAny(text, " \t\r\n\"=") {
+			text = strconv.Quote(text)
+		}
+		fmt.Fprintf(&buf, " %v=%s", keysAndValues[i], text)
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes()
+}
+
+// value returns the value of the key, and an error is written as its message. A key without its value has "!MISSING".
+func value(keysAndValues []interface{}, i int) interface{} {
+	if i >= len(keysAndValues) {
+		return "!MISSING"
+	}
+	if err, ok := keysAndValues[i].(error); ok {
+		return err.Error()
+	}
+	return keysAndValues[i]
+}
+
+func getLevel() (Level, error) {
+	switch name := strings.ToLower(strings.TrimSpace(os.Getenv(LogLevel))); name {
+	case "debug":
+		return LevelDebug, nil
+	case "", "info":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	default:
+		return LevelInfo, fmt.Errorf("unknown %s: %s", LogLevel, name)
+	}
+}
+
+func getJSON() (bool, error) {
+	switch format := strings.ToLower(strings.TrimSpace(os.Getenv(LogFormat))); format {
+	case "json":
+		return true, nil
+	case "", "text":
+		return false, nil
+	default:
+		return false, fmt.Errorf("unknown %s: %s", LogFormat, format)
+	}
+}
@@ -0,0 +1,149 @@
+/*
+Package logging : write leveled and structured logs whose level and format are given by environment variables.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setUp(t *testing.T, level string, format string) (*bytes.Buffer, func()) {
+	t.Helper()
+	log.SetOutput(ioutil.Discard)
+	os.Setenv(LogLevel, level)
+	os.Setenv(LogFormat, format)
+	Configure()
+	var buf bytes.Buffer
+	SetOutput(&buf)
+	now = func() time.Time { return time.Date(2019, 1, 2, 3, 4, 5, 0, time.UTC) }
+	return &buf, func() {
+		os.Unsetenv(LogLevel)
+		os.Unsetenv(LogFormat)
+		Configure()
+		SetOutput(os.Stderr)
+		now = time.Now
+		log.SetOutput(os.Stderr)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	assert := assert.New(t)
+	buf, tearDown := setUp(t, "debug", "json")
+	defer tearDown()
+
+	Debug("auth decision", "host", "api.example.com", "status", 403, "error", errors.New("path not allowed"), "dangling")
+	var fields map[string]interface{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &fields), "a log is a line of JSON")
+	assert.Equal(map[string]interface{}{
+		"time":     "2019-01-02T03:04:05Z",
+		"level":    "debug",
+		"msg":      "auth decision",
+		"host":     "api.example.com",
+		"status":   float64(403),
+		"error":    "path not allowed",
+		"dangling": "!MISSING",
+	}, fields, "the keys and the values are the fields")
+	assert.True(strings.HasPrefix(buf.String(), `{"time":"2019-01-02T03:04:05Z","level":"debug","msg":"auth decision","host":`), "the fields are in the order")
+	assert.Equal(1, strings.Count(buf.String(), "\n"), "a log is a line")
+}
+
+func TestText(t *testing.T) {
+	assert := assert.New(t)
+	buf, tearDown := setUp(t, "", "")
+	defer tearDown()
+
+	Warn(`AUTH_TOKENS parse failed: "basic_auths"`, "path", "/etc/tokens.json", "error", errors.New("not found"), "empty", "")
+	assert.True(strings.HasSuffix(buf.String(), ` [WARN] AUTH_TOKENS parse failed: "basic_auths" path=/etc/tokens.json error="not found" empty=""`+"\n"),
+		"the message is not quoted, and the values with spaces are quoted: %s", buf.String())
+}
+
+func TestLevel(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		level    string
+		expected []string
+		desc     string
+	}{
+		{level: "", expected: []string{"info", "warn", "error"}, desc: "info is the default level"},
+		{level: "debug", expected: []string{"debug", "info", "warn", "error"}, desc: "debug writes all logs"},
+		{level: "INFO", expected: []string{"info", "warn", "error"}, desc: "the level is case insensitive"},
+		{level: "warning", expected: []string{"warn", "error"}, desc: "warning is an alias of warn"},
+		{level: "error", expected: []string{"error"}, desc: "error writes only errors"},
+		{level: "verbose", expected: []string{"info", "warn", "error"}, desc: "an unknown level is info"},
+	}
+	for _, c := range cases {
+		buf, tearDown := setUp(t, c.level, "json")
+		Debug("debug")
+		Info("info")
+		Warn("warn")
+		Error("error")
+		written := []string{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var fields map[string]string
+			if json.Unmarshal([]byte(line), &fields) == nil {
+				written = append(written, fields["level"])
+			}
+		}
+		assert.Equal(c.expected, written, c.desc)
+		assert.Equal(c.expected[0] == "debug", Enabled(LevelDebug), c.desc)
+		tearDown()
+	}
+}
+
+func TestAccess(t *testing.T) {
+	assert := assert.New(t)
+
+	t.Run("text", func(t *testing.T) {
+		_, tearDown := setUp(t, "error", "")
+		defer tearDown()
+
+		var access bytes.Buffer
+		Access(&access, "[GIN] 200 | GET /foo/1\n", "status", 200, "path", "/foo/1")
+		assert.Equal("[GIN] 200 | GET /foo/1\n", access.String(), "the text is written as it is even if LOG_LEVEL is error")
+	})
+
+	t.Run("json", func(t *testing.T) {
+		_, tearDown := setUp(t, "error", "json")
+		defer tearDown()
+
+		var access bytes.Buffer
+		Access(&access, "[GIN] 200 | GET /foo/1\n", "status", 200, "path", "/foo/1")
+		var fields map[string]interface{}
+		assert.NoError(json.Unmarshal(access.Bytes(), &fields), "the access log is a line of JSON")
+		assert.Equal(map[string]interface{}{
+			"time":   "2019-01-02T03:04:05Z",
+			"level":  "info",
+			"msg":    "access",
+			"status": float64(200),
+			"path":   "/foo/1",
+		}, fields, "the keys and the values are the fields even if LOG_LEVEL is error")
+	})
+}
+
+func TestConfigureUnknown(t *testing.T) {
+	assert := assert.New(t)
+	buf, tearDown := setUp(t, "", "")
+	defer tearDown()
+
+	os.Setenv(LogLevel, "verbose")
+	os.Setenv(LogFormat, "json")
+	Configure()
+	var fields map[string]interface{}
+	assert.NoError(json.Unmarshal(buf.Bytes(), &fields), "the unknown value is written in the configured format")
+	assert.Equal("warn", fields["level"], "the unknown value is a warning")
+	assert.Equal("unknown LOG_LEVEL: verbose", fields["msg"], "the unknown value is written")
+}
@@ -7,18 +7,136 @@ Package main : entry point of fiware-ambassador-auth.
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
+	"syscall"
 
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
 	"github.com/RoboticBase/fiware-ambassador-auth/router"
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
 )
 
 const listenPort = "LISTEN_PORT"
 const defaultPort = "8080"
+const tlsCertFile = "TLS_CERT_FILE"
+const tlsKeyFile = "TLS_KEY_FILE"
+const validateOnly = "VALIDATE_ONLY"
 
 func main() {
+	validateFlag := flag.Bool("validate", false, "validate the token configurations and exit without starting the server")
+	exportFlag := flag.String("export", "", "write the effective token configurations as JSON with the secrets \"redact\"ed or \"hash\"ed, and exit without starting the server")
+	flag.Parse()
+	if *validateFlag || getValidateOnly() {
+		os.Exit(validate(os.Stdout))
+	}
+	if len(*exportFlag) > 0 {
+		os.Exit(export(os.Stdout, *exportFlag))
+	}
+
+	// stop the server gracefully on SIGTERM of container runtimes, and on SIGINT of terminals
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 	handler := router.NewHandler()
-	handler.Run(getListenPort())
+	var err error
+	// HTTPS is served only when both files are given, otherwise plain HTTP is served like before
+	if certFile, keyFile := os.Getenv(tlsCertFile), os.Getenv(tlsKeyFile); len(certFile) > 0 && len(keyFile) > 0 {
+		err = handler.RunTLSWithContext(ctx, getListenPort(), certFile, keyFile)
+	} else {
+		err = handler.RunWithContext(ctx, getListenPort())
+	}
+	if err != nil {
+		logging.Error("server stopped", "error", err)
+	}
+}
+
+func getValidateOnly() bool {
+	validate, err := strconv.ParseBool(os.Getenv(validateOnly))
+	return err == nil && validate
+}
+
+// validate loads the token configurations in the same way as the server, reports the summary, the warnings and the errors to out,
+// and returns the exit code, which is 1 when the configurations have any error.
+func validate(out io.Writer) int {
+	// the logs of loading repeat the warnings and the errors reported to out, so they are not written to the output of CI
+	logging.SetOutput(ioutil.Discard)
+	defer logging.SetOutput(os.Stderr)
+	holder, err := loadHolder()
+	if err != nil {
+		fmt.Fprintf(out, "ERROR: %v\ninvalid: 1 errors\n", err)
+		return 1
+	}
+	defer holder.Close()
+
+	hosts := holder.GetHosts()
+	fmt.Fprintf(out, "hosts: %d\n", len(hosts))
+	for _, host := range hosts {
+		allowedPaths := 0
+		for _, bearerToken := range holder.GetTokens(host) {
+			allowedPaths += len(holder.GetAllowedPaths(host, bearerToken))
+		}
+		users := map[string]bool{}
+		for _, pathUsers := range holder.GetBasicAuthConf(host) {
+			for user := range pathUsers {
+				users[user] = true
+			}
+		}
+		fmt.Fprintf(out, "  %s: bearer_tokens=%d (allowed_paths=%d), basic_auths=%d (allowed_paths=%d), no_auths.allowed_paths=%d\n",
+			host, len(holder.GetTokens(host)), allowedPaths, len(users), len(holder.GetBasicAuthConf(host)), len(holder.GetNoAuthPaths(host)))
+	}
+	warnings := append([]string{}, holder.Warnings()...)
+	sort.Strings(warnings)
+	for _, warning := range warnings {
+		fmt.Fprintf(out, "WARNING: %s\n", warning)
+	}
+	errors := holder.Errors()
+	for _, loadError := range errors {
+		fmt.Fprintf(out, "ERROR: %s\n", loadError)
+	}
+	if len(errors) > 0 {
+		fmt.Fprintf(out, "invalid: %d errors\n", len(errors))
+		return 1
+	}
+	fmt.Fprintf(out, "valid\n")
+	return 0
+}
+
+// export loads the token configurations in the same way as the server, and writes the effective configurations to out,
+// so that they can be committed and diffed in GitOps. It returns the exit code, which is 1 when they can not be exported.
+func export(out io.Writer, secrets string) int {
+	// the logs of loading are not written, so that only the errors of the export are written to stderr
+	logging.SetOutput(ioutil.Discard)
+	defer logging.SetOutput(os.Stderr)
+	holder, err := loadHolder()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	defer holder.Close()
+
+	exported, err := holder.Export(secrets)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	fmt.Fprintf(out, "%s\n", exported)
+	return 0
+}
+
+// loadHolder loads the token configurations, and returns the error instead of panicking like AUTH_TOKENS_REQUIRE_HOSTS.
+func loadHolder() (holder *token.Holder, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	return token.NewHolder(), nil
 }
 
 func getListenPort() string {
@@ -7,11 +7,14 @@ Package main : entry point of fiware-ambassador-auth.
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
 )
 
 func TestGetListenPortNoEnv(t *testing.T) {
@@ -47,3 +50,137 @@ func TestGetListenPortWithEnv(t *testing.T) {
 		})
 	}
 }
+
+func TestGetValidateOnly(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv(validateOnly)
+
+	cases := []struct {
+		value  string
+		expect bool
+	}{
+		{value: "", expect: false},
+		{value: "invalid", expect: false},
+		{value: "false", expect: false},
+		{value: "true", expect: true},
+	}
+	for _, c := range cases {
+		os.Setenv(validateOnly, c.value)
+		assert.Equal(c.expect, getValidateOnly(), "VALIDATE_ONLY=%q", c.value)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(token.AuthTokensPath)
+	defer os.Unsetenv(token.AuthTokensRequireHosts)
+
+	settings := func(bearerPath string, noAuthPath string) string {
+		return fmt.Sprintf(`[{
+			"host": "api.example.com",
+			"settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": [%q]}],
+				"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["^/piyo/.*$"]}],
+				"no_auths": {"allowed_paths": [%q]}
+			}
+		}]`, bearerPath, noAuthPath)
+	}
+
+	t.Run("valid", func(t *testing.T) {
+		os.Setenv(token.AuthTokens, settings("^/foo/.*$", "^/static/.*$"))
+		var out bytes.Buffer
+
+		assert.Equal(0, validate(&out), "exit 0 when the configurations are valid")
+		assert.Contains(out.String(), "hosts: 1\n", "the number of hosts is reported")
+		assert.Contains(out.String(), "api.example.com: bearer_tokens=1 (allowed_paths=1), basic_auths=1 (allowed_paths=1), no_auths.allowed_paths=1\n",
+			"the summary of the host is reported")
+		assert.Contains(out.String(), "valid\n", "the result is reported")
+		assert.NotContains(out.String(), "TOKEN1", "the tokens are never written")
+		assert.NotContains(out.String(), "password1", "the passwords are never written")
+	})
+
+	cases := []struct {
+		name     string
+		setEnv   func()
+		messages []string
+	}{
+		{
+			name:     "broken json",
+			setEnv:   func() { os.Setenv(token.AuthTokens, `[{"host": "api.example.com",}]`) },
+			messages: []string{"ERROR: parse failed: invalid character '}' looking for beginning of object key string at line 1, column 29"},
+		},
+		{
+			name: "missing field",
+			setEnv: func() {
+				os.Setenv(token.AuthTokens, `[{"host": "api.example.com", "settings": {"bearer_tokens": [], "no_auths": {}}}]`)
+			},
+			messages: []string{`ERROR: parse failed: basic_auths is required in the element [0] (host "api.example.com")`},
+		},
+		{
+			name:   "invalid patterns",
+			setEnv: func() { os.Setenv(token.AuthTokens, settings("(", "[")) },
+			messages: []string{
+				`ERROR: no_auths.allowed_paths on api.example.com: invalid pattern "["`,
+				`ERROR: bearer_tokens.allowed_paths on api.example.com: invalid pattern "("`,
+				"invalid: 2 errors",
+			},
+		},
+		{
+			name: "missing file",
+			setEnv: func() {
+				os.Unsetenv(token.AuthTokens)
+				os.Setenv(token.AuthTokensPath, "/nonexistent/tokens.json")
+			},
+			messages: []string{"ERROR: can not read AUTH_TOKENS_PATH: /nonexistent/tokens.json"},
+		},
+		{
+			name: "no hosts required",
+			setEnv: func() {
+				os.Setenv(token.AuthTokens, "[]")
+				os.Setenv(token.AuthTokensRequireHosts, "true")
+			},
+			messages: []string{"ERROR: AUTH_TOKENS_REQUIRE_HOSTS is set, but AUTH_TOKENS has no hosts"},
+		},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			os.Unsetenv(token.AuthTokens)
+			os.Unsetenv(token.AuthTokensPath)
+			os.Unsetenv(token.AuthTokensRequireHosts)
+			c.setEnv()
+			var out bytes.Buffer
+
+			assert.Equal(1, validate(&out), "exit 1 when the configurations are invalid")
+			for _, message := range c.messages {
+				assert.Contains(out.String(), message, "the error is reported")
+			}
+		})
+	}
+}
+
+func TestExport(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[{
+		"domain": "api.example.com",
+		"settings": {
+			"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+			"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["^/piyo/.*$"]}],
+			"no_auths": {}
+		}
+	}]`)
+
+	var out bytes.Buffer
+	assert.Equal(0, export(&out, token.ExportRedact), "exit 0 when the configurations are exported")
+	assert.Contains(out.String(), `"host": "api.example.com"`, "the alias is resolved")
+	assert.Contains(out.String(), `"password": "<redacted>"`, "the password is redacted")
+	assert.NotContains(out.String(), "TOKEN1", "the tokens are never written")
+	assert.NotContains(out.String(), "password1", "the passwords are never written")
+	assert.NotContains(out.String(), "rawTokens", "the log of loading is not written")
+
+	out.Reset()
+	assert.Equal(1, export(&out, "plain"), "exit 1 for an unknown secrets")
+	assert.Empty(out.String(), "nothing is exported")
+}
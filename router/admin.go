@@ -0,0 +1,141 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+/*
+AdminListenPort : ADMIN_LISTEN_PORT is an environment variable name to set the port of the admin API.
+	The admin API is not started when it is not set. Do not expose the port to the outside of your cluster.
+*/
+const AdminListenPort = "ADMIN_LISTEN_PORT"
+
+const maxDecisionPaths = 100
+const maxValidateBodySize = 10 << 20
+
+type dryRunKey struct{}
+
+type decisionsRequest struct {
+	Host          string   `json:"host"`
+	Method        string   `json:"method"`
+	Authorization string   `json:"authorization"`
+	ClientIP      string   `json:"client_ip"`
+	Paths         []string `json:"paths"`
+}
+
+type decision struct {
+	Path    string `json:"path"`
+	Allowed bool   `json:"allowed"`
+	Status  int    `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (router *Handler) newAdmin() *gin.Engine {
+	admin := gin.New()
+	admin.Use(customLogger(1))
+	admin.Use(gin.Recovery())
+	admin.POST("/decisions", router.decisions)
+	admin.POST("/validate", validate)
+	admin.GET("/config", router.exportConfig)
+	if router.rejectionTracker != nil {
+		admin.GET("/rejections", router.rejections)
+	}
+	return admin
+}
+
+func (router *Handler) newAdminServer(port string) *http.Server {
+	server := router.newServer(port)
+	server.Handler = router.Admin
+	return server
+}
+
+// decisions returns the decision of each path for the credential, so that the callers do not need a round-trip per path.
+func (router *Handler) decisions(context *gin.Context) {
+	var body decisionsRequest
+	if err := context.ShouldBindJSON(&body); err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	if len(body.Host) == 0 {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "host is required"})
+		return
+	}
+	if len(body.Paths) == 0 || maxDecisionPaths < len(body.Paths) {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "paths must have 1 to 100 paths"})
+		return
+	}
+	method := strings.ToUpper(body.Method)
+	if len(method) == 0 {
+		method = http.MethodGet
+	}
+	decisions := make([]decision, 0, len(body.Paths))
+	for _, path := range body.Paths {
+		decisions = append(decisions, router.decide(body.Host, method, path, body.Authorization, body.ClientIP))
+	}
+	context.JSON(http.StatusOK, gin.H{
+		"host":      body.Host,
+		"method":    method,
+		"decisions": decisions,
+	})
+}
+
+// decide authorizes the path in process by the same logic as the requests served by Engine.
+// The request is marked as a dry run not to consume the rate limits.
+func (router *Handler) decide(host string, method string, path string, authorization string, clientIP string) decision {
+	result, status := router.decideInProcess(host, method, path, authorization, clientIP, true)
+	return decision{Path: path, Allowed: result.Allowed, Status: status, Error: result.Error}
+}
+
+// validate reports whether the candidate token configurations in the body are valid, without applying them.
+func validate(context *gin.Context) {
+	rawTokens, err := ioutil.ReadAll(http.MaxBytesReader(context.Writer, context.Request.Body, maxValidateBodySize))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "invalid body: " + err.Error()})
+		return
+	}
+	report := token.Validate(rawTokens)
+	if !report.Valid {
+		context.JSON(http.StatusUnprocessableEntity, report)
+		return
+	}
+	context.JSON(http.StatusOK, report)
+}
+
+func isDryRun(request *http.Request) bool {
+	dryRun, _ := request.Context().Value(dryRunKey{}).(bool)
+	return dryRun
+}
+
+func getAdminListenPort() string {
+	port := os.Getenv(AdminListenPort)
+	intPort, err := strconv.Atoi(port)
+	if err != nil || intPort < 1 || 65535 < intPort {
+		return ""
+	}
+	return ":" + port
+}
+
+// exportConfig returns the effective token configurations as canonical JSON, so that they can be diffed against their source.
+// The secrets are redacted by default, and hashed with "?secrets=hash".
+func (router *Handler) exportConfig(context *gin.Context) {
+	exported, err := router.holder.Export(context.DefaultQuery("secrets", token.ExportRedact))
+	if err != nil {
+		context.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	context.Data(http.StatusOK, "application/json; charset=utf-8", exported)
+}
@@ -0,0 +1,235 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerDecisions(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$", "^/bar/.*$"],
+						"rate_limit": {"requests": 1, "period": "1h"}
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`)
+	handler := NewHandler()
+
+	postDecisions := func(body string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/decisions", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		handler.Admin.ServeHTTP(w, r)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	t.Run("returns the decision of each path", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			w, response := postDecisions(`{
+				"host": "api.example.com",
+				"authorization": "Bearer TOKEN1",
+				"paths": ["/foo/1", "/bar/2?q=1", "/baz/3", "/static/app.js"]
+			}`)
+			assert.Equal(http.StatusOK, w.Code, "POST /decisions returns 200")
+			assert.Equal("GET", response["method"], "method is GET by default")
+			decisions, _ := response["decisions"].([]interface{})
+			assert.Len(decisions, 4, "a decision is returned per path")
+			expected := []struct {
+				path    string
+				allowed bool
+				status  float64
+			}{
+				{path: "/foo/1", allowed: true, status: 200},
+				{path: "/bar/2?q=1", allowed: true, status: 200},
+				{path: "/baz/3", allowed: false, status: 403},
+				{path: "/static/app.js", allowed: true, status: 200},
+			}
+			for j, e := range expected {
+				d, _ := decisions[j].(map[string]interface{})
+				assert.Equal(e.path, d["path"], "decisions keep the order of the paths")
+				assert.Equal(e.allowed, d["allowed"], "allowed of %s", e.path)
+				assert.Equal(e.status, d["status"], "status of %s", e.path)
+			}
+		}
+	})
+
+	t.Run("does not consume the rate limit", func(t *testing.T) {
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "the first request is allowed after the decisions")
+	})
+
+	t.Run("returns not allowed for an unknown token", func(t *testing.T) {
+		w, response := postDecisions(`{"host": "api.example.com", "method": "post", "authorization": "Bearer TOKEN2", "paths": ["/foo/1"]}`)
+		assert.Equal(http.StatusOK, w.Code, "POST /decisions returns 200")
+		assert.Equal("POST", response["method"], "method is upper cased")
+		decisions, _ := response["decisions"].([]interface{})
+		d, _ := decisions[0].(map[string]interface{})
+		assert.Equal(false, d["allowed"], "unknown token is not allowed")
+		assert.Equal(float64(http.StatusUnauthorized), d["status"], "unknown token returns 401")
+		assert.Equal("token mismatch", d["error"], "the reason is returned")
+	})
+
+	t.Run("returns 400 for an invalid request", func(t *testing.T) {
+		bodies := []string{
+			`invalid`,
+			`{"authorization": "Bearer TOKEN1", "paths": ["/foo/1"]}`,
+			`{"host": "api.example.com", "authorization": "Bearer TOKEN1", "paths": []}`,
+			`{"host": "api.example.com", "authorization": "Bearer TOKEN1", "paths": [` + strings.Repeat(`"/foo/1",`, maxDecisionPaths) + `"/foo/1"]}`,
+		}
+		for _, body := range bodies {
+			w, _ := postDecisions(body)
+			assert.Equal(http.StatusBadRequest, w.Code, "POST /decisions returns 400")
+		}
+	})
+
+	t.Run("is not served by Engine", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/decisions", strings.NewReader(`{}`))
+		r.Host = "api.example.com"
+		handler.Engine.ServeHTTP(w, r)
+		assert.Equal(http.StatusUnauthorized, w.Code, "/decisions is authorized as a usual path on Engine")
+	})
+}
+
+func TestGetAdminListenPort(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv(AdminListenPort)
+
+	cases := map[string]string{
+		"":      "",
+		"abc":   "",
+		"0":     "",
+		"65536": "",
+		"9090":  ":9090",
+	}
+	for port, expected := range cases {
+		os.Setenv(AdminListenPort, port)
+		assert.Equal(expected, getAdminListenPort(), "getAdminListenPort() for %q", port)
+	}
+}
+
+func TestNewHandlerValidate(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`)
+	handler := NewHandler()
+
+	postValidate := func(body string) (*httptest.ResponseRecorder, token.ValidationReport) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/validate", strings.NewReader(body))
+		handler.Admin.ServeHTTP(w, r)
+		var report token.ValidationReport
+		json.Unmarshal(w.Body.Bytes(), &report)
+		return w, report
+	}
+
+	t.Run("valid candidate", func(t *testing.T) {
+		w, report := postValidate(`[{"host": "other\\.example\\.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`)
+		assert.Equal(http.StatusOK, w.Code, "POST /validate returns 200 when the candidate is valid")
+		assert.True(report.Valid, "the candidate is valid")
+		assert.Equal(1, report.Hosts, "the number of hosts is reported")
+	})
+
+	t.Run("invalid candidate", func(t *testing.T) {
+		w, report := postValidate(`[{"host": "other\\.example\\.com", "settings": {"basic_auths": [], "no_auths": {}}}]`)
+		assert.Equal(http.StatusUnprocessableEntity, w.Code, "POST /validate returns 422 when the candidate is invalid")
+		assert.False(report.Valid, "the candidate is invalid")
+		assert.Equal([]string{"bearer_tokens is required"}, report.Errors, "the errors are reported")
+	})
+
+	t.Run("does not apply the candidate", func(t *testing.T) {
+		w := serve(handler, "GET", "api.example.com", "/static/app.js", map[string]string{})
+		assert.Equal(http.StatusOK, w.Code, "the live configurations are kept")
+		w = serve(handler, "GET", "other.example.com", "/static/app.js", map[string]string{})
+		assert.Equal(http.StatusForbidden, w.Code, "the candidate host is not applied")
+	})
+}
+
+func TestNewHandlerExportConfig(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+	handler := NewHandler()
+
+	getConfig := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		handler.Admin.ServeHTTP(w, r)
+		return w
+	}
+
+	w := getConfig("/config")
+	assert.Equal(http.StatusOK, w.Code, "GET /config returns 200")
+	var exported []map[string]interface{}
+	assert.NoError(json.Unmarshal(w.Body.Bytes(), &exported), "the effective configurations are JSON")
+	if assert.Len(exported, 1, "the hosts are exported") {
+		settings := exported[0]["settings"].(map[string]interface{})
+		bearerTokens := settings["bearer_tokens"].([]interface{})
+		assert.Equal("<redacted>", bearerTokens[0].(map[string]interface{})["token"], "the alias is resolved and the token is redacted by default")
+		assert.Equal(true, settings["cache"], "the omitted values are filled with their defaults")
+	}
+
+	w = getConfig("/config?secrets=hash")
+	assert.Equal(http.StatusOK, w.Code, "GET /config?secrets=hash returns 200")
+	assert.Contains(w.Body.String(), `"token": "sha256:`, "the token is hashed")
+	assert.NotContains(w.Body.String(), "TOKEN1", "the token is never exported")
+
+	w = getConfig("/config?secrets=plain")
+	assert.Equal(http.StatusBadRequest, w.Code, "GET /config returns 400 for an unknown secrets")
+}
@@ -0,0 +1,49 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+/*
+APIKeyQueryParam : APIKEY_QUERY_PARAM is an environment variable name to set the query parameter which carries a bearer token, like "apikey".
+*/
+const APIKeyQueryParam = "APIKEY_QUERY_PARAM"
+
+/*
+APIKeyHeader : APIKEY_HEADER is an environment variable name to set the header which carries a bearer token, like "X-API-Key".
+	The header wins over the query parameter, and both win over the Authorization header.
+*/
+const APIKeyHeader = "APIKEY_HEADER"
+
+// apiKey returns the bearer token given by the API key header or the query parameter of the original request,
+// or an empty string when neither is configured nor given.
+func (router *Handler) apiKey(request *http.Request, rawQuery string) string {
+	if len(router.apiKeyHeader) > 0 {
+		if apiKey := strings.TrimSpace(request.Header.Get(router.apiKeyHeader)); len(apiKey) > 0 {
+			return apiKey
+		}
+	}
+	if len(router.apiKeyQueryParam) > 0 {
+		// the parameters before a malformed one are still used
+		query, _ := url.ParseQuery(rawQuery)
+		return strings.TrimSpace(query.Get(router.apiKeyQueryParam))
+	}
+	return ""
+}
+
+// credentialHeaders returns the headers which carry the credentials, to vary the responses and to strip them.
+func (router *Handler) credentialHeaders() []string {
+	headers := []string{http.CanonicalHeaderKey(authHeader)}
+	if len(router.apiKeyHeader) > 0 {
+		headers = append(headers, http.CanonicalHeaderKey(router.apiKeyHeader))
+	}
+	return headers
+}
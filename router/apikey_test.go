@@ -0,0 +1,94 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerAPIKey(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(APIKeyQueryParam)
+	defer os.Unsetenv(APIKeyHeader)
+	defer os.Unsetenv(StripCredentialOnSuccess)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]},
+					{"token": "TOKEN2", "allowed_paths": ["^/bar/.*$"]}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+
+	t.Run("without APIKEY_QUERY_PARAM and APIKEY_HEADER", func(t *testing.T) {
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1?apikey=TOKEN1", map[string]string{"X-API-Key": "TOKEN1"})
+		assert.Equal(http.StatusUnauthorized, w.Code, "the api keys are ignored by default")
+		w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "the Authorization header is used by default")
+	})
+
+	t.Run("with APIKEY_QUERY_PARAM and APIKEY_HEADER", func(t *testing.T) {
+		os.Setenv(APIKeyQueryParam, "apikey")
+		os.Setenv(APIKeyHeader, "X-API-Key")
+		os.Setenv(VaryAuthorization, "true")
+		defer os.Unsetenv(VaryAuthorization)
+		handler := NewHandler()
+
+		cases := []struct {
+			path       string
+			headers    map[string]string
+			statusCode int
+			desc       string
+		}{
+			{path: "/foo/1?apikey=TOKEN1", headers: map[string]string{}, statusCode: http.StatusOK, desc: "the token in the query parameter is allowed"},
+			{path: "/foo/1?a=b&apikey=TOKEN2", headers: map[string]string{}, statusCode: http.StatusForbidden, desc: "the paths of the token in the query parameter are checked"},
+			{path: "/foo/1?apikey=UNKNOWN", headers: map[string]string{}, statusCode: http.StatusUnauthorized, desc: "the unknown token in the query parameter is refused"},
+			{path: "/foo/1", headers: map[string]string{"X-API-Key": "TOKEN1"}, statusCode: http.StatusOK, desc: "the token in the header is allowed"},
+			{path: "/bar/1", headers: map[string]string{"x-api-key": "TOKEN1"}, statusCode: http.StatusForbidden, desc: "the paths of the token in the header are checked"},
+			{path: "/foo/1?apikey=TOKEN2", headers: map[string]string{"X-API-Key": "TOKEN1"}, statusCode: http.StatusOK, desc: "the header wins over the query parameter"},
+			{path: "/bar/1?apikey=TOKEN1", headers: map[string]string{"X-API-Key": "TOKEN2"}, statusCode: http.StatusOK, desc: "the query parameter is not used when the header is given"},
+			{path: "/foo/1?apikey=TOKEN1", headers: map[string]string{"Authorization": "Bearer TOKEN2"}, statusCode: http.StatusOK, desc: "the query parameter wins over the Authorization header"},
+			{path: "/foo/1", headers: map[string]string{"X-API-Key": "TOKEN2", "Authorization": "Bearer TOKEN1"}, statusCode: http.StatusForbidden, desc: "the Authorization header is not used when the api key is given"},
+			{path: "/foo/1?apikey=", headers: map[string]string{"X-API-Key": "", "Authorization": "Bearer TOKEN1"}, statusCode: http.StatusOK, desc: "the Authorization header is used when the api keys are empty"},
+			{path: "/foo/1", headers: map[string]string{}, statusCode: http.StatusUnauthorized, desc: "the request without any credential is refused"},
+		}
+		for _, c := range cases {
+			w := serve(handler, "GET", "api.example.com", c.path, c.headers)
+			assert.Equal(c.statusCode, w.Code, c.desc)
+		}
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"X-API-Key": "TOKEN1"})
+		assert.Equal([]string{"Authorization", "X-Api-Key"}, w.Header()["Vary"], "the responses vary by the api key header")
+	})
+
+	t.Run("with STRIP_CREDENTIAL_ON_SUCCESS", func(t *testing.T) {
+		os.Setenv(APIKeyHeader, "X-API-Key")
+		os.Setenv(StripCredentialOnSuccess, "true")
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"X-API-Key": "TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "the token in the header is allowed")
+		assert.Equal("authorization,x-api-key", w.Header().Get(headersToRemoveHeader), "the api key header is removed as well")
+	})
+}
@@ -0,0 +1,111 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	stdcontext "context"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+Decision : the decision of a request made by Authorize.
+	Allowed is false for a soft denied request even if its status is 200, and Error is the message of the rejection.
+*/
+type Decision struct {
+	Allowed bool
+	Error   string
+}
+
+/*
+Authorize : decide a request in process without a server, and get the decision and the status code which the request would get.
+	The request goes through the same checks as the requests served by Engine, including the rate limits.
+	It is not written to the access log, nor counted in the metrics and the rejections. The path may have the query string like "/foo/1?bar=baz".
+	The request has no client IP, so it is not allowed by "ip_rules". Use AuthorizeWithClientIP for the hosts which have them.
+*/
+func (router *Handler) Authorize(host string, method string, path string, authorization string) (Decision, int) {
+	return router.AuthorizeWithClientIP(host, method, path, authorization, "")
+}
+
+/*
+AuthorizeWithClientIP : decide a request from clientIP in process like Authorize. "ip_rules" and the rate limits of no_auths are applied to clientIP.
+*/
+func (router *Handler) AuthorizeWithClientIP(host string, method string, path string, authorization string, clientIP string) (Decision, int) {
+	return router.decideInProcess(host, method, path, authorization, clientIP, false)
+}
+
+// inProcessKey is the key of the request context which carries an in-process request to the Engine deciding it.
+type inProcessKey struct{}
+
+// inProcessRequest holds the client IP of an in-process request, and receives its decision.
+type inProcessRequest struct {
+	clientIP string
+	decision Decision
+	status   int
+}
+
+// newInProcessEngine returns the Engine which decides the in-process requests by authorize, without the middlewares of Engine.
+// Engine pools the contexts, so an in-process request does not create an Engine like gin.CreateTestContext does.
+func (router *Handler) newInProcessEngine() *gin.Engine {
+	engine := gin.New()
+	engine.NoRoute(func(context *gin.Context) {
+		inProcess := context.Request.Context().Value(inProcessKey{}).(*inProcessRequest)
+		inProcess.decision, inProcess.status = router.authorize(context, router.holder.Snapshot(), inProcess.clientIP)
+	})
+	return engine
+}
+
+// discardResponseWriter discards the response of an in-process request, whose decision is returned instead.
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (w discardResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w discardResponseWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (w discardResponseWriter) WriteHeader(statusCode int) {}
+
+// decideInProcess decides a request built from the arguments by authorize, without the middlewares of Engine.
+// A dry run request does not consume the rate limits.
+func (router *Handler) decideInProcess(host string, method string, path string, authorization string, clientIP string, dryRun bool) (Decision, int) {
+	request, err := http.NewRequest(method, "/", nil)
+	if err != nil {
+		return Decision{Allowed: false, Error: err.Error()}, http.StatusBadRequest
+	}
+	parts := strings.SplitN(path, "?", 2)
+	request.URL.Path = parts[0]
+	if len(parts) == 2 {
+		request.URL.RawQuery = parts[1]
+	}
+	request.Host = host
+	if len(authorization) > 0 {
+		request.Header.Set(authHeader, authorization)
+	}
+	requestContext := request.Context()
+	if dryRun {
+		requestContext = stdcontext.WithValue(requestContext, dryRunKey{}, true)
+	}
+	inProcess := &inProcessRequest{clientIP: clientIP}
+	request = request.WithContext(stdcontext.WithValue(requestContext, inProcessKey{}, inProcess))
+
+	router.inProcess.ServeHTTP(discardResponseWriter{header: http.Header{}}, request)
+	return inProcess.decision, inProcess.status
+}
+
+// decided returns the decision recorded by reject or statusOK, and the status code written to the response.
+func decided(context *gin.Context) (Decision, int) {
+	value, _ := context.Get(decisionKey)
+	decision, _ := value.(Decision)
+	return decision, context.Writer.Status()
+}
@@ -0,0 +1,191 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"net/http"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestHandlerAuthorize(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$", {"path": "^/bar/.*$", "methods": ["GET"]}]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}, {
+			"host": "soft\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {},
+				"soft_deny": true
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		host          string
+		method        string
+		path          string
+		authorization string
+		statusCode    int
+		decision      Decision
+		desc          string
+	}{
+		{host: "api.example.com", method: "GET", path: "/static/app.js", statusCode: http.StatusOK,
+			decision: Decision{Allowed: true}, desc: "the path of no_auths is allowed"},
+		{host: "api.example.com", method: "GET", path: "/piyo/1", authorization: getBasicAuthHeader("user1", "password1"), statusCode: http.StatusOK,
+			decision: Decision{Allowed: true}, desc: "the basic authentication is allowed"},
+		{host: "api.example.com", method: "GET", path: "/piyo/1", authorization: getBasicAuthHeader("user1", "invalid"), statusCode: http.StatusUnauthorized,
+			decision: Decision{Allowed: false}, desc: "the invalid password requires the basic authentication"},
+		{host: "api.example.com", method: "GET", path: "/foo/1?bar=baz", authorization: "Bearer TOKEN1", statusCode: http.StatusOK,
+			decision: Decision{Allowed: true}, desc: "the bearer token is allowed"},
+		{host: "api.example.com", method: "GET", path: "/baz/1", authorization: "Bearer TOKEN1", statusCode: http.StatusForbidden,
+			decision: Decision{Allowed: false, Error: "path not allowd"}, desc: "the path not allowed for the bearer token is forbidden"},
+		{host: "api.example.com", method: "POST", path: "/bar/1", authorization: "Bearer TOKEN1", statusCode: http.StatusMethodNotAllowed,
+			decision: Decision{Allowed: false, Error: "method not allowed"}, desc: "the method not allowed for the path is rejected"},
+		{host: "api.example.com", method: "GET", path: "/foo/1", authorization: "Bearer UNKNOWN", statusCode: http.StatusUnauthorized,
+			decision: Decision{Allowed: false, Error: "token mismatch"}, desc: "the unknown bearer token is unauthorized"},
+		{host: "api.example.com", method: "GET", path: "/foo/1", statusCode: http.StatusUnauthorized,
+			decision: Decision{Allowed: false, Error: "missing Header: authorization"}, desc: "the request without the header is unauthorized"},
+		{host: "api.example.com", method: "OPTIONS", path: "/foo/1", statusCode: http.StatusOK,
+			decision: Decision{Allowed: true}, desc: "OPTIONS is allowed"},
+		{host: "unknown.example.com", method: "GET", path: "/foo/1", authorization: "Bearer TOKEN1", statusCode: http.StatusForbidden,
+			decision: Decision{Allowed: false, Error: "domain not allowd"}, desc: "the unknown host is not allowed"},
+		{host: "soft.example.com", method: "GET", path: "/foo/1", statusCode: http.StatusOK,
+			decision: Decision{Allowed: false}, desc: "the soft denied request is not allowed"},
+		{host: "api.example.com", method: "BAD METHOD", path: "/foo/1", statusCode: http.StatusBadRequest,
+			decision: Decision{Allowed: false, Error: `net/http: invalid method "BAD METHOD"`}, desc: "the invalid method is a bad request"},
+	}
+	for _, c := range cases {
+		decision, statusCode := handler.Authorize(c.host, c.method, c.path, c.authorization)
+		assert.Equal(c.statusCode, statusCode, c.desc)
+		assert.Equal(c.decision.Allowed, decision.Allowed, c.desc)
+		if len(c.decision.Error) > 0 {
+			assert.Equal(c.decision.Error, decision.Error, c.desc)
+		}
+
+		if statusCode != http.StatusBadRequest {
+			w := serve(handler, c.method, c.host, c.path, map[string]string{"Authorization": c.authorization})
+			assert.Equal(w.Code, statusCode, "the status is the same as the request over HTTP: %s", c.desc)
+		}
+	}
+}
+
+func TestHandlerAuthorizeInProcess(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(DenyBody)
+	defer os.Unsetenv(ExtAuthzHTTP)
+
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() { logOutput = os.Stdout }()
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+				"basic_auths": [],
+				"no_auths": {},
+				"ip_rules": {"allow": ["10.0.0.0/8"]}
+			}
+		}
+	]`)
+	os.Setenv(DenyBody, "access denied")
+	os.Setenv(ExtAuthzHTTP, "true")
+	handler := NewHandler()
+
+	cases := []struct {
+		path          string
+		authorization string
+		clientIP      string
+		statusCode    int
+		decision      Decision
+		desc          string
+	}{
+		{path: "/foo/1", authorization: "Bearer TOKEN1", clientIP: "10.0.0.1", statusCode: http.StatusOK,
+			decision: Decision{Allowed: true}, desc: "the client IP allowed by ip_rules is allowed"},
+		{path: "/foo/1", authorization: "Bearer TOKEN1", clientIP: "192.0.2.1", statusCode: http.StatusForbidden,
+			decision: Decision{Allowed: false, Error: "ip not allowed"}, desc: "the client IP not allowed by ip_rules is forbidden"},
+		{path: "/foo/1", authorization: "Bearer TOKEN1", statusCode: http.StatusForbidden,
+			decision: Decision{Allowed: false, Error: "ip not allowed"}, desc: "no client IP is not allowed by ip_rules"},
+		{path: "/bar/1", authorization: "Bearer TOKEN1", clientIP: "10.0.0.1", statusCode: http.StatusForbidden,
+			decision: Decision{Allowed: false, Error: "path not allowd"}, desc: "the actual message is kept with DENY_BODY"},
+	}
+	for _, c := range cases {
+		decision, statusCode := handler.AuthorizeWithClientIP("api.example.com", "GET", c.path, c.authorization, c.clientIP)
+		assert.Equal(c.statusCode, statusCode, c.desc)
+		assert.Equal(c.decision, decision, c.desc)
+	}
+	_, statusCode := handler.Authorize("api.example.com", "GET", "/foo/1", "Bearer TOKEN1")
+	assert.Equal(http.StatusForbidden, statusCode, "the request of Authorize() has no client IP, which ip_rules does not allow")
+	assert.Empty(buf.String(), "the in-process decisions are not written to the access log")
+
+	w := serve(handler, "GET", "api.example.com", "/metrics", nil)
+	assert.NotContains(w.Body.String(), `ambassador_auth_decisions_total{`, "the in-process decisions are not counted")
+}
+
+func TestHandlerAuthorizeConcurrent(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[{"host": "api\\.example\\.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}], "basic_auths": [], "no_auths": {}}}]`)
+	handler := NewHandler()
+
+	// the contexts of the in-process requests are reused, so a decision must never leak into another one
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				decision, statusCode := handler.Authorize("api.example.com", "GET", "/foo/1", "Bearer TOKEN1")
+				assert.Equal(http.StatusOK, statusCode, "the allowed request is decided as it is")
+				assert.True(decision.Allowed, "the allowed request is decided as it is")
+				decision, statusCode = handler.Authorize("api.example.com", "GET", "/bar/1", "Bearer TOKEN1")
+				assert.Equal(http.StatusForbidden, statusCode, "the denied request is decided as it is")
+				assert.Equal("path not allowd", decision.Error, "the denied request is decided as it is")
+			}
+		}()
+	}
+	wg.Wait()
+}
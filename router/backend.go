@@ -0,0 +1,67 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+/*
+BackendErrorPolicy : BACKEND_ERROR_POLICY is an environment variable name to set how to respond when a token can not be verified because its backend, like the JWKS endpoint, is not available.
+	"fail-closed" (default) rejects the request with 503, a status code like "401" rejects it with the status, and "fail-open" approves it.
+*/
+const BackendErrorPolicy = "BACKEND_ERROR_POLICY"
+
+const failOpen = "fail-open"
+const failClosed = "fail-closed"
+
+type backendErrorPolicy struct {
+	open   bool
+	status int
+}
+
+func getBackendErrorPolicy() backendErrorPolicy {
+	rawPolicy := strings.ToLower(strings.TrimSpace(os.Getenv(BackendErrorPolicy)))
+	switch rawPolicy {
+	case "", failClosed:
+		return backendErrorPolicy{status: http.StatusServiceUnavailable}
+	case failOpen:
+		return backendErrorPolicy{open: true}
+	}
+	status, err := strconv.Atoi(rawPolicy)
+	if err != nil || status < 400 || status > 599 {
+		logging.Warn("invalid "+BackendErrorPolicy+", use "+failClosed, "value", rawPolicy)
+		return backendErrorPolicy{status: http.StatusServiceUnavailable}
+	}
+	return backendErrorPolicy{status: status}
+}
+
+// backendError responds by the policy when no token is verified because of backend errors.
+// The error is always logged, because a fail-open approval is not authorized by any credential.
+func (router *Handler) backendError(context *gin.Context, host string, path string, err error) {
+	if router.backendErrorPolicy.open {
+		logging.Error("backend error, fail open", "host", host, "path", path, "error", err)
+		traceStep(context, "backend error, fail open")
+		router.approve(context, "unverified")
+		decide(context, "backend_error")
+		return
+	}
+	decide(context, "backend_error")
+	logging.Error("backend error, fail closed", "host", host, "path", path, "error", err)
+	traceStep(context, "backend error, fail closed")
+	reject(context, router.backendErrorPolicy.status, gin.H{
+		"authorized": false,
+		"error":      "authorization backend unavailable",
+	})
+}
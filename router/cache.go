@@ -0,0 +1,144 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+/*
+AuthCachePerHost : AUTH_CACHE_PER_HOST is an environment variable name to partition the decision caches per host.
+*/
+const AuthCachePerHost = "AUTH_CACHE_PER_HOST"
+
+/*
+AuthCacheSize : AUTH_CACHE_SIZE is an environment variable name to set the size of each decision cache (per host when partitioned).
+	AUTH_CACHE_SIZE=0 disables the caches, and every decision is evaluated for each request.
+*/
+const AuthCacheSize = "AUTH_CACHE_SIZE"
+
+const defaultAuthCacheSize = 1024
+
+// pathCaches holds the caches of the decisions about paths and credentials.
+type pathCaches struct {
+	matchBasicAuthPath  *lru.Cache
+	verifyBasicAuth     *lru.Cache
+	matchBearerAuthPath *lru.Cache
+	matchNoAuthPath     *lru.Cache
+}
+
+// newMatchHostCache returns the cache of the matched hosts, or nil when the caches are disabled.
+func newMatchHostCache(size int) *lru.Cache {
+	if size == 0 {
+		return nil
+	}
+	matchHostCache, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return matchHostCache
+}
+
+func newPathCaches(size int) *pathCaches {
+	matchBasicAuthPathCache, err := lru.New(size)
+	verifyBasicAuthCache, err := lru.New(size)
+	matchBearerAuthPathCache, err := lru.New(size)
+	matchNoAuthPathCache, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return &pathCaches{
+		matchBasicAuthPath:  matchBasicAuthPathCache,
+		verifyBasicAuth:     verifyBasicAuthCache,
+		matchBearerAuthPath: matchBearerAuthPathCache,
+		matchNoAuthPath:     matchNoAuthPathCache,
+	}
+}
+
+func (c *pathCaches) purge() {
+	c.matchBasicAuthPath.Purge()
+	c.verifyBasicAuth.Purge()
+	c.matchBearerAuthPath.Purge()
+	c.matchNoAuthPath.Purge()
+}
+
+// hostCaches returns the shared pathCaches, or the pathCaches of each host when partitioned,
+// so that a busy host does not evict the cached decisions of other hosts. It returns nil when the size is 0.
+type hostCaches struct {
+	mutex   sync.Mutex
+	perHost bool
+	size    int
+	shared  *pathCaches
+	hosts   map[string]*pathCaches
+}
+
+func newHostCaches(perHost bool, size int) *hostCaches {
+	caches := &hostCaches{
+		perHost: perHost,
+		size:    size,
+		hosts:   map[string]*pathCaches{},
+	}
+	if size > 0 {
+		caches.shared = newPathCaches(size)
+	}
+	return caches
+}
+
+func (c *hostCaches) get(host string) *pathCaches {
+	if c.size == 0 {
+		return nil
+	}
+	if !c.perHost {
+		return c.shared
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	caches, ok := c.hosts[host]
+	if !ok {
+		caches = newPathCaches(c.size)
+		c.hosts[host] = caches
+	}
+	return caches
+}
+
+// purge drops all cached decisions, and the pathCaches of the hosts which may be removed by a reload.
+func (c *hostCaches) purge() {
+	if c.shared != nil {
+		c.shared.purge()
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.hosts = map[string]*pathCaches{}
+}
+
+// decisionCaches returns the caches of the host, or nil when the host disables caching the decisions by "cache": false
+// or AUTH_CACHE_SIZE=0 disables all caches.
+func (router *Handler) decisionCaches(holder *token.Holder, host string) *pathCaches {
+	if holder.IsCacheDisabled(host) {
+		return nil
+	}
+	return router.caches.get(host)
+}
+
+func getAuthCachePerHost() bool {
+	perHost, err := strconv.ParseBool(os.Getenv(AuthCachePerHost))
+	return err == nil && perHost
+}
+
+func getAuthCacheSize() int {
+	size, err := strconv.Atoi(os.Getenv(AuthCacheSize))
+	if err != nil || size < 0 {
+		return defaultAuthCacheSize
+	}
+	return size
+}
@@ -0,0 +1,312 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerAuthCachePerHost(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(AuthCacheSize)
+
+	json := `[
+		{
+			"host": "busy\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}, {
+			"host": "quiet\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	os.Setenv(AuthCacheSize, "8")
+	bearer := map[string]string{"Authorization": "Bearer TOKEN1"}
+	quietKey := "TOKEN1\tquiet.example.com\tGET\t/quiet"
+
+	doTraffic := func(handler *Handler) {
+		w := serve(handler, "GET", "quiet.example.com", "/quiet", bearer)
+		assert.Equal(http.StatusOK, w.Code, "return 200 on the quiet host")
+		for i := 0; i < 100; i++ {
+			w := serve(handler, "GET", "busy.example.com", fmt.Sprintf("/busy/%d", i), bearer)
+			assert.Equal(http.StatusOK, w.Code, "return 200 on the busy host")
+		}
+	}
+
+	t.Run("default", func(t *testing.T) {
+		handler := NewHandler()
+		doTraffic(handler)
+		assert.Equal(8, handler.caches.get(`busy\.example\.com`).matchBearerAuthPath.Len(), "the cache size is AUTH_CACHE_SIZE")
+		assert.False(handler.caches.get(`quiet\.example\.com`).matchBearerAuthPath.Contains(quietKey), "the busy host evicts the decision of the quiet host")
+	})
+
+	t.Run("AUTH_CACHE_PER_HOST=true", func(t *testing.T) {
+		os.Setenv(AuthCachePerHost, "true")
+		defer os.Unsetenv(AuthCachePerHost)
+
+		handler := NewHandler()
+		doTraffic(handler)
+		assert.Equal(8, handler.caches.get(`busy\.example\.com`).matchBearerAuthPath.Len(), "the cache size of each host is AUTH_CACHE_SIZE")
+		assert.True(handler.caches.get(`quiet\.example\.com`).matchBearerAuthPath.Contains(quietKey), "the busy host does not evict the decision of the quiet host")
+		assert.Equal(1, handler.caches.get(`quiet\.example\.com`).matchBearerAuthPath.Len(), "the quiet host has its own cache")
+	})
+}
+
+func TestNewHandlerPurgeCachesOnReload(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	logging.SetOutput(ioutil.Discard)
+	defer os.Unsetenv(token.AuthTokensPath)
+
+	json1 := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}, {
+						"token": "TOKEN2",
+						"allowed_paths": ["^/bar/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	json2 := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN2",
+						"allowed_paths": ["^/baz/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	f, err := ioutil.TempFile("", "reload")
+	assert.Nil(err, "TempFile has no error")
+	defer os.Remove(f.Name())
+	f.WriteString(json1)
+	f.Close()
+	os.Setenv(token.AuthTokensPath, f.Name())
+
+	handler := NewHandler()
+	token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+	token2 := map[string]string{"Authorization": "Bearer TOKEN2"}
+	assert.Equal(http.StatusOK, serve(handler, "GET", "api.example.com", "/foo/1", token1).Code, "return 200 before the reload")
+	assert.Equal(http.StatusOK, serve(handler, "GET", "api.example.com", "/bar/1", token2).Code, "return 200 before the reload")
+	assert.Equal(http.StatusOK, serve(handler, "GET", "api.example.com", "/static/app.js", nil).Code, "return 200 before the reload")
+
+	// the watcher is started asynchronously, so rewrite the file until the removed no_auths is applied
+	timeout := time.After(3 * time.Second)
+	for serve(handler, "GET", "api.example.com", "/static/app.js", nil).Code != http.StatusUnauthorized {
+		ioutil.WriteFile(f.Name(), []byte(json2), 0644)
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("the cached decision of no_auths is kept after the reload")
+		}
+	}
+	assert.Equal(http.StatusUnauthorized, serve(handler, "GET", "api.example.com", "/foo/1", token1).Code, "return 401 when the token is removed")
+	assert.Equal(http.StatusForbidden, serve(handler, "GET", "api.example.com", "/bar/1", token2).Code, "return 403 when the allowed path is removed")
+	assert.Equal(http.StatusOK, serve(handler, "GET", "api.example.com", "/baz/1", token2).Code, "return 200 on the new allowed path")
+}
+
+func TestNewHandlerCacheDisabled(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	logging.SetOutput(ioutil.Discard)
+	defer os.Unsetenv(token.AuthTokensPath)
+	os.Setenv(AuthCachePerHost, "true")
+	defer os.Unsetenv(AuthCachePerHost)
+
+	settings := func(allowedPath string, cache string) string {
+		return fmt.Sprintf(`{
+			"bearer_tokens": [
+				{
+					"token": "TOKEN1",
+					"allowed_paths": ["%s"]
+				}
+			],
+			"basic_auths": [
+				{
+					"username": "user1",
+					"password": "password1",
+					"allowed_paths": ["^/piyo/.*$"]
+				}
+			],
+			"no_auths": {
+				"allowed_paths": ["^/static/.*$"]
+			}%s
+		}`, allowedPath, cache)
+	}
+	json1 := fmt.Sprintf(`[
+		{"host": "cached\\.example\\.com", "settings": %s},
+		{"host": "nocache\\.example\\.com", "settings": %s}
+	]`, settings("^/foo/.*$", ""), settings("^/foo/.*$", `, "cache": false`))
+	json2 := fmt.Sprintf(`[
+		{"host": "cached\\.example\\.com", "settings": %s},
+		{"host": "nocache\\.example\\.com", "settings": %s}
+	]`, settings("^/bar/.*$", ""), settings("^/bar/.*$", `, "cache": false`))
+	f, err := ioutil.TempFile("", "reload")
+	assert.Nil(err, "TempFile has no error")
+	defer os.Remove(f.Name())
+	f.WriteString(json1)
+	f.Close()
+	os.Setenv(token.AuthTokensPath, f.Name())
+
+	handler := NewHandler()
+	token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+	user1 := map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")}
+	for _, host := range []string{"cached.example.com", "nocache.example.com"} {
+		assert.Equal(http.StatusOK, serve(handler, "GET", host, "/foo/1", token1).Code, "return 200 on %s before the reload", host)
+		assert.Equal(http.StatusForbidden, serve(handler, "GET", host, "/bar/1", token1).Code, "return 403 on %s before the reload", host)
+		assert.Equal(http.StatusOK, serve(handler, "GET", host, "/piyo/1", user1).Code, "return 200 on %s before the reload", host)
+		assert.Equal(http.StatusOK, serve(handler, "GET", host, "/static/app.js", nil).Code, "return 200 on %s before the reload", host)
+	}
+	assert.Equal(2, handler.caches.get(`cached\.example\.com`).matchBearerAuthPath.Len(), "the decisions of the cached host are cached")
+	handler.caches.mutex.Lock()
+	_, ok := handler.caches.hosts[`nocache\.example\.com`]
+	handler.caches.mutex.Unlock()
+	assert.False(ok, "the decisions of the uncached host are not cached")
+
+	// the watcher is started asynchronously, so rewrite the file until the new allowed path is applied
+	timeout := time.After(3 * time.Second)
+	for serve(handler, "GET", "cached.example.com", "/bar/1", token1).Code != http.StatusOK {
+		ioutil.WriteFile(f.Name(), []byte(json2), 0644)
+		select {
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("the new configurations are not applied")
+		}
+	}
+	for _, host := range []string{"cached.example.com", "nocache.example.com"} {
+		assert.Equal(http.StatusForbidden, serve(handler, "GET", host, "/foo/1", token1).Code, "return 403 on %s after the reload", host)
+		assert.Equal(http.StatusOK, serve(handler, "GET", host, "/bar/1", token1).Code, "return 200 on %s after the reload", host)
+		assert.Equal(http.StatusOK, serve(handler, "GET", host, "/piyo/1", user1).Code, "return 200 on %s after the reload", host)
+		assert.Equal(http.StatusOK, serve(handler, "GET", host, "/static/app.js", nil).Code, "return 200 on %s after the reload", host)
+	}
+}
+
+func TestNewHandlerAuthCacheSize(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(AuthCacheSize)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`)
+	token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+
+	t.Run("AUTH_CACHE_SIZE=16", func(t *testing.T) {
+		os.Setenv(AuthCacheSize, "16")
+		handler := NewHandler()
+		for i := 0; i < 100; i++ {
+			serve(handler, "GET", "api.example.com", fmt.Sprintf("/foo/%d", i), token1)
+			serve(handler, "GET", fmt.Sprintf("unknown%d.example.com", i), "/foo/1", token1)
+		}
+		assert.Equal(16, handler.matchHostCache.Len(), "the cache of hosts is sized by AUTH_CACHE_SIZE")
+		assert.Equal(16, handler.caches.get(`api\.example\.com`).matchBearerAuthPath.Len(), "the caches of decisions are sized by AUTH_CACHE_SIZE")
+	})
+
+	t.Run("AUTH_CACHE_SIZE=0", func(t *testing.T) {
+		os.Setenv(AuthCacheSize, "0")
+		handler := NewHandler()
+		assert.Nil(handler.matchHostCache, "the cache of hosts is not created")
+		assert.Nil(handler.caches.get(`api\.example\.com`), "the caches of decisions are not created")
+
+		cases := []struct {
+			host       string
+			path       string
+			headers    map[string]string
+			statusCode int
+			desc       string
+		}{
+			{host: "api.example.com", path: "/foo/1", headers: token1, statusCode: http.StatusOK, desc: "the allowed path of the token is decided without caches"},
+			{host: "api.example.com", path: "/bar/1", headers: token1, statusCode: http.StatusForbidden, desc: "the other path of the token is decided without caches"},
+			{host: "api.example.com", path: "/piyo/1", headers: map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")}, statusCode: http.StatusOK, desc: "the basic authentication is decided without caches"},
+			{host: "api.example.com", path: "/piyo/1", headers: map[string]string{"Authorization": getBasicAuthHeader("user1", "wrong")}, statusCode: http.StatusUnauthorized, desc: "the wrong password is rejected without caches"},
+			{host: "api.example.com", path: "/static/app.js", headers: nil, statusCode: http.StatusOK, desc: "no_auths is decided without caches"},
+			{host: "unknown.example.com", path: "/foo/1", headers: token1, statusCode: http.StatusForbidden, desc: "the unknown host is decided without caches"},
+		}
+		for i := 0; i < 2; i++ {
+			for _, c := range cases {
+				assert.Equal(c.statusCode, serve(handler, "GET", c.host, c.path, c.headers).Code, c.desc)
+			}
+		}
+		assert.NotPanics(handler.purgeCaches, "purging the disabled caches does nothing")
+	})
+
+	t.Run("invalid AUTH_CACHE_SIZE", func(t *testing.T) {
+		for _, size := range []string{"", "-1", "invalid"} {
+			os.Setenv(AuthCacheSize, size)
+			assert.Equal(defaultAuthCacheSize, getAuthCacheSize(), "the default size is used for %q", size)
+		}
+	})
+}
@@ -0,0 +1,57 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+ExtAuthzHTTP : EXT_AUTHZ_HTTP is an environment variable name to shape the responses for the HTTP authorization service of Envoy ext_authz.
+	The approvals are 200 without body, and the denials keep their status, headers and body, which Envoy returns to the client.
+*/
+const ExtAuthzHTTP = "EXT_AUTHZ_HTTP"
+
+const extAuthzKey = "extAuthz"
+const checkResultHeader = "X-Ext-Authz-Check-Result"
+
+func getExtAuthzHTTP() bool {
+	extAuthzHTTP, err := strconv.ParseBool(os.Getenv(ExtAuthzHTTP))
+	return err == nil && extAuthzHTTP
+}
+
+func extAuthz(enabled bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(extAuthzKey, enabled)
+		c.Next()
+	}
+}
+
+// setCheckResult tells the result of the check, which Envoy passes to upstream or the client
+// when the header is listed in "allowed_upstream_headers" or "allowed_client_headers".
+func setCheckResult(context *gin.Context, allowed bool) {
+	if !context.GetBool(extAuthzKey) {
+		return
+	}
+	if allowed {
+		context.Writer.Header().Set(checkResultHeader, "allowed")
+	} else {
+		context.Writer.Header().Set(checkResultHeader, "denied")
+	}
+}
+
+// allowExtAuthz approves the request without body, because Envoy ignores the body of an approval
+// and only the headers are passed to upstream.
+func allowExtAuthz(context *gin.Context) {
+	setCheckResult(context, true)
+	context.Status(http.StatusOK)
+	context.Writer.WriteHeaderNow()
+}
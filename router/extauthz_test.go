@@ -0,0 +1,112 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerExtAuthzHTTP(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(ExtAuthzHTTP)
+	defer os.Unsetenv(StripCredentialOnSuccess)
+	defer os.Unsetenv(IdentityHeader)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`)
+	token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+
+	t.Run("without EXT_AUTHZ_HTTP", func(t *testing.T) {
+		os.Unsetenv(ExtAuthzHTTP)
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1", token1)
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the request is authorized")
+		assert.JSONEq(`{"authorized": true}`, w.Body.String(), "the approval has the JSON body by default")
+		assert.Empty(w.Header().Get(checkResultHeader), "the check result is not reported by default")
+	})
+
+	t.Run("with EXT_AUTHZ_HTTP", func(t *testing.T) {
+		os.Setenv(ExtAuthzHTTP, "true")
+		os.Setenv(StripCredentialOnSuccess, "true")
+		os.Setenv(IdentityHeader, "X-Auth-Identity")
+		handler := NewHandler()
+
+		allows := []struct {
+			path    string
+			headers map[string]string
+			desc    string
+		}{
+			{path: "/foo/1", headers: token1, desc: "the bearer token"},
+			{path: "/static/app.js", headers: nil, desc: "no_auths"},
+		}
+		for _, c := range allows {
+			w := serve(handler, "GET", "api.example.com", c.path, c.headers)
+			assert.Equal(http.StatusOK, w.Code, "return 200 when the request is allowed by %s", c.desc)
+			assert.Empty(w.Body.String(), "the approval has no body when the request is allowed by %s", c.desc)
+			assert.Equal("allowed", w.Header().Get(checkResultHeader), "the approval is reported when the request is allowed by %s", c.desc)
+		}
+		w := serve(handler, "GET", "api.example.com", "/foo/1", token1)
+		assert.Equal("authorization", w.Header().Get(headersToRemoveHeader), "the headers to remove upstream are kept")
+		assert.NotEmpty(w.Header().Get("X-Auth-Identity"), "the headers to add upstream are kept")
+
+		denies := []struct {
+			path       string
+			headers    map[string]string
+			statusCode int
+			desc       string
+		}{
+			{path: "/foo/1", headers: nil, statusCode: http.StatusUnauthorized, desc: "the missing header"},
+			{path: "/foo/1", headers: map[string]string{"Authorization": "Bearer INVALID"}, statusCode: http.StatusUnauthorized, desc: "the token mismatch"},
+			{path: "/bar/1", headers: token1, statusCode: http.StatusForbidden, desc: "the path not allowed"},
+		}
+		for _, c := range denies {
+			w := serve(handler, "GET", "api.example.com", c.path, c.headers)
+			assert.Equal(c.statusCode, w.Code, "the status of %s is kept", c.desc)
+			assert.Equal("denied", w.Header().Get(checkResultHeader), "the denial is reported for %s", c.desc)
+			var body map[string]interface{}
+			assert.Nil(json.Unmarshal(w.Body.Bytes(), &body), "the body of %s is passed to the client", c.desc)
+			assert.Equal(false, body["authorized"], "the body of %s is not changed", c.desc)
+		}
+
+		w = serve(handler, "GET", "api.example.com", "/piyo/1", nil)
+		assert.Equal(http.StatusUnauthorized, w.Code, "return 401 when basic authentication is required")
+		assert.Equal("denied", w.Header().Get(checkResultHeader), "the denial is reported for the basic auth prompt")
+		assert.NotEmpty(w.Header().Get("WWW-Authenticate"), "the challenge is passed to the client")
+	})
+}
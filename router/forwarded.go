@@ -0,0 +1,130 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+/*
+TrustForwardedHost : TRUST_FORWARDED_HOST is an environment variable name to match the hosts with "X-Forwarded-Host" instead of the Host header.
+	The header is trusted only when the request comes directly from one of "TRUSTED_PROXIES".
+*/
+const TrustForwardedHost = "TRUST_FORWARDED_HOST"
+
+/*
+TrustedProxies : TRUSTED_PROXIES is an environment variable name to set the comma separated CIDR ranges of the proxies, like "10.0.0.0/8,192.168.1.1".
+	The client IP is taken from "X-Forwarded-For" or "X-Real-Ip" only when the request comes directly from one of them.
+*/
+const TrustedProxies = "TRUSTED_PROXIES"
+
+const forwardedHostHeader = "X-Forwarded-Host"
+const forwardedForHeader = "X-Forwarded-For"
+const realIPHeader = "X-Real-Ip"
+
+func getTrustForwardedHost() bool {
+	trust, err := strconv.ParseBool(os.Getenv(TrustForwardedHost))
+	return err == nil && trust
+}
+
+// getTrustedProxies returns the ranges of the proxies whose forwarded headers are trusted.
+// An invalid range is ignored, and no proxy is trusted when no range is given.
+func getTrustedProxies() []*net.IPNet {
+	trustedProxies := []*net.IPNet{}
+	for _, rawCIDR := range strings.Split(os.Getenv(TrustedProxies), ",") {
+		rawCIDR = strings.TrimSpace(rawCIDR)
+		if len(rawCIDR) == 0 {
+			continue
+		}
+		ipNets, err := token.ParseCIDRs([]string{rawCIDR})
+		if err != nil {
+			logging.Warn("invalid "+TrustedProxies+" ignored", "error", err)
+			continue
+		}
+		trustedProxies = append(trustedProxies, ipNets...)
+	}
+	if len(trustedProxies) == 0 && getTrustForwardedHost() {
+		logging.Warn(TrustForwardedHost + " is set, but " + TrustedProxies + " is empty and " + forwardedHostHeader + " is never trusted")
+	}
+	return trustedProxies
+}
+
+// isTrustedProxy checks whether the address is one of TRUSTED_PROXIES.
+func isTrustedProxy(trustedProxies []*net.IPNet, ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, ipNet := range trustedProxies {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the address of the peer of the connection, which can not be forged unlike the forwarded headers.
+func peerIP(request *http.Request) string {
+	remoteIP := request.RemoteAddr
+	if h, _, err := net.SplitHostPort(remoteIP); err == nil {
+		remoteIP = h
+	}
+	return remoteIP
+}
+
+// clientIP returns the address of the client checked by ip_rules and counted by the rate limits.
+func (router *Handler) clientIP(request *http.Request) string {
+	return trustedClientIP(request, router.trustedProxies)
+}
+
+// trustedClientIP returns the address of the client. The forwarded headers are honored only when the peer is a trusted proxy,
+// and "X-Forwarded-For" is read from the right skipping the trusted proxies, because the addresses on the left are written
+// by the client and can be forged.
+func trustedClientIP(request *http.Request, trustedProxies []*net.IPNet) string {
+	peer := peerIP(request)
+	if !isTrustedProxy(trustedProxies, net.ParseIP(peer)) {
+		return peer
+	}
+	if forwardedFor := request.Header.Get(forwardedForHeader); len(forwardedFor) > 0 {
+		addresses := strings.Split(forwardedFor, ",")
+		for i := len(addresses) - 1; i >= 0; i-- {
+			address := strings.TrimSpace(addresses[i])
+			ip := net.ParseIP(address)
+			if ip == nil {
+				// the chain is broken by a malformed address, so the last trusted proxy is the client
+				return peer
+			}
+			if !isTrustedProxy(trustedProxies, ip) || i == 0 {
+				return address
+			}
+			peer = address
+		}
+	}
+	if realIP := strings.TrimSpace(request.Header.Get(realIPHeader)); net.ParseIP(realIP) != nil {
+		return realIP
+	}
+	return peer
+}
+
+// requestedDomain returns the first value of "X-Forwarded-Host" when the immediate client is a trusted proxy, and the Host header otherwise.
+// The immediate client is the peer of the connection, because the forwarded headers like "X-Forwarded-For" can be forged.
+func (router *Handler) requestedDomain(request *http.Request) string {
+	if !router.trustForwardedHost {
+		return request.Host
+	}
+	forwardedHost := strings.TrimSpace(strings.Split(request.Header.Get(forwardedHostHeader), ",")[0])
+	if len(forwardedHost) == 0 || !isTrustedProxy(router.trustedProxies, net.ParseIP(peerIP(request))) {
+		return request.Host
+	}
+	return forwardedHost
+}
@@ -0,0 +1,138 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func serveFrom(handler *Handler, remoteAddr string, host string, forwardedHost string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/foo/1", nil)
+	r.RemoteAddr = remoteAddr
+	r.Host = host
+	if len(forwardedHost) > 0 {
+		r.Header.Set(forwardedHostHeader, forwardedHost)
+	}
+	r.Header.Set("Authorization", "Bearer TOKEN1")
+	handler.Engine.ServeHTTP(w, r)
+	return w
+}
+
+func TestNewHandlerTrustForwardedHost(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	logging.SetOutput(ioutil.Discard)
+	defer logging.SetOutput(os.Stderr)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(TrustForwardedHost)
+	defer os.Unsetenv(TrustedProxies)
+
+	json := `[
+		{
+			"host": "^api\\.example\\.com$",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	cases := []struct {
+		trust         string
+		proxies       string
+		remoteAddr    string
+		host          string
+		forwardedHost string
+		statusCode    int
+		desc          string
+	}{
+		{trust: "", proxies: "10.0.0.0/8", remoteAddr: "10.0.0.1:1234", host: "auth.internal", forwardedHost: "api.example.com", statusCode: http.StatusForbidden,
+			desc: "X-Forwarded-Host is not trusted by default"},
+		{trust: "", proxies: "", remoteAddr: "10.0.0.1:1234", host: "api.example.com", forwardedHost: "evil.example.net", statusCode: http.StatusOK,
+			desc: "the Host header is matched by default"},
+		{trust: "true", proxies: "10.0.0.0/8", remoteAddr: "10.0.0.1:1234", host: "auth.internal", forwardedHost: "api.example.com", statusCode: http.StatusOK,
+			desc: "X-Forwarded-Host from the trusted proxy is matched"},
+		{trust: "true", proxies: "10.0.0.0/8", remoteAddr: "10.0.0.1:1234", host: "auth.internal", forwardedHost: "api.example.com, proxy.internal", statusCode: http.StatusOK,
+			desc: "the first value of X-Forwarded-Host is matched"},
+		{trust: "true", proxies: "10.0.0.0/8", remoteAddr: "10.0.0.1:1234", host: "api.example.com", forwardedHost: "evil.example.net", statusCode: http.StatusForbidden,
+			desc: "X-Forwarded-Host from the trusted proxy wins over the Host header"},
+		{trust: "true", proxies: "10.0.0.0/8", remoteAddr: "10.0.0.1:1234", host: "api.example.com", forwardedHost: "", statusCode: http.StatusOK,
+			desc: "the Host header is matched without X-Forwarded-Host"},
+		{trust: "true", proxies: "10.0.0.0/8", remoteAddr: "203.0.113.1:1234", host: "auth.internal", forwardedHost: "api.example.com", statusCode: http.StatusForbidden,
+			desc: "X-Forwarded-Host from the untrusted client is ignored"},
+		{trust: "true", proxies: "10.0.0.0/8", remoteAddr: "203.0.113.1:1234", host: "api.example.com", forwardedHost: "evil.example.net", statusCode: http.StatusOK,
+			desc: "the Host header of the untrusted client is matched"},
+		{trust: "true", proxies: " 192.168.1.1 , invalid, 2001:db8::/32", remoteAddr: "192.168.1.1:1234", host: "auth.internal", forwardedHost: "api.example.com", statusCode: http.StatusOK,
+			desc: "a single address is a trusted proxy, and the invalid one is ignored"},
+		{trust: "true", proxies: " 192.168.1.1 , invalid, 2001:db8::/32", remoteAddr: "[2001:db8::1]:1234", host: "auth.internal", forwardedHost: "api.example.com", statusCode: http.StatusOK,
+			desc: "the IPv6 proxy is trusted"},
+		{trust: "true", proxies: "", remoteAddr: "10.0.0.1:1234", host: "auth.internal", forwardedHost: "api.example.com", statusCode: http.StatusForbidden,
+			desc: "no proxy is trusted without TRUSTED_PROXIES"},
+	}
+	for _, c := range cases {
+		os.Setenv(TrustForwardedHost, c.trust)
+		os.Setenv(TrustedProxies, c.proxies)
+		handler := NewHandler()
+		w := serveFrom(handler, c.remoteAddr, c.host, c.forwardedHost)
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestHandlerClientIP(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(TrustedProxies)
+
+	os.Setenv(TrustedProxies, "10.0.0.0/8")
+	handler := NewHandler()
+
+	cases := []struct {
+		remoteAddr   string
+		forwardedFor string
+		realIP       string
+		expected     string
+		desc         string
+	}{
+		{remoteAddr: "192.0.2.1:1234", expected: "192.0.2.1", desc: "the remote address is the client IP"},
+		{remoteAddr: "192.0.2.1:1234", forwardedFor: "203.0.113.1", realIP: "203.0.113.2", expected: "192.0.2.1", desc: "the headers of an untrusted client are ignored"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "203.0.113.1", expected: "203.0.113.1", desc: "X-Forwarded-For of a trusted proxy is honored"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "198.51.100.1, 203.0.113.1, 10.0.0.2", expected: "203.0.113.1", desc: "the last untrusted address is the client IP"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "10.0.0.3, 10.0.0.2", expected: "10.0.0.3", desc: "the first address is the client IP when all are trusted"},
+		{remoteAddr: "10.0.0.1:1234", forwardedFor: "203.0.113.1, unknown", expected: "10.0.0.1", desc: "a malformed address stops at the last trusted proxy"},
+		{remoteAddr: "10.0.0.1:1234", realIP: "203.0.113.2", expected: "203.0.113.2", desc: "X-Real-Ip of a trusted proxy is honored without X-Forwarded-For"},
+		{remoteAddr: "[2001:db8::1]:1234", expected: "2001:db8::1", desc: "an IPv6 remote address is the client IP"},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/foo/1", nil)
+		r.RemoteAddr = c.remoteAddr
+		if len(c.forwardedFor) > 0 {
+			r.Header.Set(forwardedForHeader, c.forwardedFor)
+		}
+		if len(c.realIP) > 0 {
+			r.Header.Set(realIPHeader, c.realIP)
+		}
+		assert.Equal(c.expected, handler.clientIP(r), c.desc)
+	}
+}
@@ -7,41 +7,278 @@ Package router : authorize and authenticate HTTP Request using HTTP Header.
 package router
 
 import (
+	stdcontext "context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"github.com/gin-gonic/gin"
 
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
 	"github.com/RoboticBase/fiware-ambassador-auth/token"
 
 	lru "github.com/hashicorp/golang-lru"
 )
 
 const authHeader = "authorization"
-const basicReStr = `(?i)^basic (.+)$`
-const bearerReStr = `(?i)^bearer (.+)$`
-const basicUserReStr = `^([^:]+):(.+)$`
+const basicReStr = `(?i)^basic[ \t]+(.+)$`
+const bearerReStr = `(?i)^(?:%s)[ \t]+(.+)$`
+const basicUserReStr = `(?s)^([^:]+):(.+)$`
 const basicAuthRequiredHeader = `Www-Authenticate: Basic realm="Authorization Required"`
 
+/*
+AuthDebug : AUTH_DEBUG is an environment variable name to enable debug information about matched rules.
+*/
+const AuthDebug = "AUTH_DEBUG"
+
+const matchPathHeader = "X-Auth-Match-Path"
+const matchHostHeader = "X-Auth-Match-Host"
+const defaultAllowPattern = "(default_allow)"
+const tokenExpiresInHeader = "X-Token-Expires-In"
+const methodOverrideHeader = "X-HTTP-Method-Override"
+
+/*
+CorrelationID : CORRELATION_ID is an environment variable name to include the request ID in rejection responses.
+*/
+const CorrelationID = "CORRELATION_ID"
+
+/*
+VaryAuthorization : VARY_AUTHORIZATION is an environment variable name to set whether "Vary: Authorization" is added to the responses depending on credentials (default false).
+*/
+const VaryAuthorization = "VARY_AUTHORIZATION"
+
+/*
+BasicAuthJSONBody : BASIC_AUTH_JSON_BODY is an environment variable name which returned a JSON body when basic authentication is required.
+	Deprecated: the body is always JSON like the other rejections, and it is ignored.
+*/
+const BasicAuthJSONBody = "BASIC_AUTH_JSON_BODY"
+
+/*
+ReadHeaderTimeout : READ_HEADER_TIMEOUT is an environment variable name to set the amount of time allowed to read request headers.
+*/
+const ReadHeaderTimeout = "READ_HEADER_TIMEOUT"
+
+/*
+ReadTimeout : READ_TIMEOUT is an environment variable name to set the maximum duration for reading the entire request.
+*/
+const ReadTimeout = "READ_TIMEOUT"
+
+/*
+WriteTimeout : WRITE_TIMEOUT is an environment variable name to set the maximum duration before timing out writes of the response.
+*/
+const WriteTimeout = "WRITE_TIMEOUT"
+
+/*
+IdleTimeout : IDLE_TIMEOUT is an environment variable name to set the maximum amount of time to wait for the next request when keep-alives are enabled.
+*/
+const IdleTimeout = "IDLE_TIMEOUT"
+
+/*
+ShutdownTimeout : SHUTDOWN_TIMEOUT is an environment variable name to set the maximum duration to wait for the requests in flight when shutting down.
+*/
+const ShutdownTimeout = "SHUTDOWN_TIMEOUT"
+
+const defaultReadHeaderTimeout = 10 * time.Second
+const defaultReadTimeout = 30 * time.Second
+const defaultWriteTimeout = 30 * time.Second
+const defaultIdleTimeout = 120 * time.Second
+const defaultShutdownTimeout = 10 * time.Second
+
+/*
+HMACMaxClockSkew : HMAC_MAX_CLOCK_SKEW is an environment variable name to set the maximum difference between the signed timestamp of an HMAC signature and the current time.
+*/
+const HMACMaxClockSkew = "HMAC_MAX_CLOCK_SKEW"
+
+const defaultHMACMaxClockSkew = 5 * time.Minute
+
+/*
+DenyBody : DENY_BODY is an environment variable name to set the error message which replaces the bodies of all rejections.
+*/
+const DenyBody = "DENY_BODY"
+
+/*
+RejectionDetails : REJECTION_DETAILS is an environment variable name to echo the method, host and path of the request back in the bodies of all rejections for debugging.
+	The query string is never included.
+*/
+const RejectionDetails = "REJECTION_DETAILS"
+
+/*
+RateLimitHeaders : RATE_LIMIT_HEADERS is an environment variable name to add "X-RateLimit-*" headers to the responses of rate limited credentials.
+*/
+const RateLimitHeaders = "RATE_LIMIT_HEADERS"
+
+/*
+RateLimitStatus : RATE_LIMIT_STATUS is an environment variable name to set the status code returned when the rate limit is exceeded.
+*/
+const RateLimitStatus = "RATE_LIMIT_STATUS"
+
+/*
+RateLimitBody : RATE_LIMIT_BODY is an environment variable name to set the JSON object returned when the rate limit is exceeded.
+*/
+const RateLimitBody = "RATE_LIMIT_BODY"
+
+/*
+MaxAuthHeaderLength : MAX_AUTH_HEADER_LENGTH is an environment variable name to set the maximum length of the Authorization header.
+*/
+const MaxAuthHeaderLength = "MAX_AUTH_HEADER_LENGTH"
+
+const defaultMaxAuthHeaderLength = 8192
+
+/*
+OriginalURIHeader : ORIGINAL_URI_HEADER is an environment variable name to set the header which has the path of the original request, like "X-Original-URI".
+*/
+const OriginalURIHeader = "ORIGINAL_URI_HEADER"
+
+/*
+OriginalMethodHeader : ORIGINAL_METHOD_HEADER is an environment variable name to set the header which has the method of the original request, like "X-Original-Method".
+*/
+const OriginalMethodHeader = "ORIGINAL_METHOD_HEADER"
+
+/*
+StripCredentialOnSuccess : STRIP_CREDENTIAL_ON_SUCCESS is an environment variable name to ask the proxy to remove the credential from the approved requests.
+*/
+const StripCredentialOnSuccess = "STRIP_CREDENTIAL_ON_SUCCESS"
+
+/*
+IdentityHeader : IDENTITY_HEADER is an environment variable name to set the header which has the identity of the approved credential, like "X-Auth-Identity".
+*/
+const IdentityHeader = "IDENTITY_HEADER"
+
+/*
+RejectNonSlashPath : REJECT_NON_SLASH_PATH is an environment variable name to reject the requests whose path does not start with "/".
+*/
+const RejectNonSlashPath = "REJECT_NON_SLASH_PATH"
+
+/*
+HostSuffixAllowlist : HOST_SUFFIX_ALLOWLIST is an environment variable name to set the comma separated suffixes of the allowed hosts, like ".example.com".
+*/
+const HostSuffixAllowlist = "HOST_SUFFIX_ALLOWLIST"
+
+/*
+HostMatchStripPort : HOST_MATCH_STRIP_PORT is an environment variable name to remove the port of the Host header before matching the hosts.
+*/
+const HostMatchStripPort = "HOST_MATCH_STRIP_PORT"
+
+/*
+HostMatchCaseInsensitive : HOST_MATCH_CASE_INSENSITIVE is an environment variable name to lowercase the Host header before matching the hosts.
+*/
+const HostMatchCaseInsensitive = "HOST_MATCH_CASE_INSENSITIVE"
+
+/*
+BearerSchemes : BEARER_SCHEMES is an environment variable name to set the comma separated scheme keywords of bearer tokens, like "Bearer,Token".
+*/
+const BearerSchemes = "BEARER_SCHEMES"
+
+/*
+BearerScheme : BEARER_SCHEME is an environment variable name accepted as an alias of "BEARER_SCHEMES", which is used when "BEARER_SCHEMES" is not set.
+*/
+const BearerScheme = "BEARER_SCHEME"
+
+const defaultBearerScheme = "Bearer"
+
+/*
+BasicAuthInvalidUTF8 : BASIC_AUTH_INVALID_UTF8 is an environment variable name to set how to treat the basic auth credentials which are not valid UTF-8.
+	"reject" (default) never verifies them, and "replace" replaces the invalid bytes with U+FFFD in the same way as loading the JSON configurations.
+*/
+const BasicAuthInvalidUTF8 = "BASIC_AUTH_INVALID_UTF8"
+
+/*
+SecurityHeaders : SECURITY_HEADERS is an environment variable name to set the JSON object of the headers added to all responses of this service, like Content-Security-Policy.
+*/
+const SecurityHeaders = "SECURITY_HEADERS"
+
+/*
+LogSampleRate : LOG_SAMPLE_RATE is an environment variable name to log only 1 in N approved requests to the access log.
+	The denials are always logged. All requests are logged when it is not set or not greater than 1.
+*/
+const LogSampleRate = "LOG_SAMPLE_RATE"
+
+const headersToRemoveHeader = "X-Envoy-Auth-Headers-To-Remove"
+
+const requestIDHeader = "X-Request-Id"
+const correlationIDHeader = "X-Correlation-Id"
+const requestIDKey = "requestID"
+const correlationKey = "correlation"
+const softDenyKey = "softDeny"
+const denyBodyKey = "denyBody"
+const decisionKey = "decision"
+const rejectionDetailsKey = "rejectionDetails"
+const requestedMethodKey = "requestedMethod"
+const requestedPathKey = "requestedPath"
+const softDenyHeader = "X-Auth-SoftDeny"
+const requestIDReStr = `^[0-9A-Za-z\-_.:]{1,128}$`
+
+var logOutput io.Writer = os.Stdout
+
 /*
 Handler : a struct to handle HTTP Request and check its Header.
 	Handler encloses github.com/gin-gonic/gin.Engine.
 	Handler authorizes and authenticates all HTTP Requests using its HTTP Header.
 */
 type Handler struct {
-	Engine                   *gin.Engine
-	matchHostCache           *lru.Cache
-	matchBasicAuthPathCache  *lru.Cache
-	verifyBasicAuthCache     *lru.Cache
-	matchBearerAuthPathCache *lru.Cache
-	matchNoAuthPathCache     *lru.Cache
+	Engine               *gin.Engine
+	Admin                *gin.Engine
+	inProcess            *gin.Engine
+	matchHostCache       *lru.Cache
+	caches               *hostCaches
+	debug                bool
+	rateLimiter          *rateLimiter
+	anonymousLimiter     *rateLimiter
+	vary                 bool
+	originalURIHeader    string
+	originalMethodHeader string
+	apiKeyHeader         string
+	apiKeyQueryParam     string
+	credentials          token.CredentialStore
+	cacheDecisions       bool
+	rateLimitHeaders     bool
+	rateLimitStatus      int
+	rateLimitBody        gin.H
+	maxAuthHeaderLength  int
+	noAuthVerify         bool
+	stripCredential      bool
+	identityHeader       string
+	unmatchedLogger      *unmatchedLogger
+	rejectNonSlashPath   bool
+	rejectionTracker     *rejectionTracker
+	hostSuffixes         []string
+	hostMatchStripPort   bool
+	hostMatchLowercase   bool
+	trustForwardedHost   bool
+	trustedProxies       []*net.IPNet
+	realm                string
+	now                  func() time.Time
+	trace                bool
+	replaceInvalidUTF8   bool
+	backendErrorPolicy   backendErrorPolicy
+	metrics              *decisionMetrics
+	ruleHits             *ruleHits
+	holder               *token.Holder
+	basicRe              *regexp.Regexp
+	basicUserRe          *regexp.Regexp
+	tokenRe              *regexp.Regexp
+	hmacRe               *regexp.Regexp
+	hmacMaxClockSkew     time.Duration
 }
 
-func customLogger() gin.HandlerFunc {
+func customLogger(sampleRate uint64) gin.HandlerFunc {
+	var approvals uint64
 	return func(c *gin.Context) {
 		// Start timer
 		start := time.Now()
@@ -59,13 +296,19 @@ func customLogger() gin.HandlerFunc {
 		method := c.Request.Method
 		domain := c.Request.Host
 		statusCode := c.Writer.Status()
+		// the soft denials are 200, but they are denials as well
+		denied := statusCode >= http.StatusBadRequest || len(c.Writer.Header().Get(softDenyHeader)) > 0
+		if !denied && sampleRate > 1 && (atomic.AddUint64(&approvals, 1)-1)%sampleRate != 0 {
+			return
+		}
 		comment := c.Errors.ByType(gin.ErrorTypePrivate).String()
 
 		if raw != "" {
 			path = path + "?" + raw
 		}
 
-		fmt.Fprintf(os.Stdout, "[GIN] %v |%3d| %13v | %15s |%-7s %s, %s\n%s",
+		requestID := c.GetString(requestIDKey)
+		text := fmt.Sprintf("[GIN] %v |%3d| %13v | %15s |%-7s %s, %s | %s\n%s",
 			end.Format("2006/01/02 - 15:04:05"),
 			statusCode,
 			latency,
@@ -73,85 +316,567 @@ func customLogger() gin.HandlerFunc {
 			method,
 			domain,
 			path,
+			requestID,
 			comment,
 		)
+		logging.Access(logOutput, text, "status", statusCode, "latency", latency.String(), "client_ip", clientIP,
+			"method", method, "host", domain, "path", path, "request_id", requestID, "error", strings.TrimSpace(comment))
+	}
+}
+
+func requestID(correlation bool) gin.HandlerFunc {
+	requestIDRe := regexp.MustCompile(requestIDReStr)
+	return func(c *gin.Context) {
+		id := c.Request.Header.Get(requestIDHeader)
+		if !requestIDRe.MatchString(id) {
+			id = newRequestID()
+		}
+		c.Set(requestIDKey, id)
+		c.Set(correlationKey, correlation)
+		c.Writer.Header().Set(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// securityHeaders sets the headers before handling, so that they are in both approvals and rejections.
+func securityHeaders(headers map[string]string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		for name, value := range headers {
+			c.Writer.Header().Set(name, value)
+		}
+		c.Next()
 	}
 }
 
+func rejection(denyBody string, details bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set(denyBodyKey, denyBody)
+		c.Set(rejectionDetailsKey, details)
+		c.Next()
+	}
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
 /*
 NewHandler : a factory method to create Handler.
 */
 func NewHandler() *Handler {
-	engine := gin.New()
-	engine.Use(customLogger())
-	engine.Use(gin.Recovery())
 	holder := token.NewHolder()
+	return newHandler(holder, holder, true)
+}
 
-	basicRe := regexp.MustCompile(basicReStr)
-	basicUserRe := regexp.MustCompile(basicUserReStr)
-	tokenRe := regexp.MustCompile(bearerReStr)
-
-	matchHostCache, err := lru.New(1024)
-	matchBasicAuthPathCache, err := lru.New(1024)
-	verifyBasicAuthCache, err := lru.New(1024)
-	matchBearerAuthPathCache, err := lru.New(1024)
-	matchNoAuthPathCache, err := lru.New(1024)
-	if err != nil {
-		panic(err)
+/*
+NewHandlerWithStore : a factory method to create Handler which looks up credentials from the given CredentialStore.
+	The lookups are cached for ttl to bound the load of the store (no cache when ttl is not positive).
+	Hosts and the other rules are still constructed from "AUTH_TOKENS" or "AUTH_TOKENS_PATH".
+*/
+func NewHandlerWithStore(store token.CredentialStore, ttl time.Duration) *Handler {
+	credentials := store
+	if ttl > 0 {
+		credentials = newCachedStore(store, ttl, credentialCacheSize)
 	}
+	return newHandler(token.NewHolder(), credentials, false)
+}
+
+// newHandler creates Handler. When the credentials may change without reloading the holder,
+// cacheDecisions must be false not to keep the decisions depending on them.
+func newHandler(holder *token.Holder, credentials token.CredentialStore, cacheDecisions bool) *Handler {
+	rejectionTracker := getRejectionTracker()
+	trustedProxies := getTrustedProxies()
+	metrics := newDecisionMetrics()
+	engine := gin.New()
+	engine.Use(requestID(getCorrelation()))
+	engine.Use(securityHeaders(getSecurityHeaders()))
+	engine.Use(rejection(os.Getenv(DenyBody), getRejectionDetails()))
+	engine.Use(extAuthz(getExtAuthzHTTP()))
+	engine.Use(customLogger(getLogSampleRate()))
+	engine.Use(trackRejections(rejectionTracker, trustedProxies))
+	engine.Use(gin.Recovery())
+	engine.Use(recordDecisions(metrics))
+
+	cacheSize := getAuthCacheSize()
 	router := &Handler{
-		Engine:                   engine,
-		matchHostCache:           matchHostCache,
-		matchBasicAuthPathCache:  matchBasicAuthPathCache,
-		verifyBasicAuthCache:     verifyBasicAuthCache,
-		matchBearerAuthPathCache: matchBearerAuthPathCache,
-		matchNoAuthPathCache:     matchNoAuthPathCache,
+		Engine:               engine,
+		matchHostCache:       newMatchHostCache(cacheSize),
+		caches:               newHostCaches(getAuthCachePerHost(), cacheSize),
+		debug:                getDebug(),
+		rateLimiter:          newRateLimiter(rateLimiterSize),
+		anonymousLimiter:     newRateLimiter(rateLimiterSize),
+		vary:                 getVary(),
+		originalURIHeader:    getHeaderName(OriginalURIHeader),
+		originalMethodHeader: getHeaderName(OriginalMethodHeader),
+		apiKeyHeader:         getHeaderName(APIKeyHeader),
+		apiKeyQueryParam:     os.Getenv(APIKeyQueryParam),
+		credentials:          credentials,
+		cacheDecisions:       cacheDecisions,
+		rateLimitHeaders:     getRateLimitHeaders(),
+		rateLimitStatus:      getRateLimitStatus(),
+		rateLimitBody:        getRateLimitBody(),
+		maxAuthHeaderLength:  getMaxAuthHeaderLength(),
+		noAuthVerify:         getNoAuthVerifyCredentials(),
+		stripCredential:      getStripCredential(),
+		identityHeader:       getHeaderName(IdentityHeader),
+		unmatchedLogger:      getUnmatchedLogger(),
+		rejectNonSlashPath:   getRejectNonSlashPath(),
+		rejectionTracker:     rejectionTracker,
+		hostSuffixes:         getHostSuffixes(),
+		hostMatchStripPort:   getHostMatchStripPort(),
+		hostMatchLowercase:   getHostMatchCaseInsensitive(),
+		trustForwardedHost:   getTrustForwardedHost(),
+		trustedProxies:       trustedProxies,
+		realm:                getAuthRealm(),
+		now:                  time.Now,
+		trace:                getTrace(),
+		replaceInvalidUTF8:   getReplaceInvalidUTF8(),
+		backendErrorPolicy:   getBackendErrorPolicy(),
+		metrics:              metrics,
+		ruleHits:             newRuleHits(metrics, holder),
+		holder:               holder,
+		basicRe:              regexp.MustCompile(basicReStr),
+		basicUserRe:          regexp.MustCompile(basicUserReStr),
+		tokenRe:              regexp.MustCompile(fmt.Sprintf(bearerReStr, strings.Join(getBearerSchemes(), "|"))),
+		hmacRe:               regexp.MustCompile(hmacReStr),
+		hmacMaxClockSkew:     getTimeout(HMACMaxClockSkew, defaultHMACMaxClockSkew),
 	}
+	router.Admin = router.newAdmin()
+	router.inProcess = router.newInProcessEngine()
+	// the cached decisions depend on the configurations, so they must not outlive a reload
+	holder.OnReload(router.purgeCaches)
+	router.warmUp(holder, loadWarmupRequests(os.Getenv(CacheWarmupPath)))
+	registerProbes(engine, holder)
+	router.registerMetrics(engine)
 
 	engine.NoRoute(func(context *gin.Context) {
-		domain := context.Request.Host
-		path := context.Request.URL.Path
-		method := context.Request.Method
-		authHeader := context.Request.Header.Get(authHeader)
+		// pin the configurations, so that a reload during this request never mixes old and new rules
+		router.authorize(context, holder.Snapshot(), router.clientIP(context.Request))
+	})
 
-		if host, allowed := router.matchHost(domain, holder.GetHosts()); allowed {
-			if method == "OPTIONS" {
-				statusOK(context)
-			} else if router.matchNoAuthPath(domain, path, holder.GetNoAuthPaths(host)) {
+	return router
+}
+
+// authorize decides the request of the context by the configurations of holder, and returns the decision and its status code.
+// It relies on nothing set by the middlewares of Engine, so that the in-process decisions are made by the same logic.
+func (router *Handler) authorize(context *gin.Context, holder *token.Holder, clientIP string) (Decision, int) {
+	decide(context, otherReason)
+	domain := router.requestedDomain(context.Request)
+	method, path, rawQuery := router.originalRequest(context.Request)
+	authHeader := context.Request.Header.Get(authHeader)
+	setRequested(context, method, path)
+	router.startTrace(context)
+
+	// a coarse check of the host before matching the patterns of hosts
+	if !router.allowHostSuffix(domain) {
+		traceStep(context, "host suffix not allowed")
+		domainNotAllowed(context)
+		return decided(context)
+	}
+	// the hosts, the paths and the credentials are matched and cached by the normalized host
+	domain = router.normalizeDomain(domain)
+	// check the length before decoding and matching the header
+	if len(authHeader) > router.maxAuthHeaderLength {
+		traceStep(context, "authorization header too large")
+		authHeaderTooLarge(context)
+		return decided(context)
+	}
+	// a malformed request target is not matched by anchored patterns, so it is rejected explicitly
+	if router.rejectNonSlashPath && !strings.HasPrefix(path, "/") {
+		traceStep(context, "path invalid")
+		invalidPath(context)
+		return decided(context)
+	}
+
+	if host, allowed := router.matchHost(domain, holder); allowed {
+		traceStep(context, "host matched %s", host)
+		if router.debug {
+			context.Writer.Header().Set(matchHostHeader, host)
+		}
+		context.Set(softDenyKey, holder.IsSoftDeny(host))
+		router.setRealm(context, holder, host)
+		if holder.IsMethodOverride(host) {
+			method = overrideMethod(context.Request, method)
+			setRequested(context, method, path)
+		}
+		// the credentials are matched against the query string too when match_query of the host is set
+		target := queryTarget(path, rawQuery, holder.IsMatchQuery(host))
+		userAgentAllows, userAgentDenies := holder.GetUserAgentRules(host)
+		noAuth, basicAuth := router.matchRules(host, domain, method, path, rawQuery, holder)
+		rootPath := rootPathBehavior(holder, host, path)
+		if rootPath == token.RootPathAllow {
+			noAuth, basicAuth = true, false
+		}
+		bypass := noAuth && holder.IsNoAuthBypass(host)
+		if rootPath == token.RootPathDeny {
+			traceStep(context, "root path denied")
+			rootPathDenied(context)
+		} else if !holder.GetIPRules(host).Allows(clientIP) && !bypass {
+			traceStep(context, "client ip %s denied", clientIP)
+			ipNotAllowed(context)
+		} else if !allowUserAgent(context.Request.UserAgent(), userAgentAllows, userAgentDenies) && !bypass {
+			traceStep(context, "user agent denied")
+			userAgentNotAllowed(context)
+		} else if method == "OPTIONS" {
+			traceStep(context, "OPTIONS allowed")
+			decide(context, "options")
+			statusOK(context)
+		} else if noAuth && router.noAuthVerify && len(authHeader) > 0 && !router.verifyCredential(holder, host, domain, authHeader, router.tokenRe, router.basicRe, router.basicUserRe, router.hmacRe) {
+			traceStep(context, "no_auths matched with an invalid credential")
+			invalidCredential(context)
+		} else if noAuth {
+			traceStep(context, "no_auths matched")
+			decide(context, "no_auth")
+			router.hitNoAuthRule(context, holder, host, method, noAuthTarget(path, rawQuery, holder.GetNoAuthQuery(host)))
+			// anonymous clients are throttled by IP with a separate limiter, so that they never evict the windows of credentials
+			if rateLimit := holder.GetNoAuthRateLimit(host); rateLimit == nil || router.takeRateLimit(context, router.anonymousLimiter, host+"\tanonymous\t"+clientIP, rateLimit) {
 				statusOK(context)
-			} else if router.matchBasicAuthPath(domain, path, holder.GetBasicAuthConf(host)) {
-				if router.verifyBasicAuth(domain, path, authHeader, basicRe, basicUserRe, holder.GetBasicAuthConf(host)) {
-					statusOK(context)
-				} else {
-					basicAuthRequired(context)
+			}
+		} else if basicAuth {
+			traceStep(context, "basic_auths matched")
+			router.varyByCredential(context)
+			if user, ok := router.verifyBasicAuth(router.decisionCaches(holder, host), host, domain, target, authHeader, router.basicRe, router.basicUserRe); ok {
+				traceStep(context, "basic user %s verified", user.username)
+				router.hitRule(context, host, user.label)
+				if router.checkLimits(context, method, host+"\tbasic\t"+user.username, user.limits) {
+					router.approve(context, "basic:"+user.username)
 				}
 			} else {
-				if len(authHeader) == 0 {
-					authHeaderMissing(context)
+				traceStep(context, "basic user not verified")
+				basicAuthRequired(context)
+			}
+		} else {
+			traceStep(context, "no_auths and basic_auths not matched")
+			router.varyByCredential(context)
+			if apiKey := router.apiKey(context.Request, rawQuery); len(apiKey) > 0 {
+				traceStep(context, "api key given")
+				router.authorizeBearer(context, holder, host, domain, method, target, []string{apiKey})
+			} else if len(authHeader) == 0 {
+				traceStep(context, "authorization header missing")
+				router.warnUnmatched(context, host, path, "missing header")
+				authHeaderMissing(context)
+			} else if hmacMatches := router.hmacRe.FindStringSubmatch(authHeader); len(hmacMatches) > 0 {
+				hmacAuth, ok := holder.GetHMACAuth(host, hmacMatches[1])
+				traceStep(context, "hmac key %s known=%t", hmacMatches[1], ok)
+				router.authorizeHMAC(context, hmacMatches[1], hmacAuth, ok, method, path, target, hmacMatches[2])
+			} else {
+				var bearerTokens []string
+				if matches := router.tokenRe.FindStringSubmatch(authHeader); len(matches) > 0 {
+					bearerTokens = splitBearerTokens(matches[1])
+				}
+				if len(bearerTokens) > maxBearerTokens {
+					traceStep(context, "too many bearer tokens")
+					tooManyBearerTokens(context)
 				} else {
-					matches := tokenRe.FindAllStringSubmatch(authHeader, -1)
-					if len(matches) == 0 || !holder.HasToken(host, matches[0][1]) {
-						tokenMissmatch(context)
-					} else if !router.matchBearerAuthPath(domain, path, matches[0][1], holder.GetAllowedPaths(host, matches[0][1])) {
-						pathNotAllowed(context)
-					} else {
-						statusOK(context)
-					}
+					router.authorizeBearer(context, holder, host, domain, method, target, bearerTokens)
 				}
 			}
-		} else {
-			domainNotAllowed(context)
 		}
-	})
+	} else {
+		traceStep(context, "host not matched")
+		domainNotAllowed(context)
+	}
+	return decided(context)
+}
 
-	return router
+func getDebug() bool {
+	debug, err := strconv.ParseBool(os.Getenv(AuthDebug))
+	return err == nil && debug
+}
+
+// getHeaderName returns the name of the custom header set by the environment variable in the canonical form,
+// so that it is looked up case-insensitively like the other headers even if it has surrounding spaces.
+func getHeaderName(env string) string {
+	return http.CanonicalHeaderKey(strings.TrimSpace(os.Getenv(env)))
+}
+
+func getVary() bool {
+	vary, err := strconv.ParseBool(os.Getenv(VaryAuthorization))
+	return err == nil && vary
+}
+
+func getRateLimitHeaders() bool {
+	rateLimitHeaders, err := strconv.ParseBool(os.Getenv(RateLimitHeaders))
+	return err == nil && rateLimitHeaders
+}
+
+func getRateLimitStatus() int {
+	status, err := strconv.Atoi(os.Getenv(RateLimitStatus))
+	if err != nil || status < 400 || 599 < status {
+		return http.StatusTooManyRequests
+	}
+	return status
+}
+
+func getRateLimitBody() gin.H {
+	rawBody := os.Getenv(RateLimitBody)
+	if len(rawBody) == 0 {
+		return nil
+	}
+	var body gin.H
+	if err := json.Unmarshal([]byte(rawBody), &body); err != nil || body == nil {
+		logging.Warn(RateLimitBody+" parse failed", "error", err)
+		return nil
+	}
+	return body
+}
+
+func getSecurityHeaders() map[string]string {
+	rawHeaders := os.Getenv(SecurityHeaders)
+	if len(rawHeaders) == 0 {
+		return nil
+	}
+	var headers map[string]string
+	if err := json.Unmarshal([]byte(rawHeaders), &headers); err != nil {
+		logging.Warn(SecurityHeaders+" parse failed", "error", err)
+		return nil
+	}
+	return headers
+}
+
+func getMaxAuthHeaderLength() int {
+	maxAuthHeaderLength, err := strconv.Atoi(os.Getenv(MaxAuthHeaderLength))
+	if err != nil || maxAuthHeaderLength <= 0 {
+		return defaultMaxAuthHeaderLength
+	}
+	return maxAuthHeaderLength
+}
+
+func getStripCredential() bool {
+	stripCredential, err := strconv.ParseBool(os.Getenv(StripCredentialOnSuccess))
+	return err == nil && stripCredential
+}
+
+func getReplaceInvalidUTF8() bool {
+	return strings.EqualFold(os.Getenv(BasicAuthInvalidUTF8), "replace")
+}
+
+func getLogSampleRate() uint64 {
+	sampleRate, err := strconv.ParseUint(os.Getenv(LogSampleRate), 10, 64)
+	if err != nil || sampleRate < 1 {
+		return 1
+	}
+	return sampleRate
+}
+
+func getRejectNonSlashPath() bool {
+	rejectNonSlashPath, err := strconv.ParseBool(os.Getenv(RejectNonSlashPath))
+	return err == nil && rejectNonSlashPath
+}
+
+// getBearerSchemes returns the quoted scheme keywords of bearer tokens, which are matched case-insensitively.
+func getBearerSchemes() []string {
+	rawSchemes := os.Getenv(BearerSchemes)
+	if len(strings.TrimSpace(rawSchemes)) == 0 {
+		rawSchemes = os.Getenv(BearerScheme)
+	}
+	var schemes []string
+	for _, scheme := range strings.Split(rawSchemes, ",") {
+		if scheme = strings.TrimSpace(scheme); len(scheme) > 0 {
+			schemes = append(schemes, regexp.QuoteMeta(scheme))
+		}
+	}
+	if len(schemes) == 0 {
+		return []string{defaultBearerScheme}
+	}
+	return schemes
+}
+
+func getHostSuffixes() []string {
+	var suffixes []string
+	for _, suffix := range strings.Split(os.Getenv(HostSuffixAllowlist), ",") {
+		suffix = strings.Trim(strings.ToLower(strings.TrimSpace(suffix)), ".")
+		if len(suffix) > 0 {
+			suffixes = append(suffixes, suffix)
+		}
+	}
+	return suffixes
+}
+
+func getHostMatchStripPort() bool {
+	stripPort, err := strconv.ParseBool(os.Getenv(HostMatchStripPort))
+	return err == nil && stripPort
+}
+
+func getHostMatchCaseInsensitive() bool {
+	caseInsensitive, err := strconv.ParseBool(os.Getenv(HostMatchCaseInsensitive))
+	return err == nil && caseInsensitive
+}
+
+func getRejectionDetails() bool {
+	details, err := strconv.ParseBool(os.Getenv(RejectionDetails))
+	return err == nil && details
+}
+
+func getCorrelation() bool {
+	correlation, err := strconv.ParseBool(os.Getenv(CorrelationID))
+	return err == nil && correlation
 }
 
 /*
 Run : start listening HTTP Request using enclosed gin.Engine.
 */
 func (router *Handler) Run(port string) {
-	router.Engine.Run(port)
+	if err := router.RunWithContext(stdcontext.Background(), port); err != nil {
+		logging.Error("server stopped", "error", err)
+	}
+}
+
+/*
+RunWithContext : start listening HTTP Request, and shut down gracefully when ctx is done.
+	The requests in flight are waited for "SHUTDOWN_TIMEOUT" (default 10s), and the watcher of "AUTH_TOKENS_PATH" is stopped.
+*/
+func (router *Handler) RunWithContext(ctx stdcontext.Context, port string) error {
+	server := router.newServer(port)
+	return router.serve(ctx, server, server.ListenAndServe)
+}
+
+// serve runs the server by listen with the admin server, until listen fails or ctx is done.
+func (router *Handler) serve(ctx stdcontext.Context, server *http.Server, listen func() error) error {
+	defer router.holder.Close()
+	var admin *http.Server
+	if adminPort := getAdminListenPort(); len(adminPort) > 0 {
+		admin = router.newAdminServer(adminPort)
+		go func() {
+			if err := admin.ListenAndServe(); err != http.ErrServerClosed {
+				logging.Error("admin server stopped", "error", err)
+			}
+		}()
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- listen()
+	}()
+
+	select {
+	case err := <-served:
+		if admin != nil {
+			admin.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+	logging.Info("shutting down")
+	shutdownCtx, cancel := stdcontext.WithTimeout(stdcontext.Background(), getTimeout(ShutdownTimeout, defaultShutdownTimeout))
+	defer cancel()
+	if admin != nil {
+		admin.Shutdown(shutdownCtx)
+	}
+	err := server.Shutdown(shutdownCtx)
+	// ListenAndServe returns ErrServerClosed as soon as Shutdown is called
+	<-served
+	return err
+}
+
+func (router *Handler) newServer(addr string) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           router.Engine,
+		ReadHeaderTimeout: getTimeout(ReadHeaderTimeout, defaultReadHeaderTimeout),
+		ReadTimeout:       getTimeout(ReadTimeout, defaultReadTimeout),
+		WriteTimeout:      getTimeout(WriteTimeout, defaultWriteTimeout),
+		IdleTimeout:       getTimeout(IdleTimeout, defaultIdleTimeout),
+	}
+}
+
+func getTimeout(name string, defaultTimeout time.Duration) time.Duration {
+	timeout, err := time.ParseDuration(os.Getenv(name))
+	if err != nil || timeout <= 0 {
+		return defaultTimeout
+	}
+	return timeout
+}
+
+// originalRequest returns the method, the path and the raw query to be authorized.
+// When the proxy sends the original request line in the configured headers, they are used instead of the request line.
+func (router *Handler) originalRequest(request *http.Request) (string, string, string) {
+	method := request.Method
+	path := request.URL.Path
+	rawQuery := request.URL.RawQuery
+	if len(router.originalMethodHeader) > 0 {
+		if originalMethod := request.Header.Get(router.originalMethodHeader); len(originalMethod) > 0 {
+			method = strings.ToUpper(originalMethod)
+		}
+	}
+	if len(router.originalURIHeader) > 0 {
+		if originalURI := request.Header.Get(router.originalURIHeader); len(originalURI) > 0 {
+			if u, err := url.ParseRequestURI(originalURI); err == nil {
+				path = u.Path
+				rawQuery = u.RawQuery
+			} else {
+				parts := strings.SplitN(originalURI, "?", 2)
+				path = parts[0]
+				rawQuery = ""
+				if len(parts) == 2 {
+					rawQuery = parts[1]
+				}
+			}
+		}
+	}
+	return method, path, rawQuery
+}
+
+// overrideMethod returns the method in "X-HTTP-Method-Override" of a POST request.
+// OPTIONS is not honored because preflight requests are allowed without authentication.
+func overrideMethod(request *http.Request, method string) string {
+	if method != http.MethodPost {
+		return method
+	}
+	override := strings.ToUpper(strings.TrimSpace(request.Header.Get(methodOverrideHeader)))
+	if len(override) == 0 || override == http.MethodOptions {
+		return method
+	}
+	return override
+}
+
+// allowHostSuffix checks that the canonicalized host is one of the suffixes or their subdomains.
+// All hosts are allowed when no suffix is configured.
+func (router *Handler) allowHostSuffix(domain string) bool {
+	if len(router.hostSuffixes) == 0 {
+		return true
+	}
+	host := normalizeHost(domain)
+	for _, suffix := range router.hostSuffixes {
+		if host == suffix || strings.HasSuffix(host, "."+suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeHost lowercases the requested host, and removes its port and its trailing dot.
+func normalizeHost(domain string) string {
+	host := strings.ToLower(domain)
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(host, ".")
+}
+
+// normalizeDomain lowercases the requested host and removes its port when HOST_MATCH_CASE_INSENSITIVE and HOST_MATCH_STRIP_PORT are set.
+// The brackets of an IPv6 address are kept, so that the same patterns match the host with and without the port.
+func (router *Handler) normalizeDomain(domain string) string {
+	if router.hostMatchLowercase {
+		domain = strings.ToLower(domain)
+	}
+	if router.hostMatchStripPort {
+		if h, _, err := net.SplitHostPort(domain); err == nil {
+			if strings.Contains(h, ":") {
+				h = "[" + h + "]"
+			}
+			domain = h
+		}
+	}
+	return domain
+}
+
+// allowExactHost checks that the requested host equals exactly "require_exact_host" of the credential if it is set.
+func allowExactHost(domain string, exactHost string) bool {
+	return len(exactHost) == 0 || normalizeHost(domain) == exactHost
 }
 
 type hostTuple struct {
@@ -159,131 +884,679 @@ type hostTuple struct {
 	allowed bool
 }
 
-func (router *Handler) matchHost(domain string, hosts []string) (string, bool) {
-	if !router.matchHostCache.Contains(domain) {
-		router.matchHostCache.Add(domain, hostTuple{host: "", allowed: false})
-		for _, host := range hosts {
-			if regexp.MustCompile(host).MatchString(domain) {
-				router.matchHostCache.Add(domain, hostTuple{host: host, allowed: true})
-			}
+// purgeCaches drops the cached decisions of hosts, paths and credentials.
+func (router *Handler) purgeCaches() {
+	if router.matchHostCache != nil {
+		router.matchHostCache.Purge()
+	}
+	router.caches.purge()
+}
+
+// matchHost returns the host matching the domain. The cache is nil when AUTH_CACHE_SIZE=0 disables the caches.
+func (router *Handler) matchHost(domain string, holder *token.Holder) (string, bool) {
+	if router.matchHostCache != nil {
+		if v, ok := router.matchHostCache.Get(domain); ok {
+			r, _ := v.(hostTuple)
+			return r.host, r.allowed
 		}
 	}
-	v, _ := router.matchHostCache.Get(domain)
-	r, _ := v.(hostTuple)
-	return r.host, r.allowed
+	host, allowed := holder.MatchHost(domain)
+	if router.matchHostCache != nil {
+		router.matchHostCache.Add(domain, hostTuple{host: host, allowed: allowed})
+	}
+	if router.debug && allowed {
+		logging.Info("host matched", "domain", domain, "pattern", host, "matched_patterns", strings.Join(token.MatchHostPatterns(domain, holder.GetHostPatterns()), ","))
+	}
+	return host, allowed
+}
+
+// rootPathBehavior returns root_path of the host for the root path, and RootPathRules for the other paths.
+// The root path is exactly "/", which is matched by many broad patterns like "^/.*$" unintentionally.
+func rootPathBehavior(holder *token.Holder, host string, path string) string {
+	if path != "/" {
+		return token.RootPathRules
+	}
+	return holder.GetRootPath(host)
 }
 
-func (router *Handler) matchBasicAuthPath(domain string, path string, basicAuthConf map[string]map[string]string) bool {
+// matchRules decides whether the path is allowed without authentication or requires basic authentication.
+// When both rules match the path, the rule with the higher priority wins, and no_auths wins on a tie.
+func (router *Handler) matchRules(host string, domain string, method string, path string, rawQuery string, holder *token.Holder) (bool, bool) {
+	caches := router.decisionCaches(holder, host)
+	noAuth := router.allowNoAuth(caches, domain, method, path, rawQuery, holder.GetNoAuthPaths(host), holder.GetNoAuthPathMethods(host), holder.GetNoAuthQuery(host))
+	basicAuthPriority, basicAuth := router.matchBasicAuthPath(caches, domain, queryTarget(path, rawQuery, holder.IsMatchQuery(host)), holder.GetBasicAuthPriorities(host))
+	if noAuth && basicAuth && holder.GetNoAuthPriority(host) < basicAuthPriority {
+		noAuth = false
+	}
+	return noAuth, basicAuth && !noAuth
+}
+
+type priorityTuple struct {
+	priority int
+	matched  bool
+}
+
+// matchBasicAuthPath returns the priority of basic authentication for the path. The caches are nil when the host disables them.
+func (router *Handler) matchBasicAuthPath(caches *pathCaches, domain string, path string, basicAuthPriorities map[*regexp.Regexp]int) (int, bool) {
 	key := domain + "\t" + path
-	if !router.matchBasicAuthPathCache.Contains(key) {
-		router.matchBasicAuthPathCache.Add(key, false)
-		for pathReStr := range basicAuthConf {
-			if regexp.MustCompile(pathReStr).MatchString(path) {
-				router.matchBasicAuthPathCache.Add(key, true)
-			}
+	if caches != nil {
+		if v, ok := caches.matchBasicAuthPath.Get(key); ok {
+			r, _ := v.(priorityTuple)
+			return r.priority, r.matched
+		}
+	}
+	// when several paths match, the highest priority is used
+	matched := priorityTuple{priority: 0, matched: false}
+	for pathRe, priority := range basicAuthPriorities {
+		if pathRe.MatchString(path) && (!matched.matched || matched.priority < priority) {
+			matched = priorityTuple{priority: priority, matched: true}
 		}
 	}
-	v, _ := router.matchBasicAuthPathCache.Get(key)
-	r, _ := v.(bool)
-	return r
+	if caches != nil {
+		caches.matchBasicAuthPath.Add(key, matched)
+	}
+	return matched.priority, matched.matched
+}
+
+type userTuple struct {
+	username string
+	label    string
+	limits   token.Limits
+	verified bool
 }
 
-func (router *Handler) verifyBasicAuth(domain string, path string, authHeader string, basicRe *regexp.Regexp, basicUserRe *regexp.Regexp, basicAuthConf map[string]map[string]string) bool {
+func (router *Handler) verifyBasicAuth(caches *pathCaches, host string, domain string, path string, authHeader string, basicRe *regexp.Regexp, basicUserRe *regexp.Regexp) (userTuple, bool) {
 	key := authHeader + "\t" + domain + "\t" + path
-	if !router.verifyBasicAuthCache.Contains(key) {
-		matches := basicRe.FindAllStringSubmatch(authHeader, -1)
-		router.verifyBasicAuthCache.Add(key, false)
-		if len(authHeader) > 0 && len(matches) > 0 {
-			encodedUser, err := base64.StdEncoding.DecodeString(matches[0][1])
-			if err == nil {
-				userMatches := basicUserRe.FindAllStringSubmatch(string(encodedUser), -1)
-				if len(userMatches[0]) == 3 {
-					for pathReStr, user := range basicAuthConf {
-						if regexp.MustCompile(pathReStr).MatchString(path) {
-							password, ok := user[userMatches[0][1]]
-							if ok {
-								if password == userMatches[0][2] {
-									router.verifyBasicAuthCache.Add(key, true)
-								}
-							}
-						}
-					}
-				}
+	if router.cacheDecisions && caches != nil {
+		if v, ok := caches.verifyBasicAuth.Get(key); ok {
+			r, _ := v.(userTuple)
+			return r, r.verified
+		}
+	}
+	r := userTuple{username: "", verified: false}
+	matches := basicRe.FindAllStringSubmatch(authHeader, -1)
+	if len(authHeader) > 0 && len(matches) > 0 {
+		if username, password, ok := router.decodeBasicCredential(matches[0][1], basicUserRe); ok {
+			basicCredentials, _ := router.credentials.LookupBasic(host, username)
+			if basicCredential, ok := matchBasicCredential(basicCredentials, domain, path, password); ok {
+				r = userTuple{username: username, label: basicCredential.Label, limits: basicCredential.Limits, verified: true}
 			}
 		}
 	}
-	v, _ := router.verifyBasicAuthCache.Get(key)
-	r, _ := v.(bool)
-	return r
+	if router.cacheDecisions && caches != nil {
+		caches.verifyBasicAuth.Add(key, r)
+	}
+	return r, r.verified
 }
 
-func (router *Handler) matchBearerAuthPath(domain string, path string, token string, allowedPaths []*regexp.Regexp) bool {
-	key := token + "\t" + domain + "\t" + path
-	if !router.matchBearerAuthPathCache.Contains(key) {
-		router.matchBearerAuthPathCache.Add(key, false)
-		for _, allowedPath := range allowedPaths {
+// matchBasicCredential returns the credential which has the password and allows the path.
+// The user given with different passwords has a credential for each of them, which opens only its own paths.
+func matchBasicCredential(basicCredentials []token.BasicCredential, domain string, path string, password string) (token.BasicCredential, bool) {
+	for _, basicCredential := range basicCredentials {
+		if !allowBasicCredential(basicCredential, domain, password) {
+			continue
+		}
+		for _, allowedPath := range basicCredential.AllowedPaths {
 			if allowedPath.MatchString(path) {
-				router.matchBearerAuthPathCache.Add(key, true)
+				return basicCredential, true
 			}
 		}
 	}
-	v, _ := router.matchBearerAuthPathCache.Get(key)
-	r, _ := v.(bool)
-	return r
+	return token.BasicCredential{}, false
 }
 
-func (router *Handler) matchNoAuthPath(domain string, path string, noAuthPaths []string) bool {
-	key := domain + "\t" + path
-	if !router.matchNoAuthPathCache.Contains(key) {
-		router.matchNoAuthPathCache.Add(key, false)
-		for _, noAuthPath := range noAuthPaths {
-			if regexp.MustCompile(noAuthPath).MatchString(path) {
-				router.matchNoAuthPathCache.Add(key, true)
+// allowBasicCredential checks the password and the exact host of the credential of basic authentication.
+func allowBasicCredential(basicCredential token.BasicCredential, domain string, password string) bool {
+	return verifyPassword(basicCredential, password) && allowExactHost(domain, basicCredential.ExactHost)
+}
+
+// verifyPassword compares the password of basic authentication with the hash of the user when it is given,
+// or with the plain password. The decisions are cached per Authorization header, so the hash is rarely computed.
+func verifyPassword(basicCredential token.BasicCredential, password string) bool {
+	if len(basicCredential.PasswordHash) > 0 {
+		return token.ComparePasswordHash(basicCredential.PasswordHash, password)
+	}
+	return equalSecret(basicCredential.Password, password)
+}
+
+// equalSecret compares the secrets in constant time not to leak how much of them matches.
+// The digests are compared, so that the time does not depend on the lengths either.
+func equalSecret(expected string, actual string) bool {
+	expectedSum := sha256.Sum256([]byte(expected))
+	actualSum := sha256.Sum256([]byte(actual))
+	return subtle.ConstantTimeCompare(expectedSum[:], actualSum[:]) == 1
+}
+
+// decodeBasicCredential decodes the user-pass of basic auth and splits it on the first colon,
+// because a username cannot contain a colon but a password can (RFC 7617).
+func (router *Handler) decodeBasicCredential(encoded string, basicUserRe *regexp.Regexp) (string, string, bool) {
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", "", false
+	}
+	userPass := string(decoded)
+	if !utf8.ValidString(userPass) {
+		if !router.replaceInvalidUTF8 {
+			return "", "", false
+		}
+		// converting to runes replaces each invalid byte with U+FFFD like encoding/json
+		userPass = string([]rune(userPass))
+	}
+	userMatches := basicUserRe.FindStringSubmatch(userPass)
+	if len(userMatches) != 3 {
+		return "", "", false
+	}
+	return userMatches[1], userMatches[2], true
+}
+
+// maxBearerTokens is the maximum number of the bearer tokens in a header, not to look up and verify them without limit.
+const maxBearerTokens = 5
+
+// splitBearerTokens splits the value of the bearer scheme into the tokens separated by whitespaces or commas.
+func splitBearerTokens(value string) []string {
+	return strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || unicode.IsSpace(r)
+	})
+}
+
+// authorizeBearer authorizes the request by the bearer tokens in the order of the header, and the first authorized token wins.
+// When no token is authorized, 403 is returned if any of them is known, otherwise the token mismatch is returned.
+func (router *Handler) authorizeBearer(context *gin.Context, holder *token.Holder, host string, domain string, method string, path string, bearerTokens []string) {
+	if jwtAuth, ok := holder.GetJWTAuth(host); ok {
+		router.authorizeJWT(context, holder, jwtAuth, host, method, path, bearerTokens)
+		return
+	}
+	if introspectionAuth, ok := holder.GetIntrospectionAuth(host); ok {
+		router.authorizeIntrospection(context, holder, introspectionAuth, host, method, path, bearerTokens)
+		return
+	}
+	known := false
+	// the methods of the method scoped paths matching the path, which the known tokens allow
+	allowedMethods := []string{}
+	if len(bearerTokens) == 0 {
+		traceStep(context, "bearer token missing")
+	}
+	for _, bearerToken := range bearerTokens {
+		bearerCredential, found := router.credentials.LookupBearer(host, bearerToken)
+		if !found {
+			traceStep(context, "bearer token %s unknown", tokenFingerprint(bearerToken))
+			continue
+		}
+		known = true
+		// the rule does not apply to the other hosts even if they match the pattern of the host
+		if !allowExactHost(domain, bearerCredential.ExactHost) {
+			traceStep(context, "bearer token %s host not exact", tokenFingerprint(bearerToken))
+			continue
+		}
+		if pattern, ok := router.matchBearerAuthPath(router.decisionCaches(holder, host), domain, method, path, bearerToken, bearerCredential); ok {
+			traceStep(context, "bearer token %s allowed by %s", tokenFingerprint(bearerToken), pattern)
+			router.hitRule(context, host, bearerCredential.Label)
+			if router.debug {
+				logging.Info("bearer token matched", "host", host, "path", path, "pattern", pattern)
+				context.Writer.Header().Set(matchPathHeader, pattern)
+			}
+			if router.checkLimits(context, method, host+"\tbearer\t"+bearerToken, bearerCredential.Limits) {
+				if !bearerCredential.ValidUntil.IsZero() {
+					context.Writer.Header().Set(tokenExpiresInHeader, strconv.FormatInt(router.expiresIn(bearerCredential.ValidUntil), 10))
+				}
+				router.approve(context, "bearer:"+tokenFingerprint(bearerToken))
 			}
+			return
+		}
+		traceStep(context, "bearer token %s path not allowed", tokenFingerprint(bearerToken))
+		allowedMethods = appendScopedMethods(allowedMethods, bearerCredential, path)
+	}
+	if known && len(allowedMethods) > 0 {
+		router.warnUnmatched(context, host, path, "method not allowed")
+		methodNotAllowed(context, allowedMethods)
+	} else if known {
+		router.warnUnmatched(context, host, path, "path not allowed")
+		pathNotAllowed(context)
+	} else if holder.IsUnknownTokenForbidden(host) {
+		router.warnUnmatched(context, host, path, "token mismatch")
+		tokenForbidden(context)
+	} else {
+		router.warnUnmatched(context, host, path, "token mismatch")
+		tokenMissmatch(context)
+	}
+}
+
+type pathTuple struct {
+	pattern string
+	allowed bool
+}
+
+func (router *Handler) matchBearerAuthPath(caches *pathCaches, domain string, method string, path string, token string, bearerCredential token.BearerCredential) (string, bool) {
+	key := token + "\t" + domain + "\t" + method + "\t" + path
+	if router.cacheDecisions && caches != nil {
+		if v, ok := caches.matchBearerAuthPath.Get(key); ok {
+			r, _ := v.(pathTuple)
+			return r.pattern, r.allowed
+		}
+	}
+	// when several allowed paths match, the longest (most specific) pattern is reported
+	matched := pathTuple{pattern: "", allowed: false}
+	for _, allowedPath := range bearerCredential.AllowedPaths {
+		// an allowed path scoped to methods does not match the other methods
+		if methods, ok := bearerCredential.AllowedPathMethods[allowedPath]; ok && !containsMethod(methods, method) {
+			continue
+		}
+		if allowedPath.MatchString(path) && (!matched.allowed || len(matched.pattern) < len(allowedPath.String())) {
+			matched = pathTuple{pattern: allowedPath.String(), allowed: true}
+		}
+	}
+	if !matched.allowed && bearerCredential.DefaultAllow {
+		matched = pathTuple{pattern: defaultAllowPattern, allowed: true}
+	}
+	// denied paths win over both allowed paths and default_allow
+	for _, deniedPath := range bearerCredential.DeniedPaths {
+		if deniedPath.MatchString(path) {
+			matched = pathTuple{pattern: "", allowed: false}
+			break
+		}
+	}
+	if router.cacheDecisions && caches != nil {
+		caches.matchBearerAuthPath.Add(key, matched)
+	}
+	return matched.pattern, matched.allowed
+}
+
+// appendScopedMethods appends the methods of the method scoped paths of the token which match the path.
+// A denied path is not allowed for any method, so its methods are never appended.
+func appendScopedMethods(methods []string, bearerCredential token.BearerCredential, path string) []string {
+	for _, deniedPath := range bearerCredential.DeniedPaths {
+		if deniedPath.MatchString(path) {
+			return methods
+		}
+	}
+	for _, allowedPath := range bearerCredential.AllowedPaths {
+		scoped, ok := bearerCredential.AllowedPathMethods[allowedPath]
+		if !ok || !allowedPath.MatchString(path) {
+			continue
+		}
+		for _, method := range scoped {
+			if method = strings.ToUpper(method); !containsMethod(methods, method) {
+				methods = append(methods, method)
+			}
+		}
+	}
+	return methods
+}
+
+// matchNoAuthPath checks whether the path is allowed without authentication. The caches are nil when the host disables them.
+func (router *Handler) matchNoAuthPath(caches *pathCaches, domain string, method string, path string, noAuthPaths []*regexp.Regexp, noAuthPathMethods map[*regexp.Regexp][]string) bool {
+	key := domain + "\t" + method + "\t" + path
+	if caches != nil {
+		if v, ok := caches.matchNoAuthPath.Get(key); ok {
+			r, _ := v.(bool)
+			return r
+		}
+	}
+	matched := false
+	for _, noAuthPath := range noAuthPaths {
+		// a path scoped to methods does not match the other methods, which require authentication
+		if methods, ok := noAuthPathMethods[noAuthPath]; ok && !containsMethod(methods, method) {
+			continue
+		}
+		if noAuthPath.MatchString(path) {
+			matched = true
+			break
+		}
+	}
+	if caches != nil {
+		caches.matchNoAuthPath.Add(key, matched)
+	}
+	return matched
+}
+
+// allowNoAuth checks whether the request is allowed without authentication.
+// The query string is matched together with the path only when match_query is set,
+// and any of denied_query_params in the query makes the rule not applied.
+func (router *Handler) allowNoAuth(caches *pathCaches, domain string, method string, path string, rawQuery string, noAuthPaths []*regexp.Regexp, noAuthPathMethods map[*regexp.Regexp][]string, noAuthQuery token.NoAuthQuery) bool {
+	if !router.matchNoAuthPath(caches, domain, method, noAuthTarget(path, rawQuery, noAuthQuery), noAuthPaths, noAuthPathMethods) {
+		return false
+	}
+	return !hasDeniedQueryParam(rawQuery, noAuthQuery.DeniedQueryParams)
+}
+
+// noAuthTarget returns the path matched by no_auths, which has the query string only when match_query is set.
+func noAuthTarget(path string, rawQuery string, noAuthQuery token.NoAuthQuery) string {
+	return queryTarget(path, rawQuery, noAuthQuery.MatchQuery)
+}
+
+// queryTarget returns the path with the query string like the request URI when matchQuery is true, otherwise the path.
+// The decisions are cached by the returned target, so the requests with different query strings are never mixed up.
+func queryTarget(path string, rawQuery string, matchQuery bool) string {
+	if matchQuery && len(rawQuery) > 0 {
+		return path + "?" + rawQuery
+	}
+	return path
+}
+
+func hasDeniedQueryParam(rawQuery string, deniedQueryParams []string) bool {
+	if len(deniedQueryParams) == 0 {
+		return false
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		// a query which cannot be parsed may hide a denied parameter
+		return true
+	}
+	for _, deniedQueryParam := range deniedQueryParams {
+		if _, ok := query[deniedQueryParam]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+func allowUserAgent(userAgent string, allows []*regexp.Regexp, denies []*regexp.Regexp) bool {
+	for _, deny := range denies {
+		if deny.MatchString(userAgent) {
+			return false
+		}
+	}
+	if allows == nil {
+		return true
+	}
+	for _, allow := range allows {
+		if allow.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// warnUnmatched logs the request which falls through all rules, except the dry runs of the admin API.
+func (router *Handler) warnUnmatched(context *gin.Context, host string, path string, reason string) {
+	if !isDryRun(context.Request) {
+		router.unmatchedLogger.warn(host, path, reason)
+	}
+}
+
+func (router *Handler) varyByCredential(context *gin.Context) {
+	if router.vary {
+		for _, header := range router.credentialHeaders() {
+			context.Writer.Header().Add("Vary", header)
+		}
+	}
+}
+
+func (router *Handler) checkLimits(context *gin.Context, method string, key string, limits token.Limits) bool {
+	if len(limits.AllowedMethods) > 0 && !containsMethod(limits.AllowedMethods, method) {
+		traceStep(context, "method %s not allowed", method)
+		methodForbidden(context)
+		return false
+	}
+	if limits.MaxBodySize > 0 && context.Request.ContentLength > limits.MaxBodySize {
+		traceStep(context, "body too large")
+		requestEntityTooLarge(context)
+		return false
+	}
+	if limits.RateLimit != nil {
+		return router.takeRateLimit(context, router.rateLimiter, key, limits.RateLimit)
+	}
+	return true
+}
+
+// takeRateLimit takes a request from the window of the key, and rejects the request when the rate limit is exceeded.
+// Dry runs never consume the rate limit.
+func (router *Handler) takeRateLimit(context *gin.Context, limiter *rateLimiter, key string, rateLimit *token.RateLimit) bool {
+	if isDryRun(context.Request) {
+		return true
+	}
+	remaining, reset, ok := limiter.take(key, rateLimit)
+	if router.rateLimitHeaders {
+		context.Writer.Header().Set("X-RateLimit-Limit", strconv.Itoa(rateLimit.Requests))
+		context.Writer.Header().Set("X-RateLimit-Remaining", strconv.Itoa(remaining))
+		context.Writer.Header().Set("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	}
+	if !ok {
+		traceStep(context, "rate limit exceeded")
+		router.tooManyRequests(context, reset.Sub(limiter.now()))
+		return false
+	}
+	return true
+}
+
+func containsMethod(methods []string, method string) bool {
+	for _, m := range methods {
+		if strings.EqualFold(m, method) {
+			return true
+		}
+	}
+	return false
+}
+
+func reject(context *gin.Context, code int, obj gin.H) {
+	// the decision keeps the actual message, which may be replaced in the body
+	message, _ := obj["error"].(string)
+	context.Set(decisionKey, Decision{Allowed: false, Error: message})
+	if denyBody := context.GetString(denyBodyKey); len(denyBody) > 0 {
+		// log the actual reason because the body does not tell which check failed
+		logging.Info("deny", "host", context.Request.Host, "path", context.Request.URL.Path, "status", code, "error", obj["error"])
+		obj = gin.H{
+			"authorized": false,
+			"error":      denyBody,
 		}
 	}
-	v, _ := router.matchNoAuthPathCache.Get(key)
-	r, _ := v.(bool)
-	return r
+	if context.GetBool(softDenyKey) {
+		// pass the request to upstream with a flag, and keep the intended denial in the log
+		logging.Warn("soft deny", "host", context.Request.Host, "path", context.Request.URL.Path, "status", code, "error", obj["error"])
+		context.Writer.Header().Del("WWW-Authenticate")
+		context.Writer.Header().Del("Retry-After")
+		context.Writer.Header().Set(softDenyHeader, "true")
+		obj["soft_deny"] = true
+		code = http.StatusOK
+	}
+	setCheckResult(context, false)
+	if context.GetBool(correlationKey) {
+		id := context.GetString(requestIDKey)
+		context.Writer.Header().Set(correlationIDHeader, id)
+		obj["correlation_id"] = id
+	}
+	if context.GetBool(rejectionDetailsKey) {
+		method, path := requested(context)
+		obj["method"] = method
+		obj["host"] = context.Request.Host
+		obj["path"] = path
+	}
+	context.JSON(code, obj)
+}
+
+// setRequested keeps the method and path which are decided, that may be given by the original request headers.
+func setRequested(context *gin.Context, method string, path string) {
+	context.Set(requestedMethodKey, method)
+	context.Set(requestedPathKey, path)
+}
+
+// requested returns the method and path which are decided, or those of the request itself before they are known.
+func requested(context *gin.Context) (string, string) {
+	method, path := context.GetString(requestedMethodKey), context.GetString(requestedPathKey)
+	if len(method) == 0 {
+		method, path = context.Request.Method, context.Request.URL.Path
+	}
+	return method, path
 }
 
 func domainNotAllowed(context *gin.Context) {
-	context.JSON(http.StatusForbidden, gin.H{
+	decide(context, "domain_not_allowed")
+	reject(context, http.StatusForbidden, gin.H{
 		"authorized": false,
 		"error":      "domain not allowd",
 	})
 }
 
+func ipNotAllowed(context *gin.Context) {
+	decide(context, "ip_not_allowed")
+	reject(context, http.StatusForbidden, gin.H{
+		"authorized": false,
+		"error":      "ip not allowed",
+	})
+}
+
+func userAgentNotAllowed(context *gin.Context) {
+	decide(context, "user_agent_not_allowed")
+	reject(context, http.StatusForbidden, gin.H{
+		"authorized": false,
+		"error":      "user agent not allowed",
+	})
+}
+
+func authHeaderTooLarge(context *gin.Context) {
+	decide(context, "header_too_large")
+	reject(context, http.StatusBadRequest, gin.H{
+		"authorized": false,
+		"error":      "too large Header: " + authHeader,
+	})
+}
+
+func tooManyBearerTokens(context *gin.Context) {
+	decide(context, "too_many_tokens")
+	reject(context, http.StatusBadRequest, gin.H{
+		"authorized": false,
+		"error":      "too many bearer tokens",
+	})
+}
+
+func invalidPath(context *gin.Context) {
+	decide(context, "invalid_path")
+	reject(context, http.StatusBadRequest, gin.H{
+		"authorized": false,
+		"error":      "invalid path",
+	})
+}
+
 func authHeaderMissing(context *gin.Context) {
-	context.Writer.Header().Set("WWW-Authenticate", "Bearer realm=\"token_required\"")
-	context.JSON(http.StatusUnauthorized, gin.H{
+	decide(context, "no_header")
+	context.Writer.Header().Set("WWW-Authenticate", "Bearer realm="+realm(context, defaultBearerRealm))
+	reject(context, http.StatusUnauthorized, gin.H{
 		"authorized": false,
 		"error":      "missing Header: " + authHeader,
 	})
 }
 
 func tokenMissmatch(context *gin.Context) {
-	context.Writer.Header().Set("WWW-Authenticate", "Bearer realm=\"token_required\" error=\"invalid_token\"")
-	context.JSON(http.StatusUnauthorized, gin.H{
+	decide(context, "token_mismatch")
+	context.Writer.Header().Set("WWW-Authenticate", "Bearer realm="+realm(context, defaultBearerRealm)+" error=\"invalid_token\"")
+	reject(context, http.StatusUnauthorized, gin.H{
+		"authorized": false,
+		"error":      "token mismatch",
+	})
+}
+
+func tokenForbidden(context *gin.Context) {
+	decide(context, "token_mismatch")
+	reject(context, http.StatusForbidden, gin.H{
 		"authorized": false,
 		"error":      "token mismatch",
 	})
 }
 
 func pathNotAllowed(context *gin.Context) {
-	context.Writer.Header().Set("WWW-Authenticate", "Bearer realm=\"token_required\" error=\"not_allowed\"")
-	context.JSON(http.StatusForbidden, gin.H{
+	decide(context, "path_not_allowed")
+	context.Writer.Header().Set("WWW-Authenticate", "Bearer realm="+realm(context, defaultBearerRealm)+" error=\"not_allowed\"")
+	reject(context, http.StatusForbidden, gin.H{
 		"authorized": false,
 		"error":      "path not allowd",
 	})
 }
 
+func rootPathDenied(context *gin.Context) {
+	decide(context, "root_path_denied")
+	reject(context, http.StatusForbidden, gin.H{
+		"authorized": false,
+		"error":      "root path not allowed",
+	})
+}
+
+func methodForbidden(context *gin.Context) {
+	decide(context, "method_not_allowed")
+	reject(context, http.StatusForbidden, gin.H{
+		"authorized": false,
+		"error":      "method not allowed",
+	})
+}
+
+// methodNotAllowed rejects the method of a path which is allowed only for the other methods by the method scoped paths.
+func methodNotAllowed(context *gin.Context, allowed []string) {
+	decide(context, "method_not_allowed")
+	context.Writer.Header().Set("Allow", strings.Join(allowed, ", "))
+	reject(context, http.StatusMethodNotAllowed, gin.H{
+		"authorized": false,
+		"error":      "method not allowed",
+	})
+}
+
+func requestEntityTooLarge(context *gin.Context) {
+	decide(context, "body_too_large")
+	reject(context, http.StatusRequestEntityTooLarge, gin.H{
+		"authorized": false,
+		"error":      "request entity too large",
+	})
+}
+
+func (router *Handler) tooManyRequests(context *gin.Context, retryAfter time.Duration) {
+	decide(context, "rate_limited")
+	seconds := int64((retryAfter + time.Second - 1) / time.Second)
+	context.Writer.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+	obj := gin.H{
+		"authorized": false,
+		"error":      "too many requests",
+	}
+	if router.rateLimitBody != nil {
+		// copy the configured body because reject may add fields to it
+		obj = gin.H{}
+		for k, v := range router.rateLimitBody {
+			obj[k] = v
+		}
+	}
+	reject(context, router.rateLimitStatus, obj)
+}
+
 func basicAuthRequired(context *gin.Context) {
-	context.Writer.Header().Set("WWW-Authenticate", "Basic realm=\"basic authentication required\"")
-	context.String(http.StatusUnauthorized, "")
+	decide(context, "basic_auth_required")
+	context.Writer.Header().Set("WWW-Authenticate", "Basic realm="+realm(context, defaultBasicRealm))
+	reject(context, http.StatusUnauthorized, gin.H{
+		"authorized": false,
+		"error":      "basic authentication required",
+	})
+}
+
+// approve accepts the request authorized by a credential. The proxy removes the headers listed in
+// "x-envoy-auth-headers-to-remove" and adds the identity header when it is allowed to pass to upstream.
+func (router *Handler) approve(context *gin.Context, identity string) {
+	decide(context, "credential")
+	if router.stripCredential {
+		context.Writer.Header().Set(headersToRemoveHeader, strings.ToLower(strings.Join(router.credentialHeaders(), ",")))
+	}
+	if len(router.identityHeader) > 0 {
+		context.Writer.Header().Set(router.identityHeader, identity)
+	}
+	statusOK(context)
+}
+
+// expiresIn returns the remaining lifetime of the token in seconds, rounded up.
+func (router *Handler) expiresIn(validUntil time.Time) int64 {
+	remaining := validUntil.Sub(router.now())
+	if remaining <= 0 {
+		return 0
+	}
+	return int64((remaining + time.Second - 1) / time.Second)
+}
+
+// tokenFingerprint identifies the bearer token without revealing it.
+func tokenFingerprint(bearerToken string) string {
+	sum := sha256.Sum256([]byte(bearerToken))
+	return hex.EncodeToString(sum[:6])
 }
 
 func statusOK(context *gin.Context) {
+	context.Set(decisionKey, Decision{Allowed: true})
+	if context.GetBool(extAuthzKey) {
+		allowExtAuthz(context)
+		return
+	}
 	context.JSON(http.StatusOK, gin.H{
 		"authorized": true,
 	})
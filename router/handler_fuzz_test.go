@@ -0,0 +1,95 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func FuzzAuthHeader(f *testing.F) {
+	gin.SetMode(gin.ReleaseMode)
+	logging.SetOutput(ioutil.Discard)
+	logOutput = ioutil.Discard
+	defer func() { logOutput = os.Stdout }()
+
+	json := `[
+		{
+			"host": "127\\.0\\.0\\.1:.*",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$", "("]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	defer os.Unsetenv(token.AuthTokens)
+	handler := NewHandler()
+
+	seeds := []string{
+		"",
+		"bearer",
+		"bearer ",
+		"bearer TOKEN1",
+		"Bearer TOKEN1 TOKEN2",
+		"basic",
+		"Basic ",
+		"Basic !!!",
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("nocolon")),
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("")),
+		"Basic " + base64.StdEncoding.EncodeToString([]byte(":")),
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("user1:")),
+		"Basic " + base64.StdEncoding.EncodeToString([]byte(":password1")),
+		"Basic " + base64.StdEncoding.EncodeToString([]byte("user1:password1")),
+	}
+	for _, seed := range seeds {
+		for _, path := range []string{"/foo/1", "/piyo/1", "/static/1", "/"} {
+			f.Add(seed, path)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, authHeader string, path string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = path
+		r.Host = "127.0.0.1:8080"
+		r.Header.Set("Authorization", authHeader)
+		handler.Engine.ServeHTTP(w, r)
+
+		switch w.Code {
+		case http.StatusOK, http.StatusUnauthorized, http.StatusForbidden:
+		default:
+			t.Fatalf("unexpected status %d for Authorization %q and path %q", w.Code, authHeader, path)
+		}
+	})
+}
@@ -7,16 +7,25 @@ Package router : authorize and authenticate HTTP Request using HTTP Header.
 package router
 
 import (
+	"bytes"
+	stdcontext "context"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
 
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
 	"github.com/RoboticBase/fiware-ambassador-auth/token"
 )
 
@@ -27,6 +36,17 @@ func getBasicAuthHeader(username string, password string) string {
 	return "Basic " + base64.StdEncoding.EncodeToString([]byte(auth))
 }
 
+func serve(handler *Handler, method string, host string, path string, headers map[string]string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(method, path, nil)
+	r.Host = host
+	for k, v := range headers {
+		r.Header.Set(k, v)
+	}
+	handler.Engine.ServeHTTP(w, r)
+	return w
+}
+
 func setUp(t *testing.T) (func(string, string, string) (*http.Response, error), func()) {
 	t.Helper()
 	gin.SetMode(gin.ReleaseMode)
@@ -705,3 +725,3150 @@ func TestNewHandlerNoEnv(t *testing.T) {
 		}
 	})
 }
+
+func TestNewHandlerDebugMatchedPath(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	json := `[
+		{
+			"host": "127\\.0\\.0\\.1:.*",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$", "^/foo/bar/.*$", "^/foo/bar/\\d+$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	t.Run("with AUTH_DEBUG", func(t *testing.T) {
+		os.Setenv(AuthDebug, "true")
+		defer os.Unsetenv(AuthDebug)
+
+		cases := []struct {
+			path       string
+			statusCode int
+			pattern    string
+			desc       string
+		}{
+			{path: "/foo/1", statusCode: http.StatusOK, pattern: "^/foo/.*$", desc: "report the only matched pattern"},
+			{path: "/foo/bar/a", statusCode: http.StatusOK, pattern: "^/foo/bar/.*$", desc: "report the most specific pattern of two matched patterns"},
+			{path: "/foo/bar/1", statusCode: http.StatusOK, pattern: "^/foo/bar/\\d+$", desc: "report the most specific pattern of three matched patterns"},
+			{path: "/bar/1", statusCode: http.StatusForbidden, pattern: "", desc: "report nothing when no pattern is matched"},
+		}
+
+		for _, c := range cases {
+			t.Run(fmt.Sprintf("?path=%v", c.path), func(t *testing.T) {
+				r, err := doRequest("GET", c.path, "bearer TOKEN1")
+				assert.Nil(err, "GET has no error")
+				assert.Equal(c.statusCode, r.StatusCode, c.desc)
+				assert.Equal(c.pattern, r.Header.Get(matchPathHeader), c.desc)
+			})
+		}
+	})
+
+	t.Run("without AUTH_DEBUG", func(t *testing.T) {
+		r, err := doRequest("GET", "/foo/bar/1", "bearer TOKEN1")
+		assert.Nil(err, "GET has no error")
+		assert.Equal(http.StatusOK, r.StatusCode, "return 200")
+		assert.Equal("", r.Header.Get(matchPathHeader), "does not report the matched pattern")
+	})
+}
+
+func TestNewHandlerDebugMatchedHost(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(ioutil.Discard)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/api/.*$"]
+				}
+			}
+		}, {
+			"host": "www.example.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/www/.*$"]
+				}
+			}
+		}, {
+			"host": ".*\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/any/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	t.Run("with AUTH_DEBUG", func(t *testing.T) {
+		os.Setenv(AuthDebug, "true")
+		defer os.Unsetenv(AuthDebug)
+		handler := NewHandler()
+
+		buf.Reset()
+		w := serve(handler, "GET", "api.example.com", "/api/1", nil)
+		assert.Equal(http.StatusOK, w.Code, "the first matched host wins")
+		assert.Equal(`api\.example\.com`, w.Header().Get(matchHostHeader), "report the matched host pattern")
+		assert.Contains(buf.String(), `host matched domain=api.example.com pattern=api\.example\.com matched_patterns=api\.example\.com,.*\.example\.com`,
+			"log all host patterns matched by the domain")
+
+		buf.Reset()
+		w = serve(handler, "GET", "wwwxexample.com", "/www/1", nil)
+		assert.Equal(http.StatusOK, w.Code, "a literal dot matches any character")
+		assert.Equal("www.example.com", w.Header().Get(matchHostHeader), "report the over-broad host pattern")
+		assert.Contains(buf.String(), `host matched domain=wwwxexample.com pattern=www.example.com`, "log the over-broad host pattern")
+
+		buf.Reset()
+		w = serve(handler, "GET", "api.example.com", "/api/1", nil)
+		assert.Equal(`api\.example\.com`, w.Header().Get(matchHostHeader), "report the cached host pattern")
+		assert.NotContains(buf.String(), "host matched", "log the host patterns only once per domain")
+
+		w = serve(handler, "GET", "unknown.example.org", "/any/1", nil)
+		assert.Equal("", w.Header().Get(matchHostHeader), "report nothing when no host is matched")
+	})
+
+	t.Run("without AUTH_DEBUG", func(t *testing.T) {
+		handler := NewHandler()
+		buf.Reset()
+		w := serve(handler, "GET", "api.example.com", "/api/1", nil)
+		assert.Equal(http.StatusOK, w.Code, "return 200")
+		assert.Equal("", w.Header().Get(matchHostHeader), "does not report the matched host pattern")
+		assert.NotContains(buf.String(), "host matched", "does not log the matched host patterns")
+	})
+}
+
+func TestNewHandlerHostOrder(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	noAuths := func(host string, path string, isDefault bool) string {
+		return fmt.Sprintf(`{"host": %q, "default": %t, "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": [%q]}}}`, host, isDefault, path)
+	}
+
+	t.Run("the first matched host wins", func(t *testing.T) {
+		os.Setenv(token.AuthTokens, "["+noAuths(`.*\.example\.com`, "^/wildcard/.*$", false)+","+noAuths(`api\.example\.com`, "^/api/.*$", false)+"]")
+		handler := NewHandler()
+
+		for i := 0; i < 2; i++ {
+			w := serve(handler, "GET", "api.example.com", "/wildcard/1", nil)
+			assert.Equal(http.StatusOK, w.Code, "the host configured first is used even if the later one is more specific")
+			w = serve(handler, "GET", "api.example.com", "/api/1", nil)
+			assert.Equal(http.StatusUnauthorized, w.Code, "the host configured later is not used")
+		}
+	})
+
+	t.Run("the default host is used when no host matches", func(t *testing.T) {
+		os.Setenv(token.AuthTokens, "["+noAuths("catch-all", "^/default/.*$", true)+","+noAuths(`api\.example\.com`, "^/api/.*$", false)+"]")
+		handler := NewHandler()
+
+		cases := []struct {
+			host       string
+			path       string
+			statusCode int
+			desc       string
+		}{
+			{host: "api.example.com", path: "/api/1", statusCode: http.StatusOK, desc: "the matched host wins over the default host configured before it"},
+			{host: "api.example.com", path: "/default/1", statusCode: http.StatusUnauthorized, desc: "the default host is not used for the matched domain"},
+			{host: "other.example.org", path: "/default/1", statusCode: http.StatusOK, desc: "the default host is used for the unknown domain"},
+			{host: "other.example.org", path: "/api/1", statusCode: http.StatusUnauthorized, desc: "the rules of the default host are used for the unknown domain"},
+			{host: "catch-all", path: "/default/1", statusCode: http.StatusOK, desc: "the domain equal to the default host is also served by it"},
+		}
+		for _, c := range cases {
+			w := serve(handler, "GET", c.host, c.path, nil)
+			assert.Equal(c.statusCode, w.Code, c.desc)
+		}
+	})
+
+	t.Run("without the default host", func(t *testing.T) {
+		os.Setenv(token.AuthTokens, "["+noAuths(`api\.example\.com`, "^/api/.*$", false)+"]")
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "other.example.org", "/api/1", nil)
+		assert.Equal(http.StatusForbidden, w.Code, "the unknown domain is refused")
+	})
+}
+
+func TestNewHandlerInvalidHostPattern(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "(",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": [".*"]
+				}
+			}
+		}, {
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/api/.*$"]
+				}
+			}
+		}
+	]`)
+
+	compileErrors := token.NewHolder().CompileErrors()
+	if assert.Len(compileErrors, 1, "the invalid host is reported") {
+		assert.Contains(compileErrors[0].Error(), `host on (: invalid pattern "("`, "the invalid host is reported as a compile error")
+	}
+
+	handler := NewHandler()
+	assert.NotPanics(func() {
+		w := serve(handler, "GET", "(", "/api/1", nil)
+		assert.Equal(http.StatusForbidden, w.Code, "the invalid host never matches even the same domain")
+		w = serve(handler, "GET", "api.example.com", "/api/1", nil)
+		assert.Equal(http.StatusOK, w.Code, "the other hosts are still served")
+	}, "the invalid host does not panic the requests")
+}
+
+func TestNewHandlerExactHost(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	// the upper case host matches the host pattern only when it is lowercased
+	os.Setenv(HostMatchCaseInsensitive, "true")
+	defer os.Unsetenv(HostMatchCaseInsensitive)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "admin.example.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/admin/.*$"],
+						"require_exact_host": "admin.example.com"
+					}, {
+						"token": "TOKEN2",
+						"allowed_paths": ["^/admin/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/secret/.*$"],
+						"require_exact_host": "admin.example.com"
+					}
+				],
+				"no_auths": {}
+			}
+		}
+	]`)
+	handler := NewHandler()
+	token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+	token2 := map[string]string{"Authorization": "Bearer TOKEN2"}
+	user1 := map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")}
+
+	cases := []struct {
+		domain     string
+		headers    map[string]string
+		path       string
+		statusCode int
+		desc       string
+	}{
+		{domain: "admin.example.com", headers: token1, path: "/admin/1", statusCode: http.StatusOK, desc: "the bearer token is accepted on the exact host"},
+		{domain: "ADMIN.example.com:8080", headers: token1, path: "/admin/1", statusCode: http.StatusOK, desc: "the requested host is normalized"},
+		{domain: "admin.example.com.", headers: token1, path: "/admin/1", statusCode: http.StatusOK, desc: "the trailing dot is ignored"},
+		{domain: "adminxexample.com", headers: token1, path: "/admin/1", statusCode: http.StatusForbidden, desc: "the bearer token is denied on the other host matching the host pattern"},
+		{domain: "evil-admin.example.com.attacker.net", headers: token1, path: "/admin/1", statusCode: http.StatusForbidden, desc: "the bearer token is denied on the host containing the host pattern"},
+		{domain: "adminxexample.com", headers: token2, path: "/admin/1", statusCode: http.StatusOK, desc: "the bearer token without require_exact_host is accepted on the host matching the host pattern"},
+		{domain: "admin.example.com", headers: user1, path: "/secret/1", statusCode: http.StatusOK, desc: "the basic auth user is accepted on the exact host"},
+		{domain: "adminxexample.com", headers: user1, path: "/secret/1", statusCode: http.StatusUnauthorized, desc: "the basic auth user is denied on the other host matching the host pattern"},
+	}
+	for _, c := range cases {
+		w := serve(handler, "GET", c.domain, c.path, c.headers)
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestNewHandlerMethodScopedPaths(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": [
+							"^/foo/.*$",
+							{"path": "^/bar/.*$", "methods": ["GET", "head"]},
+							{"path": "^/bar/write/.*$", "methods": ["POST"]}
+						]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+	handler := NewHandler()
+	token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+
+	cases := []struct {
+		method     string
+		path       string
+		statusCode int
+		desc       string
+	}{
+		{method: "DELETE", path: "/foo/1", statusCode: http.StatusOK, desc: "the plain string path allows all methods"},
+		{method: "GET", path: "/bar/1", statusCode: http.StatusOK, desc: "the method scoped path allows its methods"},
+		{method: "HEAD", path: "/bar/1", statusCode: http.StatusOK, desc: "the methods are case insensitive"},
+		{method: "POST", path: "/bar/1", statusCode: http.StatusMethodNotAllowed, desc: "the method scoped path denies the other methods"},
+		{method: "POST", path: "/bar/write/1", statusCode: http.StatusOK, desc: "the other path allows the method"},
+		{method: "GET", path: "/bar/1", statusCode: http.StatusOK, desc: "the cached decision of the other method is not used"},
+	}
+	for _, c := range cases {
+		w := serve(handler, c.method, "api.example.com", c.path, token1)
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestNewHandlerMethodNotAllowed(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": [
+							{"path": "^/bar/.*$", "methods": ["GET", "head"]},
+							{"path": "^/bar/write/.*$", "methods": ["POST", "get"]}
+						],
+						"denied_paths": ["^/bar/secret/.*$"]
+					},
+					{
+						"token": "TOKEN2",
+						"allowed_paths": ["^/foo/.*$"],
+						"allowed_methods": ["GET"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+	handler := NewHandler()
+
+	cases := []struct {
+		method     string
+		path       string
+		token      string
+		statusCode int
+		allow      string
+		desc       string
+	}{
+		{method: "POST", path: "/bar/1", token: "TOKEN1", statusCode: http.StatusMethodNotAllowed, allow: "GET, HEAD", desc: "Allow has the methods of the matched path"},
+		{method: "DELETE", path: "/bar/write/1", token: "TOKEN1", statusCode: http.StatusMethodNotAllowed, allow: "GET, HEAD, POST", desc: "Allow has the methods of all matched paths without duplicates"},
+		{method: "GET", path: "/bar/secret/1", token: "TOKEN1", statusCode: http.StatusForbidden, allow: "", desc: "the denied path is not allowed for any method"},
+		{method: "POST", path: "/baz/1", token: "TOKEN1", statusCode: http.StatusForbidden, allow: "", desc: "the path matched by no path is not allowed"},
+		{method: "POST", path: "/foo/1", token: "TOKEN2", statusCode: http.StatusForbidden, allow: "", desc: "allowed_methods is not a method scoped path and is rejected as before"},
+	}
+	for _, c := range cases {
+		w := serve(handler, c.method, "api.example.com", c.path, map[string]string{"Authorization": "Bearer " + c.token})
+		assert.Equal(c.statusCode, w.Code, c.desc)
+		assert.Equal(c.allow, w.Header().Get("Allow"), c.desc)
+	}
+}
+
+func TestNewHandlerMethodScopedNoAuthPaths(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/static/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": [
+						"^/public/.*$",
+						{"path": "^/static/.*$", "methods": ["GET", "head"]}
+					]
+				}
+			}
+		}
+	]`)
+	handler := NewHandler()
+
+	cases := []struct {
+		method     string
+		path       string
+		headers    map[string]string
+		statusCode int
+		desc       string
+	}{
+		{method: "DELETE", path: "/public/1", headers: map[string]string{}, statusCode: http.StatusOK, desc: "the plain string path allows all methods without authentication"},
+		{method: "GET", path: "/static/app.js", headers: map[string]string{}, statusCode: http.StatusOK, desc: "the method scoped path allows its methods without authentication"},
+		{method: "HEAD", path: "/static/app.js", headers: map[string]string{}, statusCode: http.StatusOK, desc: "the methods are case insensitive"},
+		{method: "POST", path: "/static/app.js", headers: map[string]string{}, statusCode: http.StatusUnauthorized, desc: "the other methods fall through to require authentication"},
+		{method: "POST", path: "/static/app.js", headers: map[string]string{"Authorization": "Bearer TOKEN1"}, statusCode: http.StatusOK, desc: "the other methods are allowed with a credential"},
+		{method: "GET", path: "/static/app.js", headers: map[string]string{}, statusCode: http.StatusOK, desc: "the cached decision of the other method is not used"},
+	}
+	for _, c := range cases {
+		w := serve(handler, c.method, "api.example.com", c.path, c.headers)
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestNewHandlerGlobPaths(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	// both hosts have the same intent, written as the globs and as the patterns
+	json := `[
+		{
+			"host": "glob\\.example\\.com",
+			"settings": {
+				"path_match": "glob",
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["/foo/*", {"path": "/bar/**", "methods": ["GET"]}]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["/piyo/**"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["/static/**"]
+				}
+			}
+		}, {
+			"host": "regex\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/[^/]*$", {"path": "^/bar/.*$", "methods": ["GET"]}]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+	bearer := map[string]string{"Authorization": "Bearer TOKEN1"}
+	basic := map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")}
+
+	cases := []struct {
+		method     string
+		path       string
+		headers    map[string]string
+		statusCode int
+		desc       string
+	}{
+		{method: "GET", path: "/foo/1", headers: bearer, statusCode: http.StatusOK, desc: "* matches a segment"},
+		{method: "GET", path: "/foo/1/2", headers: bearer, statusCode: http.StatusForbidden, desc: "* does not match several segments"},
+		{method: "GET", path: "/bar/1/2", headers: bearer, statusCode: http.StatusOK, desc: "** matches several segments"},
+		{method: "POST", path: "/bar/1", headers: bearer, statusCode: http.StatusMethodNotAllowed, desc: "the methods of the glob are checked"},
+		{method: "GET", path: "/piyo/1/2", headers: basic, statusCode: http.StatusOK, desc: "the glob of basic_auths is matched"},
+		{method: "GET", path: "/piyo/1", headers: map[string]string{}, statusCode: http.StatusUnauthorized, desc: "the glob of basic_auths requires the authentication"},
+		{method: "GET", path: "/static/css/main.css", headers: map[string]string{}, statusCode: http.StatusOK, desc: "the glob of no_auths is matched"},
+		{method: "GET", path: "/staticx/main.css", headers: map[string]string{}, statusCode: http.StatusUnauthorized, desc: "the glob of no_auths is anchored"},
+	}
+	for _, c := range cases {
+		glob := serve(handler, c.method, "glob.example.com", c.path, c.headers)
+		regex := serve(handler, c.method, "regex.example.com", c.path, c.headers)
+		assert.Equal(c.statusCode, glob.Code, "glob: %s", c.desc)
+		assert.Equal(regex.Code, glob.Code, "the glob and the pattern have the same result: %s", c.desc)
+	}
+}
+
+func TestNewHandlerWithLimits(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "127\\.0\\.0\\.1:.*",
+			"settings": {
+				"defaults": {
+					"rate_limit": {"requests": 3, "period": "1h"},
+					"max_body_size": 8,
+					"allowed_methods": ["GET", "POST"]
+				},
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}, {
+						"token": "TOKEN2",
+						"allowed_paths": ["^/foo/.*$"],
+						"rate_limit": {"requests": 100, "period": "1h"},
+						"allowed_methods": ["PUT"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"],
+						"max_body_size": 16
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	handler := NewHandler()
+	ts := httptest.NewServer(handler.Engine)
+	defer ts.Close()
+
+	doRequest := func(method string, path string, authHeader string, body string) (*http.Response, error) {
+		r, err := http.NewRequest(method, ts.URL+path, strings.NewReader(body))
+		if err != nil {
+			t.Errorf("NewRequest Error. %v", err)
+		}
+		if len(authHeader) != 0 {
+			r.Header.Add("Authorization", authHeader)
+		}
+		return http.DefaultClient.Do(r)
+	}
+
+	t.Run("allowed_methods", func(t *testing.T) {
+		cases := []struct {
+			method     string
+			authHeader string
+			statusCode int
+			desc       string
+		}{
+			{method: "GET", authHeader: "bearer TOKEN2", statusCode: http.StatusForbidden, desc: "TOKEN2 overrides allowed_methods"},
+			{method: "PUT", authHeader: "bearer TOKEN2", statusCode: http.StatusOK, desc: "TOKEN2 overrides allowed_methods"},
+			{method: "DELETE", authHeader: "bearer TOKEN2", statusCode: http.StatusForbidden, desc: "TOKEN2 overrides allowed_methods"},
+		}
+		for _, c := range cases {
+			t.Run(fmt.Sprintf("?method=%v", c.method), func(t *testing.T) {
+				r, err := doRequest(c.method, "/foo/1", c.authHeader, "")
+				assert.Nil(err, fmt.Sprintf("%s has no error", c.method))
+				assert.Equal(c.statusCode, r.StatusCode, c.desc)
+			})
+		}
+	})
+
+	t.Run("max_body_size", func(t *testing.T) {
+		cases := []struct {
+			path       string
+			authHeader string
+			body       string
+			statusCode int
+			desc       string
+		}{
+			{path: "/piyo/1", authHeader: getBasicAuthHeader("user1", "password1"), body: "0123456789abcdef", statusCode: http.StatusOK, desc: "user1 overrides max_body_size"},
+			{path: "/piyo/1", authHeader: getBasicAuthHeader("user1", "password1"), body: "0123456789abcdefg", statusCode: http.StatusRequestEntityTooLarge, desc: "user1 overrides max_body_size"},
+			{path: "/static/1", authHeader: "", body: "0123456789abcdefg", statusCode: http.StatusOK, desc: "no_auths paths are not limited"},
+		}
+		for _, c := range cases {
+			t.Run(fmt.Sprintf("?path=%v&length=%d", c.path, len(c.body)), func(t *testing.T) {
+				r, err := doRequest("POST", c.path, c.authHeader, c.body)
+				assert.Nil(err, "POST has no error")
+				assert.Equal(c.statusCode, r.StatusCode, c.desc)
+			})
+		}
+	})
+
+	t.Run("rate_limit", func(t *testing.T) {
+		for i := 1; i <= 4; i++ {
+			r, err := doRequest("GET", "/foo/1", "bearer TOKEN1", "")
+			assert.Nil(err, "GET has no error")
+			if i <= 3 {
+				assert.Equal(http.StatusOK, r.StatusCode, "TOKEN1 inherits rate_limit of the defaults")
+			} else {
+				assert.Equal(http.StatusTooManyRequests, r.StatusCode, "TOKEN1 inherits rate_limit of the defaults")
+				assert.NotEmpty(r.Header.Get("Retry-After"), "Retry-After header is set")
+			}
+		}
+	})
+}
+
+func TestNewHandlerCorrelationID(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() { logOutput = os.Stdout }()
+
+	json := `[
+		{
+			"host": "127\\.0\\.0\\.1:.*",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	doRequest := func(handler *Handler, host string, path string, authHeader string, requestID string) *httptest.ResponseRecorder {
+		buf.Reset()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Host = host
+		if len(authHeader) != 0 {
+			r.Header.Add("Authorization", authHeader)
+		}
+		if len(requestID) != 0 {
+			r.Header.Add(requestIDHeader, requestID)
+		}
+		handler.Engine.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("with CORRELATION_ID", func(t *testing.T) {
+		os.Setenv(CorrelationID, "true")
+		defer os.Unsetenv(CorrelationID)
+		handler := NewHandler()
+
+		cases := []struct {
+			host       string
+			path       string
+			authHeader string
+			statusCode int
+			inBody     bool
+			desc       string
+		}{
+			{host: "example.com", path: "/foo/1", authHeader: "bearer TOKEN1", statusCode: http.StatusForbidden, inBody: true, desc: "domain not allowed"},
+			{host: "127.0.0.1:8080", path: "/foo/1", authHeader: "", statusCode: http.StatusUnauthorized, inBody: true, desc: "missing header"},
+			{host: "127.0.0.1:8080", path: "/foo/1", authHeader: "bearer TOKEN2", statusCode: http.StatusUnauthorized, inBody: true, desc: "token mismatch"},
+			{host: "127.0.0.1:8080", path: "/bar/1", authHeader: "bearer TOKEN1", statusCode: http.StatusForbidden, inBody: true, desc: "path not allowed"},
+			{host: "127.0.0.1:8080", path: "/piyo/1", authHeader: getBasicAuthHeader("user1", "invalid"), statusCode: http.StatusUnauthorized, inBody: true, desc: "basic authentication required"},
+		}
+
+		for _, c := range cases {
+			t.Run(c.desc, func(t *testing.T) {
+				w := doRequest(handler, c.host, c.path, c.authHeader, "")
+				assert.Equal(c.statusCode, w.Code, c.desc)
+
+				id := w.Header().Get(correlationIDHeader)
+				assert.Regexp("^[0-9a-f]{32}$", id, "X-Correlation-Id header is set")
+				assert.Equal(id, w.Header().Get(requestIDHeader), "X-Correlation-Id equals X-Request-Id")
+				assert.Contains(buf.String(), id, "the log contains the correlation ID")
+				if c.inBody {
+					assert.Contains(w.Body.String(), fmt.Sprintf(`"correlation_id":"%s"`, id), "the body contains the correlation ID")
+				}
+			})
+		}
+
+		t.Run("given X-Request-Id", func(t *testing.T) {
+			w := doRequest(handler, "127.0.0.1:8080", "/bar/1", "bearer TOKEN1", "given-request-id")
+			assert.Equal("given-request-id", w.Header().Get(correlationIDHeader), "the given request ID is used as the correlation ID")
+			assert.Contains(w.Body.String(), `"correlation_id":"given-request-id"`, "the body contains the given request ID")
+			assert.Contains(buf.String(), "given-request-id", "the log contains the given request ID")
+		})
+
+		t.Run("given invalid X-Request-Id", func(t *testing.T) {
+			w := doRequest(handler, "127.0.0.1:8080", "/bar/1", "bearer TOKEN1", "invalid request id")
+			assert.Regexp("^[0-9a-f]{32}$", w.Header().Get(correlationIDHeader), "a new request ID is generated")
+		})
+
+		t.Run("approved", func(t *testing.T) {
+			w := doRequest(handler, "127.0.0.1:8080", "/foo/1", "bearer TOKEN1", "")
+			assert.Equal(http.StatusOK, w.Code, "return 200")
+			assert.Equal("", w.Header().Get(correlationIDHeader), "X-Correlation-Id header is not set on approval")
+			assert.NotContains(w.Body.String(), "correlation_id", "the body does not contain the correlation ID on approval")
+		})
+	})
+
+	t.Run("without CORRELATION_ID", func(t *testing.T) {
+		handler := NewHandler()
+		w := doRequest(handler, "127.0.0.1:8080", "/bar/1", "bearer TOKEN1", "")
+		assert.Equal(http.StatusForbidden, w.Code, "return 403")
+		assert.NotEmpty(w.Header().Get(requestIDHeader), "X-Request-Id header is always set")
+		assert.Equal("", w.Header().Get(correlationIDHeader), "X-Correlation-Id header is not set")
+		assert.NotContains(w.Body.String(), "correlation_id", "the body does not contain the correlation ID")
+	})
+}
+
+func TestNewHandlerVaryHeader(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	json := `[
+		{
+			"host": "127\\.0\\.0\\.1:.*",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	cases := []struct {
+		method     string
+		path       string
+		authHeader string
+		statusCode int
+		vary       bool
+		desc       string
+	}{
+		{method: "GET", path: "/foo/1", authHeader: "bearer TOKEN1", statusCode: http.StatusOK, vary: true, desc: "approved by bearer token"},
+		{method: "GET", path: "/foo/1", authHeader: "", statusCode: http.StatusUnauthorized, vary: true, desc: "missing Authorization header"},
+		{method: "GET", path: "/foo/1", authHeader: "bearer TOKEN2", statusCode: http.StatusUnauthorized, vary: true, desc: "token mismatch"},
+		{method: "GET", path: "/bar/1", authHeader: "bearer TOKEN1", statusCode: http.StatusForbidden, vary: true, desc: "path not allowed"},
+		{method: "GET", path: "/piyo/1", authHeader: getBasicAuthHeader("user1", "password1"), statusCode: http.StatusOK, vary: true, desc: "approved by basic authentication"},
+		{method: "GET", path: "/piyo/1", authHeader: "", statusCode: http.StatusUnauthorized, vary: true, desc: "basic authentication required"},
+		{method: "GET", path: "/static/1", authHeader: "", statusCode: http.StatusOK, vary: false, desc: "no_auths path does not depend on credentials"},
+		{method: "OPTIONS", path: "/foo/1", authHeader: "", statusCode: http.StatusOK, vary: false, desc: "OPTIONS does not depend on credentials"},
+	}
+
+	t.Run("default", func(t *testing.T) {
+		for _, c := range cases {
+			t.Run(c.desc, func(t *testing.T) {
+				r, err := doRequest(c.method, c.path, c.authHeader)
+				assert.Nil(err, fmt.Sprintf("%s has no error", c.method))
+				assert.Equal(c.statusCode, r.StatusCode, c.desc)
+				assert.Empty(r.Header["Vary"], "Vary header is not set by default")
+			})
+		}
+	})
+
+	t.Run("VARY_AUTHORIZATION=true", func(t *testing.T) {
+		os.Setenv(VaryAuthorization, "true")
+		defer os.Unsetenv(VaryAuthorization)
+		for _, c := range cases {
+			t.Run(c.desc, func(t *testing.T) {
+				r, err := doRequest(c.method, c.path, c.authHeader)
+				assert.Nil(err, fmt.Sprintf("%s has no error", c.method))
+				assert.Equal(c.statusCode, r.StatusCode, c.desc)
+				if c.vary {
+					assert.Equal([]string{"Authorization"}, r.Header["Vary"], "Vary header is set when the response depends on credentials")
+				} else {
+					assert.Empty(r.Header["Vary"], "Vary header is not set when the response does not depend on credentials")
+				}
+			})
+		}
+	})
+
+	t.Run("VARY_AUTHORIZATION=false", func(t *testing.T) {
+		os.Setenv(VaryAuthorization, "false")
+		defer os.Unsetenv(VaryAuthorization)
+		for _, c := range cases {
+			t.Run(c.desc, func(t *testing.T) {
+				r, err := doRequest(c.method, c.path, c.authHeader)
+				assert.Nil(err, fmt.Sprintf("%s has no error", c.method))
+				assert.Equal(c.statusCode, r.StatusCode, c.desc)
+				assert.Empty(r.Header["Vary"], "Vary header is never set")
+			})
+		}
+	})
+}
+
+func TestNewHandlerUserAgentRules(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "allow\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				},
+				"user_agent_allow": ["^Mozilla/", "^curl/"],
+				"user_agent_deny": ["(?i)bot"]
+			}
+		},
+		{
+			"host": "deny\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				},
+				"user_agent_deny": ["(?i)bot", "^$"]
+			}
+		},
+		{
+			"host": "none\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		host       string
+		userAgent  string
+		statusCode int
+		desc       string
+	}{
+		{host: "allow.example.com", userAgent: "Mozilla/5.0", statusCode: http.StatusOK, desc: "allowed user agent"},
+		{host: "allow.example.com", userAgent: "curl/7.58.0", statusCode: http.StatusOK, desc: "allowed user agent"},
+		{host: "allow.example.com", userAgent: "Mozilla/5.0 (compatible; Googlebot/2.1)", statusCode: http.StatusForbidden, desc: "deny has priority over allow"},
+		{host: "allow.example.com", userAgent: "Wget/1.19", statusCode: http.StatusForbidden, desc: "user agent which does not match allow"},
+		{host: "allow.example.com", userAgent: "", statusCode: http.StatusForbidden, desc: "empty user agent does not match allow"},
+		{host: "deny.example.com", userAgent: "Wget/1.19", statusCode: http.StatusOK, desc: "user agent which does not match deny"},
+		{host: "deny.example.com", userAgent: "SomeBot/1.0", statusCode: http.StatusForbidden, desc: "denied user agent"},
+		{host: "deny.example.com", userAgent: "", statusCode: http.StatusForbidden, desc: "empty user agent is denied"},
+		{host: "none.example.com", userAgent: "SomeBot/1.0", statusCode: http.StatusOK, desc: "no rules"},
+		{host: "none.example.com", userAgent: "", statusCode: http.StatusOK, desc: "no rules"},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("?host=%v&userAgent=%v", c.host, c.userAgent), func(t *testing.T) {
+			w := serve(handler, "GET", c.host, "/static/1", map[string]string{"User-Agent": c.userAgent})
+			assert.Equal(c.statusCode, w.Code, c.desc)
+			if c.statusCode == http.StatusForbidden {
+				assert.Contains(w.Body.String(), "user agent not allowed", c.desc)
+			}
+		})
+	}
+}
+
+func TestNewHandlerBasicAuthCredentials(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(BasicAuthInvalidUTF8)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "pa:ss",
+						"allowed_paths": ["^/foo/.*$"]
+					},
+					{
+						"username": "ユーザー",
+						"password": "パスワード",
+						"allowed_paths": ["^/foo/.*$"]
+					},
+					{
+						"username": "user3",
+						"password": "caf\ufffd",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": []
+				}
+			}
+		}
+	]`)
+
+	cases := []struct {
+		username   string
+		password   string
+		invalid    string
+		statusCode int
+		desc       string
+	}{
+		{username: "user1", password: "pa:ss", invalid: "", statusCode: http.StatusOK, desc: "a password can contain colons"},
+		{username: "user1:pa", password: "ss", invalid: "", statusCode: http.StatusOK, desc: "the credentials are split on the first colon"},
+		{username: "user1", password: "", invalid: "", statusCode: http.StatusUnauthorized, desc: "an empty password is rejected"},
+		{username: "", password: "pa:ss", invalid: "", statusCode: http.StatusUnauthorized, desc: "an empty username is rejected"},
+		{username: "ユーザー", password: "パスワード", invalid: "", statusCode: http.StatusOK, desc: "UTF-8 credentials are verified"},
+		{username: "ユーザー", password: "パスワ", invalid: "", statusCode: http.StatusUnauthorized, desc: "UTF-8 credentials are compared exactly"},
+		{username: "user3", password: "caf\xe9", invalid: "", statusCode: http.StatusUnauthorized, desc: "malformed UTF-8 is rejected by default"},
+		{username: "user3", password: "caf\xe9", invalid: "reject", statusCode: http.StatusUnauthorized, desc: "malformed UTF-8 is rejected"},
+		{username: "user3", password: "caf\xe9", invalid: "replace", statusCode: http.StatusOK, desc: "malformed UTF-8 is replaced like the JSON configurations"},
+	}
+	for _, c := range cases {
+		os.Setenv(BasicAuthInvalidUTF8, c.invalid)
+		handler := NewHandler()
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": getBasicAuthHeader(c.username, c.password)})
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestNewHandlerBasicAuthUserWithDifferentPasswords(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [
+					{"username": "user1", "password": "password1", "allowed_paths": ["^/foo/.*$"]},
+					{"username": "user1", "password": "password2", "allowed_paths": ["^/bar/.*$"]}
+				],
+				"no_auths": {
+					"allowed_paths": []
+				}
+			}
+		}
+	]`)
+	handler := NewHandler()
+
+	cases := []struct {
+		password   string
+		path       string
+		statusCode int
+		desc       string
+	}{
+		{password: "password1", path: "/foo/1", statusCode: http.StatusOK, desc: "the first password opens its own paths"},
+		{password: "password2", path: "/bar/1", statusCode: http.StatusOK, desc: "the second password opens its own paths"},
+		{password: "password1", path: "/bar/1", statusCode: http.StatusUnauthorized, desc: "the first password does not open the paths of the second"},
+		{password: "password2", path: "/foo/1", statusCode: http.StatusUnauthorized, desc: "the second password does not open the paths of the first"},
+		{password: "password3", path: "/foo/1", statusCode: http.StatusUnauthorized, desc: "the other password is rejected"},
+	}
+	for _, c := range cases {
+		w := serve(handler, "GET", "api.example.com", c.path, map[string]string{"Authorization": getBasicAuthHeader("user1", c.password)})
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestNewHandlerBasicAuthPasswordHash(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	// the hashes of "password1" (bcrypt) and "password2" (argon2id)
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password_hash": "$2a$04$Xkj1WVHjJUDrWkDxa0DiZu06PVDgfK4eVOZhn2BgQeYOsoc8cSr6S",
+						"allowed_paths": ["^/foo/.*$"]
+					},
+					{
+						"username": "user2",
+						"password_hash": "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQxMjM0NTY3OA$w8tgnTyjYgojBv/+Md2bfQGGv038frrIImycZ/rdwBc",
+						"allowed_paths": ["^/foo/.*$"]
+					},
+					{
+						"username": "user3",
+						"password": "password3",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": []
+				}
+			}
+		}
+	]`)
+	handler := NewHandler()
+
+	cases := []struct {
+		username   string
+		password   string
+		statusCode int
+		desc       string
+	}{
+		{username: "user1", password: "password1", statusCode: http.StatusOK, desc: "the password is verified by the bcrypt hash"},
+		{username: "user1", password: "password2", statusCode: http.StatusUnauthorized, desc: "the wrong password is rejected by the bcrypt hash"},
+		{username: "user1", password: "$2a$04$Xkj1WVHjJUDrWkDxa0DiZu06PVDgfK4eVOZhn2BgQeYOsoc8cSr6S", statusCode: http.StatusUnauthorized, desc: "the hash itself is not a password"},
+		{username: "user2", password: "password2", statusCode: http.StatusOK, desc: "the password is verified by the argon2id hash"},
+		{username: "user2", password: "password1", statusCode: http.StatusUnauthorized, desc: "the wrong password is rejected by the argon2id hash"},
+		{username: "user3", password: "password3", statusCode: http.StatusOK, desc: "the plain password still works"},
+	}
+	for _, c := range cases {
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": getBasicAuthHeader(c.username, c.password)})
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestNewHandlerMalformedBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": []
+				}
+			}
+		}
+	]`)
+
+	handler := NewHandler()
+	for _, userPass := range []string{"nocolon", "", ":", "user1", "user1:", ":password1"} {
+		authHeader := "Basic " + base64.StdEncoding.EncodeToString([]byte(userPass))
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": authHeader})
+		assert.Equal(http.StatusUnauthorized, w.Code, "return 401 when the credentials are %q", userPass)
+		assert.Contains(w.Header().Get("WWW-Authenticate"), "Basic", "basic authentication is required when the credentials are %q", userPass)
+	}
+	w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")})
+	assert.Equal(http.StatusOK, w.Code, "the handler still works after the malformed credentials")
+}
+
+func TestDecodeBasicCredential(t *testing.T) {
+	assert := assert.New(t)
+	router := &Handler{}
+	basicUserRe := regexp.MustCompile(basicUserReStr)
+
+	encode := func(userPass string) string {
+		return base64.StdEncoding.EncodeToString([]byte(userPass))
+	}
+	cases := []struct {
+		encoded  string
+		username string
+		password string
+		ok       bool
+	}{
+		{encoded: encode("user:pa:ss"), username: "user", password: "pa:ss", ok: true},
+		{encoded: encode("user::"), username: "user", password: ":", ok: true},
+		{encoded: encode("user:pass\nword"), username: "user", password: "pass\nword", ok: true},
+		{encoded: encode("user:"), ok: false},
+		{encoded: encode(":pass"), ok: false},
+		{encoded: encode(":"), ok: false},
+		{encoded: encode("user"), ok: false},
+		{encoded: encode(""), ok: false},
+		{encoded: "invalid base64", ok: false},
+	}
+	for _, c := range cases {
+		username, password, ok := router.decodeBasicCredential(c.encoded, basicUserRe)
+		assert.Equal(c.ok, ok, "decodeBasicCredential(%q)", c.encoded)
+		assert.Equal(c.username, username, "username of %q", c.encoded)
+		assert.Equal(c.password, password, "password of %q", c.encoded)
+	}
+}
+
+func TestEqualSecret(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		expected string
+		actual   string
+		equal    bool
+	}{
+		{expected: "password1", actual: "password1", equal: true},
+		{expected: "", actual: "", equal: true},
+		{expected: "password1", actual: "password2", equal: false},
+		{expected: "password1", actual: "password", equal: false},
+		{expected: "password1", actual: "password12", equal: false},
+		{expected: "password1", actual: "PASSWORD1", equal: false},
+		{expected: "password1", actual: "", equal: false},
+	}
+	for _, c := range cases {
+		assert.Equal(c.equal, equalSecret(c.expected, c.actual), "equalSecret(%q, %q)", c.expected, c.actual)
+	}
+}
+
+func TestNewHandlerBasicAuthRequiredBody(t *testing.T) {
+	assert := assert.New(t)
+	doRequest, tearDown := setUp(t)
+	defer tearDown()
+
+	json := `[
+		{
+			"host": "127\\.0\\.0\\.1:.*",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	cases := []struct {
+		name       string
+		authHeader string
+	}{
+		{name: "without Header", authHeader: ""},
+		{name: "with invalid password", authHeader: getBasicAuthHeader("user1", "invalid")},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			r, err := doRequest("GET", "/piyo/1", c.authHeader)
+			assert.Nil(err, "GET has no error")
+			assert.Equal(http.StatusUnauthorized, r.StatusCode, "return 401")
+			assert.Equal(`Basic realm="basic authentication required"`, r.Header.Get("WWW-Authenticate"), "WWW-Authenticate header is set")
+			assert.Contains(r.Header.Get("Content-Type"), "application/json", "the body is json")
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.JSONEq(`{"authorized": false, "error": "basic authentication required"}`, string(body), "the body has the same shape as other rejections")
+		})
+	}
+}
+
+func TestNewHandlerSoftDeny(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(ioutil.Discard)
+
+	json := `[
+		{
+			"host": "soft\\.example\\.com",
+			"settings": {
+				"soft_deny": true,
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {},
+				"user_agent_deny": ["(?i)bot"]
+			}
+		}, {
+			"host": "hard\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		path    string
+		headers map[string]string
+		err     string
+	}{
+		{path: "/foo/1", headers: map[string]string{}, err: "missing Header: authorization"},
+		{path: "/foo/1", headers: map[string]string{"Authorization": "Bearer INVALID"}, err: "token mismatch"},
+		{path: "/bar/1", headers: map[string]string{"Authorization": "Bearer TOKEN1"}, err: "path not allowd"},
+		{path: "/piyo/1", headers: map[string]string{"Authorization": getBasicAuthHeader("user1", "invalid")}, err: "basic authentication required"},
+		{path: "/foo/1", headers: map[string]string{"Authorization": "Bearer TOKEN1", "User-Agent": "Googlebot/2.1"}, err: "user agent not allowed"},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("soft:%s", c.err), func(t *testing.T) {
+			buf.Reset()
+			w := serve(handler, "GET", "soft.example.com", c.path, c.headers)
+			assert.Equal(http.StatusOK, w.Code, "return 200 when the request would be denied")
+			assert.Equal("true", w.Header().Get(softDenyHeader), "the request is flagged")
+			assert.Empty(w.Header().Get("WWW-Authenticate"), "no challenge is returned")
+			assert.JSONEq(fmt.Sprintf(`{"authorized": false, "soft_deny": true, "error": "%s"}`, c.err), w.Body.String(), "the body has the intended denial")
+			assert.Contains(buf.String(), "soft deny host=soft.example.com path="+c.path, "the intended denial is logged")
+			assert.Contains(buf.String(), c.err, "the intended denial is logged")
+		})
+	}
+
+	t.Run("soft:allowed", func(t *testing.T) {
+		w := serve(handler, "GET", "soft.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the request is allowed")
+		assert.Empty(w.Header().Get(softDenyHeader), "the allowed request is not flagged")
+	})
+
+	t.Run("hard", func(t *testing.T) {
+		w := serve(handler, "GET", "hard.example.com", "/bar/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusForbidden, w.Code, "return 403 when soft_deny is not set")
+		assert.Empty(w.Header().Get(softDenyHeader), "the denied request is not flagged")
+	})
+
+	t.Run("unknown host", func(t *testing.T) {
+		w := serve(handler, "GET", "unknown.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusForbidden, w.Code, "return 403 when the host does not match")
+		assert.Empty(w.Header().Get(softDenyHeader), "the denied request is not flagged")
+	})
+}
+
+func TestNewServer(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	handler := NewHandler()
+
+	t.Run("default", func(t *testing.T) {
+		server := handler.newServer(":8080")
+		assert.Equal(":8080", server.Addr, "the server listens the given address")
+		assert.Equal(handler.Engine, server.Handler, "the server uses the enclosed gin.Engine")
+		assert.Equal(10*time.Second, server.ReadHeaderTimeout, "ReadHeaderTimeout is 10s by default")
+		assert.Equal(30*time.Second, server.ReadTimeout, "ReadTimeout is 30s by default")
+		assert.Equal(30*time.Second, server.WriteTimeout, "WriteTimeout is 30s by default")
+		assert.Equal(120*time.Second, server.IdleTimeout, "IdleTimeout is 120s by default")
+	})
+
+	t.Run("configured", func(t *testing.T) {
+		os.Setenv(ReadHeaderTimeout, "1s")
+		os.Setenv(ReadTimeout, "2s")
+		os.Setenv(WriteTimeout, "500ms")
+		os.Setenv(IdleTimeout, "1m")
+		defer os.Unsetenv(ReadHeaderTimeout)
+		defer os.Unsetenv(ReadTimeout)
+		defer os.Unsetenv(WriteTimeout)
+		defer os.Unsetenv(IdleTimeout)
+
+		server := handler.newServer(":8080")
+		assert.Equal(1*time.Second, server.ReadHeaderTimeout, "ReadHeaderTimeout is configured")
+		assert.Equal(2*time.Second, server.ReadTimeout, "ReadTimeout is configured")
+		assert.Equal(500*time.Millisecond, server.WriteTimeout, "WriteTimeout is configured")
+		assert.Equal(1*time.Minute, server.IdleTimeout, "IdleTimeout is configured")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		os.Setenv(ReadHeaderTimeout, "1")
+		os.Setenv(ReadTimeout, "-1s")
+		os.Setenv(WriteTimeout, "0s")
+		os.Setenv(IdleTimeout, "invalid")
+		defer os.Unsetenv(ReadHeaderTimeout)
+		defer os.Unsetenv(ReadTimeout)
+		defer os.Unsetenv(WriteTimeout)
+		defer os.Unsetenv(IdleTimeout)
+
+		server := handler.newServer(":8080")
+		assert.Equal(10*time.Second, server.ReadHeaderTimeout, "the default is used when the value has no unit")
+		assert.Equal(30*time.Second, server.ReadTimeout, "the default is used when the value is negative")
+		assert.Equal(30*time.Second, server.WriteTimeout, "the default is used when the value is zero")
+		assert.Equal(120*time.Second, server.IdleTimeout, "the default is used when the value is invalid")
+	})
+}
+
+func TestRunWithContext(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokensPath)
+
+	json1 := `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+	json2 := `[{"host": "test2.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+	f, err := ioutil.TempFile("", "shutdown")
+	assert.Nil(err, "TempFile has no error")
+	defer os.Remove(f.Name())
+	f.WriteString(json1)
+	f.Close()
+	os.Setenv(token.AuthTokensPath, f.Name())
+
+	handler := NewHandler()
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- handler.RunWithContext(ctx, "127.0.0.1:0")
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+
+	select {
+	case err := <-stopped:
+		assert.Nil(err, "RunWithContext() returns no error when it is shut down")
+	case <-time.After(3 * time.Second):
+		t.Fatal("RunWithContext() does not return after the context is canceled")
+	}
+
+	// RunWithContext waits for the watcher to exit, so the file is not reloaded any more
+	ioutil.WriteFile(f.Name(), []byte(json2), 0644)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal([]string{"test1.example.com"}, handler.holder.GetHosts(), "the watcher of AUTH_TOKENS_PATH is stopped")
+}
+
+func TestNewHandlerOriginalRequest(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"],
+						"allowed_methods": ["GET"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	cases := []struct {
+		method     string
+		path       string
+		headers    map[string]string
+		statusCode int
+		desc       string
+	}{
+		{method: "GET", path: "/auth", headers: map[string]string{"X-Original-URI": "/static/app.js"}, statusCode: http.StatusOK, desc: "no_auths matches the original path"},
+		{method: "GET", path: "/static/app.js", headers: map[string]string{"X-Original-URI": "/bar/1"}, statusCode: http.StatusUnauthorized, desc: "the request path is not used when the original path is given"},
+		{method: "GET", path: "/auth", headers: map[string]string{"X-Original-URI": "/foo/1?q=1", "Authorization": "Bearer TOKEN1"}, statusCode: http.StatusOK, desc: "the query of the original path is ignored"},
+		{method: "GET", path: "/auth", headers: map[string]string{"X-Original-URI": "/bar/1", "Authorization": "Bearer TOKEN1"}, statusCode: http.StatusForbidden, desc: "bearer token is checked against the original path"},
+		{method: "GET", path: "/auth", headers: map[string]string{"X-Original-URI": "/foo/1", "X-Original-Method": "POST", "Authorization": "Bearer TOKEN1"}, statusCode: http.StatusForbidden, desc: "allowed_methods is checked against the original method"},
+		{method: "POST", path: "/auth", headers: map[string]string{"X-Original-URI": "/foo/1", "X-Original-Method": "get", "Authorization": "Bearer TOKEN1"}, statusCode: http.StatusOK, desc: "the original method is case insensitive"},
+		{method: "GET", path: "/auth", headers: map[string]string{"X-Original-URI": "/foo/1", "X-Original-Method": "OPTIONS"}, statusCode: http.StatusOK, desc: "OPTIONS is checked against the original method"},
+		{method: "GET", path: "/auth", headers: map[string]string{"X-Original-URI": "/piyo/1", "Authorization": getBasicAuthHeader("user1", "password1")}, statusCode: http.StatusOK, desc: "basic authentication is checked against the original path"},
+		{method: "GET", path: "/auth", headers: map[string]string{"X-Original-URI": "/piyo/1"}, statusCode: http.StatusUnauthorized, desc: "basic authentication is required for the original path"},
+		{method: "GET", path: "/foo/1", headers: map[string]string{"Authorization": "Bearer TOKEN1"}, statusCode: http.StatusOK, desc: "the request line is used when the headers are not given"},
+	}
+
+	t.Run("with ORIGINAL_URI_HEADER and ORIGINAL_METHOD_HEADER", func(t *testing.T) {
+		os.Setenv(OriginalURIHeader, "X-Original-URI")
+		os.Setenv(OriginalMethodHeader, "X-Original-Method")
+		defer os.Unsetenv(OriginalURIHeader)
+		defer os.Unsetenv(OriginalMethodHeader)
+		handler := NewHandler()
+
+		for _, c := range cases {
+			t.Run(c.desc, func(t *testing.T) {
+				w := serve(handler, c.method, "api.example.com", c.path, c.headers)
+				assert.Equal(c.statusCode, w.Code, c.desc)
+			})
+		}
+	})
+
+	t.Run("default", func(t *testing.T) {
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/auth", map[string]string{"X-Original-URI": "/static/app.js"})
+		assert.Equal(http.StatusUnauthorized, w.Code, "X-Original-URI is ignored by default")
+		w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"X-Original-Method": "POST", "Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "X-Original-Method is ignored by default")
+	})
+}
+
+func TestNewHandlerNoAuthQuery(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "default\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^.*/static/.+$"]
+				}
+			}
+		}, {
+			"host": "query\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/[^?]+$", "^/files/[^?]+\\?version=\\d+$"],
+					"match_query": true,
+					"denied_query_params": ["token", "signature"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		host       string
+		path       string
+		statusCode int
+		desc       string
+	}{
+		{host: "default.example.com", path: "/static/app.js", statusCode: http.StatusOK, desc: "path only by default"},
+		{host: "default.example.com", path: "/static/app.js?token=secret", statusCode: http.StatusOK, desc: "the query is ignored by default"},
+		{host: "query.example.com", path: "/static/app.js", statusCode: http.StatusOK, desc: "the path without query matches"},
+		{host: "query.example.com", path: "/static/app.js?v=1", statusCode: http.StatusUnauthorized, desc: "the query is matched together with the path"},
+		{host: "query.example.com", path: "/files/a.txt?version=1", statusCode: http.StatusOK, desc: "the allowed query matches"},
+		{host: "query.example.com", path: "/files/a.txt?version=latest", statusCode: http.StatusUnauthorized, desc: "the disallowed query value does not match"},
+		{host: "query.example.com", path: "/files/a.txt", statusCode: http.StatusUnauthorized, desc: "the path without the required query does not match"},
+		{host: "query.example.com", path: "/static/app.js?token=secret", statusCode: http.StatusUnauthorized, desc: "the denied query param is rejected"},
+		{host: "query.example.com", path: "/files/a.txt?version=1&signature=abc", statusCode: http.StatusUnauthorized, desc: "the denied query param is rejected even if the query matches"},
+		{host: "query.example.com", path: "/static/app.js?token", statusCode: http.StatusUnauthorized, desc: "the denied query param without value is rejected"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			w := serve(handler, "GET", c.host, c.path, map[string]string{})
+			assert.Equal(c.statusCode, w.Code, c.desc)
+		})
+	}
+
+	t.Run("denied query param only", func(t *testing.T) {
+		os.Setenv(token.AuthTokens, `[{"host": "api\\.example\\.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["^/static/.+$"], "denied_query_params": ["token"]}}}]`)
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/static/app.js?v=1", map[string]string{})
+		assert.Equal(http.StatusOK, w.Code, "the query is not matched when match_query is not set")
+		w = serve(handler, "GET", "api.example.com", "/static/app.js?v=1&token=secret", map[string]string{})
+		assert.Equal(http.StatusUnauthorized, w.Code, "the denied query param is rejected when match_query is not set")
+	})
+}
+
+func TestNewHandlerRateLimitResponse(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"],
+						"rate_limit": {"requests": 2, "period": "1m"}
+					}, {
+						"token": "TOKEN2",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	now := time.Date(2019, 1, 1, 0, 0, 30, 0, time.UTC)
+	reset := strconv.FormatInt(now.Add(time.Minute).Unix(), 10)
+	token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+
+	t.Run("default", func(t *testing.T) {
+		handler := NewHandler()
+		handler.rateLimiter.now = func() time.Time { return now }
+
+		for i := 1; i <= 3; i++ {
+			w := serve(handler, "GET", "api.example.com", "/foo/1", token1)
+			assert.Empty(w.Header().Get("X-RateLimit-Limit"), "X-RateLimit-Limit header is not set by default")
+			assert.Empty(w.Header().Get("X-RateLimit-Remaining"), "X-RateLimit-Remaining header is not set by default")
+			assert.Empty(w.Header().Get("X-RateLimit-Reset"), "X-RateLimit-Reset header is not set by default")
+			if i == 3 {
+				assert.Equal(http.StatusTooManyRequests, w.Code, "return 429 by default")
+				assert.Equal("60", w.Header().Get("Retry-After"), "Retry-After header is set")
+				assert.JSONEq(`{"authorized": false, "error": "too many requests"}`, w.Body.String(), "the default body is returned")
+			}
+		}
+	})
+
+	t.Run("RATE_LIMIT_HEADERS=true", func(t *testing.T) {
+		os.Setenv(RateLimitHeaders, "true")
+		defer os.Unsetenv(RateLimitHeaders)
+		handler := NewHandler()
+		handler.rateLimiter.now = func() time.Time { return now }
+
+		for i, remaining := range []string{"1", "0", "0"} {
+			w := serve(handler, "GET", "api.example.com", "/foo/1", token1)
+			if i < 2 {
+				assert.Equal(http.StatusOK, w.Code, "return 200 within the rate limit")
+			} else {
+				assert.Equal(http.StatusTooManyRequests, w.Code, "return 429 when the rate limit is exceeded")
+			}
+			assert.Equal("2", w.Header().Get("X-RateLimit-Limit"), "X-RateLimit-Limit header is the number of requests")
+			assert.Equal(remaining, w.Header().Get("X-RateLimit-Remaining"), "X-RateLimit-Remaining header is the remaining budget")
+			assert.Equal(reset, w.Header().Get("X-RateLimit-Reset"), "X-RateLimit-Reset header is the end of the window")
+		}
+
+		now = now.Add(time.Minute)
+		w := serve(handler, "GET", "api.example.com", "/foo/1", token1)
+		assert.Equal(http.StatusOK, w.Code, "return 200 in the next window")
+		assert.Equal("1", w.Header().Get("X-RateLimit-Remaining"), "the budget is restored in the next window")
+		now = now.Add(-time.Minute)
+
+		w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN2"})
+		assert.Equal(http.StatusOK, w.Code, "return 200 without rate_limit")
+		assert.Empty(w.Header().Get("X-RateLimit-Limit"), "X-RateLimit-Limit header is not set without rate_limit")
+	})
+
+	t.Run("RATE_LIMIT_STATUS and RATE_LIMIT_BODY", func(t *testing.T) {
+		os.Setenv(RateLimitStatus, "503")
+		os.Setenv(RateLimitBody, `{"message": "slow down"}`)
+		defer os.Unsetenv(RateLimitStatus)
+		defer os.Unsetenv(RateLimitBody)
+		handler := NewHandler()
+		handler.rateLimiter.now = func() time.Time { return now }
+
+		for i := 1; i <= 4; i++ {
+			w := serve(handler, "GET", "api.example.com", "/foo/1", token1)
+			if i >= 3 {
+				assert.Equal(http.StatusServiceUnavailable, w.Code, "the configured status is returned")
+				assert.Equal("60", w.Header().Get("Retry-After"), "Retry-After header is set")
+				assert.JSONEq(`{"message": "slow down"}`, w.Body.String(), "the configured body is returned")
+			}
+		}
+	})
+
+	t.Run("invalid RATE_LIMIT_STATUS and RATE_LIMIT_BODY", func(t *testing.T) {
+		os.Setenv(RateLimitStatus, "200")
+		os.Setenv(RateLimitBody, `["slow down"]`)
+		defer os.Unsetenv(RateLimitStatus)
+		defer os.Unsetenv(RateLimitBody)
+		handler := NewHandler()
+		handler.rateLimiter.now = func() time.Time { return now }
+
+		for i := 1; i <= 3; i++ {
+			w := serve(handler, "GET", "api.example.com", "/foo/1", token1)
+			if i == 3 {
+				assert.Equal(http.StatusTooManyRequests, w.Code, "return 429 when the status is invalid")
+				assert.JSONEq(`{"authorized": false, "error": "too many requests"}`, w.Body.String(), "the default body is returned when the body is invalid")
+			}
+		}
+	})
+}
+
+func TestNewHandlerRulePriority(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "default\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/public/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/public/.*$"]
+				}
+			}
+		}, {
+			"host": "priority\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [
+					{
+						"username": "admin",
+						"password": "password1",
+						"allowed_paths": ["^/public/admin/.*$"],
+						"priority": 10
+					}, {
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/public/.*$", "^/private/.*$"],
+						"priority": -1
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/public/.*$"],
+					"priority": 5
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		host       string
+		path       string
+		statusCode int
+		desc       string
+	}{
+		{host: "default.example.com", path: "/public/1", statusCode: http.StatusOK, desc: "no_auths wins when the priorities are the same"},
+		{host: "priority.example.com", path: "/public/1", statusCode: http.StatusOK, desc: "no_auths wins when its priority is higher"},
+		{host: "priority.example.com", path: "/public/admin/1", statusCode: http.StatusUnauthorized, desc: "basic_auths wins when its priority is higher"},
+		{host: "priority.example.com", path: "/private/1", statusCode: http.StatusUnauthorized, desc: "basic_auths is applied when only it matches"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			w := serve(handler, "GET", c.host, c.path, map[string]string{})
+			assert.Equal(c.statusCode, w.Code, c.desc)
+		})
+	}
+
+	t.Run("basic authentication of the path with the higher priority", func(t *testing.T) {
+		w := serve(handler, "GET", "priority.example.com", "/public/admin/1", map[string]string{"Authorization": getBasicAuthHeader("admin", "password1")})
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the user is allowed")
+		w = serve(handler, "GET", "priority.example.com", "/public/admin/1", map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")})
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the user is allowed by the path with the lower priority")
+	})
+}
+
+func TestNewHandlerMaxAuthHeaderLength(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	t.Run("default", func(t *testing.T) {
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the header is normal")
+		w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer " + strings.Repeat("A", 8192)})
+		assert.Equal(http.StatusBadRequest, w.Code, "return 400 when the header exceeds 8192 bytes")
+		assert.JSONEq(`{"authorized": false, "error": "too large Header: authorization"}`, w.Body.String(), "the error is returned")
+		w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer " + strings.Repeat("A", 8185)})
+		assert.Equal(http.StatusUnauthorized, w.Code, "the header of 8192 bytes is checked as usual")
+	})
+
+	t.Run("MAX_AUTH_HEADER_LENGTH=32", func(t *testing.T) {
+		os.Setenv(MaxAuthHeaderLength, "32")
+		defer os.Unsetenv(MaxAuthHeaderLength)
+		handler := NewHandler()
+
+		cases := []struct {
+			path       string
+			authHeader string
+			statusCode int
+			desc       string
+		}{
+			{path: "/foo/1", authHeader: "Bearer TOKEN1", statusCode: http.StatusOK, desc: "return 200 when the bearer token is short enough"},
+			{path: "/piyo/1", authHeader: getBasicAuthHeader("user1", "password1"), statusCode: http.StatusOK, desc: "return 200 when the basic authentication is short enough"},
+			{path: "/foo/1", authHeader: "Bearer " + strings.Repeat("A", 26), statusCode: http.StatusBadRequest, desc: "return 400 when the bearer token is too long"},
+			{path: "/piyo/1", authHeader: getBasicAuthHeader("user1", strings.Repeat("p", 32)), statusCode: http.StatusBadRequest, desc: "return 400 when the basic authentication is too long"},
+			{path: "/static/1", authHeader: "Bearer " + strings.Repeat("A", 26), statusCode: http.StatusBadRequest, desc: "return 400 even if the path does not require authentication"},
+		}
+
+		for _, c := range cases {
+			t.Run(c.desc, func(t *testing.T) {
+				w := serve(handler, "GET", "api.example.com", c.path, map[string]string{"Authorization": c.authHeader})
+				assert.Equal(c.statusCode, w.Code, c.desc)
+			})
+		}
+	})
+}
+
+func TestNewHandlerUnknownTokenForbidden(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "default\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}, {
+			"host": "forbidden\\.example\\.com",
+			"settings": {
+				"unknown_token_forbidden": true,
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	t.Run("default", func(t *testing.T) {
+		w := serve(handler, "GET", "default.example.com", "/foo/1", map[string]string{"Authorization": "Bearer INVALID"})
+		assert.Equal(http.StatusUnauthorized, w.Code, "return 401 when the token is unknown")
+		assert.NotEmpty(w.Header().Get("WWW-Authenticate"), "WWW-Authenticate header is set")
+		assert.JSONEq(`{"authorized": false, "error": "token mismatch"}`, w.Body.String(), "the error is returned")
+	})
+
+	t.Run("unknown_token_forbidden", func(t *testing.T) {
+		cases := []struct {
+			authHeader string
+			statusCode int
+			challenge  bool
+			desc       string
+		}{
+			{authHeader: "Bearer INVALID", statusCode: http.StatusForbidden, challenge: false, desc: "return 403 without challenge when the token is unknown"},
+			{authHeader: "Basic INVALID", statusCode: http.StatusForbidden, challenge: false, desc: "return 403 without challenge when the scheme is not bearer"},
+			{authHeader: "", statusCode: http.StatusUnauthorized, challenge: true, desc: "return 401 when Authorization header is not set"},
+			{authHeader: "Bearer TOKEN1", statusCode: http.StatusOK, challenge: false, desc: "return 200 when the token is known"},
+		}
+
+		for _, c := range cases {
+			t.Run(c.desc, func(t *testing.T) {
+				w := serve(handler, "GET", "forbidden.example.com", "/foo/1", map[string]string{"Authorization": c.authHeader})
+				assert.Equal(c.statusCode, w.Code, c.desc)
+				assert.Equal(c.challenge, len(w.Header().Get("WWW-Authenticate")) > 0, c.desc)
+			})
+		}
+	})
+}
+
+func TestNewHandlerMultipleBearerTokens(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"],
+						"allowed_methods": ["GET"]
+					}, {
+						"token": "TOKEN2",
+						"allowed_paths": ["^/foo/.*$", "^/bar/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		method     string
+		path       string
+		authHeader string
+		statusCode int
+		desc       string
+	}{
+		{method: "GET", path: "/foo/1", authHeader: "Bearer INVALID TOKEN1", statusCode: http.StatusOK, desc: "return 200 when any of the space separated tokens is authorized"},
+		{method: "GET", path: "/foo/1", authHeader: "Bearer INVALID,TOKEN1", statusCode: http.StatusOK, desc: "return 200 when any of the comma separated tokens is authorized"},
+		{method: "GET", path: "/foo/1", authHeader: "Bearer INVALID, \tTOKEN1 ,", statusCode: http.StatusOK, desc: "return 200 when the tokens are separated by whitespaces and commas"},
+		{method: "GET", path: "/bar/1", authHeader: "Bearer TOKEN1 TOKEN2", statusCode: http.StatusOK, desc: "return 200 when the later token is authorized for the path"},
+		{method: "GET", path: "/bar/1", authHeader: "Bearer TOKEN1 INVALID", statusCode: http.StatusForbidden, desc: "return 403 when the known token is not authorized for the path"},
+		{method: "GET", path: "/foo/1", authHeader: "Bearer INVALID1 INVALID2", statusCode: http.StatusUnauthorized, desc: "return 401 when all tokens are unknown"},
+		{method: "GET", path: "/foo/1", authHeader: "Bearer ,", statusCode: http.StatusUnauthorized, desc: "return 401 when no token is given"},
+		{method: "POST", path: "/foo/1", authHeader: "Bearer TOKEN1 TOKEN2", statusCode: http.StatusForbidden, desc: "the first authorized token wins even if its limitations reject the request"},
+		{method: "POST", path: "/foo/1", authHeader: "Bearer TOKEN2 TOKEN1", statusCode: http.StatusOK, desc: "the first authorized token wins"},
+		{method: "GET", path: "/foo/1", authHeader: "Bearer A B C D TOKEN1", statusCode: http.StatusOK, desc: "return 200 when the header has as many tokens as the limit"},
+		{method: "GET", path: "/foo/1", authHeader: "Bearer A B C D E TOKEN1", statusCode: http.StatusBadRequest, desc: "return 400 when the header has more tokens than the limit"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			w := serve(handler, c.method, "api.example.com", c.path, map[string]string{"Authorization": c.authHeader})
+			assert.Equal(c.statusCode, w.Code, c.desc)
+		})
+	}
+
+	w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer A B C D E F"})
+	assert.JSONEq(`{"authorized": false, "error": "too many bearer tokens"}`, w.Body.String(), "the error is returned")
+}
+
+func TestNewHandlerDenyBody(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(DenyBody)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"],
+						"rate_limit": {"requests": 1, "period": "1h"}
+					}, {
+						"token": "TOKEN2",
+						"allowed_paths": ["^/foo/.*$"],
+						"allowed_methods": ["GET"],
+						"max_body_size": 4
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {},
+				"user_agent_deny": ["(?i)bot"]
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	os.Setenv(DenyBody, "access denied")
+	handler := NewHandler()
+
+	w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+	assert.Equal(http.StatusOK, w.Code, "return 200 when the request is authorized")
+	assert.JSONEq(`{"authorized": true}`, w.Body.String(), "the body of the authorized request is not replaced")
+
+	cases := []struct {
+		method     string
+		host       string
+		path       string
+		headers    map[string]string
+		statusCode int
+		challenge  string
+		desc       string
+	}{
+		{method: "GET", host: "unknown.example.com", path: "/foo/1", headers: map[string]string{}, statusCode: http.StatusForbidden, desc: "domain not allowed"},
+		{method: "GET", host: "api.example.com", path: "/foo/1", headers: map[string]string{"User-Agent": "Googlebot/2.1"}, statusCode: http.StatusForbidden, desc: "user agent not allowed"},
+		{method: "GET", host: "api.example.com", path: "/foo/1", headers: map[string]string{}, statusCode: http.StatusUnauthorized, challenge: `Bearer realm="token_required"`, desc: "missing header"},
+		{method: "GET", host: "api.example.com", path: "/foo/1", headers: map[string]string{"Authorization": "Bearer INVALID"}, statusCode: http.StatusUnauthorized, challenge: `Bearer realm="token_required" error="invalid_token"`, desc: "token mismatch"},
+		{method: "GET", host: "api.example.com", path: "/bar/1", headers: map[string]string{"Authorization": "Bearer TOKEN2"}, statusCode: http.StatusForbidden, challenge: `Bearer realm="token_required" error="not_allowed"`, desc: "path not allowed"},
+		{method: "POST", host: "api.example.com", path: "/foo/1", headers: map[string]string{"Authorization": "Bearer TOKEN2"}, statusCode: http.StatusForbidden, desc: "method not allowed"},
+		{method: "GET", host: "api.example.com", path: "/foo/1", headers: map[string]string{"Authorization": "Bearer TOKEN1"}, statusCode: http.StatusTooManyRequests, desc: "too many requests"},
+		{method: "GET", host: "api.example.com", path: "/piyo/1", headers: map[string]string{}, statusCode: http.StatusUnauthorized, challenge: `Basic realm="basic authentication required"`, desc: "basic authentication required"},
+		{method: "GET", host: "api.example.com", path: "/foo/1", headers: map[string]string{"Authorization": "Bearer " + strings.Repeat("A", 8192)}, statusCode: http.StatusBadRequest, desc: "too large header"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			w := serve(handler, c.method, c.host, c.path, c.headers)
+			assert.Equal(c.statusCode, w.Code, "the status code is kept")
+			assert.Equal(c.challenge, w.Header().Get("WWW-Authenticate"), "the challenge header is kept")
+			assert.JSONEq(`{"authorized": false, "error": "access denied"}`, w.Body.String(), "all rejections share the configured body")
+		})
+	}
+
+	t.Run("request entity too large", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/foo/1", strings.NewReader("too large"))
+		r.Host = "api.example.com"
+		r.Header.Set("Authorization", "Bearer TOKEN2")
+		handler.Engine.ServeHTTP(w, r)
+		assert.Equal(http.StatusRequestEntityTooLarge, w.Code, "the status code is kept")
+		assert.JSONEq(`{"authorized": false, "error": "access denied"}`, w.Body.String(), "all rejections share the configured body")
+	})
+}
+
+func TestNewHandlerSecurityHeaders(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(SecurityHeaders)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {}
+			}
+		}
+	]`)
+
+	t.Run("SECURITY_HEADERS is set", func(t *testing.T) {
+		os.Setenv(SecurityHeaders, `{"Content-Security-Policy": "default-src 'none'", "X-Content-Type-Options": "nosniff"}`)
+		handler := NewHandler()
+
+		cases := []struct {
+			host       string
+			path       string
+			headers    map[string]string
+			statusCode int
+			desc       string
+		}{
+			{host: "api.example.com", path: "/foo/1", headers: map[string]string{"Authorization": "Bearer TOKEN1"}, statusCode: http.StatusOK, desc: "the approval"},
+			{host: "api.example.com", path: "/bar/1", headers: map[string]string{"Authorization": "Bearer TOKEN1"}, statusCode: http.StatusForbidden, desc: "the rejection of the path"},
+			{host: "api.example.com", path: "/foo/1", headers: map[string]string{}, statusCode: http.StatusUnauthorized, desc: "the rejection of the missing header"},
+			{host: "api.example.com", path: "/piyo/1", headers: map[string]string{}, statusCode: http.StatusUnauthorized, desc: "the basic auth prompt"},
+			{host: "unknown.example.com", path: "/foo/1", headers: map[string]string{}, statusCode: http.StatusForbidden, desc: "the rejection of the host"},
+		}
+		for _, c := range cases {
+			w := serve(handler, "GET", c.host, c.path, c.headers)
+			assert.Equal(c.statusCode, w.Code, c.desc)
+			assert.Equal("default-src 'none'", w.Header().Get("Content-Security-Policy"), c.desc+" has Content-Security-Policy")
+			assert.Equal("nosniff", w.Header().Get("X-Content-Type-Options"), c.desc+" has X-Content-Type-Options")
+		}
+	})
+
+	t.Run("SECURITY_HEADERS is invalid", func(t *testing.T) {
+		os.Setenv(SecurityHeaders, `["nosniff"]`)
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "the invalid SECURITY_HEADERS is ignored")
+		assert.Empty(w.Header().Get("X-Content-Type-Options"), "no header is added when SECURITY_HEADERS is invalid")
+	})
+
+	t.Run("SECURITY_HEADERS is not set", func(t *testing.T) {
+		os.Unsetenv(SecurityHeaders)
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Empty(w.Header().Get("Content-Security-Policy"), "no header is added by default")
+	})
+}
+
+func TestNewHandlerStripCredential(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(StripCredentialOnSuccess)
+	defer os.Unsetenv(IdentityHeader)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	t.Run("without STRIP_CREDENTIAL_ON_SUCCESS", func(t *testing.T) {
+		os.Unsetenv(StripCredentialOnSuccess)
+		os.Unsetenv(IdentityHeader)
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the request is authorized")
+		assert.Empty(w.Header().Get(headersToRemoveHeader), "the credential is kept by default")
+	})
+
+	t.Run("with STRIP_CREDENTIAL_ON_SUCCESS and IDENTITY_HEADER", func(t *testing.T) {
+		os.Setenv(StripCredentialOnSuccess, "true")
+		os.Setenv(IdentityHeader, "X-Auth-Identity")
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the bearer token is authorized")
+		assert.Equal("authorization", w.Header().Get(headersToRemoveHeader), "the proxy removes the Authorization header")
+		assert.Equal("bearer:"+tokenFingerprint("TOKEN1"), w.Header().Get("X-Auth-Identity"), "the identity does not reveal the token")
+		assert.NotContains(w.Header().Get("X-Auth-Identity"), "TOKEN1", "the identity does not reveal the token")
+
+		w = serve(handler, "GET", "api.example.com", "/piyo/1", map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")})
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the basic authentication is authorized")
+		assert.Equal("authorization", w.Header().Get(headersToRemoveHeader), "the proxy removes the Authorization header")
+		assert.Equal("basic:user1", w.Header().Get("X-Auth-Identity"), "the identity is the username")
+
+		w = serve(handler, "GET", "api.example.com", "/static/app.js", map[string]string{})
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the path is allowed without authentication")
+		assert.Empty(w.Header().Get(headersToRemoveHeader), "nothing is removed without a credential")
+		assert.Empty(w.Header().Get("X-Auth-Identity"), "no identity without a credential")
+
+		w = serve(handler, "GET", "api.example.com", "/bar/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusForbidden, w.Code, "return 403 when the path is not allowed")
+		assert.Empty(w.Header().Get(headersToRemoveHeader), "nothing is removed from the rejected request")
+		assert.Empty(w.Header().Get("X-Auth-Identity"), "no identity for the rejected request")
+	})
+}
+
+func TestNewHandlerRejectNonSlashPath(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(RejectNonSlashPath)
+	defer os.Unsetenv(OriginalURIHeader)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": [".*"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	os.Setenv(OriginalURIHeader, "X-Original-URI")
+
+	serveRaw := func(handler *Handler, path string, headers map[string]string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = "api.example.com"
+		r.URL.Path = path
+		for k, v := range headers {
+			r.Header.Set(k, v)
+		}
+		handler.Engine.ServeHTTP(w, r)
+		return w
+	}
+
+	t.Run("without REJECT_NON_SLASH_PATH", func(t *testing.T) {
+		os.Unsetenv(RejectNonSlashPath)
+		handler := NewHandler()
+
+		w := serveRaw(handler, "foo/1", map[string]string{})
+		assert.Equal(http.StatusOK, w.Code, "the path without slash is not rejected by default")
+	})
+
+	t.Run("with REJECT_NON_SLASH_PATH", func(t *testing.T) {
+		os.Setenv(RejectNonSlashPath, "true")
+		handler := NewHandler()
+
+		cases := []struct {
+			path       string
+			headers    map[string]string
+			statusCode int
+			desc       string
+		}{
+			{path: "/foo/1", headers: map[string]string{}, statusCode: http.StatusOK, desc: "return 200 when the path starts with slash"},
+			{path: "foo/1", headers: map[string]string{}, statusCode: http.StatusBadRequest, desc: "return 400 when the path does not start with slash"},
+			{path: "", headers: map[string]string{}, statusCode: http.StatusBadRequest, desc: "return 400 when the path is empty"},
+			{path: "/foo/1", headers: map[string]string{"X-Original-URI": "foo/1"}, statusCode: http.StatusBadRequest, desc: "return 400 when the original path does not start with slash"},
+			{path: "foo/1", headers: map[string]string{"X-Original-URI": "/foo/1?q=1"}, statusCode: http.StatusOK, desc: "return 200 when the original path starts with slash"},
+		}
+		for _, c := range cases {
+			w := serveRaw(handler, c.path, c.headers)
+			assert.Equal(c.statusCode, w.Code, c.desc)
+			if c.statusCode == http.StatusBadRequest {
+				assert.JSONEq(`{"authorized": false, "error": "invalid path"}`, w.Body.String(), c.desc)
+			}
+		}
+	})
+}
+
+func TestNewHandlerDefaultAllow(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": [],
+						"default_allow": true,
+						"denied_paths": ["^/admin/.*$"]
+					}, {
+						"token": "TOKEN2",
+						"allowed_paths": ["^/foo/.*$", "^/admin/.*$"],
+						"denied_paths": ["^/admin/secret/.*$"]
+					}, {
+						"token": "TOKEN3",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		token      string
+		path       string
+		statusCode int
+		desc       string
+	}{
+		{token: "TOKEN1", path: "/foo/1", statusCode: http.StatusOK, desc: "default_allow token reaches unlisted paths"},
+		{token: "TOKEN1", path: "/bar/1", statusCode: http.StatusOK, desc: "default_allow token reaches unlisted paths"},
+		{token: "TOKEN1", path: "/admin/1", statusCode: http.StatusForbidden, desc: "default_allow token is blocked by denied_paths"},
+		{token: "TOKEN2", path: "/admin/1", statusCode: http.StatusOK, desc: "allowed path is allowed"},
+		{token: "TOKEN2", path: "/admin/secret/1", statusCode: http.StatusForbidden, desc: "denied_paths win over allowed_paths"},
+		{token: "TOKEN2", path: "/bar/1", statusCode: http.StatusForbidden, desc: "unlisted path is denied by default"},
+		{token: "TOKEN3", path: "/bar/1", statusCode: http.StatusForbidden, desc: "unlisted path is denied by default"},
+	}
+	for _, c := range cases {
+		for i := 0; i < 2; i++ {
+			w := serve(handler, "GET", "api.example.com", c.path, map[string]string{"Authorization": "Bearer " + c.token})
+			assert.Equal(c.statusCode, w.Code, "%s: %s %s", c.desc, c.token, c.path)
+		}
+	}
+}
+
+func TestNewHandlerHostSuffixAllowlist(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(HostSuffixAllowlist)
+
+	json := `[
+		{
+			"host": ".*",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": [".*"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	t.Run("without HOST_SUFFIX_ALLOWLIST", func(t *testing.T) {
+		os.Unsetenv(HostSuffixAllowlist)
+		handler := NewHandler()
+		w := serve(handler, "GET", "evil.example.net", "/foo/1", map[string]string{})
+		assert.Equal(http.StatusOK, w.Code, "all hosts are allowed by default")
+	})
+
+	t.Run("with HOST_SUFFIX_ALLOWLIST", func(t *testing.T) {
+		os.Setenv(HostSuffixAllowlist, " .example.com, example.org ,")
+		handler := NewHandler()
+
+		cases := []struct {
+			host       string
+			statusCode int
+		}{
+			{host: "api.example.com", statusCode: http.StatusOK},
+			{host: "API.Example.COM", statusCode: http.StatusOK},
+			{host: "api.example.com:8080", statusCode: http.StatusOK},
+			{host: "api.example.com.", statusCode: http.StatusOK},
+			{host: "example.com", statusCode: http.StatusOK},
+			{host: "www.example.org", statusCode: http.StatusOK},
+			{host: "evil.example.net", statusCode: http.StatusForbidden},
+			{host: "badexample.com", statusCode: http.StatusForbidden},
+			{host: "example.com.evil.net", statusCode: http.StatusForbidden},
+			{host: "", statusCode: http.StatusForbidden},
+		}
+		for _, c := range cases {
+			w := serve(handler, "GET", c.host, "/foo/1", map[string]string{})
+			assert.Equal(c.statusCode, w.Code, "host: %q", c.host)
+		}
+	})
+}
+
+func TestNewHandlerHostMatchNormalization(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(HostMatchStripPort)
+	defer os.Unsetenv(HostMatchCaseInsensitive)
+
+	json := `[
+		{
+			"host": "^api\\.example\\.com$",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}, {
+			"host": "^\\[::1\\]$",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	bearer := map[string]string{"Authorization": "Bearer TOKEN1"}
+	hosts := []string{"api.example.com", "API.Example.COM", "api.example.com:8080", "Api.Example.Com:443", "[::1]", "[::1]:8080"}
+
+	t.Run("without HOST_MATCH_STRIP_PORT and HOST_MATCH_CASE_INSENSITIVE", func(t *testing.T) {
+		os.Unsetenv(HostMatchStripPort)
+		os.Unsetenv(HostMatchCaseInsensitive)
+		handler := NewHandler()
+
+		expected := []int{http.StatusOK, http.StatusForbidden, http.StatusForbidden, http.StatusForbidden, http.StatusOK, http.StatusForbidden}
+		for i, host := range hosts {
+			w := serve(handler, "GET", host, "/foo/1", bearer)
+			assert.Equal(expected[i], w.Code, "the Host header is matched as it is by default: %q", host)
+		}
+	})
+
+	t.Run("with HOST_MATCH_STRIP_PORT", func(t *testing.T) {
+		os.Setenv(HostMatchStripPort, "true")
+		os.Unsetenv(HostMatchCaseInsensitive)
+		handler := NewHandler()
+
+		expected := []int{http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusForbidden, http.StatusOK, http.StatusOK}
+		for i, host := range hosts {
+			w := serve(handler, "GET", host, "/foo/1", bearer)
+			assert.Equal(expected[i], w.Code, "the port is removed, but the case is kept: %q", host)
+		}
+	})
+
+	t.Run("with HOST_MATCH_STRIP_PORT and HOST_MATCH_CASE_INSENSITIVE", func(t *testing.T) {
+		os.Setenv(HostMatchStripPort, "true")
+		os.Setenv(HostMatchCaseInsensitive, "true")
+		handler := NewHandler()
+
+		for _, host := range hosts {
+			w := serve(handler, "GET", host, "/foo/1", bearer)
+			assert.Equal(http.StatusOK, w.Code, "the same logical host is matched consistently: %q", host)
+			w = serve(handler, "GET", host, "/bar/1", bearer)
+			assert.Equal(http.StatusForbidden, w.Code, "the paths are still checked: %q", host)
+		}
+		assert.Equal(2, handler.matchHostCache.Len(), "the hosts are cached by the normalized values")
+		assert.True(handler.matchHostCache.Contains("api.example.com"), "the normalized host is the key of the cache")
+		assert.True(handler.matchHostCache.Contains("[::1]"), "the brackets of the IPv6 address are kept")
+	})
+}
+
+func TestNewHandlerTokenExpiresIn(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"],
+						"expires_at": "2100-01-01T00:00:00Z"
+					}, {
+						"token": "TOKEN2",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+	now := time.Date(2099, 12, 31, 23, 0, 0, 0, time.UTC)
+	handler.now = func() time.Time { return now }
+
+	w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+	assert.Equal(http.StatusOK, w.Code, "return 200 when the token is authorized")
+	assert.Equal("3600", w.Header().Get(tokenExpiresInHeader), "the remaining lifetime is reported in seconds")
+
+	now = now.Add(1500 * time.Millisecond)
+	w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+	assert.Equal("3599", w.Header().Get(tokenExpiresInHeader), "the remaining lifetime is rounded up")
+
+	w = serve(handler, "GET", "api.example.com", "/bar/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+	assert.Equal(http.StatusForbidden, w.Code, "return 403 when the path is not allowed")
+	assert.Empty(w.Header().Get(tokenExpiresInHeader), "the header is not set to the rejected responses")
+
+	w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN2"})
+	assert.Equal(http.StatusOK, w.Code, "return 200 when the token is authorized")
+	assert.Empty(w.Header().Get(tokenExpiresInHeader), "the header is omitted when the token does not expire")
+}
+
+func TestNewHandlerMethodOverride(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	settings := `{
+		"method_override": %t,
+		"bearer_tokens": [
+			{
+				"token": "TOKEN1",
+				"allowed_paths": ["^/foo/.*$"],
+				"allowed_methods": ["POST"]
+			}, {
+				"token": "TOKEN2",
+				"allowed_paths": ["^/foo/.*$"],
+				"allowed_methods": ["DELETE"]
+			}
+		],
+		"basic_auths": [],
+		"no_auths": {}
+	}`
+	json := fmt.Sprintf(`[
+		{"host": "override\\.example\\.com", "settings": %s},
+		{"host": "api\\.example\\.com", "settings": %s}
+	]`, fmt.Sprintf(settings, true), fmt.Sprintf(settings, false))
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		method     string
+		host       string
+		token      string
+		override   string
+		statusCode int
+		desc       string
+	}{
+		{method: "POST", host: "override.example.com", token: "TOKEN1", override: "", statusCode: http.StatusOK, desc: "POST without the header is POST"},
+		{method: "POST", host: "override.example.com", token: "TOKEN1", override: "DELETE", statusCode: http.StatusForbidden, desc: "the override changes the method"},
+		{method: "POST", host: "override.example.com", token: "TOKEN2", override: "delete", statusCode: http.StatusOK, desc: "the override changes the method"},
+		{method: "GET", host: "override.example.com", token: "TOKEN2", override: "DELETE", statusCode: http.StatusForbidden, desc: "the override is honored only for POST"},
+		{method: "POST", host: "override.example.com", token: "", override: "OPTIONS", statusCode: http.StatusUnauthorized, desc: "the override to OPTIONS is not honored"},
+		{method: "POST", host: "api.example.com", token: "TOKEN1", override: "DELETE", statusCode: http.StatusOK, desc: "the override is ignored by default"},
+		{method: "POST", host: "api.example.com", token: "TOKEN2", override: "DELETE", statusCode: http.StatusForbidden, desc: "the override is ignored by default"},
+	}
+	for _, c := range cases {
+		headers := map[string]string{}
+		if len(c.token) > 0 {
+			headers["Authorization"] = "Bearer " + c.token
+		}
+		if len(c.override) > 0 {
+			headers[methodOverrideHeader] = c.override
+		}
+		w := serve(handler, c.method, c.host, "/foo/1", headers)
+		assert.Equal(c.statusCode, w.Code, "%s: %s %s with %s", c.desc, c.method, c.host, c.token)
+	}
+}
+
+func TestNewHandlerMatchQuery(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	settings := `{
+		"match_query": %t,
+		"bearer_tokens": [
+			{
+				"token": "TOKEN1",
+				"allowed_paths": ["^/entities\\?(.*&)?type=Room(&.*)?$"]
+			}
+		],
+		"basic_auths": [
+			{
+				"username": "user1",
+				"password": "password1",
+				"allowed_paths": ["^/piyo\\?type=Room$"]
+			}
+		],
+		"no_auths": {
+			"allowed_paths": ["^/static\\?v=[0-9]+$"]
+		}
+	}`
+	json := fmt.Sprintf(`[
+		{"host": "query\\.example\\.com", "settings": %s},
+		{"host": "api\\.example\\.com", "settings": %s}
+	]`, fmt.Sprintf(settings, true), fmt.Sprintf(settings, false))
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		host       string
+		path       string
+		headers    map[string]string
+		statusCode int
+		desc       string
+	}{
+		{host: "query.example.com", path: "/entities?type=Room", headers: map[string]string{"Authorization": "Bearer TOKEN1"},
+			statusCode: http.StatusOK, desc: "the bearer token is allowed the query"},
+		{host: "query.example.com", path: "/entities?limit=10&type=Room", headers: map[string]string{"Authorization": "Bearer TOKEN1"},
+			statusCode: http.StatusOK, desc: "the bearer token is allowed the query with the other params"},
+		{host: "query.example.com", path: "/entities?type=Device", headers: map[string]string{"Authorization": "Bearer TOKEN1"},
+			statusCode: http.StatusForbidden, desc: "the bearer token is not allowed the other query even after the allowed one is cached"},
+		{host: "query.example.com", path: "/entities", headers: map[string]string{"Authorization": "Bearer TOKEN1"},
+			statusCode: http.StatusForbidden, desc: "the bearer token is not allowed the path without the query"},
+		{host: "query.example.com", path: "/piyo?type=Room", headers: map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")},
+			statusCode: http.StatusOK, desc: "the basic authentication user is allowed the query"},
+		{host: "query.example.com", path: "/piyo?type=Device", headers: map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")},
+			statusCode: http.StatusUnauthorized, desc: "the other query does not match basic_auths"},
+		{host: "query.example.com", path: "/static?v=1", headers: map[string]string{},
+			statusCode: http.StatusOK, desc: "no_auths matches the query"},
+		{host: "query.example.com", path: "/static?v=latest", headers: map[string]string{},
+			statusCode: http.StatusUnauthorized, desc: "no_auths does not match the other query"},
+		{host: "api.example.com", path: "/entities?type=Device", headers: map[string]string{"Authorization": "Bearer TOKEN1"},
+			statusCode: http.StatusForbidden, desc: "the query is not matched when match_query is not set"},
+		{host: "api.example.com", path: "/static?v=1", headers: map[string]string{},
+			statusCode: http.StatusUnauthorized, desc: "no_auths does not match the query when match_query is not set"},
+	}
+	for _, c := range cases {
+		w := serve(handler, "GET", c.host, c.path, c.headers)
+		assert.Equal(c.statusCode, w.Code, "%s: %s%s", c.desc, c.host, c.path)
+	}
+}
+
+func TestNewHandlerAuthSchemes(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(BearerSchemes)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	credential := base64.StdEncoding.EncodeToString([]byte("user1:password1"))
+
+	cases := []struct {
+		schemes    string
+		path       string
+		authHeader string
+		statusCode int
+	}{
+		{schemes: "", path: "/foo/1", authHeader: "Bearer TOKEN1", statusCode: http.StatusOK},
+		{schemes: "", path: "/foo/1", authHeader: "BEARER\tTOKEN1", statusCode: http.StatusOK},
+		{schemes: "", path: "/foo/1", authHeader: "bearer  TOKEN1", statusCode: http.StatusOK},
+		{schemes: "", path: "/foo/1", authHeader: "bEaReR \t TOKEN1", statusCode: http.StatusOK},
+		{schemes: "", path: "/foo/1", authHeader: "BearerTOKEN1", statusCode: http.StatusUnauthorized},
+		{schemes: "", path: "/foo/1", authHeader: "Token TOKEN1", statusCode: http.StatusUnauthorized},
+		{schemes: "Bearer, Token", path: "/foo/1", authHeader: "token\tTOKEN1", statusCode: http.StatusOK},
+		{schemes: "Bearer, Token", path: "/foo/1", authHeader: "Bearer TOKEN1", statusCode: http.StatusOK},
+		{schemes: "Token", path: "/foo/1", authHeader: "Bearer TOKEN1", statusCode: http.StatusUnauthorized},
+		{schemes: "", path: "/piyo/1", authHeader: "Basic " + credential, statusCode: http.StatusOK},
+		{schemes: "", path: "/piyo/1", authHeader: "BASIC\t" + credential, statusCode: http.StatusOK},
+		{schemes: "", path: "/piyo/1", authHeader: "basic   " + credential, statusCode: http.StatusOK},
+	}
+	for _, c := range cases {
+		os.Setenv(BearerSchemes, c.schemes)
+		handler := NewHandler()
+		w := serve(handler, "GET", "api.example.com", c.path, map[string]string{"Authorization": c.authHeader})
+		assert.Equal(c.statusCode, w.Code, "BEARER_SCHEMES=%q, Authorization: %q", c.schemes, c.authHeader)
+	}
+
+	t.Run("BEARER_SCHEME", func(t *testing.T) {
+		os.Unsetenv(BearerSchemes)
+		os.Setenv(BearerScheme, "Token")
+		defer os.Unsetenv(BearerScheme)
+
+		handler := NewHandler()
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Token TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "the custom scheme of BEARER_SCHEME is accepted")
+		w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusUnauthorized, w.Code, "the wrong scheme is refused")
+
+		os.Setenv(BearerSchemes, "Bearer")
+		handler = NewHandler()
+		w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Token TOKEN1"})
+		assert.Equal(http.StatusUnauthorized, w.Code, "BEARER_SCHEMES wins over BEARER_SCHEME")
+	})
+}
+
+func TestNewHandlerNoAuthBypass(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	settings := `{
+		"bearer_tokens": [
+			{
+				"token": "TOKEN1",
+				"allowed_paths": ["^/foo/.*$"]
+			}
+		],
+		"basic_auths": [],
+		"no_auths": {
+			"allowed_paths": ["^/static/.*$"],
+			"bypass_protections": %t
+		},
+		"user_agent_deny": ["(?i)bot"]
+	}`
+	json := fmt.Sprintf(`[
+		{"host": "bypass\\.example\\.com", "settings": %s},
+		{"host": "api\\.example\\.com", "settings": %s}
+	]`, fmt.Sprintf(settings, true), fmt.Sprintf(settings, false))
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+
+	cases := []struct {
+		host       string
+		path       string
+		userAgent  string
+		statusCode int
+		desc       string
+	}{
+		{host: "api.example.com", path: "/static/app.js", userAgent: "Googlebot/2.1", statusCode: http.StatusForbidden, desc: "the protections apply to no_auths by default"},
+		{host: "api.example.com", path: "/static/app.js", userAgent: "Mozilla/5.0", statusCode: http.StatusOK, desc: "the allowed client reaches no_auths"},
+		{host: "bypass.example.com", path: "/static/app.js", userAgent: "Googlebot/2.1", statusCode: http.StatusOK, desc: "no_auths bypass the protections"},
+		{host: "bypass.example.com", path: "/foo/1", userAgent: "Googlebot/2.1", statusCode: http.StatusForbidden, desc: "the protections still apply to the other paths"},
+	}
+	for _, c := range cases {
+		w := serve(handler, "GET", c.host, c.path, map[string]string{"User-Agent": c.userAgent, "Authorization": "Bearer TOKEN1"})
+		assert.Equal(c.statusCode, w.Code, "%s: %s%s", c.desc, c.host, c.path)
+	}
+}
+
+func TestNewHandlerAuthTrace(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(AuthTrace)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/admin/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`)
+
+	t.Run("no trace by default", func(t *testing.T) {
+		handler := NewHandler()
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusOK, w.Code, "the request is allowed")
+		assert.Empty(w.Header().Get(traceHeader), "X-Auth-Trace is not set without AUTH_TRACE")
+	})
+
+	os.Setenv(AuthTrace, "true")
+	handler := NewHandler()
+	fingerprint := tokenFingerprint("TOKEN1")
+	cases := []struct {
+		host       string
+		path       string
+		headers    map[string]string
+		statusCode int
+		trace      string
+	}{
+		{host: "api.example.com", path: "/static/app.js", headers: map[string]string{}, statusCode: http.StatusOK,
+			trace: `host matched api\.example\.com; no_auths matched`},
+		{host: "api.example.com", path: "/foo/1", headers: map[string]string{"Authorization": "Bearer TOKEN1"}, statusCode: http.StatusOK,
+			trace: `host matched api\.example\.com; no_auths and basic_auths not matched; bearer token ` + fingerprint + ` allowed by ^/foo/.*$`},
+		{host: "api.example.com", path: "/bar/1", headers: map[string]string{"Authorization": "Bearer TOKEN1"}, statusCode: http.StatusForbidden,
+			trace: `host matched api\.example\.com; no_auths and basic_auths not matched; bearer token ` + fingerprint + ` path not allowed`},
+		{host: "api.example.com", path: "/admin/1", headers: map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")}, statusCode: http.StatusOK,
+			trace: `host matched api\.example\.com; basic_auths matched; basic user user1 verified`},
+		{host: "other.example.com", path: "/foo/1", headers: map[string]string{}, statusCode: http.StatusForbidden,
+			trace: `host not matched`},
+	}
+	for _, c := range cases {
+		w := serve(handler, "GET", c.host, c.path, c.headers)
+		assert.Equal(c.statusCode, w.Code, "status of %s%s", c.host, c.path)
+		assert.Equal(c.trace, w.Header().Get(traceHeader), "trace of %s%s", c.host, c.path)
+		assert.NotContains(w.Header().Get(traceHeader), "TOKEN1", "the trace never includes the token")
+		assert.NotContains(w.Header().Get(traceHeader), "password1", "the trace never includes the password")
+	}
+}
+
+func TestNewHandlerNoAuthRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(TrustedProxies)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"],
+					"rate_limit": {"requests": 2, "period": "1m"}
+				}
+			}
+		}
+	]`)
+	// the requests of serve come from 192.0.2.1
+	os.Setenv(TrustedProxies, "192.0.2.1")
+	handler := NewHandler()
+	now := time.Date(2019, 1, 1, 0, 0, 30, 0, time.UTC)
+	handler.anonymousLimiter.now = func() time.Time { return now }
+	client1 := map[string]string{"X-Forwarded-For": "203.0.113.1"}
+	client2 := map[string]string{"X-Forwarded-For": "203.0.113.2"}
+
+	for i := 1; i <= 3; i++ {
+		w := serve(handler, "GET", "api.example.com", "/static/app.js", client1)
+		if i < 3 {
+			assert.Equal(http.StatusOK, w.Code, "return 200 within the rate limit")
+		} else {
+			assert.Equal(http.StatusTooManyRequests, w.Code, "return 429 when the anonymous rate limit is exceeded")
+			assert.Equal("60", w.Header().Get("Retry-After"), "Retry-After header is set")
+		}
+	}
+	w := serve(handler, "GET", "api.example.com", "/static/app.js", client2)
+	assert.Equal(http.StatusOK, w.Code, "the rate limit is counted per client IP")
+	w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"X-Forwarded-For": "203.0.113.1", "Authorization": "Bearer TOKEN1"})
+	assert.Equal(http.StatusOK, w.Code, "the rate limit does not apply to the other paths")
+	w = serve(handler, "OPTIONS", "api.example.com", "/static/app.js", client1)
+	assert.Equal(http.StatusOK, w.Code, "the rate limit does not apply to OPTIONS")
+
+	for i := 1; i <= 3; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/static/app.js", nil)
+		r.Host = "api.example.com"
+		r.RemoteAddr = "198.51.100.1:1234"
+		r.Header.Set("X-Forwarded-For", fmt.Sprintf("203.0.113.%d", 100+i))
+		handler.Engine.ServeHTTP(w, r)
+		if i < 3 {
+			assert.Equal(http.StatusOK, w.Code, "return 200 within the rate limit of the untrusted client")
+		} else {
+			assert.Equal(http.StatusTooManyRequests, w.Code, "the forged X-Forwarded-For of an untrusted client does not evade the rate limit")
+		}
+	}
+
+	now = now.Add(time.Minute)
+	w = serve(handler, "GET", "api.example.com", "/static/app.js", client1)
+	assert.Equal(http.StatusOK, w.Code, "the rate limit is reset in the next period")
+}
+
+func TestNewHandlerConcurrentReload(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	logging.SetOutput(ioutil.Discard)
+	defer os.Unsetenv(token.AuthTokensPath)
+
+	json1 := `[{"host": "api\\.example\\.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}], "basic_auths": [], "no_auths": {}}}]`
+	json2 := `[{"host": "api\\.example\\.com", "settings": {"bearer_tokens": [{"token": "TOKEN2", "allowed_paths": ["^/foo/.*$"]}], "basic_auths": [], "no_auths": {}}}]`
+	f, err := ioutil.TempFile("", "reload")
+	assert.Nil(err, "TempFile has no error")
+	defer os.Remove(f.Name())
+	f.WriteString(json1)
+	f.Close()
+	os.Setenv(token.AuthTokensPath, f.Name())
+
+	handler := NewHandler()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			// the file is replaced by renaming, because a half-written file is not a configuration of either
+			if i%2 == 0 {
+				ioutil.WriteFile(f.Name()+".new", []byte(json2), 0644)
+			} else {
+				ioutil.WriteFile(f.Name()+".new", []byte(json1), 0644)
+			}
+			os.Rename(f.Name()+".new", f.Name())
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Contains([]int{http.StatusOK, http.StatusUnauthorized}, w.Code, "the request is authorized by either configuration")
+	}
+}
+
+func TestNewHandlerRootPath(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	settings := func(rootPath string) string {
+		s := `{
+			"bearer_tokens": [
+				{"token": "BROAD", "allowed_paths": ["^/.*$"]},
+				{"token": "SCOPED", "allowed_paths": ["^/foo/.*$"]},
+				{"token": "EMPTY", "allowed_paths": []}
+			],
+			"basic_auths": [],
+			"no_auths": {}`
+		if len(rootPath) > 0 {
+			s += `, "root_path": "` + rootPath + `"`
+		}
+		return s + "}"
+	}
+	os.Setenv(token.AuthTokens, `[
+		{"host": "default.example.com", "settings": `+settings("")+`},
+		{"host": "rules.example.com", "settings": `+settings("rules")+`},
+		{"host": "deny.example.com", "settings": `+settings("deny")+`},
+		{"host": "allow.example.com", "settings": `+settings("allow")+`}
+	]`)
+	handler := NewHandler()
+
+	cases := []struct {
+		host       string
+		path       string
+		token      string
+		statusCode int
+		desc       string
+	}{
+		{host: "default.example.com", path: "/", token: "", statusCode: http.StatusUnauthorized, desc: "/ requires a token by default"},
+		{host: "default.example.com", path: "/", token: "SCOPED", statusCode: http.StatusForbidden, desc: "/ is not allowed for a scoped token by default"},
+		{host: "default.example.com", path: "/", token: "EMPTY", statusCode: http.StatusUnauthorized, desc: "/ is not allowed for a token without allowed_paths by default, which is not held"},
+		{host: "default.example.com", path: "/", token: "BROAD", statusCode: http.StatusOK, desc: "/ is matched by a broad pattern by default"},
+		{host: "rules.example.com", path: "/", token: "", statusCode: http.StatusUnauthorized, desc: "/ requires a token when root_path is rules"},
+		{host: "rules.example.com", path: "/", token: "BROAD", statusCode: http.StatusOK, desc: "/ is matched by a broad pattern when root_path is rules"},
+		{host: "deny.example.com", path: "/", token: "", statusCode: http.StatusForbidden, desc: "/ is denied without token when root_path is deny"},
+		{host: "deny.example.com", path: "/", token: "SCOPED", statusCode: http.StatusForbidden, desc: "/ is denied for a scoped token when root_path is deny"},
+		{host: "deny.example.com", path: "/", token: "EMPTY", statusCode: http.StatusForbidden, desc: "/ is denied for a token without allowed_paths when root_path is deny"},
+		{host: "deny.example.com", path: "/", token: "BROAD", statusCode: http.StatusForbidden, desc: "/ is denied even for a broad pattern when root_path is deny"},
+		{host: "deny.example.com", path: "/foo/1", token: "SCOPED", statusCode: http.StatusOK, desc: "the other paths are not changed when root_path is deny"},
+		{host: "deny.example.com", path: "/index.html", token: "BROAD", statusCode: http.StatusOK, desc: "only / itself is denied when root_path is deny"},
+		{host: "allow.example.com", path: "/", token: "", statusCode: http.StatusOK, desc: "/ is allowed without token when root_path is allow"},
+		{host: "allow.example.com", path: "/", token: "SCOPED", statusCode: http.StatusOK, desc: "/ is allowed for a scoped token when root_path is allow"},
+		{host: "allow.example.com", path: "/", token: "EMPTY", statusCode: http.StatusOK, desc: "/ is allowed for a token without allowed_paths when root_path is allow"},
+		{host: "allow.example.com", path: "/foo/1", token: "", statusCode: http.StatusUnauthorized, desc: "the other paths are not changed when root_path is allow"},
+	}
+	for _, c := range cases {
+		headers := map[string]string{}
+		if len(c.token) > 0 {
+			headers["Authorization"] = "Bearer " + c.token
+		}
+		w := serve(handler, "GET", c.host, c.path, headers)
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestNewHandlerIPRules(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(TrustedProxies)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "internal.example.com",
+			"settings": {
+				"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["^.*$"]},
+				"ip_rules": {"allow": ["10.0.0.0/8", "fd00::/8"], "deny": ["0.0.0.0/0", "::/0"]}
+			}
+		}, {
+			"host": "blocked.example.com",
+			"settings": {
+				"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["^.*$"]},
+				"ip_rules": {"deny": ["203.0.113.0/24", "2001:db8::/32"]}
+			}
+		}, {
+			"host": "public.example.com",
+			"settings": {
+				"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["^.*$"]},
+				"ip_rules": {}
+			}
+		}
+	]`)
+	os.Setenv(TrustedProxies, "198.51.100.0/24")
+	handler := NewHandler()
+
+	cases := []struct {
+		host         string
+		remoteAddr   string
+		forwardedFor string
+		statusCode   int
+		desc         string
+	}{
+		{host: "internal.example.com", remoteAddr: "10.1.2.3:1234", statusCode: http.StatusOK, desc: "an allowed IPv4 RemoteAddr is accepted"},
+		{host: "internal.example.com", remoteAddr: "[fd12::1]:1234", statusCode: http.StatusOK, desc: "an allowed IPv6 RemoteAddr is accepted"},
+		{host: "internal.example.com", remoteAddr: "192.0.2.1:1234", statusCode: http.StatusForbidden, desc: "a denied IPv4 RemoteAddr is refused"},
+		{host: "internal.example.com", remoteAddr: "[2001:db8::1]:1234", statusCode: http.StatusForbidden, desc: "a denied IPv6 RemoteAddr is refused"},
+		{host: "internal.example.com", remoteAddr: "192.0.2.1:1234", forwardedFor: "10.1.2.3", statusCode: http.StatusForbidden, desc: "a forged X-Forwarded-For from an untrusted client is refused"},
+		{host: "internal.example.com", remoteAddr: "10.1.2.3:1234", forwardedFor: "192.0.2.2", statusCode: http.StatusOK, desc: "X-Forwarded-For from an untrusted client is ignored"},
+		{host: "internal.example.com", remoteAddr: "198.51.100.1:1234", forwardedFor: "10.1.2.3", statusCode: http.StatusOK, desc: "an allowed X-Forwarded-For from a trusted proxy is accepted"},
+		{host: "internal.example.com", remoteAddr: "198.51.100.1:1234", forwardedFor: "192.0.2.2", statusCode: http.StatusForbidden, desc: "a denied X-Forwarded-For from a trusted proxy is refused"},
+		{host: "internal.example.com", remoteAddr: "198.51.100.1:1234", forwardedFor: "192.0.2.2, fd12::1", statusCode: http.StatusOK, desc: "the last IPv6 address of X-Forwarded-For is checked"},
+		{host: "internal.example.com", remoteAddr: "198.51.100.1:1234", forwardedFor: "10.1.2.3, 192.0.2.2", statusCode: http.StatusForbidden, desc: "a forged address on the left of X-Forwarded-For is ignored"},
+		{host: "internal.example.com", remoteAddr: "198.51.100.1:1234", forwardedFor: "10.1.2.3, 198.51.100.2", statusCode: http.StatusOK, desc: "the trusted proxies in X-Forwarded-For are skipped"},
+		{host: "blocked.example.com", remoteAddr: "192.0.2.1:1234", statusCode: http.StatusOK, desc: "an IP out of deny is accepted without allow"},
+		{host: "blocked.example.com", remoteAddr: "203.0.113.1:1234", statusCode: http.StatusForbidden, desc: "an IPv4 address in deny is refused"},
+		{host: "blocked.example.com", remoteAddr: "198.51.100.1:1234", forwardedFor: "2001:db8::1", statusCode: http.StatusForbidden, desc: "an IPv6 X-Forwarded-For in deny is refused"},
+		{host: "public.example.com", remoteAddr: "203.0.113.1:1234", statusCode: http.StatusOK, desc: "the empty rules allow all IPv4 addresses"},
+		{host: "public.example.com", remoteAddr: "[2001:db8::1]:1234", statusCode: http.StatusOK, desc: "the empty rules allow all IPv6 addresses"},
+	}
+	for _, c := range cases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/foo/1", nil)
+		r.Host = c.host
+		r.RemoteAddr = c.remoteAddr
+		if len(c.forwardedFor) > 0 {
+			r.Header.Set("X-Forwarded-For", c.forwardedFor)
+		}
+		handler.Engine.ServeHTTP(w, r)
+		assert.Equal(c.statusCode, w.Code, c.desc)
+		if c.statusCode == http.StatusForbidden {
+			assert.Contains(w.Body.String(), `"error":"ip not allowed"`, c.desc)
+		}
+	}
+}
+
+func TestNewHandlerLogSampleRate(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(LogSampleRate)
+
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() { logOutput = os.Stdout }()
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+	countLogs := func(handler *Handler, path string, authHeader string, requests int) int {
+		buf.Reset()
+		for i := 0; i < requests; i++ {
+			serve(handler, "GET", "api.example.com", path, map[string]string{"Authorization": authHeader})
+		}
+		return strings.Count(buf.String(), "[GIN]")
+	}
+
+	cases := []struct {
+		sampleRate string
+		approvals  int
+	}{
+		{sampleRate: "", approvals: 100},
+		{sampleRate: "invalid", approvals: 100},
+		{sampleRate: "0", approvals: 100},
+		{sampleRate: "1", approvals: 100},
+		{sampleRate: "10", approvals: 10},
+		{sampleRate: "30", approvals: 4},
+	}
+	for _, c := range cases {
+		os.Setenv(LogSampleRate, c.sampleRate)
+		handler := NewHandler()
+		assert.Equal(c.approvals, countLogs(handler, "/foo/1", "Bearer TOKEN1", 100), "the approvals are sampled with LOG_SAMPLE_RATE=%q", c.sampleRate)
+		assert.Equal(100, countLogs(handler, "/foo/1", "Bearer INVALID", 100), "the denials are always logged with LOG_SAMPLE_RATE=%q", c.sampleRate)
+		assert.Equal(100, countLogs(handler, "/bar/1", "Bearer TOKEN1", 100), "the forbidden requests are always logged with LOG_SAMPLE_RATE=%q", c.sampleRate)
+	}
+}
+
+func TestNewHandlerRejectionDetails(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(RejectionDetails)
+	defer os.Unsetenv(OriginalURIHeader)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+	token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+
+	t.Run("without REJECTION_DETAILS", func(t *testing.T) {
+		handler := NewHandler()
+
+		w := serve(handler, "POST", "api.example.com", "/bar/1", token1)
+		assert.Equal(http.StatusForbidden, w.Code, "the path is not allowed")
+		assert.JSONEq(`{"authorized": false, "error": "path not allowd"}`, w.Body.String(), "the rejection has no details by default")
+	})
+
+	t.Run("with REJECTION_DETAILS", func(t *testing.T) {
+		os.Setenv(RejectionDetails, "true")
+		os.Setenv(OriginalURIHeader, "X-Original-URI")
+		handler := NewHandler()
+
+		w := serve(handler, "POST", "api.example.com", "/bar/1?secret=value", token1)
+		assert.Equal(http.StatusForbidden, w.Code, "the path is not allowed")
+		assert.JSONEq(`{"authorized": false, "error": "path not allowd", "method": "POST", "host": "api.example.com", "path": "/bar/1"}`, w.Body.String(),
+			"the rejection has the method, host and path without the query string")
+
+		w = serve(handler, "GET", "api.example.com", "/foo/1", nil)
+		assert.Equal(http.StatusUnauthorized, w.Code, "the header is missing")
+		assert.Contains(w.Body.String(), `"method":"GET"`, "the rejection has the method")
+		assert.Contains(w.Body.String(), `"path":"/foo/1"`, "the rejection has the path")
+
+		w = serve(handler, "GET", "unknown.example.com", "/foo/1", token1)
+		assert.Equal(http.StatusForbidden, w.Code, "the host is not allowed")
+		assert.Contains(w.Body.String(), `"host":"unknown.example.com"`, "the rejection of the unknown host has the host")
+
+		w = serve(handler, "GET", "api.example.com", "/", map[string]string{"Authorization": "Bearer TOKEN1", "X-Original-URI": "/bar/2?secret=value"})
+		assert.Equal(http.StatusForbidden, w.Code, "the original path is not allowed")
+		assert.Contains(w.Body.String(), `"path":"/bar/2"`, "the rejection has the original path which is decided")
+
+		w = serve(handler, "GET", "api.example.com", "/foo/1", token1)
+		assert.Equal(http.StatusOK, w.Code, "the path is allowed")
+		assert.JSONEq(`{"authorized": true}`, w.Body.String(), "the approval has no details")
+	})
+}
+
+func TestNewHandlerCustomHeaderCasing(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(APIKeyHeader)
+	defer os.Unsetenv(OriginalURIHeader)
+	defer os.Unsetenv(OriginalMethodHeader)
+	defer os.Unsetenv(IdentityHeader)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "127\\.0\\.0\\.1",
+			"settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"], "allowed_methods": ["GET"]}],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+
+	for _, names := range [][]string{
+		{"X-API-Key", "X-Original-URI", "X-Original-Method", "X-Auth-Identity"},
+		{"x-api-key", "x-original-uri", "x-original-method", "x-auth-identity"},
+		{" X-API-KEY ", "X-ORIGINAL-URI", "X-ORIGINAL-METHOD", "X-AUTH-IDENTITY"},
+	} {
+		os.Setenv(APIKeyHeader, names[0])
+		os.Setenv(OriginalURIHeader, names[1])
+		os.Setenv(OriginalMethodHeader, names[2])
+		os.Setenv(IdentityHeader, names[3])
+		ts := httptest.NewServer(NewHandler().Engine)
+
+		for _, sent := range [][]string{
+			{"X-Api-Key", "X-Original-Uri", "X-Original-Method"},
+			{"x-api-key", "x-original-uri", "x-original-method"},
+			{"X-API-KEY", "X-ORIGINAL-URI", "X-ORIGINAL-METHOD"},
+		} {
+			r, _ := http.NewRequest("POST", ts.URL+"/auth", nil)
+			// the headers are written without canonicalizing, as the other proxies may send them
+			r.Header[sent[0]] = []string{"TOKEN1"}
+			r.Header[sent[1]] = []string{"/foo/1"}
+			r.Header[sent[2]] = []string{"GET"}
+			resp, err := http.DefaultClient.Do(r)
+			if !assert.NoError(err) {
+				continue
+			}
+			resp.Body.Close()
+			assert.Equal(http.StatusOK, resp.StatusCode, "the headers %q are recognized by the configured names %q", sent, names)
+			assert.Equal("bearer:"+tokenFingerprint("TOKEN1"), resp.Header.Get("X-Auth-Identity"), "the identity is written by the configured name %q", names[3])
+		}
+		ts.Close()
+	}
+}
+
+func TestNewHandlerLogFormatJSON(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(logging.LogFormat)
+	defer logging.Configure()
+
+	var buf bytes.Buffer
+	logOutput = &buf
+	defer func() { logOutput = os.Stdout }()
+
+	os.Setenv(logging.LogFormat, "json")
+	logging.Configure()
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+	handler := NewHandler()
+	w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+
+	assert.NotContains(buf.String(), "[GIN]")
+	var entry map[string]interface{}
+	if assert.NoError(json.Unmarshal(bytes.TrimSpace(buf.Bytes()), &entry)) {
+		assert.Equal("access", entry["msg"])
+		assert.Equal(float64(200), entry["status"])
+		assert.Equal("GET", entry["method"])
+		assert.Equal("api.example.com", entry["host"])
+		assert.Equal("/foo/1", entry["path"])
+		assert.Equal(w.Header().Get("X-Request-Id"), entry["request_id"])
+	}
+}
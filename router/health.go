@@ -0,0 +1,64 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+/*
+HealthPath : HEALTH_PATH is an environment variable name to set the path of the liveness probe (default "/healthz").
+	The probe is disabled when it is set but empty.
+*/
+const HealthPath = "HEALTH_PATH"
+
+/*
+ReadyPath : READY_PATH is an environment variable name to set the path of the readiness probe (default "/readyz").
+	The probe is disabled when it is set but empty.
+*/
+const ReadyPath = "READY_PATH"
+
+const defaultHealthPath = "/healthz"
+const defaultReadyPath = "/readyz"
+
+func getProbePath(name string, defaultPath string) string {
+	path, ok := os.LookupEnv(name)
+	if !ok {
+		return defaultPath
+	}
+	return path
+}
+
+// registerProbes registers the probes, which are answered without authentication before NoRoute.
+func registerProbes(engine *gin.Engine, holder *token.Holder) {
+	// the other paths like "/healthz/" must be authorized by NoRoute, not redirected
+	engine.RedirectTrailingSlash = false
+	engine.RedirectFixedPath = false
+	if healthPath := getProbePath(HealthPath, defaultHealthPath); len(healthPath) > 0 {
+		healthz := func(context *gin.Context) {
+			context.JSON(http.StatusOK, gin.H{"status": "ok"})
+		}
+		engine.GET(healthPath, healthz)
+		engine.HEAD(healthPath, healthz)
+	}
+	if readyPath := getProbePath(ReadyPath, defaultReadyPath); len(readyPath) > 0 {
+		readyz := func(context *gin.Context) {
+			if !holder.IsReady() {
+				context.JSON(http.StatusServiceUnavailable, gin.H{"status": "not ready"})
+				return
+			}
+			context.JSON(http.StatusOK, gin.H{"status": "ok"})
+		}
+		engine.GET(readyPath, readyz)
+		engine.HEAD(readyPath, readyz)
+	}
+}
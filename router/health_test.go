@@ -0,0 +1,94 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerProbes(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(HealthPath)
+	defer os.Unsetenv(ReadyPath)
+
+	validTokens := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`
+
+	t.Run("the configurations are loaded", func(t *testing.T) {
+		os.Setenv(token.AuthTokens, validTokens)
+		handler := NewHandler()
+
+		cases := []struct {
+			method     string
+			path       string
+			statusCode int
+			desc       string
+		}{
+			{method: "GET", path: "/healthz", statusCode: http.StatusOK, desc: "/healthz is reachable without authorization"},
+			{method: "HEAD", path: "/healthz", statusCode: http.StatusOK, desc: "/healthz accepts HEAD"},
+			{method: "GET", path: "/readyz", statusCode: http.StatusOK, desc: "/readyz is ready when the configurations are loaded"},
+			{method: "GET", path: "/healthz/", statusCode: http.StatusUnauthorized, desc: "the other paths are authorized without redirection"},
+			{method: "GET", path: "/foo/1", statusCode: http.StatusUnauthorized, desc: "the other paths are authorized"},
+		}
+		for _, c := range cases {
+			w := serve(handler, c.method, "api.example.com", c.path, nil)
+			assert.Equal(c.statusCode, w.Code, c.desc)
+		}
+		w := serve(handler, "GET", "unknown.example.com", "/healthz", nil)
+		assert.Equal(http.StatusOK, w.Code, "/healthz does not consult the configurations")
+	})
+
+	t.Run("the configurations are empty or invalid", func(t *testing.T) {
+		for _, rawTokens := range []string{"", "[]", "[{"} {
+			os.Setenv(token.AuthTokens, rawTokens)
+			handler := NewHandler()
+
+			w := serve(handler, "GET", "api.example.com", "/healthz", nil)
+			assert.Equal(http.StatusOK, w.Code, "/healthz is alive when AUTH_TOKENS is %q", rawTokens)
+			w = serve(handler, "GET", "api.example.com", "/readyz", nil)
+			assert.Equal(http.StatusServiceUnavailable, w.Code, "/readyz is not ready when AUTH_TOKENS is %q", rawTokens)
+		}
+	})
+
+	t.Run("HEALTH_PATH and READY_PATH are set", func(t *testing.T) {
+		os.Setenv(token.AuthTokens, validTokens)
+		os.Setenv(HealthPath, "/live")
+		os.Setenv(ReadyPath, "")
+		defer os.Unsetenv(HealthPath)
+		defer os.Unsetenv(ReadyPath)
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/live", nil)
+		assert.Equal(http.StatusOK, w.Code, "the liveness probe is served on HEALTH_PATH")
+		w = serve(handler, "GET", "api.example.com", "/healthz", nil)
+		assert.Equal(http.StatusUnauthorized, w.Code, "/healthz is authorized when HEALTH_PATH is changed")
+		w = serve(handler, "GET", "api.example.com", "/readyz", nil)
+		assert.Equal(http.StatusUnauthorized, w.Code, "the readiness probe is disabled when READY_PATH is empty")
+	})
+}
@@ -0,0 +1,149 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+const hmacReStr = `(?i)^hmac[ \t]+([^:]+):(.+)$`
+
+// hmacSigningString builds the payload signed by the client: the method, the path and
+// the signed headers formatted as "<lowercase name>:<trimmed value>" in the configured order, each followed by "\n".
+func hmacSigningString(request *http.Request, method string, path string, signedHeaders []string) (string, error) {
+	var b bytes.Buffer
+	b.WriteString(method + "\n" + path + "\n")
+	for _, signedHeader := range signedHeaders {
+		var values []string
+		if strings.EqualFold(signedHeader, "host") {
+			values = []string{request.Host}
+		} else {
+			values = request.Header[http.CanonicalHeaderKey(signedHeader)]
+		}
+		if len(values) == 0 || len(values[0]) == 0 {
+			return "", fmt.Errorf("missing signed header: %s", strings.ToLower(signedHeader))
+		}
+		b.WriteString(strings.ToLower(signedHeader) + ":" + strings.TrimSpace(strings.Join(values, ",")) + "\n")
+	}
+	return b.String(), nil
+}
+
+// hmacTimestamp returns the time when the request was signed, from the first signed "x-timestamp" (Unix time in seconds)
+// or "date" header, so that a captured signature cannot be replayed after the clock skew window.
+func hmacTimestamp(request *http.Request, signedHeaders []string) (time.Time, error) {
+	for _, signedHeader := range signedHeaders {
+		value := strings.TrimSpace(request.Header.Get(signedHeader))
+		switch strings.ToLower(signedHeader) {
+		case "x-timestamp":
+			seconds, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid signed timestamp: x-timestamp")
+			}
+			return time.Unix(seconds, 0), nil
+		case "date":
+			date, err := http.ParseTime(value)
+			if err != nil {
+				return time.Time{}, fmt.Errorf("invalid signed timestamp: date")
+			}
+			return date, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("missing signed timestamp: date or x-timestamp")
+}
+
+func signHMAC(secret string, signingString string) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signingString))
+	return mac.Sum(nil)
+}
+
+func verifyHMACSignature(secret string, signingString string, signature string) bool {
+	decoded, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	return hmac.Equal(signHMAC(secret, signingString), decoded)
+}
+
+// authorizeHMAC verifies the signature of the path and its signed timestamp, and matches allowed_paths against the target,
+// which has the query string when match_query of the host is set.
+func (router *Handler) authorizeHMAC(context *gin.Context, keyID string, hmacAuth token.HMACAuth, ok bool, method string, path string, target string, signature string) {
+	if !ok {
+		signatureMismatch(context)
+		return
+	}
+	signingString, err := hmacSigningString(context.Request, method, path, hmacAuth.SignedHeaders)
+	if err != nil {
+		traceStep(context, "hmac signed header missing")
+		signedHeaderMissing(context, err)
+		return
+	}
+	if !verifyHMACSignature(hmacAuth.Secret, signingString, signature) {
+		traceStep(context, "hmac signature mismatch")
+		signatureMismatch(context)
+		return
+	}
+	signedAt, err := hmacTimestamp(context.Request, hmacAuth.SignedHeaders)
+	if err != nil {
+		traceStep(context, "hmac signed timestamp missing")
+		signedHeaderMissing(context, err)
+		return
+	}
+	if skew := router.now().Sub(signedAt); skew > router.hmacMaxClockSkew || skew < -router.hmacMaxClockSkew {
+		traceStep(context, "hmac signature expired, skew %s", skew)
+		signatureExpired(context)
+		return
+	}
+	for _, allowedPath := range hmacAuth.AllowedPaths {
+		if allowedPath.MatchString(target) {
+			traceStep(context, "hmac path allowed by %s", allowedPath.String())
+			router.approve(context, "hmac:"+keyID)
+			return
+		}
+	}
+	traceStep(context, "hmac path not allowed")
+	pathNotAllowed(context)
+}
+
+func signatureMismatch(context *gin.Context) {
+	decide(context, "signature_mismatch")
+	context.Writer.Header().Set("WWW-Authenticate", "HMAC realm=\"signature_required\" error=\"invalid_signature\"")
+	reject(context, http.StatusUnauthorized, gin.H{
+		"authorized": false,
+		"error":      "signature mismatch",
+	})
+}
+
+func signedHeaderMissing(context *gin.Context, err error) {
+	decide(context, "signed_header_missing")
+	context.Writer.Header().Set("WWW-Authenticate", "HMAC realm=\"signature_required\" error=\"invalid_request\"")
+	reject(context, http.StatusUnauthorized, gin.H{
+		"authorized": false,
+		"error":      err.Error(),
+	})
+}
+
+func signatureExpired(context *gin.Context) {
+	decide(context, "signature_expired")
+	context.Writer.Header().Set("WWW-Authenticate", "HMAC realm=\"signature_required\" error=\"invalid_signature\"")
+	reject(context, http.StatusUnauthorized, gin.H{
+		"authorized": false,
+		"error":      "signature expired",
+	})
+}
@@ -0,0 +1,245 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func getHMACAuthHeader(keyID string, secret string, signingString string) string {
+	return "HMAC " + keyID + ":" + base64.StdEncoding.EncodeToString(signHMAC(secret, signingString))
+}
+
+func TestHMACSigningString(t *testing.T) {
+	assert := assert.New(t)
+
+	r := httptest.NewRequest("POST", "/foo/1", nil)
+	r.Host = "api.example.com"
+	r.Header.Set("Date", "Tue, 01 Jan 2019 00:00:00 GMT")
+	r.Header.Set("X-Content-Sha256", " abcdef ")
+
+	cases := []struct {
+		signedHeaders []string
+		expect        string
+		err           string
+	}{
+		{signedHeaders: []string{}, expect: "POST\n/foo/1\n"},
+		{signedHeaders: []string{"Date"}, expect: "POST\n/foo/1\ndate:Tue, 01 Jan 2019 00:00:00 GMT\n"},
+		{signedHeaders: []string{"host", "x-content-sha256", "date"}, expect: "POST\n/foo/1\nhost:api.example.com\nx-content-sha256:abcdef\ndate:Tue, 01 Jan 2019 00:00:00 GMT\n"},
+		{signedHeaders: []string{"date", "X-Missing"}, err: "missing signed header: x-missing"},
+	}
+
+	for _, c := range cases {
+		t.Run(fmt.Sprintf("signedHeaders=%v", c.signedHeaders), func(t *testing.T) {
+			signingString, err := hmacSigningString(r, r.Method, r.URL.Path, c.signedHeaders)
+			if len(c.err) == 0 {
+				assert.Nil(err, "no error")
+				assert.Equal(c.expect, signingString, "the signing string consists of the method, the path and the signed headers")
+			} else {
+				assert.EqualError(err, c.err, "error when a signed header is missing")
+			}
+		})
+	}
+}
+
+func TestNewHandlerHMACAuth(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {},
+				"hmac_auths": [
+					{
+						"key_id": "key1",
+						"secret": "secret1",
+						"signed_headers": ["host", "date", "x-content-sha256"],
+						"allowed_paths": ["^/foo/.*$"]
+					},
+					{
+						"key_id": "key3",
+						"secret": "secret3",
+						"signed_headers": ["x-timestamp"],
+						"allowed_paths": ["^/foo/.*$"]
+					},
+					{
+						"key_id": "key4",
+						"secret": "secret4",
+						"signed_headers": ["host"],
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				]
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+	handler := NewHandler()
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	handler.now = func() time.Time { return now }
+
+	date := "Tue, 01 Jan 2019 00:00:00 GMT"
+	staleDate := "Mon, 31 Dec 2018 23:54:59 GMT"
+	digest := "abcdef"
+	signedAt := func(path string, date string) string {
+		return fmt.Sprintf("POST\n%s\nhost:api.example.com\ndate:%s\nx-content-sha256:%s\n", path, date, digest)
+	}
+	signed := func(path string) string {
+		return signedAt(path, date)
+	}
+	timestamp := func(t time.Time) string {
+		return strconv.FormatInt(t.Unix(), 10)
+	}
+
+	cases := []struct {
+		path       string
+		authHeader string
+		headers    map[string]string
+		statusCode int
+		desc       string
+	}{
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key1", "secret1", signed("/foo/1")),
+			headers:    map[string]string{"Date": date, "X-Content-Sha256": digest},
+			statusCode: http.StatusOK,
+			desc:       "return 200 when the signature is made from the configured signed headers",
+		},
+		{
+			path:       "/bar/1",
+			authHeader: getHMACAuthHeader("key1", "secret1", signed("/bar/1")),
+			headers:    map[string]string{"Date": date, "X-Content-Sha256": digest},
+			statusCode: http.StatusForbidden,
+			desc:       "return 403 when the path is not allowed",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key1", "secret1", fmt.Sprintf("POST\n/foo/1\nhost:api.example.com\ndate:%s\n", date)),
+			headers:    map[string]string{"Date": date, "X-Content-Sha256": digest},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when the client signs a different set of headers",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key1", "secret1", signed("/foo/1")),
+			headers:    map[string]string{"Date": date, "X-Content-Sha256": "altered"},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when a signed header is altered",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key1", "secret1", signed("/foo/1")),
+			headers:    map[string]string{"Date": date},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when a signed header is missing",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key1", "invalid", signed("/foo/1")),
+			headers:    map[string]string{"Date": date, "X-Content-Sha256": digest},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when the secret is wrong",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key2", "secret1", signed("/foo/1")),
+			headers:    map[string]string{"Date": date, "X-Content-Sha256": digest},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when the key id is unknown",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key1", "secret1", signedAt("/foo/1", staleDate)),
+			headers:    map[string]string{"Date": staleDate, "X-Content-Sha256": digest},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when the signed date is older than the clock skew window",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key1", "secret1", signedAt("/foo/1", "Tue, 01 Jan 2019 00:05:01 GMT")),
+			headers:    map[string]string{"Date": "Tue, 01 Jan 2019 00:05:01 GMT", "X-Content-Sha256": digest},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when the signed date is later than the clock skew window",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key3", "secret3", "POST\n/foo/1\nx-timestamp:"+timestamp(now.Add(-time.Minute))+"\n"),
+			headers:    map[string]string{"X-Timestamp": timestamp(now.Add(-time.Minute))},
+			statusCode: http.StatusOK,
+			desc:       "return 200 when the signed x-timestamp is within the clock skew window",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key3", "secret3", "POST\n/foo/1\nx-timestamp:"+timestamp(now.Add(-time.Hour))+"\n"),
+			headers:    map[string]string{"X-Timestamp": timestamp(now.Add(-time.Hour))},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when the signed x-timestamp is outside the clock skew window",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key3", "secret3", "POST\n/foo/1\nx-timestamp:now\n"),
+			headers:    map[string]string{"X-Timestamp": "now"},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when the signed x-timestamp is invalid",
+		},
+		{
+			path:       "/foo/1",
+			authHeader: getHMACAuthHeader("key4", "secret4", "POST\n/foo/1\nhost:api.example.com\n"),
+			headers:    map[string]string{},
+			statusCode: http.StatusUnauthorized,
+			desc:       "return 401 when neither date nor x-timestamp is signed",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.desc, func(t *testing.T) {
+			c.headers["Authorization"] = c.authHeader
+			w := serve(handler, "POST", "api.example.com", c.path, c.headers)
+			assert.Equal(c.statusCode, w.Code, c.desc)
+		})
+	}
+
+	t.Run("missing signed header error", func(t *testing.T) {
+		w := serve(handler, "POST", "api.example.com", "/foo/1", map[string]string{
+			"Authorization": getHMACAuthHeader("key1", "secret1", signed("/foo/1")),
+			"Date":          date,
+		})
+		assert.Contains(w.Body.String(), "missing signed header: x-content-sha256", "the missing header is reported")
+	})
+
+	t.Run("missing signed timestamp error", func(t *testing.T) {
+		w := serve(handler, "POST", "api.example.com", "/foo/1", map[string]string{
+			"Authorization": getHMACAuthHeader("key4", "secret4", "POST\n/foo/1\nhost:api.example.com\n"),
+		})
+		assert.Contains(w.Body.String(), "missing signed timestamp: date or x-timestamp", "the missing timestamp is reported")
+	})
+
+	t.Run("expired signature error", func(t *testing.T) {
+		w := serve(handler, "POST", "api.example.com", "/foo/1", map[string]string{
+			"Authorization":    getHMACAuthHeader("key1", "secret1", signedAt("/foo/1", staleDate)),
+			"Date":             staleDate,
+			"X-Content-Sha256": digest,
+		})
+		assert.Contains(w.Body.String(), "signature expired", "the expired signature is reported")
+	})
+}
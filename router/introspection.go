@@ -0,0 +1,67 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"github.com/gin-gonic/gin"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+// authorizeIntrospection authorizes the request by the bearer tokens checked by the introspection endpoint in the order of the header
+// like authorizeJWT, and the first authorized token wins.
+func (router *Handler) authorizeIntrospection(context *gin.Context, holder *token.Holder, introspectionAuth token.IntrospectionAuth, host string, method string, path string, bearerTokens []string) {
+	active := false
+	var backendErr error
+	if len(bearerTokens) == 0 {
+		traceStep(context, "bearer token missing")
+	}
+	for _, bearerToken := range bearerTokens {
+		claims, err := introspectionAuth.Introspector.Introspect(bearerToken)
+		if err != nil {
+			traceStep(context, "introspection of %s failed: %v", tokenFingerprint(bearerToken), err)
+			if _, ok := err.(*token.BackendError); ok {
+				backendErr = err
+			}
+			continue
+		}
+		active = true
+		subject := introspectionSubject(claims, bearerToken)
+		if pattern, ok := matchJWTPath(introspectionAuth.Paths(claims), path); ok {
+			traceStep(context, "introspected token of %s allowed by %s", subject, pattern)
+			if router.checkLimits(context, method, host+"\tintrospection\t"+subject, introspectionAuth.Limits) {
+				router.approve(context, "introspection:"+subject)
+			}
+			return
+		}
+		traceStep(context, "introspected token of %s path not allowed", subject)
+	}
+	if active {
+		router.warnUnmatched(context, host, path, "path not allowed")
+		pathNotAllowed(context)
+	} else if backendErr != nil {
+		router.backendError(context, host, path, backendErr)
+	} else if holder.IsUnknownTokenForbidden(host) {
+		router.warnUnmatched(context, host, path, "token mismatch")
+		tokenForbidden(context)
+	} else {
+		router.warnUnmatched(context, host, path, "token mismatch")
+		tokenMissmatch(context)
+	}
+}
+
+// introspectionSubject returns "sub" or "username" of the introspection response, both of which are optional in RFC 7662,
+// or the fingerprint of the token not to log the token itself.
+func introspectionSubject(claims token.Claims, bearerToken string) string {
+	if subject := claims.Subject(); len(subject) > 0 {
+		return subject
+	}
+	if username, ok := claims["username"].(string); ok && len(username) > 0 {
+		return username
+	}
+	return tokenFingerprint(bearerToken)
+}
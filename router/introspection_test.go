@@ -0,0 +1,137 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerIntrospection(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.PostFormValue("token") {
+		case "ACTIVE":
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "user1", "scope": "openid read:foo"})
+		case "NOSCOPE":
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "username": "user2", "scope": "openid"})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv(token.AuthTokens, fmt.Sprintf(`[
+		{
+			"host": "introspection\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {},
+				"introspection": {
+					"url": "%s",
+					"client_id": "client1",
+					"client_secret": "secret1",
+					"cache_ttl": "60s",
+					"allowed_paths": ["^/public/.*$"],
+					"claim_paths": {"read:foo": ["^/foo/.*$"]},
+					"allowed_methods": ["GET"]
+				}
+			}
+		}, {
+			"host": "literal\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`, server.URL))
+	handler := NewHandler()
+
+	cases := []struct {
+		method     string
+		host       string
+		path       string
+		token      string
+		statusCode int
+		desc       string
+	}{
+		{method: "GET", host: "introspection.example.com", path: "/public/1", token: "ACTIVE", statusCode: http.StatusOK, desc: "allowed_paths are allowed for an active token"},
+		{method: "GET", host: "introspection.example.com", path: "/foo/1", token: "ACTIVE", statusCode: http.StatusOK, desc: "claim_paths are allowed for the scope of the token"},
+		{method: "GET", host: "introspection.example.com", path: "/public/1", token: "NOSCOPE", statusCode: http.StatusOK, desc: "allowed_paths are allowed without the scope"},
+		{method: "GET", host: "introspection.example.com", path: "/foo/1", token: "NOSCOPE", statusCode: http.StatusForbidden, desc: "claim_paths are not allowed without the scope"},
+		{method: "GET", host: "introspection.example.com", path: "/bar/1", token: "ACTIVE", statusCode: http.StatusForbidden, desc: "the other paths are not allowed"},
+		{method: "POST", host: "introspection.example.com", path: "/foo/1", token: "ACTIVE", statusCode: http.StatusForbidden, desc: "the limitations of introspection are applied"},
+		{method: "GET", host: "introspection.example.com", path: "/foo/1", token: "INACTIVE", statusCode: http.StatusUnauthorized, desc: "an inactive token is rejected"},
+		{method: "GET", host: "introspection.example.com", path: "/foo/1", token: "TOKEN1", statusCode: http.StatusUnauthorized, desc: "the literal tokens are not accepted when introspection is set"},
+		{method: "GET", host: "introspection.example.com", path: "/foo/1", token: "", statusCode: http.StatusUnauthorized, desc: "a request without token is rejected"},
+		{method: "GET", host: "literal.example.com", path: "/foo/1", token: "ACTIVE", statusCode: http.StatusUnauthorized, desc: "the tokens are not introspected when introspection is not set"},
+	}
+	for _, c := range cases {
+		headers := map[string]string{}
+		if len(c.token) > 0 {
+			headers["Authorization"] = "Bearer " + c.token
+		}
+		w := serve(handler, c.method, c.host, c.path, headers)
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestNewHandlerIntrospectionBackendError(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	os.Setenv(token.AuthTokens, fmt.Sprintf(`[
+		{
+			"host": "introspection\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {},
+				"introspection": {
+					"url": "%s",
+					"allowed_paths": ["^/foo/.*$"]
+				}
+			}
+		}
+	]`, server.URL))
+	handler := NewHandler()
+
+	w := serve(handler, "GET", "introspection.example.com", "/foo/1", map[string]string{"Authorization": "Bearer ACTIVE"})
+	assert.Equal(http.StatusServiceUnavailable, w.Code, "fail closed with 503 when the introspection endpoint is not available")
+	w = serve(handler, "GET", "introspection.example.com", "/foo/1", nil)
+	assert.Equal(http.StatusUnauthorized, w.Code, "a request without token is rejected regardless of the endpoint")
+}
@@ -0,0 +1,72 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+// authorizeJWT authorizes the request by the bearer tokens verified as JWTs in the order of the header, and the first authorized token wins.
+// When no token is authorized, 403 is returned if any of them is verified, the response of BACKEND_ERROR_POLICY
+// if any of them is not verified because of the backend, otherwise the token mismatch is returned.
+func (router *Handler) authorizeJWT(context *gin.Context, holder *token.Holder, jwtAuth token.JWTAuth, host string, method string, path string, bearerTokens []string) {
+	verified := false
+	var backendErr error
+	if len(bearerTokens) == 0 {
+		traceStep(context, "bearer token missing")
+	}
+	for _, bearerToken := range bearerTokens {
+		claims, err := jwtAuth.Verifier.Verify(bearerToken)
+		if err != nil {
+			traceStep(context, "jwt %s not verified: %v", tokenFingerprint(bearerToken), err)
+			if _, ok := err.(*token.BackendError); ok {
+				backendErr = err
+			}
+			continue
+		}
+		verified = true
+		subject := claims.Subject()
+		// the paths depend on the claims, so the decisions are not cached unlike the literal tokens
+		if pattern, ok := matchJWTPath(jwtAuth.Paths(claims), path); ok {
+			traceStep(context, "jwt of %s allowed by %s", subject, pattern)
+			if router.checkLimits(context, method, host+"\tjwt\t"+subject, jwtAuth.Limits) {
+				router.approve(context, "jwt:"+subject)
+			}
+			return
+		}
+		traceStep(context, "jwt of %s path not allowed", subject)
+	}
+	if verified {
+		router.warnUnmatched(context, host, path, "path not allowed")
+		pathNotAllowed(context)
+	} else if backendErr != nil {
+		router.backendError(context, host, path, backendErr)
+	} else if holder.IsUnknownTokenForbidden(host) {
+		router.warnUnmatched(context, host, path, "token mismatch")
+		tokenForbidden(context)
+	} else {
+		router.warnUnmatched(context, host, path, "token mismatch")
+		tokenMissmatch(context)
+	}
+}
+
+// matchJWTPath returns the longest (most specific) pattern matching the path like the literal tokens.
+func matchJWTPath(allowedPaths []*regexp.Regexp, path string) (string, bool) {
+	matched := ""
+	allowed := false
+	for _, allowedPath := range allowedPaths {
+		if allowedPath.MatchString(path) && (!allowed || len(matched) < len(allowedPath.String())) {
+			matched = allowedPath.String()
+			allowed = true
+		}
+	}
+	return matched, allowed
+}
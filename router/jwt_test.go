@@ -0,0 +1,276 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func getJWT(key *rsa.PrivateKey, claims map[string]interface{}) string {
+	encode := func(v interface{}) string {
+		b, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(b)
+	}
+	signingInput := encode(map[string]string{"alg": "RS256", "typ": "JWT", "kid": "key1"}) + "." + encode(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestNewHandlerJWT(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer server.Close()
+
+	os.Setenv(token.AuthTokens, fmt.Sprintf(`[
+		{
+			"host": "jwt\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {},
+				"jwt": {
+					"issuer": "https://issuer.example.com/",
+					"jwks_url": "%s",
+					"audience": "api",
+					"allowed_paths": ["^/public/.*$"],
+					"claim_paths": {"read:foo": ["^/foo/.*$"]},
+					"allowed_methods": ["GET"]
+				}
+			}
+		}, {
+			"host": "literal\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`, server.URL))
+	handler := NewHandler()
+
+	claims := func(scope string, exp time.Time) map[string]interface{} {
+		return map[string]interface{}{
+			"iss":   "https://issuer.example.com/",
+			"aud":   "api",
+			"sub":   "user1",
+			"scope": scope,
+			"exp":   exp.Unix(),
+		}
+	}
+	valid := getJWT(key, claims("openid read:foo", time.Now().Add(time.Hour)))
+	noScope := getJWT(key, claims("openid", time.Now().Add(time.Hour)))
+	expired := getJWT(key, claims("openid read:foo", time.Now().Add(-time.Hour)))
+	forged := getJWT(otherKey, claims("openid read:foo", time.Now().Add(time.Hour)))
+
+	cases := []struct {
+		method     string
+		host       string
+		path       string
+		token      string
+		statusCode int
+		desc       string
+	}{
+		{method: "GET", host: "jwt.example.com", path: "/public/1", token: valid, statusCode: http.StatusOK, desc: "allowed_paths are allowed for a verified JWT"},
+		{method: "GET", host: "jwt.example.com", path: "/foo/1", token: valid, statusCode: http.StatusOK, desc: "claim_paths are allowed for the scope of the JWT"},
+		{method: "GET", host: "jwt.example.com", path: "/foo/1", token: noScope, statusCode: http.StatusForbidden, desc: "claim_paths are not allowed without the scope"},
+		{method: "GET", host: "jwt.example.com", path: "/bar/1", token: valid, statusCode: http.StatusForbidden, desc: "the other paths are not allowed"},
+		{method: "POST", host: "jwt.example.com", path: "/foo/1", token: valid, statusCode: http.StatusForbidden, desc: "the limitations of jwt are applied"},
+		{method: "GET", host: "jwt.example.com", path: "/foo/1", token: expired, statusCode: http.StatusUnauthorized, desc: "an expired JWT is rejected"},
+		{method: "GET", host: "jwt.example.com", path: "/foo/1", token: forged, statusCode: http.StatusUnauthorized, desc: "a JWT signed by another key is rejected"},
+		{method: "GET", host: "jwt.example.com", path: "/foo/1", token: "TOKEN1", statusCode: http.StatusUnauthorized, desc: "the literal tokens are not accepted when jwt is set"},
+		{method: "GET", host: "jwt.example.com", path: "/foo/1", token: "", statusCode: http.StatusUnauthorized, desc: "a request without token is rejected"},
+		{method: "GET", host: "literal.example.com", path: "/foo/1", token: "TOKEN1", statusCode: http.StatusOK, desc: "the literal tokens are accepted when jwt is not set"},
+		{method: "GET", host: "literal.example.com", path: "/foo/1", token: valid, statusCode: http.StatusUnauthorized, desc: "JWTs are not accepted when jwt is not set"},
+	}
+	for _, c := range cases {
+		headers := map[string]string{}
+		if len(c.token) > 0 {
+			headers["Authorization"] = "Bearer " + c.token
+		}
+		w := serve(handler, c.method, c.host, c.path, headers)
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
+
+func TestNewHandlerJWTBackendError(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(BackendErrorPolicy)
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	os.Setenv(token.AuthTokens, fmt.Sprintf(`[
+		{
+			"host": "jwt\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {},
+				"jwt": {
+					"issuer": "https://issuer.example.com/",
+					"jwks_url": "%s",
+					"allowed_paths": ["^/foo/.*$"]
+				}
+			}
+		}
+	]`, server.URL))
+	valid := getJWT(key, map[string]interface{}{
+		"iss": "https://issuer.example.com/",
+		"sub": "user1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	cases := []struct {
+		policy     string
+		statusCode int
+		desc       string
+	}{
+		{policy: "", statusCode: http.StatusServiceUnavailable, desc: "fail closed with 503 by default"},
+		{policy: "fail-closed", statusCode: http.StatusServiceUnavailable, desc: "fail closed with 503"},
+		{policy: "fail-open", statusCode: http.StatusOK, desc: "fail open"},
+		{policy: "401", statusCode: http.StatusUnauthorized, desc: "fail closed with the status"},
+		{policy: "200", statusCode: http.StatusServiceUnavailable, desc: "a status which is not an error is ignored"},
+		{policy: "unknown", statusCode: http.StatusServiceUnavailable, desc: "an unknown policy is ignored"},
+	}
+	for _, c := range cases {
+		os.Setenv(BackendErrorPolicy, c.policy)
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "jwt.example.com", "/foo/1", map[string]string{"Authorization": "Bearer " + valid})
+		assert.Equal(c.statusCode, w.Code, c.desc)
+		w = serve(handler, "GET", "jwt.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusUnauthorized, w.Code, "a malformed token is rejected regardless of the backend when "+c.desc)
+		w = serve(handler, "GET", "jwt.example.com", "/foo/1", nil)
+		assert.Equal(http.StatusUnauthorized, w.Code, "a request without token is rejected regardless of the backend when "+c.desc)
+	}
+}
+
+func TestNewHandlerJWTTenants(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	key, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "key1",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	}))
+	defer server.Close()
+
+	// the tenants share the identity provider, and are separated by the issuer and the audience
+	os.Setenv(token.AuthTokens, fmt.Sprintf(`[
+		{
+			"host": "tenant-a\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {},
+				"jwt": {"issuer": "https://idp.example.com/a", "jwks_url": "%[1]s", "audience": "api-a", "allowed_paths": ["^/.*$"]}
+			}
+		}, {
+			"host": "tenant-b\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {},
+				"jwt": {"issuer": "https://idp.example.com/b", "jwks_url": "%[1]s", "audience": "api-b", "allowed_paths": ["^/.*$"]}
+			}
+		}, {
+			"host": "shared\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [],
+				"no_auths": {},
+				"jwt": {"issuer": ["https://idp.example.com/a", "https://idp.example.com/b"], "jwks_url": "%[1]s", "audience": ["api-a", "api-b"], "allowed_paths": ["^/.*$"]}
+			}
+		}
+	]`, server.URL))
+	handler := NewHandler()
+
+	jwt := func(issuer string, audience string) string {
+		return getJWT(key, map[string]interface{}{
+			"iss": issuer,
+			"aud": audience,
+			"sub": "user1",
+			"exp": time.Now().Add(time.Hour).Unix(),
+		})
+	}
+	tokenA := jwt("https://idp.example.com/a", "api-a")
+	tokenB := jwt("https://idp.example.com/b", "api-b")
+	wrongAudience := jwt("https://idp.example.com/a", "api-b")
+
+	cases := []struct {
+		host       string
+		token      string
+		statusCode int
+		desc       string
+	}{
+		{host: "tenant-a.example.com", token: tokenA, statusCode: http.StatusOK, desc: "the token of the tenant is accepted"},
+		{host: "tenant-b.example.com", token: tokenB, statusCode: http.StatusOK, desc: "the token of the other tenant is accepted on its host"},
+		{host: "tenant-b.example.com", token: tokenA, statusCode: http.StatusUnauthorized, desc: "the token of another tenant is rejected by the issuer"},
+		{host: "tenant-a.example.com", token: tokenB, statusCode: http.StatusUnauthorized, desc: "the token of another tenant is rejected by the issuer"},
+		{host: "tenant-a.example.com", token: wrongAudience, statusCode: http.StatusUnauthorized, desc: "the token for another audience is rejected"},
+		{host: "shared.example.com", token: tokenA, statusCode: http.StatusOK, desc: "any of the issuers and the audiences is accepted"},
+		{host: "shared.example.com", token: tokenB, statusCode: http.StatusOK, desc: "any of the issuers and the audiences is accepted"},
+	}
+	for _, c := range cases {
+		w := serve(handler, "GET", c.host, "/foo/1", map[string]string{"Authorization": "Bearer " + c.token})
+		assert.Equal(c.statusCode, w.Code, c.desc)
+	}
+}
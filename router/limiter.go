@@ -0,0 +1,64 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"sync"
+	"time"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const rateLimiterSize = 10240
+
+/*
+rateLimiter : a fixed window rate limiter.
+	The number of tracked windows is bounded, so the least recently used window is evicted when it is full.
+*/
+type rateLimiter struct {
+	mutex   sync.Mutex
+	windows *lru.Cache
+	now     func() time.Time
+}
+
+type rateWindow struct {
+	start time.Time
+	count int
+}
+
+func newRateLimiter(size int) *rateLimiter {
+	windows, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return &rateLimiter{
+		windows: windows,
+		now:     time.Now,
+	}
+}
+
+func (limiter *rateLimiter) take(key string, rateLimit *token.RateLimit) (int, time.Time, bool) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+
+	now := limiter.now()
+	window := rateWindow{start: now, count: 0}
+	if v, ok := limiter.windows.Get(key); ok {
+		if w, _ := v.(rateWindow); now.Before(w.start.Add(rateLimit.Period)) {
+			window = w
+		}
+	}
+	reset := window.start.Add(rateLimit.Period)
+	if window.count >= rateLimit.Requests {
+		return 0, reset, false
+	}
+	window.count++
+	limiter.windows.Add(key, window)
+	return rateLimit.Requests - window.count, reset, true
+}
@@ -0,0 +1,61 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestRateLimiterTake(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter := newRateLimiter(2)
+	limiter.now = func() time.Time { return now }
+	rateLimit := &token.RateLimit{Requests: 3, Period: 10 * time.Second}
+
+	for i := 1; i <= 3; i++ {
+		t.Run(fmt.Sprintf("request %d in the first window", i), func(t *testing.T) {
+			remaining, reset, ok := limiter.take("key1", rateLimit)
+			assert.True(ok, "allow requests within the limit")
+			assert.Equal(3-i, remaining, "remaining decreases")
+			assert.Equal(now.Add(10*time.Second), reset, "reset is the end of the window")
+		})
+	}
+
+	t.Run("request over the limit", func(t *testing.T) {
+		remaining, reset, ok := limiter.take("key1", rateLimit)
+		assert.False(ok, "deny requests over the limit")
+		assert.Equal(0, remaining, "no remaining")
+		assert.Equal(now.Add(10*time.Second), reset, "reset is the end of the window")
+	})
+
+	t.Run("another key", func(t *testing.T) {
+		remaining, _, ok := limiter.take("key2", rateLimit)
+		assert.True(ok, "each key has its own window")
+		assert.Equal(2, remaining, "remaining of another key is independent")
+	})
+
+	t.Run("request in the next window", func(t *testing.T) {
+		now = now.Add(10 * time.Second)
+		remaining, reset, ok := limiter.take("key1", rateLimit)
+		assert.True(ok, "allow requests after the window is reset")
+		assert.Equal(2, remaining, "remaining is reset")
+		assert.Equal(now.Add(10*time.Second), reset, "reset is the end of the new window")
+	})
+
+	t.Run("bounded windows", func(t *testing.T) {
+		limiter.take("key3", rateLimit)
+		assert.Equal(2, limiter.windows.Len(), "the number of windows is bounded")
+	})
+}
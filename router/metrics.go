@@ -0,0 +1,115 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+/*
+MetricsPath : METRICS_PATH is an environment variable name to set the path of the Prometheus metrics (default "/metrics").
+	The metrics are disabled when it is set but empty.
+*/
+const MetricsPath = "METRICS_PATH"
+
+const defaultMetricsPath = "/metrics"
+const decisionReasonKey = "decisionReason"
+const otherReason = "other"
+
+// decisionMetrics holds the metrics of the decisions. Each Handler has its own registry,
+// so that creating several Handlers never registers the same metrics twice.
+type decisionMetrics struct {
+	registry  *prometheus.Registry
+	decisions *prometheus.CounterVec
+	latency   prometheus.Histogram
+}
+
+func newDecisionMetrics() *decisionMetrics {
+	metrics := &decisionMetrics{
+		registry: prometheus.NewRegistry(),
+		decisions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ambassador_auth_decisions_total",
+			Help: "The number of the authorization decisions by the result and the reason.",
+		}, []string{"result", "reason"}),
+		latency: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "ambassador_auth_decision_duration_seconds",
+			Help:    "The latency of the authorization decisions in seconds.",
+			Buckets: prometheus.ExponentialBuckets(0.0001, 4, 8),
+		}),
+	}
+	metrics.registry.MustRegister(metrics.decisions, metrics.latency)
+	return metrics
+}
+
+// registerMetrics serves the metrics without authentication before NoRoute.
+func (router *Handler) registerMetrics(engine *gin.Engine) {
+	if metricsPath := getProbePath(MetricsPath, defaultMetricsPath); len(metricsPath) > 0 {
+		engine.GET(metricsPath, gin.WrapH(promhttp.HandlerFor(router.metrics.registry, promhttp.HandlerOpts{})))
+	}
+}
+
+// recordDecisions counts the decisions of NoRoute by the result and the reason set by decide.
+// The other routes like the probes and the dry runs of the admin API are not counted.
+func recordDecisions(metrics *decisionMetrics) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		reason, ok := c.Get(decisionReasonKey)
+		if !ok {
+			return
+		}
+		reasonLabel, _ := reason.(string)
+		if len(reasonLabel) == 0 {
+			reasonLabel = otherReason
+		}
+		// each decision is logged only for debugging, so that the other levels stay quiet on every request
+		if logging.Enabled(logging.LevelDebug) {
+			method, path := requested(c)
+			logging.Debug("auth decision", "host", c.Request.Host, "method", method, "path", path,
+				"status", c.Writer.Status(), "result", decisionResult(c), "reason", reasonLabel)
+		}
+		if isDryRun(c.Request) {
+			return
+		}
+		metrics.decisions.WithLabelValues(decisionResult(c), reasonLabel).Inc()
+		metrics.latency.Observe(time.Since(start).Seconds())
+	}
+}
+
+// decide records the reason of the decision. The last reason wins, like a rejection after the match of no_auths.
+func decide(context *gin.Context, reason string) {
+	context.Set(decisionReasonKey, reason)
+}
+
+func decisionResult(c *gin.Context) string {
+	if len(c.Writer.Header().Get(softDenyHeader)) > 0 {
+		return "soft_denied"
+	}
+	switch status := c.Writer.Status(); {
+	case status == http.StatusOK:
+		return "ok"
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusForbidden:
+		return "forbidden"
+	case status == http.StatusBadRequest:
+		return "bad_request"
+	case status == http.StatusRequestEntityTooLarge:
+		return "too_large"
+	case status == http.StatusTooManyRequests:
+		return "too_many_requests"
+	default:
+		return "error"
+	}
+}
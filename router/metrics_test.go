@@ -0,0 +1,167 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerMetrics(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(MetricsPath)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`)
+
+	t.Run("the decisions are counted", func(t *testing.T) {
+		handler := NewHandler()
+		token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+
+		w := serve(handler, "GET", "api.example.com", "/metrics", nil)
+		assert.Equal(http.StatusOK, w.Code, "/metrics is reachable without authorization")
+		assert.NotContains(w.Body.String(), `ambassador_auth_decisions_total{`, "no decision is counted before the requests")
+
+		serve(handler, "GET", "api.example.com", "/foo/1", token1)
+		serve(handler, "GET", "api.example.com", "/foo/2", token1)
+		serve(handler, "GET", "api.example.com", "/static/app.js", nil)
+		serve(handler, "GET", "api.example.com", "/foo/1", nil)
+		serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer INVALID"})
+		serve(handler, "GET", "api.example.com", "/bar/1", token1)
+		serve(handler, "GET", "unknown.example.com", "/foo/1", token1)
+		serve(handler, "GET", "api.example.com", "/healthz", nil)
+
+		w = serve(handler, "GET", "unknown.example.com", "/metrics", nil)
+		assert.Equal(http.StatusOK, w.Code, "/metrics does not consult the configurations")
+		body := w.Body.String()
+		cases := []struct {
+			metric string
+			desc   string
+		}{
+			{metric: `ambassador_auth_decisions_total{reason="credential",result="ok"} 2`, desc: "the approvals by credentials"},
+			{metric: `ambassador_auth_decisions_total{reason="no_auth",result="ok"} 1`, desc: "the approvals by no_auths"},
+			{metric: `ambassador_auth_decisions_total{reason="no_header",result="unauthorized"} 1`, desc: "the missing header"},
+			{metric: `ambassador_auth_decisions_total{reason="token_mismatch",result="unauthorized"} 1`, desc: "the token mismatch"},
+			{metric: `ambassador_auth_decisions_total{reason="path_not_allowed",result="forbidden"} 1`, desc: "the path not allowed"},
+			{metric: `ambassador_auth_decisions_total{reason="domain_not_allowed",result="forbidden"} 1`, desc: "the domain not allowed"},
+			{metric: `ambassador_auth_decision_duration_seconds_count 7`, desc: "the latency of the decisions, without the probes and the metrics"},
+		}
+		for _, c := range cases {
+			assert.Contains(body, c.metric, c.desc)
+		}
+	})
+
+	t.Run("METRICS_PATH is empty", func(t *testing.T) {
+		os.Setenv(MetricsPath, "")
+		handler := NewHandler()
+
+		w := serve(handler, "GET", "api.example.com", "/metrics", nil)
+		assert.Equal(http.StatusUnauthorized, w.Code, "/metrics is authorized when METRICS_PATH is empty")
+	})
+}
+
+func TestNewHandlerDecisionLogs(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer logging.Configure()
+	defer os.Unsetenv(logging.LogFormat)
+	defer os.Unsetenv(logging.LogLevel)
+
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(os.Stderr)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+	os.Setenv(logging.LogFormat, "json")
+	token1 := map[string]string{"Authorization": "Bearer TOKEN1"}
+
+	decisions := func() []map[string]interface{} {
+		logs := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			var fields map[string]interface{}
+			if json.Unmarshal([]byte(line), &fields) == nil && fields["msg"] == "auth decision" {
+				logs = append(logs, fields)
+			}
+		}
+		return logs
+	}
+
+	t.Run("LOG_LEVEL=debug", func(t *testing.T) {
+		os.Setenv(logging.LogLevel, "debug")
+		logging.Configure()
+		handler := NewHandler()
+		buf.Reset()
+
+		serve(handler, "POST", "api.example.com", "/bar/1", token1)
+		serve(handler, "GET", "api.example.com", "/foo/1", token1)
+		logs := decisions()
+		if assert.Len(logs, 2, "each decision is logged") {
+			assert.Equal("debug", logs[0]["level"], "the decision is logged at debug level")
+			assert.Equal("api.example.com", logs[0]["host"], "the host is logged")
+			assert.Equal("POST", logs[0]["method"], "the method is logged")
+			assert.Equal("/bar/1", logs[0]["path"], "the path is logged")
+			assert.Equal(float64(http.StatusForbidden), logs[0]["status"], "the status is logged")
+			assert.Equal("forbidden", logs[0]["result"], "the result is logged")
+			assert.Equal("path_not_allowed", logs[0]["reason"], "the reason is logged")
+			assert.Equal("ok", logs[1]["result"], "the approval is logged as well")
+		}
+		assert.NotContains(buf.String(), "TOKEN1", "the token is never logged")
+	})
+
+	t.Run("LOG_LEVEL=info", func(t *testing.T) {
+		os.Setenv(logging.LogLevel, "info")
+		logging.Configure()
+		handler := NewHandler()
+		buf.Reset()
+
+		serve(handler, "POST", "api.example.com", "/bar/1", token1)
+		serve(handler, "GET", "api.example.com", "/foo/1", token1)
+		assert.Empty(decisions(), "the decisions are not logged")
+	})
+}
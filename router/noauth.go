@@ -0,0 +1,92 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+/*
+NoAuthVerifyCredentials : NO_AUTH_VERIFY_CREDENTIALS is an environment variable name to verify the Authorization header given to the paths of no_auths.
+	The requests without the header are still allowed, but those with a malformed or invalid credential are rejected with 401.
+*/
+const NoAuthVerifyCredentials = "NO_AUTH_VERIFY_CREDENTIALS"
+
+func getNoAuthVerifyCredentials() bool {
+	verify, err := strconv.ParseBool(os.Getenv(NoAuthVerifyCredentials))
+	return err == nil && verify
+}
+
+// verifyCredential checks that the Authorization header has a credential of the host regardless of the path,
+// because the path of no_auths is allowed for everyone and only the credential itself is in question.
+func (router *Handler) verifyCredential(holder *token.Holder, host string, domain string, authHeader string, tokenRe *regexp.Regexp, basicRe *regexp.Regexp, basicUserRe *regexp.Regexp, hmacRe *regexp.Regexp) bool {
+	if matches := basicRe.FindStringSubmatch(authHeader); len(matches) > 0 {
+		username, password, ok := router.decodeBasicCredential(matches[1], basicUserRe)
+		if !ok {
+			return false
+		}
+		basicCredentials, _ := router.credentials.LookupBasic(host, username)
+		for _, basicCredential := range basicCredentials {
+			if allowBasicCredential(basicCredential, domain, password) {
+				return true
+			}
+		}
+		return false
+	}
+	if matches := hmacRe.FindStringSubmatch(authHeader); len(matches) > 0 {
+		// the signature covers the request, which is verified only when the key is used to authorize it
+		_, ok := holder.GetHMACAuth(host, matches[1])
+		return ok
+	}
+	matches := tokenRe.FindStringSubmatch(authHeader)
+	if len(matches) == 0 {
+		return false
+	}
+	bearerTokens := splitBearerTokens(matches[1])
+	if len(bearerTokens) > maxBearerTokens {
+		return false
+	}
+	jwtAuth, isJWT := holder.GetJWTAuth(host)
+	introspectionAuth, isIntrospection := holder.GetIntrospectionAuth(host)
+	for _, bearerToken := range bearerTokens {
+		if isJWT {
+			_, err := jwtAuth.Verifier.Verify(bearerToken)
+			// the anonymous path is not blocked by the outage of the backend
+			if _, backendErr := err.(*token.BackendError); err == nil || backendErr {
+				return true
+			}
+			continue
+		}
+		if isIntrospection {
+			_, err := introspectionAuth.Introspector.Introspect(bearerToken)
+			if _, backendErr := err.(*token.BackendError); err == nil || backendErr {
+				return true
+			}
+			continue
+		}
+		if bearerCredential, ok := router.credentials.LookupBearer(host, bearerToken); ok && allowExactHost(domain, bearerCredential.ExactHost) {
+			return true
+		}
+	}
+	return false
+}
+
+func invalidCredential(context *gin.Context) {
+	decide(context, "invalid_credential")
+	context.Writer.Header().Set("WWW-Authenticate", "Bearer realm="+realm(context, defaultBearerRealm)+" error=\"invalid_token\"")
+	reject(context, http.StatusUnauthorized, gin.H{
+		"authorized": false,
+		"error":      "invalid credential",
+	})
+}
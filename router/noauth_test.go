@@ -0,0 +1,79 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerNoAuthVerifyCredentials(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(NoAuthVerifyCredentials)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+				"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["^/piyo/.*$"]}],
+				"hmac_auths": [{"key_id": "key1", "secret": "secret1", "allowed_paths": ["^/hmac/.*$"]}],
+				"no_auths": {"allowed_paths": ["^/static/.*$"]}
+			}
+		}
+	]`)
+
+	cases := []struct {
+		authHeader string
+		statusCode int
+		desc       string
+	}{
+		{authHeader: "", statusCode: http.StatusOK, desc: "the request without credential is allowed"},
+		{authHeader: "Bearer TOKEN1", statusCode: http.StatusOK, desc: "the valid bearer token is allowed even if its paths do not match"},
+		{authHeader: getBasicAuthHeader("user1", "password1"), statusCode: http.StatusOK, desc: "the valid basic credential is allowed even if its paths do not match"},
+		{authHeader: "HMAC key1:signature", statusCode: http.StatusOK, desc: "the known HMAC key is allowed"},
+		{authHeader: "Bearer INVALID", statusCode: http.StatusUnauthorized, desc: "the unknown bearer token is refused"},
+		{authHeader: "Bearer TOKEN1, INVALID", statusCode: http.StatusOK, desc: "any valid bearer token of the header is enough"},
+		{authHeader: getBasicAuthHeader("user1", "invalid"), statusCode: http.StatusUnauthorized, desc: "the wrong password is refused"},
+		{authHeader: "Basic invalid", statusCode: http.StatusUnauthorized, desc: "the malformed basic credential is refused"},
+		{authHeader: "HMAC unknown:signature", statusCode: http.StatusUnauthorized, desc: "the unknown HMAC key is refused"},
+		{authHeader: "Unknown TOKEN1", statusCode: http.StatusUnauthorized, desc: "the unknown scheme is refused"},
+	}
+
+	t.Run("without NO_AUTH_VERIFY_CREDENTIALS", func(t *testing.T) {
+		os.Unsetenv(NoAuthVerifyCredentials)
+		handler := NewHandler()
+		for _, c := range cases {
+			w := serve(handler, "GET", "api.example.com", "/static/1", map[string]string{"Authorization": c.authHeader})
+			assert.Equal(http.StatusOK, w.Code, "any credential is ignored by default: %s", c.authHeader)
+		}
+	})
+
+	t.Run("with NO_AUTH_VERIFY_CREDENTIALS", func(t *testing.T) {
+		os.Setenv(NoAuthVerifyCredentials, "true")
+		handler := NewHandler()
+		for _, c := range cases {
+			w := serve(handler, "GET", "api.example.com", "/static/1", map[string]string{"Authorization": c.authHeader})
+			assert.Equal(c.statusCode, w.Code, c.desc)
+			if c.statusCode == http.StatusUnauthorized {
+				assert.JSONEq(`{"authorized": false, "error": "invalid credential"}`, w.Body.String(), c.desc)
+			}
+		}
+
+		w := serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer INVALID"})
+		assert.Equal(http.StatusUnauthorized, w.Code, "the other paths are not changed")
+		assert.JSONEq(`{"authorized": false, "error": "token mismatch"}`, w.Body.String(), "the other paths are not changed")
+	})
+}
@@ -0,0 +1,48 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+/*
+AuthRealm : AUTH_REALM is an environment variable name to set the realm of the WWW-Authenticate headers of bearer tokens and basic authentication.
+	"realm" in the settings of a host wins over it.
+*/
+const AuthRealm = "AUTH_REALM"
+
+const defaultBearerRealm = "token_required"
+const defaultBasicRealm = "basic authentication required"
+const realmKey = "realm"
+
+// setRealm keeps the realm of the host for the rejections, and nothing is kept when neither the host nor AUTH_REALM gives it.
+func (router *Handler) setRealm(context *gin.Context, holder *token.Holder, host string) {
+	if hostRealm, ok := holder.GetRealm(host); ok {
+		context.Set(realmKey, hostRealm)
+	} else if len(router.realm) > 0 {
+		context.Set(realmKey, router.realm)
+	}
+}
+
+// realm returns the quoted realm of the request, or the default realm of the scheme which has been used before the realm is configurable.
+func realm(context *gin.Context, defaultRealm string) string {
+	value := context.GetString(realmKey)
+	if len(value) == 0 {
+		value = defaultRealm
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(value) + `"`
+}
+
+func getAuthRealm() string {
+	return strings.TrimSpace(os.Getenv(AuthRealm))
+}
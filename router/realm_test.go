@@ -0,0 +1,100 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerRealm(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(AuthRealm)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {}
+			}
+		}, {
+			"host": "team\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {},
+				"realm": "team \"a\""
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	cases := []struct {
+		authRealm string
+		host      string
+		path      string
+		headers   map[string]string
+		expected  string
+		desc      string
+	}{
+		{authRealm: "", host: "api.example.com", path: "/foo/1", headers: map[string]string{},
+			expected: `Bearer realm="token_required"`, desc: "the default realm of bearer tokens is kept"},
+		{authRealm: "", host: "api.example.com", path: "/foo/1", headers: map[string]string{"Authorization": "Bearer UNKNOWN"},
+			expected: `Bearer realm="token_required" error="invalid_token"`, desc: "the default realm of the invalid token is kept"},
+		{authRealm: "", host: "api.example.com", path: "/piyo/1", headers: map[string]string{},
+			expected: `Basic realm="basic authentication required"`, desc: "the default realm of basic authentication is kept"},
+		{authRealm: "example", host: "api.example.com", path: "/foo/1", headers: map[string]string{},
+			expected: `Bearer realm="example"`, desc: "AUTH_REALM is the realm of bearer tokens"},
+		{authRealm: "example", host: "api.example.com", path: "/bar/1", headers: map[string]string{"Authorization": "Bearer TOKEN1"},
+			expected: `Bearer realm="example" error="not_allowed"`, desc: "AUTH_REALM is the realm of the path not allowed"},
+		{authRealm: "example", host: "api.example.com", path: "/piyo/1", headers: map[string]string{},
+			expected: `Basic realm="example"`, desc: "AUTH_REALM is the realm of basic authentication"},
+		{authRealm: "example", host: "team.example.com", path: "/foo/1", headers: map[string]string{},
+			expected: `Bearer realm="team \"a\""`, desc: "the realm of the host wins over AUTH_REALM, and it is quoted"},
+		{authRealm: "", host: "team.example.com", path: "/piyo/1", headers: map[string]string{},
+			expected: `Basic realm="team \"a\""`, desc: "the realm of the host is the realm of basic authentication"},
+	}
+	for _, c := range cases {
+		os.Setenv(AuthRealm, c.authRealm)
+		handler := NewHandler()
+		w := serve(handler, "GET", c.host, c.path, c.headers)
+		assert.Contains([]int{http.StatusUnauthorized, http.StatusForbidden}, w.Code, c.desc)
+		assert.Equal(c.expected, w.Header().Get("WWW-Authenticate"), c.desc)
+	}
+}
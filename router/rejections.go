@@ -0,0 +1,142 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+RejectionStats : REJECTION_STATS is an environment variable name to count the rejected requests by client IP.
+	The counts are served by "GET /rejections" of the admin API.
+*/
+const RejectionStats = "REJECTION_STATS"
+
+/*
+RejectionStatsPeriod : REJECTION_STATS_PERIOD is an environment variable name to set the period to reset the counts of the rejected requests.
+*/
+const RejectionStatsPeriod = "REJECTION_STATS_PERIOD"
+
+const defaultRejectionStatsPeriod = time.Hour
+const rejectionStatsSize = 10240
+const defaultRejectionTop = 10
+
+/*
+rejectionTracker : counts the rejected requests by client IP.
+	The number of tracked IPs is bounded not to grow under spoofed IPs, so the rejections from new IPs are counted as untracked when it is full.
+*/
+type rejectionTracker struct {
+	mutex     sync.Mutex
+	counts    map[string]int
+	untracked int
+	size      int
+	start     time.Time
+	period    time.Duration
+	now       func() time.Time
+}
+
+type rejectionCount struct {
+	ClientIP string `json:"client_ip"`
+	Count    int    `json:"count"`
+}
+
+func newRejectionTracker(size int, period time.Duration) *rejectionTracker {
+	return &rejectionTracker{
+		counts: map[string]int{},
+		size:   size,
+		period: period,
+		now:    time.Now,
+	}
+}
+
+func getRejectionTracker() *rejectionTracker {
+	rejectionStats, err := strconv.ParseBool(os.Getenv(RejectionStats))
+	if err != nil || !rejectionStats {
+		return nil
+	}
+	return newRejectionTracker(rejectionStatsSize, getTimeout(RejectionStatsPeriod, defaultRejectionStatsPeriod))
+}
+
+// resetIfExpired starts a new period. The caller must hold the mutex.
+func (tracker *rejectionTracker) resetIfExpired() {
+	now := tracker.now()
+	if tracker.start.IsZero() || !now.Before(tracker.start.Add(tracker.period)) {
+		tracker.counts = map[string]int{}
+		tracker.untracked = 0
+		tracker.start = now
+	}
+}
+
+func (tracker *rejectionTracker) add(clientIP string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.resetIfExpired()
+	if _, ok := tracker.counts[clientIP]; ok || len(tracker.counts) < tracker.size {
+		tracker.counts[clientIP]++
+	} else {
+		tracker.untracked++
+	}
+}
+
+// top returns the client IPs which have the most rejections in the current period, the untracked count and the start of the period.
+func (tracker *rejectionTracker) top(n int) ([]rejectionCount, int, time.Time) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.resetIfExpired()
+	counts := make([]rejectionCount, 0, len(tracker.counts))
+	for clientIP, count := range tracker.counts {
+		counts = append(counts, rejectionCount{ClientIP: clientIP, Count: count})
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].ClientIP < counts[j].ClientIP
+	})
+	if n < len(counts) {
+		counts = counts[:n]
+	}
+	return counts, tracker.untracked, tracker.start
+}
+
+// trackRejections counts the responses which are not authorized, including the soft denied ones,
+// by the client IP trusted in the same way as ip_rules, so that a client can not blame the other IPs by forging the headers.
+func trackRejections(tracker *rejectionTracker, trustedProxies []*net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+		if tracker == nil || isDryRun(c.Request) {
+			return
+		}
+		if c.Writer.Status() != http.StatusOK || len(c.Writer.Header().Get(softDenyHeader)) > 0 {
+			tracker.add(trustedClientIP(c.Request, trustedProxies))
+		}
+	}
+}
+
+func (router *Handler) rejections(context *gin.Context) {
+	n, err := strconv.Atoi(context.DefaultQuery("top", strconv.Itoa(defaultRejectionTop)))
+	if err != nil || n < 1 {
+		context.JSON(http.StatusBadRequest, gin.H{"error": "top must be a positive integer"})
+		return
+	}
+	counts, untracked, start := router.rejectionTracker.top(n)
+	context.JSON(http.StatusOK, gin.H{
+		"since":      start.UTC().Format(time.RFC3339),
+		"untracked":  untracked,
+		"rejections": counts,
+	})
+}
@@ -0,0 +1,149 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestRejectionTracker(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	tracker := newRejectionTracker(2, time.Hour)
+	tracker.now = func() time.Time { return now }
+
+	t.Run("count by client IP", func(t *testing.T) {
+		tracker.add("192.0.2.1")
+		tracker.add("192.0.2.2")
+		tracker.add("192.0.2.2")
+		counts, untracked, start := tracker.top(10)
+		assert.Equal([]rejectionCount{{ClientIP: "192.0.2.2", Count: 2}, {ClientIP: "192.0.2.1", Count: 1}}, counts, "the most rejected IP comes first")
+		assert.Equal(0, untracked, "no untracked rejections")
+		assert.Equal(now, start, "the period starts at the first rejection")
+
+		counts, _, _ = tracker.top(1)
+		assert.Equal([]rejectionCount{{ClientIP: "192.0.2.2", Count: 2}}, counts, "only the top N are returned")
+	})
+
+	t.Run("bounded IPs", func(t *testing.T) {
+		tracker.add("192.0.2.3")
+		tracker.add("192.0.2.1")
+		counts, untracked, _ := tracker.top(10)
+		assert.Len(counts, 2, "the number of tracked IPs is bounded")
+		assert.Equal(1, untracked, "the rejections from new IPs are untracked when it is full")
+		assert.Equal([]rejectionCount{{ClientIP: "192.0.2.1", Count: 2}, {ClientIP: "192.0.2.2", Count: 2}}, counts,
+			"the tracked IPs are still counted, and the ties are ordered by IP")
+	})
+
+	t.Run("reset after the period", func(t *testing.T) {
+		now = now.Add(time.Hour)
+		counts, untracked, start := tracker.top(10)
+		assert.Len(counts, 0, "the counts are reset")
+		assert.Equal(0, untracked, "the untracked count is reset")
+		assert.Equal(now, start, "a new period starts")
+	})
+}
+
+func TestNewHandlerRejectionStats(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(RejectionStats)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+
+	serveFrom := func(handler *Handler, clientIP string, authorization string) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/foo/1", nil)
+		r.Host = "api.example.com"
+		r.RemoteAddr = clientIP + ":12345"
+		r.Header.Set("Authorization", authorization)
+		handler.Engine.ServeHTTP(w, r)
+	}
+	getRejections := func(handler *Handler, query string) (*httptest.ResponseRecorder, map[string]interface{}) {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/rejections"+query, nil)
+		handler.Admin.ServeHTTP(w, r)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		return w, response
+	}
+
+	t.Run("without REJECTION_STATS", func(t *testing.T) {
+		os.Unsetenv(RejectionStats)
+		handler := NewHandler()
+		w, _ := getRejections(handler, "")
+		assert.Equal(http.StatusNotFound, w.Code, "GET /rejections is not served by default")
+	})
+
+	t.Run("with REJECTION_STATS", func(t *testing.T) {
+		os.Setenv(RejectionStats, "true")
+		handler := NewHandler()
+
+		for i := 0; i < 3; i++ {
+			serveFrom(handler, "192.0.2.1", "Bearer INVALID")
+		}
+		serveFrom(handler, "192.0.2.2", "Bearer INVALID")
+		for i := 0; i < 2; i++ {
+			serveFrom(handler, "192.0.2.3", "")
+		}
+		serveFrom(handler, "192.0.2.4", "Bearer TOKEN1")
+
+		w, response := getRejections(handler, "?top=2")
+		assert.Equal(http.StatusOK, w.Code, "GET /rejections returns 200")
+		assert.Equal([]interface{}{
+			map[string]interface{}{"client_ip": "192.0.2.1", "count": float64(3)},
+			map[string]interface{}{"client_ip": "192.0.2.3", "count": float64(2)},
+		}, response["rejections"], "the top N client IPs are returned")
+		assert.Equal(float64(0), response["untracked"], "no untracked rejections")
+
+		_, response = getRejections(handler, "")
+		rejections, _ := response["rejections"].([]interface{})
+		assert.Len(rejections, 3, "the authorized requests are not counted")
+
+		w, _ = getRejections(handler, "?top=abc")
+		assert.Equal(http.StatusBadRequest, w.Code, "return 400 when top is invalid")
+
+		for i := 0; i < 4; i++ {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/foo/1", nil)
+			r.Host = "api.example.com"
+			r.RemoteAddr = "192.0.2.5:12345"
+			r.Header.Set("X-Forwarded-For", "192.0.2.2")
+			handler.Engine.ServeHTTP(w, r)
+		}
+		_, response = getRejections(handler, "?top=1")
+		assert.Equal([]interface{}{
+			map[string]interface{}{"client_ip": "192.0.2.5", "count": float64(4)},
+		}, response["rejections"], "the forged X-Forwarded-For of an untrusted client is not counted")
+	})
+}
@@ -0,0 +1,89 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"os"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+/*
+RuleStats : RULE_STATS is an environment variable name to count the hits of each rule on the metrics endpoint.
+	The rules are identified by the host and the label, so that the tokens and the passwords are never exposed.
+*/
+const RuleStats = "RULE_STATS"
+
+// ruleHits counts the bearer tokens, the basic auth users and the patterns of no_auths matching the requests.
+// The labels are limited to the rules of the configurations, so that the requests never add the series.
+type ruleHits struct {
+	hits *prometheus.CounterVec
+}
+
+func getRuleStats() bool {
+	ruleStats, err := strconv.ParseBool(os.Getenv(RuleStats))
+	return err == nil && ruleStats
+}
+
+// newRuleHits registers the counters on the registry of the metrics, or returns nil when RULE_STATS is not set.
+func newRuleHits(metrics *decisionMetrics, holder *token.Holder) *ruleHits {
+	if !getRuleStats() {
+		return nil
+	}
+	ruleHits := &ruleHits{
+		hits: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "ambassador_auth_rule_hits_total",
+			Help: "The number of the requests matching each rule by the host and the label of the rule.",
+		}, []string{"host", "rule"}),
+	}
+	metrics.registry.MustRegister(ruleHits.hits)
+	ruleHits.initialize(holder)
+	// the removed rules must not remain, and the labels of the indices may point to other rules after a reload
+	holder.OnReload(func() {
+		ruleHits.hits.Reset()
+		ruleHits.initialize(holder)
+	})
+	return ruleHits
+}
+
+// initialize exposes the rules never matched as zero, so that the unused rules can be found.
+func (ruleHits *ruleHits) initialize(holder *token.Holder) {
+	for _, host := range holder.GetHosts() {
+		for _, label := range holder.GetRuleLabels(host) {
+			ruleHits.hits.WithLabelValues(host, label)
+		}
+	}
+}
+
+// hitRule counts the rule of the label. The dry runs of the admin API and the rules without label are not counted.
+func (router *Handler) hitRule(context *gin.Context, host string, label string) {
+	if router.ruleHits == nil || len(label) == 0 || isDryRun(context.Request) {
+		return
+	}
+	router.ruleHits.hits.WithLabelValues(host, label).Inc()
+}
+
+// hitNoAuthRule counts the first pattern of no_auths matching the target like matchNoAuthPath.
+func (router *Handler) hitNoAuthRule(context *gin.Context, holder *token.Holder, host string, method string, target string) {
+	if router.ruleHits == nil {
+		return
+	}
+	noAuthPathMethods := holder.GetNoAuthPathMethods(host)
+	for _, noAuthPath := range holder.GetNoAuthPaths(host) {
+		if methods, ok := noAuthPathMethods[noAuthPath]; ok && !containsMethod(methods, method) {
+			continue
+		}
+		if noAuthPath.MatchString(target) {
+			router.hitRule(context, host, holder.GetNoAuthLabels(host)[noAuthPath])
+			return
+		}
+	}
+}
@@ -0,0 +1,96 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/base64"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerRuleStats(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(RuleStats)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"],
+						"label": "mobile-app"
+					}, {
+						"token": "TOKEN2",
+						"allowed_paths": ["^/bar/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$", "^/public/.*$"]
+				}
+			}
+		}
+	]`)
+	host := `api\\.example\\.com`
+
+	t.Run("the rules are not counted by default", func(t *testing.T) {
+		os.Unsetenv(RuleStats)
+		handler := NewHandler()
+		serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+
+		w := serve(handler, "GET", "api.example.com", "/metrics", nil)
+		assert.NotContains(w.Body.String(), "ambassador_auth_rule_hits_total", "the rule hits are not exposed without RULE_STATS")
+	})
+
+	t.Run("the hits of each rule are counted", func(t *testing.T) {
+		os.Setenv(RuleStats, "true")
+		handler := NewHandler()
+		basic := "Basic " + base64.StdEncoding.EncodeToString([]byte("user1:password1"))
+
+		serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		serve(handler, "GET", "api.example.com", "/foo/2", map[string]string{"Authorization": "Bearer TOKEN1"})
+		serve(handler, "GET", "api.example.com", "/piyo/1", map[string]string{"Authorization": basic})
+		serve(handler, "GET", "api.example.com", "/static/app.js", nil)
+		serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer INVALID"})
+		serve(handler, "GET", "api.example.com", "/baz/1", map[string]string{"Authorization": "Bearer TOKEN2"})
+
+		w := serve(handler, "GET", "api.example.com", "/metrics", nil)
+		assert.Equal(http.StatusOK, w.Code, "/metrics is reachable without authorization")
+		body := w.Body.String()
+		cases := []struct {
+			metric string
+			desc   string
+		}{
+			{metric: `ambassador_auth_rule_hits_total{host="` + host + `",rule="mobile-app"} 2`, desc: "the bearer token is counted by its label"},
+			{metric: `ambassador_auth_rule_hits_total{host="` + host + `",rule="bearer_tokens[1]"} 0`, desc: "the bearer token whose path is not allowed stays zero"},
+			{metric: `ambassador_auth_rule_hits_total{host="` + host + `",rule="basic_auths[0]"} 1`, desc: "the basic auth user is counted by its index"},
+			{metric: `ambassador_auth_rule_hits_total{host="` + host + `",rule="no_auths.allowed_paths[0]"} 1`, desc: "the pattern of no_auths is counted by its index"},
+			{metric: `ambassador_auth_rule_hits_total{host="` + host + `",rule="no_auths.allowed_paths[1]"} 0`, desc: "the unused pattern of no_auths stays zero"},
+		}
+		for _, c := range cases {
+			assert.Contains(body, c.metric, c.desc)
+		}
+		assert.NotContains(body, "TOKEN1", "the tokens are never exposed")
+		assert.NotContains(body, "password1", "the passwords are never exposed")
+	})
+}
@@ -0,0 +1,74 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"time"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+const credentialCacheSize = 10240
+
+// cachedStore caches the lookups of a CredentialStore for ttl to bound the load of its backend.
+// Not found results are also cached, so that unknown credentials do not reach the backend on every request.
+type cachedStore struct {
+	store   token.CredentialStore
+	ttl     time.Duration
+	entries *lru.Cache
+	now     func() time.Time
+}
+
+type credentialEntry struct {
+	credential interface{}
+	found      bool
+	expires    time.Time
+}
+
+func newCachedStore(store token.CredentialStore, ttl time.Duration, size int) *cachedStore {
+	entries, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return &cachedStore{
+		store:   store,
+		ttl:     ttl,
+		entries: entries,
+		now:     time.Now,
+	}
+}
+
+func (s *cachedStore) LookupBearer(host string, bearerToken string) (token.BearerCredential, bool) {
+	entry := s.lookup("bearer\t"+host+"\t"+bearerToken, func() (interface{}, bool) {
+		return s.store.LookupBearer(host, bearerToken)
+	})
+	credential, _ := entry.credential.(token.BearerCredential)
+	return credential, entry.found
+}
+
+func (s *cachedStore) LookupBasic(host string, username string) ([]token.BasicCredential, bool) {
+	entry := s.lookup("basic\t"+host+"\t"+username, func() (interface{}, bool) {
+		return s.store.LookupBasic(host, username)
+	})
+	credentials, _ := entry.credential.([]token.BasicCredential)
+	return credentials, entry.found
+}
+
+func (s *cachedStore) lookup(key string, fetch func() (interface{}, bool)) credentialEntry {
+	now := s.now()
+	if v, ok := s.entries.Get(key); ok {
+		if entry := v.(credentialEntry); now.Before(entry.expires) {
+			return entry
+		}
+	}
+	credential, found := fetch()
+	entry := credentialEntry{credential: credential, found: found, expires: now.Add(s.ttl)}
+	s.entries.Add(key, entry)
+	return entry
+}
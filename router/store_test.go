@@ -0,0 +1,193 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"net/http"
+	"os"
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+type fakeStore struct {
+	mutex   sync.Mutex
+	bearers map[string]token.BearerCredential
+	basics  map[string][]token.BasicCredential
+	lookups int
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		bearers: map[string]token.BearerCredential{},
+		basics:  map[string][]token.BasicCredential{},
+	}
+}
+
+func (s *fakeStore) LookupBearer(host string, bearerToken string) (token.BearerCredential, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lookups++
+	credential, ok := s.bearers[host+"\t"+bearerToken]
+	return credential, ok
+}
+
+func (s *fakeStore) LookupBasic(host string, username string) ([]token.BasicCredential, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lookups++
+	credentials, ok := s.basics[host+"\t"+username]
+	return credentials, ok
+}
+
+func (s *fakeStore) setBearer(host string, bearerToken string, credential token.BearerCredential) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.bearers[host+"\t"+bearerToken] = credential
+}
+
+func (s *fakeStore) setBasic(host string, username string, credentials ...token.BasicCredential) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.basics[host+"\t"+username] = credentials
+}
+
+func (s *fakeStore) count() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.lookups
+}
+
+func TestCachedStore(t *testing.T) {
+	assert := assert.New(t)
+
+	store := newFakeStore()
+	cached := newCachedStore(store, time.Minute, 16)
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	cached.now = func() time.Time { return now }
+
+	_, ok := cached.LookupBearer("host1", "TOKEN1")
+	assert.False(ok, "LookupBearer() returns false when the token does not exist")
+	assert.Equal(1, store.count(), "the store is looked up")
+
+	store.setBearer("host1", "TOKEN1", token.BearerCredential{AllowedPaths: []*regexp.Regexp{regexp.MustCompile("^/foo/")}})
+	_, ok = cached.LookupBearer("host1", "TOKEN1")
+	assert.False(ok, "the not found result is cached until ttl passes")
+	assert.Equal(1, store.count(), "the store is not looked up while cached")
+
+	now = now.Add(time.Minute)
+	credential, ok := cached.LookupBearer("host1", "TOKEN1")
+	assert.True(ok, "LookupBearer() returns the new result after ttl passes")
+	assert.Len(credential.AllowedPaths, 1, "the credential of the store is returned")
+	assert.Equal(2, store.count(), "the store is looked up after ttl passes")
+
+	store.setBasic("host1", "TOKEN1", token.BasicCredential{Password: "password1"})
+	_, ok = cached.LookupBasic("host1", "TOKEN1")
+	assert.True(ok, "bearer tokens and basic users are cached separately")
+	_, ok = cached.LookupBasic("host2", "TOKEN1")
+	assert.False(ok, "hosts are cached separately")
+	assert.Equal(4, store.count(), "the store is looked up for each key")
+}
+
+// storeHost is the host of the configuration, which is given to CredentialStore
+const storeHost = `api\.example\.com`
+
+func TestNewHandlerWithStore(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "STATIC",
+						"allowed_paths": ["^/.*$"]
+					}
+				],
+				"basic_auths": [
+					{
+						"username": "static",
+						"password": "static",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	t.Run("without cache", func(t *testing.T) {
+		store := newFakeStore()
+		handler := NewHandlerWithStore(store, 0)
+
+		bearer := map[string]string{"Authorization": "Bearer TOKEN1"}
+		w := serve(handler, "GET", "api.example.com", "/foo/1", bearer)
+		assert.Equal(http.StatusUnauthorized, w.Code, "return 401 when the store does not have the token")
+		w = serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer STATIC"})
+		assert.Equal(http.StatusUnauthorized, w.Code, "bearer_tokens of the configuration are not used")
+
+		store.setBearer(storeHost, "TOKEN1", token.BearerCredential{AllowedPaths: []*regexp.Regexp{regexp.MustCompile("^/foo/.*$")}})
+		w = serve(handler, "GET", "api.example.com", "/foo/1", bearer)
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the store has the token")
+		w = serve(handler, "GET", "api.example.com", "/bar/1", bearer)
+		assert.Equal(http.StatusForbidden, w.Code, "return 403 when the path is not allowed by the store")
+
+		store.setBearer(storeHost, "TOKEN1", token.BearerCredential{AllowedPaths: []*regexp.Regexp{regexp.MustCompile("^/bar/.*$")}})
+		w = serve(handler, "GET", "api.example.com", "/foo/1", bearer)
+		assert.Equal(http.StatusForbidden, w.Code, "the decision follows the change of the store")
+		w = serve(handler, "GET", "api.example.com", "/bar/1", bearer)
+		assert.Equal(http.StatusOK, w.Code, "the decision follows the change of the store")
+
+		store.setBearer(storeHost, "TOKEN1", token.BearerCredential{
+			AllowedPaths: []*regexp.Regexp{regexp.MustCompile("^/bar/.*$")},
+			Limits:       token.Limits{AllowedMethods: []string{"GET"}},
+		})
+		w = serve(handler, "POST", "api.example.com", "/bar/1", bearer)
+		assert.Equal(http.StatusForbidden, w.Code, "the limitations of the store are checked")
+
+		basic := map[string]string{"Authorization": getBasicAuthHeader("user1", "password1")}
+		w = serve(handler, "GET", "api.example.com", "/piyo/1", basic)
+		assert.Equal(http.StatusUnauthorized, w.Code, "return 401 when the store does not have the user")
+		w = serve(handler, "GET", "api.example.com", "/piyo/1", map[string]string{"Authorization": getBasicAuthHeader("static", "static")})
+		assert.Equal(http.StatusUnauthorized, w.Code, "users of basic_auths of the configuration are not used")
+
+		store.setBasic(storeHost, "user1", token.BasicCredential{Password: "password1", AllowedPaths: []*regexp.Regexp{regexp.MustCompile("^/piyo/.*$")}})
+		w = serve(handler, "GET", "api.example.com", "/piyo/1", basic)
+		assert.Equal(http.StatusOK, w.Code, "return 200 when the store has the user")
+
+		store.setBasic(storeHost, "user1", token.BasicCredential{Password: "changed", AllowedPaths: []*regexp.Regexp{regexp.MustCompile("^/piyo/.*$")}})
+		w = serve(handler, "GET", "api.example.com", "/piyo/1", basic)
+		assert.Equal(http.StatusUnauthorized, w.Code, "the decision follows the change of the password")
+	})
+
+	t.Run("with cache", func(t *testing.T) {
+		store := newFakeStore()
+		store.setBearer(storeHost, "TOKEN1", token.BearerCredential{AllowedPaths: []*regexp.Regexp{regexp.MustCompile("^/foo/.*$")}})
+		handler := NewHandlerWithStore(store, time.Hour)
+
+		bearer := map[string]string{"Authorization": "Bearer TOKEN1"}
+		for i := 0; i < 3; i++ {
+			w := serve(handler, "GET", "api.example.com", "/foo/1", bearer)
+			assert.Equal(http.StatusOK, w.Code, "return 200 when the store has the token")
+		}
+		assert.Equal(1, store.count(), "the lookup is cached")
+
+		store.setBearer(storeHost, "TOKEN1", token.BearerCredential{AllowedPaths: []*regexp.Regexp{}})
+		w := serve(handler, "GET", "api.example.com", "/foo/1", bearer)
+		assert.Equal(http.StatusOK, w.Code, "the cached credential is used until ttl passes")
+	})
+}
@@ -0,0 +1,101 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	stdcontext "context"
+	"crypto/tls"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+/*
+RunTLS : start listening HTTPS Request using enclosed gin.Engine with the certificate and the key of PEM files.
+	The files are loaded again when they are changed, so that the rotated certificate is used without restarting.
+*/
+func (router *Handler) RunTLS(port string, certFile string, keyFile string) {
+	if err := router.RunTLSWithContext(stdcontext.Background(), port, certFile, keyFile); err != nil {
+		logging.Error("server stopped", "error", err)
+	}
+}
+
+/*
+RunTLSWithContext : start listening HTTPS Request like RunTLS, and shut down gracefully when ctx is done like RunWithContext.
+*/
+func (router *Handler) RunTLSWithContext(ctx stdcontext.Context, port string, certFile string, keyFile string) error {
+	loader, err := newCertificateLoader(certFile, keyFile)
+	if err != nil {
+		router.holder.Close()
+		return err
+	}
+	server := router.newServer(port)
+	server.TLSConfig = &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: loader.getCertificate,
+	}
+	return router.serve(ctx, server, func() error {
+		return server.ListenAndServeTLS("", "")
+	})
+}
+
+// certificateLoader holds the certificate, and loads it again when the modification time of either file is changed,
+// like the rotation by cert-manager. The current certificate is kept when the new files can not be loaded.
+type certificateLoader struct {
+	certFile    string
+	keyFile     string
+	mutex       sync.Mutex
+	certificate *tls.Certificate
+	certModTime time.Time
+	keyModTime  time.Time
+}
+
+func newCertificateLoader(certFile string, keyFile string) (*certificateLoader, error) {
+	loader := &certificateLoader{certFile: certFile, keyFile: keyFile}
+	if err := loader.load(); err != nil {
+		return nil, err
+	}
+	return loader, nil
+}
+
+// load loads the files. The caller must hold the mutex except in the constructor.
+func (loader *certificateLoader) load() error {
+	certModTime, keyModTime := modTime(loader.certFile), modTime(loader.keyFile)
+	certificate, err := tls.LoadX509KeyPair(loader.certFile, loader.keyFile)
+	if err != nil {
+		return err
+	}
+	loader.certificate = &certificate
+	loader.certModTime = certModTime
+	loader.keyModTime = keyModTime
+	return nil
+}
+
+func (loader *certificateLoader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	loader.mutex.Lock()
+	defer loader.mutex.Unlock()
+	if !modTime(loader.certFile).Equal(loader.certModTime) || !modTime(loader.keyFile).Equal(loader.keyModTime) {
+		if err := loader.load(); err != nil {
+			// the certificate and the key may be written one by one, so try again on the next handshake
+			logging.Error("certificate reload failed, and the current certificate is kept", "error", err)
+		} else {
+			logging.Info("certificate reloaded", "path", loader.certFile)
+		}
+	}
+	return loader.certificate, nil
+}
+
+// modTime returns the modification time of the file following the symlinks, or zero when it does not exist.
+func modTime(name string) time.Time {
+	info, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
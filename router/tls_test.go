@@ -0,0 +1,169 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	stdcontext "context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+// writeSelfSignedCert writes a self-signed certificate for 127.0.0.1 and its key as PEM files, and returns the certificate.
+func writeSelfSignedCert(t *testing.T, certFile string, keyFile string, serial int64) *x509.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: "fiware-ambassador-auth"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		panic(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		panic(err)
+	}
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		panic(err)
+	}
+	return cert
+}
+
+// freeAddr returns an address which is not used at the moment.
+func freeAddr() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer listener.Close()
+	return listener.Addr().String()
+}
+
+func TestRunTLSWithContext(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+	dir, err := ioutil.TempDir("", "tls")
+	assert.Nil(err, "TempDir has no error")
+	defer os.RemoveAll(dir)
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	cert1 := writeSelfSignedCert(t, certFile, keyFile, 1)
+
+	t.Run("invalid files", func(t *testing.T) {
+		err := NewHandler().RunTLSWithContext(stdcontext.Background(), freeAddr(), filepath.Join(dir, "unknown.crt"), keyFile)
+		assert.Error(err, "RunTLSWithContext() returns the error when the certificate can not be loaded")
+	})
+
+	addr := freeAddr()
+	handler := NewHandler()
+	ctx, cancel := stdcontext.WithCancel(stdcontext.Background())
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- handler.RunTLSWithContext(ctx, addr, certFile, keyFile)
+	}()
+	defer func() {
+		cancel()
+		assert.Nil(<-stopped, "RunTLSWithContext() returns no error when it is shut down")
+	}()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(cert1)
+	// the connections are not reused, so that each request gets the current certificate
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}, DisableKeepAlives: true}}
+	get := func(authorization string) (*http.Response, error) {
+		request, _ := http.NewRequest("GET", "https://"+addr+"/foo/1", nil)
+		request.Host = "api.example.com"
+		if len(authorization) > 0 {
+			request.Header.Set("Authorization", authorization)
+		}
+		return client.Do(request)
+	}
+
+	// the server is started asynchronously, so retry until it listens
+	var response *http.Response
+	timeout := time.After(3 * time.Second)
+	for response, err = get("Bearer TOKEN1"); err != nil; response, err = get("Bearer TOKEN1") {
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("the HTTPS server does not respond: %v", err)
+		}
+	}
+	response.Body.Close()
+	assert.Equal(http.StatusOK, response.StatusCode, "the HTTPS request is authorized")
+	assert.Equal(cert1.SerialNumber, response.TLS.PeerCertificates[0].SerialNumber, "the certificate is served")
+
+	response, err = get("Bearer INVALID")
+	if assert.Nil(err, "the HTTPS request has no error") {
+		response.Body.Close()
+		assert.Equal(http.StatusUnauthorized, response.StatusCode, "the HTTPS request with an invalid token is rejected")
+	}
+
+	t.Run("the rotated certificate is reloaded", func(t *testing.T) {
+		cert2 := writeSelfSignedCert(t, certFile, keyFile, 2)
+		// the modification time may not change within the resolution of the file system
+		later := time.Now().Add(time.Minute)
+		os.Chtimes(certFile, later, later)
+		os.Chtimes(keyFile, later, later)
+		roots.AddCert(cert2)
+
+		response, err := get("Bearer TOKEN1")
+		if assert.Nil(err, "the HTTPS request has no error") {
+			response.Body.Close()
+			assert.Equal(http.StatusOK, response.StatusCode, "the HTTPS request is authorized after the rotation")
+			assert.Equal(cert2.SerialNumber, response.TLS.PeerCertificates[0].SerialNumber, "the rotated certificate is served")
+		}
+	})
+}
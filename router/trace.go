@@ -0,0 +1,49 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+/*
+AuthTrace : AUTH_TRACE is an environment variable name to report the sequence of checks which each request went through.
+*/
+const AuthTrace = "AUTH_TRACE"
+
+const traceHeader = "X-Auth-Trace"
+const traceKey = "trace"
+
+func getTrace() bool {
+	trace, err := strconv.ParseBool(os.Getenv(AuthTrace))
+	return err == nil && trace
+}
+
+// startTrace enables the trace of the request when AUTH_TRACE is set.
+func (router *Handler) startTrace(context *gin.Context) {
+	if router.trace {
+		context.Set(traceKey, []string{})
+	}
+}
+
+// traceStep appends a step to the trace and reports the steps so far in the response header.
+// The steps must not include secrets like tokens and passwords.
+func traceStep(context *gin.Context, format string, args ...interface{}) {
+	v, ok := context.Get(traceKey)
+	if !ok {
+		return
+	}
+	steps, _ := v.([]string)
+	steps = append(steps, fmt.Sprintf(format, args...))
+	context.Set(traceKey, steps)
+	context.Writer.Header().Set(traceHeader, strings.Join(steps, "; "))
+}
@@ -0,0 +1,87 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+/*
+LogUnmatched : LOG_UNMATCHED is an environment variable name to log a warning when no rule of the matched host applies to the requested path.
+	Only "warn" is supported.
+*/
+const LogUnmatched = "LOG_UNMATCHED"
+
+const unmatchedLogSize = 1024
+const unmatchedLogLimit = 10
+const unmatchedLogPeriod = time.Minute
+
+/*
+unmatchedLogger : a logger of the requests which fall through all rules.
+	Each pair of host and path is logged only once, and the number of warnings is limited per period not to spam the log.
+*/
+type unmatchedLogger struct {
+	mutex  sync.Mutex
+	seen   *lru.Cache
+	now    func() time.Time
+	start  time.Time
+	count  int
+	limit  int
+	period time.Duration
+}
+
+func newUnmatchedLogger(size int, limit int, period time.Duration) *unmatchedLogger {
+	seen, err := lru.New(size)
+	if err != nil {
+		panic(err)
+	}
+	return &unmatchedLogger{
+		seen:   seen,
+		now:    time.Now,
+		limit:  limit,
+		period: period,
+	}
+}
+
+func getUnmatchedLogger() *unmatchedLogger {
+	if !strings.EqualFold(os.Getenv(LogUnmatched), "warn") {
+		return nil
+	}
+	return newUnmatchedLogger(unmatchedLogSize, unmatchedLogLimit, unmatchedLogPeriod)
+}
+
+// warn logs the fall-through of the request. It does nothing when the logger is disabled (nil).
+func (logger *unmatchedLogger) warn(host string, path string, reason string) {
+	if logger == nil {
+		return
+	}
+	logger.mutex.Lock()
+	defer logger.mutex.Unlock()
+
+	key := host + "\t" + path
+	if logger.seen.Contains(key) {
+		return
+	}
+	now := logger.now()
+	if !now.Before(logger.start.Add(logger.period)) {
+		logger.start = now
+		logger.count = 0
+	}
+	if logger.count >= logger.limit {
+		return
+	}
+	logger.count++
+	logger.seen.Add(key, struct{}{})
+	logging.Warn("no rule matched", "host", host, "path", path, "reason", reason)
+}
@@ -0,0 +1,122 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestUnmatchedLoggerWarn(t *testing.T) {
+	assert := assert.New(t)
+
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(ioutil.Discard)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	logger := newUnmatchedLogger(10, 2, time.Minute)
+	logger.now = func() time.Time { return now }
+
+	t.Run("deduplicate the same host and path", func(t *testing.T) {
+		buf.Reset()
+		logger.warn("api.example.com", "/foo/1", "token mismatch")
+		logger.warn("api.example.com", "/foo/1", "path not allowed")
+		assert.Equal(1, strings.Count(buf.String(), "[WARN]"), "the same host and path is logged once")
+		assert.Contains(buf.String(), `host=api.example.com path=/foo/1 reason="token mismatch"`, "the first reason is logged")
+	})
+
+	t.Run("limit the warnings per period", func(t *testing.T) {
+		buf.Reset()
+		logger.warn("api.example.com", "/foo/2", "token mismatch")
+		logger.warn("api.example.com", "/foo/3", "token mismatch")
+		assert.Equal(1, strings.Count(buf.String(), "[WARN]"), "the warnings over the limit are suppressed")
+		assert.Contains(buf.String(), "path=/foo/2", "/foo/2 is logged within the limit")
+
+		buf.Reset()
+		now = now.Add(time.Minute)
+		logger.warn("api.example.com", "/foo/3", "token mismatch")
+		assert.Contains(buf.String(), "path=/foo/3", "the suppressed path is logged in the next period")
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		buf.Reset()
+		var disabled *unmatchedLogger
+		disabled.warn("api.example.com", "/foo/4", "token mismatch")
+		assert.Empty(buf.String(), "nothing is logged when disabled")
+	})
+}
+
+func TestNewHandlerLogUnmatched(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(LogUnmatched)
+
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(ioutil.Discard)
+
+	os.Setenv(token.AuthTokens, `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [
+					{
+						"token": "TOKEN1",
+						"allowed_paths": ["^/foo/.*$"]
+					}
+				],
+				"basic_auths": [],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`)
+
+	t.Run("without LOG_UNMATCHED", func(t *testing.T) {
+		os.Unsetenv(LogUnmatched)
+		handler := NewHandler()
+		buf.Reset()
+		w := serve(handler, "GET", "api.example.com", "/bar/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		assert.Equal(http.StatusForbidden, w.Code, "return 403")
+		assert.NotContains(buf.String(), "[WARN]", "nothing is logged by default")
+	})
+
+	t.Run("with LOG_UNMATCHED=warn", func(t *testing.T) {
+		os.Setenv(LogUnmatched, "warn")
+		handler := NewHandler()
+		buf.Reset()
+
+		for i := 0; i < 3; i++ {
+			w := serve(handler, "GET", "api.example.com", "/bar/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+			assert.Equal(http.StatusForbidden, w.Code, "return 403")
+		}
+		assert.Equal(1, strings.Count(buf.String(), `[WARN] no rule matched host=api\.example\.com path=/bar/1 `), "the unmatched path is logged once")
+
+		w := serve(handler, "GET", "api.example.com", "/public/1", map[string]string{})
+		assert.Equal(http.StatusUnauthorized, w.Code, "return 401")
+		assert.Contains(buf.String(), `path=/public/1 reason="missing header"`, "the path without any rule is logged")
+
+		buf.Reset()
+		serve(handler, "GET", "api.example.com", "/foo/1", map[string]string{"Authorization": "Bearer TOKEN1"})
+		serve(handler, "GET", "api.example.com", "/static/app.js", map[string]string{})
+		assert.NotContains(buf.String(), "[WARN]", "the matched paths are not logged")
+	})
+}
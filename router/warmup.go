@@ -0,0 +1,66 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+/*
+CacheWarmupPath : CACHE_WARMUP_PATH is an environment variable name to set the file path of representative requests to warm up the caches.
+*/
+const CacheWarmupPath = "CACHE_WARMUP_PATH"
+
+type warmupRequest struct {
+	Host   string `json:"host"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+}
+
+func loadWarmupRequests(warmupPath string) []warmupRequest {
+	if len(warmupPath) == 0 {
+		return nil
+	}
+	rawRequests, err := ioutil.ReadFile(warmupPath)
+	if err != nil {
+		logging.Error("can not read "+CacheWarmupPath, "path", warmupPath, "error", err)
+		return nil
+	}
+	var requests []warmupRequest
+	if err := json.Unmarshal(rawRequests, &requests); err != nil {
+		logging.Error(CacheWarmupPath+" parse failed", "path", warmupPath, "error", err)
+		return nil
+	}
+	return requests
+}
+
+// warmUp fills the caches of the host and the paths which do not depend on credentials,
+// so that the first requests after deploy do not pay the cold cache cost.
+func (router *Handler) warmUp(holder *token.Holder, requests []warmupRequest) {
+	for _, request := range requests {
+		// the caches are keyed by the normalized host in the same way as the requests
+		domain := router.normalizeDomain(request.Host)
+		host, allowed := router.matchHost(domain, holder)
+		if !allowed || strings.EqualFold(request.Method, "OPTIONS") {
+			continue
+		}
+		parts := strings.SplitN(request.Path, "?", 2)
+		rawQuery := ""
+		if len(parts) == 2 {
+			rawQuery = parts[1]
+		}
+		router.matchRules(host, domain, request.Method, parts[0], rawQuery, holder)
+	}
+	if len(requests) > 0 {
+		logging.Info("caches are warmed up", "requests", len(requests))
+	}
+}
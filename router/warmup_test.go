@@ -0,0 +1,84 @@
+/*
+Package router : authorize and authenticate HTTP Request using HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/token"
+)
+
+func TestNewHandlerWarmUp(t *testing.T) {
+	assert := assert.New(t)
+	gin.SetMode(gin.ReleaseMode)
+	defer os.Unsetenv(token.AuthTokens)
+	defer os.Unsetenv(CacheWarmupPath)
+
+	json := `[
+		{
+			"host": "api\\.example\\.com",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [
+					{
+						"username": "user1",
+						"password": "password1",
+						"allowed_paths": ["^/piyo/.*$"]
+					}
+				],
+				"no_auths": {
+					"allowed_paths": ["^/static/.*$"]
+				}
+			}
+		}
+	]`
+	os.Setenv(token.AuthTokens, json)
+
+	f, err := ioutil.TempFile("", "warmup")
+	assert.Nil(err, "TempFile has no error")
+	defer os.Remove(f.Name())
+	f.WriteString(`[
+		{"host": "api.example.com", "method": "GET", "path": "/static/app.js"},
+		{"host": "api.example.com", "method": "GET", "path": "/piyo/1"},
+		{"host": "api.example.com", "method": "OPTIONS", "path": "/options"},
+		{"host": "unknown.example.com", "method": "GET", "path": "/unknown"}
+	]`)
+	f.Close()
+
+	t.Run("with CACHE_WARMUP_PATH", func(t *testing.T) {
+		os.Setenv(CacheWarmupPath, f.Name())
+		handler := NewHandler()
+
+		assert.True(handler.matchHostCache.Contains("api.example.com"), "the host is cached")
+		assert.True(handler.matchHostCache.Contains("unknown.example.com"), "the unknown host is also cached")
+		assert.True(handler.caches.get(`api\.example\.com`).matchNoAuthPath.Contains("api.example.com\tGET\t/static/app.js"), "the path without authentication is cached")
+		assert.True(handler.caches.get(`api\.example\.com`).matchBasicAuthPath.Contains("api.example.com\t/static/app.js"), "the basic authentication is also checked to compare the priorities")
+		assert.True(handler.caches.get(`api\.example\.com`).matchNoAuthPath.Contains("api.example.com\tGET\t/piyo/1"), "the path with authentication is cached")
+		assert.True(handler.caches.get(`api\.example\.com`).matchBasicAuthPath.Contains("api.example.com\t/piyo/1"), "the path of basic authentication is cached")
+		assert.False(handler.caches.get(`api\.example\.com`).matchNoAuthPath.Contains("api.example.com\tOPTIONS\t/options"), "the path of OPTIONS is not cached")
+		assert.False(handler.caches.get(`api\.example\.com`).matchNoAuthPath.Contains("unknown.example.com\tGET\t/unknown"), "the path of the unknown host is not cached")
+	})
+
+	t.Run("invalid CACHE_WARMUP_PATH", func(t *testing.T) {
+		for _, warmupPath := range []string{"/not/exist", os.DevNull} {
+			os.Setenv(CacheWarmupPath, warmupPath)
+			handler := NewHandler()
+			assert.Equal(0, handler.matchHostCache.Len(), "no cache is warmed up")
+		}
+	})
+
+	t.Run("without CACHE_WARMUP_PATH", func(t *testing.T) {
+		os.Unsetenv(CacheWarmupPath)
+		handler := NewHandler()
+		assert.Equal(0, handler.matchHostCache.Len(), "no cache is warmed up")
+	})
+}
@@ -0,0 +1,135 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+/*
+BackendCacheDir : BACKEND_CACHE_DIR is an environment variable name to set the directory to keep the JWKS and the inactive introspection results.
+	They are read after a restart until they expire, so that the keys are not fetched again on every deploy. Nothing is kept when it is not set.
+*/
+const BackendCacheDir = "BACKEND_CACHE_DIR"
+
+// cacheLifetime returns how long the response may be cached by its "Cache-Control" or "Expires",
+// and false when the response does not tell it. "no-store" and "no-cache" are never cached.
+func cacheLifetime(header http.Header, now time.Time) (time.Duration, bool) {
+	if cacheControl := header.Get("Cache-Control"); len(cacheControl) > 0 {
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if directive == "no-store" || directive == "no-cache" {
+				return 0, true
+			}
+		}
+		for _, directive := range strings.Split(cacheControl, ",") {
+			directive = strings.ToLower(strings.TrimSpace(directive))
+			if !strings.HasPrefix(directive, "max-age=") {
+				continue
+			}
+			maxAge, err := strconv.ParseInt(strings.Trim(strings.TrimPrefix(directive, "max-age="), `"`), 10, 64)
+			if err != nil || maxAge < 0 {
+				return 0, true
+			}
+			// the response may have been cached by a proxy for Age seconds
+			age, _ := strconv.ParseInt(header.Get("Age"), 10, 64)
+			if age >= maxAge {
+				return 0, true
+			}
+			return time.Duration(maxAge-age) * time.Second, true
+		}
+	}
+	if expires := header.Get("Expires"); len(expires) > 0 {
+		// an invalid date like "0" means that the response is already expired
+		expiresAt, err := http.ParseTime(expires)
+		if err != nil || !now.Before(expiresAt) {
+			return 0, true
+		}
+		return expiresAt.Sub(now), true
+	}
+	return 0, false
+}
+
+// cacheFile returns the path of the file to keep the results of the backend identified by the parts,
+// or an empty string when dir is not set.
+func cacheFile(dir string, prefix string, parts ...string) string {
+	if len(dir) == 0 {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(strings.Join(parts, "\n")))
+	return filepath.Join(dir, prefix+"-"+hex.EncodeToString(sum[:])+".json")
+}
+
+// readCacheFile reads the cached results into v, and returns false when they are not available.
+// A missing file is silently ignored, because it is the first start.
+func readCacheFile(path string, v interface{}) bool {
+	if len(path) == 0 {
+		return false
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logging.Warn("can not read the backend cache", "path", path, "error", err)
+		}
+		return false
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		logging.Warn("invalid backend cache ignored", "path", path, "error", err)
+		return false
+	}
+	return true
+}
+
+// writeCacheFile writes v through a temporary file, so that a concurrent reader or a crash never sees a partial file.
+func writeCacheFile(path string, v interface{}) {
+	if len(path) == 0 {
+		return
+	}
+	b, err := json.Marshal(v)
+	if err == nil {
+		err = writeFileAtomically(path, b)
+	}
+	if err != nil {
+		logging.Warn("can not write the backend cache", "path", path, "error", err)
+	}
+}
+
+func writeFileAtomically(path string, b []byte) error {
+	dir := filepath.Dir(path)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCacheLifetime(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		header   map[string]string
+		lifetime time.Duration
+		ok       bool
+		desc     string
+	}{
+		{header: map[string]string{}, lifetime: 0, ok: false, desc: "the lifetime is not known without the headers"},
+		{header: map[string]string{"Cache-Control": "public, max-age=600"}, lifetime: 10 * time.Minute, ok: true, desc: "max-age is the lifetime"},
+		{header: map[string]string{"Cache-Control": "max-age=600", "Age": "60"}, lifetime: 9 * time.Minute, ok: true, desc: "Age is subtracted from max-age"},
+		{header: map[string]string{"Cache-Control": "max-age=600", "Age": "600"}, lifetime: 0, ok: true, desc: "the response older than max-age is expired"},
+		{header: map[string]string{"Cache-Control": "max-age=600, no-store"}, lifetime: 0, ok: true, desc: "no-store is never cached"},
+		{header: map[string]string{"Cache-Control": "No-Cache"}, lifetime: 0, ok: true, desc: "no-cache is never cached"},
+		{header: map[string]string{"Cache-Control": "max-age=invalid"}, lifetime: 0, ok: true, desc: "the invalid max-age is expired"},
+		{header: map[string]string{"Cache-Control": "max-age=600", "Expires": "Tue, 01 Jan 2019 01:00:00 GMT"}, lifetime: 10 * time.Minute, ok: true, desc: "max-age wins over Expires"},
+		{header: map[string]string{"Cache-Control": "public", "Expires": "Tue, 01 Jan 2019 01:00:00 GMT"}, lifetime: time.Hour, ok: true, desc: "Expires is used without max-age"},
+		{header: map[string]string{"Expires": "Mon, 31 Dec 2018 23:00:00 GMT"}, lifetime: 0, ok: true, desc: "the past Expires is expired"},
+		{header: map[string]string{"Expires": "0"}, lifetime: 0, ok: true, desc: "the invalid Expires is expired"},
+	}
+	for _, c := range cases {
+		header := http.Header{}
+		for name, value := range c.header {
+			header.Set(name, value)
+		}
+		lifetime, ok := cacheLifetime(header, now)
+		assert.Equal(c.lifetime, lifetime, c.desc)
+		assert.Equal(c.ok, ok, c.desc)
+	}
+}
+
+func TestCacheFile(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "backendcache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	assert.Equal("", cacheFile("", "jwks", "https://example.com/jwks"), "no file without the directory")
+	path := cacheFile(filepath.Join(dir, "cache"), "jwks", "https://example.com/jwks")
+	assert.NotEqual(path, cacheFile(filepath.Join(dir, "cache"), "jwks", "https://example.com/other"), "each backend has its own file")
+
+	var values map[string]string
+	assert.False(readCacheFile(path, &values), "the missing file is not available")
+	writeCacheFile(path, map[string]string{"key": "value"})
+	if assert.True(readCacheFile(path, &values), "the written file is available, creating the directory") {
+		assert.Equal(map[string]string{"key": "value"}, values)
+	}
+	infos, _ := ioutil.ReadDir(filepath.Dir(path))
+	assert.Len(infos, 1, "no temporary file is left")
+
+	ioutil.WriteFile(path, []byte("broken"), 0600)
+	assert.False(readCacheFile(path, &values), "the broken file is ignored")
+}
+
+func TestBackendCacheDir(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv(BackendCacheDir)
+
+	os.Setenv(BackendCacheDir, "/var/cache/ambassador-auth")
+	assert.Equal("/var/cache/ambassador-auth", NewJWTVerifier("https://issuer.example.com/", "https://issuer.example.com/jwks", "").cacheDir, "the JWKS is kept in BACKEND_CACHE_DIR")
+	assert.Equal("/var/cache/ambassador-auth", NewIntrospector("https://issuer.example.com/introspect", "", "", time.Minute).cacheDir, "the inactive tokens are kept in BACKEND_CACHE_DIR")
+	os.Unsetenv(BackendCacheDir)
+	assert.Equal("", NewJWTVerifier("https://issuer.example.com/", "https://issuer.example.com/jwks", "").cacheDir, "nothing is kept by default")
+}
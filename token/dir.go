@@ -0,0 +1,90 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+	"github.com/fsnotify/fsnotify"
+)
+
+/*
+AuthTokensDir : AUTH_TOKENS_DIR is an environment variable name to set the directory of token configurations files.
+	All ".json", ".yaml" and ".yml" files of the directory are combined in the order of their names, and the entries
+	of the same host are merged in the same way as "AUTH_TOKENS_DUPLICATE_HOSTS". "AUTH_TOKENS_PATH" wins when both are set.
+*/
+const AuthTokensDir = "AUTH_TOKENS_DIR"
+
+// isTokensFile checks whether the file of the directory is one of the token configurations files.
+// The hidden files are ignored, like "..data" and the versioned directories of Kubernetes volumes.
+func isTokensFile(name string) bool {
+	if strings.HasPrefix(name, ".") {
+		return false
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	default:
+		return false
+	}
+}
+
+// readTokensDir reads the token configurations files of the directory and concatenates their entries into one JSON array.
+// A file which can not be parsed is returned as it is, so that the whole configurations fail to be parsed
+// in the same way as an invalid file of "AUTH_TOKENS_PATH".
+func readTokensDir(rawTokensDir string) ([]byte, error) {
+	infos, err := ioutil.ReadDir(rawTokensDir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, info := range infos {
+		if isTokensFile(info.Name()) {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+
+	entries := []json.RawMessage{}
+	for _, name := range names {
+		path := filepath.Join(rawTokensDir, name)
+		// the files of Kubernetes volumes are symlinks, so the targets are checked
+		if info, err := os.Stat(path); err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		rawTokens, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		logging.Info("read tokens", "path", path)
+		rawTokens = decodeTokens(rawTokens, getTokensFormat(path))
+		var fileEntries []json.RawMessage
+		if err := json.Unmarshal(rawTokens, &fileEntries); err != nil {
+			logging.Error("can not parse the token configurations of AUTH_TOKENS_DIR", "path", path, "error", err)
+			return rawTokens, nil
+		}
+		entries = append(entries, fileEntries...)
+	}
+	return json.Marshal(entries)
+}
+
+// isTokensDirEvent checks whether the event of the directory may change the token configurations files.
+func isTokensDirEvent(event fsnotify.Event, rawTokensDir string) bool {
+	if filepath.Clean(filepath.Dir(event.Name)) != filepath.Clean(rawTokensDir) {
+		return false
+	}
+	if isTokensFile(filepath.Base(event.Name)) {
+		return event.Op&fsnotify.Chmod != event.Op
+	}
+	return filepath.Base(event.Name) == kubernetesDataLink && event.Op&(fsnotify.Create|fsnotify.Rename) != 0
+}
@@ -0,0 +1,129 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func setUpTokensDir(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", tmpFilePrefix)
+	if err != nil {
+		panic(err)
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			panic(err)
+		}
+	}
+	return dir
+}
+
+func TestNewHolderWithAuthTokensDir(t *testing.T) {
+	assert := assert.New(t)
+	tmpFiles, tearDown := setUp(t)
+	defer tearDown()
+
+	teamA := `[{"host": "a\\.example\\.com", "settings": {
+		"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+		"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["^/piyo/.*$"]}],
+		"no_auths": {"allowed_paths": ["^/static/.*$"]}
+	}}]`
+	teamB := `
+- host: b\.example\.com
+  settings:
+    bearer_tokens:
+      - token: TOKEN2
+        allowed_paths: ['^/bar/.*$']
+    basic_auths: []
+    no_auths: {}
+`
+	// team-c redefines the host of team-a, and its tokens are merged into the entry of team-a
+	teamC := `[{"host": "a\\.example\\.com", "settings": {
+		"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/baz/.*$"]}, {"token": "TOKEN3", "allowed_paths": ["^/qux/.*$"]}],
+		"basic_auths": [{"username": "user2", "password": "password2", "allowed_paths": ["^/piyo/.*$"]}],
+		"no_auths": {"allowed_paths": ["^/public/.*$"]}
+	}}]`
+
+	dir := setUpTokensDir(t, map[string]string{
+		"team-a.json":  teamA,
+		"team-b.yaml":  teamB,
+		"team-c.json":  teamC,
+		"README.md":    "not a token configurations file",
+		".hidden.json": `[{"host": "hidden\\.example\\.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`,
+	})
+	defer os.RemoveAll(dir)
+	os.Setenv(AuthTokensDir, dir)
+	os.Setenv(AuthTokensWatch, "false")
+
+	holder := NewHolder()
+	assert.Equal([]string{`a\.example\.com`, `b\.example\.com`}, holder.GetHosts(), "the hosts of all files are loaded in the order of the file names")
+	assert.Equal([]string{"TOKEN1", "TOKEN3"}, holder.GetTokens(`a\.example\.com`), "the tokens of the same host are merged")
+	assert.Equal([]string{"^/foo/.*$", "^/baz/.*$"}, patternStrings(holder.GetAllowedPaths(`a\.example\.com`, "TOKEN1")),
+		"the paths of the token given in both files are united")
+	assert.Equal(map[string]map[string]string{"^/piyo/.*$": {"user1": "password1", "user2": "password2"}}, holder.GetBasicAuthConf(`a\.example\.com`),
+		"the basic authentications of the same host are merged")
+	assert.Equal([]string{"^/static/.*$", "^/public/.*$"}, patternStrings(holder.GetNoAuthPaths(`a\.example\.com`)),
+		"the no_auths paths of the same host are merged")
+	assert.Equal([]string{"TOKEN2"}, holder.GetTokens(`b\.example\.com`), "the YAML file is loaded with the JSON files")
+	assert.Empty(holder.Errors(), "the directory is loaded without errors")
+
+	fp, closeFile := setUpTmpFile(t, tmpFiles)
+	fp.WriteString(`[{"host": "path.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`)
+	closeFile()
+	os.Setenv(AuthTokensPath, fp.Name())
+	assert.Equal([]string{"path.example.com"}, NewHolder().GetHosts(), "AUTH_TOKENS_PATH wins over AUTH_TOKENS_DIR")
+	os.Unsetenv(AuthTokensPath)
+
+	os.Setenv(AuthTokensDuplicateHosts, DuplicateHostsError)
+	assert.Empty(NewHolder().GetHosts(), "the host redefined in another file is refused when AUTH_TOKENS_DUPLICATE_HOSTS is error")
+	os.Unsetenv(AuthTokensDuplicateHosts)
+
+	ioutil.WriteFile(filepath.Join(dir, "team-d.json"), []byte(`[{"host": "d.example.com"}]`), 0644)
+	holder = NewHolder()
+	assert.Empty(holder.GetHosts(), "the whole configurations are refused when a file is invalid")
+	if assert.Len(holder.Errors(), 1, "the invalid file is an error") {
+		assert.Contains(holder.Errors()[0], "seettings is required", "the error is the parse error of the file")
+	}
+
+	os.Setenv(AuthTokensDir, "/nonexistent/tokens.d")
+	holder = NewHolder()
+	assert.Equal([]string{"can not read AUTH_TOKENS_DIR: /nonexistent/tokens.d"}, holder.Errors(), "the directory which can not be read is an error")
+	assert.Equal([]string{`no hosts are configured, all requests are denied: AUTH_TOKENS_DIR ("/nonexistent/tokens.d") has no hosts`}, holder.Warnings(),
+		"the warning tells AUTH_TOKENS_DIR")
+}
+
+func TestHolderMonitorAuthTokensDir(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	json1 := `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+	json2 := `[{"host": "test2.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+
+	dir := setUpTokensDir(t, map[string]string{"team1.json": json1})
+	defer os.RemoveAll(dir)
+	os.Setenv(AuthTokensDir, dir)
+
+	holder := NewHolder()
+	defer holder.Close()
+	assert.Equal([]string{"test1.example.com"}, holder.GetHosts(), "the first configurations are loaded")
+
+	waitForHosts(t, holder, []string{"test1.example.com", "test2.example.com"}, func() {
+		ioutil.WriteFile(filepath.Join(dir, "team2.json"), []byte(json2), 0644)
+	})
+	waitForHosts(t, holder, []string{"test2.example.com"}, func() {
+		os.Remove(filepath.Join(dir, "team1.json"))
+	})
+	assert.Equal([]string{"test2.example.com"}, holder.GetHosts(), "the added and the removed files are reloaded")
+}
@@ -0,0 +1,335 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"time"
+)
+
+/*
+ExportRedact : the secrets (bearer tokens, passwords and HMAC secrets) are replaced with "<redacted>" when exporting, which is the default.
+*/
+const ExportRedact = "redact"
+
+/*
+ExportHash : the secrets are replaced with their SHA-256 hashes when exporting, so that a changed secret is found by diffing.
+*/
+const ExportHash = "hash"
+
+const redactedSecret = "<redacted>"
+
+type exportedHost struct {
+	Host     string           `json:"host"`
+	Settings exportedSettings `json:"settings"`
+	Default  bool             `json:"default"`
+}
+
+type exportedSettings struct {
+	BearerTokens          []exportedBearerToken  `json:"bearer_tokens"`
+	BasicAuths            []exportedBasicAuth    `json:"basic_auths"`
+	HMACAuths             []exportedHMACAuth     `json:"hmac_auths"`
+	NoAuths               exportedNoAuths        `json:"no_auths"`
+	JWT                   *exportedJWT           `json:"jwt,omitempty"`
+	Introspection         *exportedIntrospection `json:"introspection,omitempty"`
+	UAAllows              []string               `json:"user_agent_allow"`
+	UADenies              []string               `json:"user_agent_deny"`
+	IPRules               *exportedIPRules       `json:"ip_rules,omitempty"`
+	SoftDeny              bool                   `json:"soft_deny"`
+	UnknownTokenForbidden bool                   `json:"unknown_token_forbidden"`
+	MethodOverride        bool                   `json:"method_override"`
+	MatchQuery            bool                   `json:"match_query"`
+	Cache                 bool                   `json:"cache"`
+	RootPath              string                 `json:"root_path"`
+	Realm                 string                 `json:"realm,omitempty"`
+}
+
+type exportedLimits struct {
+	RateLimit      *exportedRateLimit `json:"rate_limit,omitempty"`
+	MaxBodySize    *int64             `json:"max_body_size,omitempty"`
+	AllowedMethods *[]string          `json:"allowed_methods,omitempty"`
+}
+
+type exportedRateLimit struct {
+	Requests int    `json:"requests"`
+	Period   string `json:"period"`
+}
+
+type exportedAllowedPath struct {
+	Path    string   `json:"path"`
+	Methods []string `json:"methods"`
+}
+
+type exportedBearerToken struct {
+	Token        string        `json:"token"`
+	AllowedPaths []interface{} `json:"allowed_paths"`
+	DeniedPaths  []string      `json:"denied_paths"`
+	DefaultAllow bool          `json:"default_allow"`
+	ExactHost    string        `json:"require_exact_host,omitempty"`
+	Label        string        `json:"label"`
+	ValidUntil   string        `json:"valid_until,omitempty"`
+	exportedLimits
+}
+
+type exportedBasicAuth struct {
+	Username     string   `json:"username"`
+	Password     string   `json:"password,omitempty"`
+	PasswordHash string   `json:"password_hash,omitempty"`
+	AllowedPaths []string `json:"allowed_paths"`
+	Priority     int      `json:"priority"`
+	ExactHost    string   `json:"require_exact_host,omitempty"`
+	Label        string   `json:"label"`
+	exportedLimits
+}
+
+type exportedHMACAuth struct {
+	KeyID         string   `json:"key_id"`
+	Secret        string   `json:"secret"`
+	SignedHeaders []string `json:"signed_headers"`
+	AllowedPaths  []string `json:"allowed_paths"`
+}
+
+type exportedNoAuths struct {
+	AllowedPaths      []interface{}      `json:"allowed_paths"`
+	MatchQuery        bool               `json:"match_query"`
+	DeniedQueryParams []string           `json:"denied_query_params"`
+	Priority          int                `json:"priority"`
+	BypassProtections bool               `json:"bypass_protections"`
+	RateLimit         *exportedRateLimit `json:"rate_limit,omitempty"`
+}
+
+type exportedJWT struct {
+	Issuers      []string            `json:"issuer"`
+	JWKSURL      string              `json:"jwks_url"`
+	Audiences    []string            `json:"audience"`
+	AllowedPaths []string            `json:"allowed_paths"`
+	Claim        string              `json:"claim"`
+	ClaimPaths   map[string][]string `json:"claim_paths"`
+	exportedLimits
+}
+
+type exportedIntrospection struct {
+	URL              string              `json:"url"`
+	ClientID         string              `json:"client_id"`
+	ClientSecret     string              `json:"client_secret"`
+	CacheTTL         string              `json:"cache_ttl"`
+	NegativeCacheTTL string              `json:"negative_cache_ttl"`
+	AllowedPaths     []string            `json:"allowed_paths"`
+	Claim            string              `json:"claim"`
+	ClaimPaths       map[string][]string `json:"claim_paths"`
+	exportedLimits
+}
+
+type exportedIPRules struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+/*
+Export : get the effective token configurations of this Holder as canonical JSON, to diff them against their source.
+	The aliases of the field names are resolved, the YAML is converted, the entries of the same host are merged,
+	"defaults" is applied to each rule, and the omitted values are filled with their defaults.
+	The secrets are redacted or hashed by secrets ("redact" or "hash"), and the weak tokens refused by AUTH_TOKENS_STRICT are not exported.
+*/
+func (holder *Holder) Export(secrets string) ([]byte, error) {
+	var hideSecret func(string) string
+	switch secrets {
+	case ExportRedact:
+		hideSecret = func(string) string { return redactedSecret }
+	case ExportHash:
+		hideSecret = func(secret string) string {
+			sum := sha256.Sum256([]byte(secret))
+			return "sha256:" + hex.EncodeToString(sum[:])
+		}
+	default:
+		return nil, fmt.Errorf("secrets must be %q or %q: %q", ExportRedact, ExportHash, secrets)
+	}
+
+	exported := []exportedHost{}
+	// a snapshot which failed to be parsed does not hold rawTokens, and has no hosts
+	if rawTokens := holder.load().rawTokens; rawTokens != nil {
+		var hostSettingsList []hostSettings
+		if err := json.Unmarshal(rawTokens, &hostSettingsList); err != nil {
+			return nil, err
+		}
+		hostSettingsList, err := mergeHosts(hostSettingsList, getDuplicateHosts())
+		if err != nil {
+			return nil, err
+		}
+		policy := getTokenPolicy()
+		for _, hostSettings := range hostSettingsList {
+			exported = append(exported, exportHost(hostSettings, policy, hideSecret))
+		}
+	}
+	// "<redacted>" is written as it is instead of "\u003credacted\u003e"
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(exported); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func exportHost(hostSettings hostSettings, policy tokenPolicy, hideSecret func(string) string) exportedHost {
+	settings := hostSettings.AuthTokens.withDefaults()
+	exported := exportedSettings{
+		BearerTokens: []exportedBearerToken{},
+		BasicAuths:   []exportedBasicAuth{},
+		HMACAuths:    []exportedHMACAuth{},
+		NoAuths: exportedNoAuths{
+			AllowedPaths:      exportAllowedPaths(settings.NoAuths.RawAllowedPaths, settings.NoAuths.AllowedPathMethods),
+			MatchQuery:        settings.NoAuths.MatchQuery,
+			DeniedQueryParams: exportStrings(settings.NoAuths.DeniedQueryParams),
+			Priority:          settings.NoAuths.Priority,
+			BypassProtections: settings.NoAuths.BypassProtections,
+			RateLimit:         exportRateLimit(settings.NoAuths.RateLimit),
+		},
+		UAAllows:              exportStrings(settings.UAAllows),
+		UADenies:              exportStrings(settings.UADenies),
+		SoftDeny:              settings.SoftDeny,
+		UnknownTokenForbidden: settings.UnknownTokenForbidden,
+		MethodOverride:        settings.MethodOverride,
+		MatchQuery:            settings.MatchQuery,
+		Cache:                 settings.Cache,
+		RootPath:              settings.RootPath,
+		Realm:                 settings.Realm,
+	}
+	for index, bearerToken := range settings.BearerTokens {
+		if policy.strict && len(policy.check(hostSettings.Host, bearerToken.Token)) > 0 {
+			continue
+		}
+		var validUntil string
+		if !bearerToken.ValidUntil.IsZero() {
+			validUntil = bearerToken.ValidUntil.UTC().Format(time.RFC3339)
+		}
+		exported.BearerTokens = append(exported.BearerTokens, exportedBearerToken{
+			Token:          hideSecret(bearerToken.Token),
+			AllowedPaths:   exportAllowedPaths(bearerToken.RawAllowedPaths, bearerToken.AllowedPathMethods),
+			DeniedPaths:    exportStrings(bearerToken.RawDeniedPaths),
+			DefaultAllow:   bearerToken.DefaultAllow,
+			ExactHost:      bearerToken.ExactHost,
+			Label:          ruleLabel(bearerToken.Label, "bearer_tokens", index),
+			ValidUntil:     validUntil,
+			exportedLimits: exportLimits(bearerToken.Limits),
+		})
+	}
+	for index, basicAuth := range settings.BasicAuths {
+		exported.BasicAuths = append(exported.BasicAuths, exportedBasicAuth{
+			Username:       basicAuth.Username,
+			Password:       hideSecretIfGiven(basicAuth.Password, hideSecret),
+			PasswordHash:   hideSecretIfGiven(basicAuth.PasswordHash, hideSecret),
+			AllowedPaths:   exportStrings(basicAuth.RawAllowedPaths),
+			Priority:       basicAuth.Priority,
+			ExactHost:      basicAuth.ExactHost,
+			Label:          ruleLabel(basicAuth.Label, "basic_auths", index),
+			exportedLimits: exportLimits(basicAuth.Limits),
+		})
+	}
+	for _, hmacAuth := range settings.HMACAuths {
+		exported.HMACAuths = append(exported.HMACAuths, exportedHMACAuth{
+			KeyID:         hmacAuth.KeyID,
+			Secret:        hideSecret(hmacAuth.Secret),
+			SignedHeaders: exportStrings(hmacAuth.SignedHeaders),
+			AllowedPaths:  exportStrings(hmacAuth.RawAllowedPaths),
+		})
+	}
+	if jwt := settings.JWT; jwt != nil {
+		claimPaths := map[string][]string{}
+		for value, rawPaths := range jwt.RawClaimPaths {
+			claimPaths[value] = exportStrings(rawPaths)
+		}
+		exported.JWT = &exportedJWT{
+			Issuers:        exportStrings(jwt.Issuers),
+			JWKSURL:        jwt.JWKSURL,
+			Audiences:      exportStrings(jwt.Audiences),
+			AllowedPaths:   exportStrings(jwt.RawAllowedPaths),
+			Claim:          jwt.Claim,
+			ClaimPaths:     claimPaths,
+			exportedLimits: exportLimits(jwt.Limits),
+		}
+	}
+	if introspection := settings.Introspection; introspection != nil {
+		claimPaths := map[string][]string{}
+		for value, rawPaths := range introspection.RawClaimPaths {
+			claimPaths[value] = exportStrings(rawPaths)
+		}
+		exported.Introspection = &exportedIntrospection{
+			URL:              introspection.URL,
+			ClientID:         introspection.ClientID,
+			ClientSecret:     hideSecretIfGiven(introspection.ClientSecret, hideSecret),
+			CacheTTL:         introspection.CacheTTL.String(),
+			NegativeCacheTTL: introspection.NegativeCacheTTL.String(),
+			AllowedPaths:     exportStrings(introspection.RawAllowedPaths),
+			Claim:            introspection.Claim,
+			ClaimPaths:       claimPaths,
+			exportedLimits:   exportLimits(introspection.Limits),
+		}
+	}
+	if settings.IPRules != nil {
+		exported.IPRules = &exportedIPRules{Allow: exportIPNets(settings.IPRules.Allow), Deny: exportIPNets(settings.IPRules.Deny)}
+	}
+	return exportedHost{Host: hostSettings.Host, Settings: exported, Default: hostSettings.Default}
+}
+
+// exportAllowedPaths exports a path scoped to methods as an object, and the other paths as strings like their source.
+func exportAllowedPaths(rawAllowedPaths []string, allowedPathMethods [][]string) []interface{} {
+	allowedPaths := make([]interface{}, 0, len(rawAllowedPaths))
+	for i, rawAllowedPath := range rawAllowedPaths {
+		if i < len(allowedPathMethods) && allowedPathMethods[i] != nil {
+			allowedPaths = append(allowedPaths, exportedAllowedPath{Path: rawAllowedPath, Methods: allowedPathMethods[i]})
+		} else {
+			allowedPaths = append(allowedPaths, rawAllowedPath)
+		}
+	}
+	return allowedPaths
+}
+
+// hideSecretIfGiven keeps an empty secret empty, because a basic authentication user has either a password or a password hash.
+func hideSecretIfGiven(secret string, hideSecret func(string) string) string {
+	if len(secret) == 0 {
+		return ""
+	}
+	return hideSecret(secret)
+}
+
+func exportLimits(limits limitSettings) exportedLimits {
+	return exportedLimits{
+		RateLimit:      exportRateLimit(limits.RateLimit),
+		MaxBodySize:    limits.MaxBodySize,
+		AllowedMethods: limits.AllowedMethods,
+	}
+}
+
+func exportRateLimit(rateLimit *rateLimit) *exportedRateLimit {
+	if rateLimit == nil {
+		return nil
+	}
+	return &exportedRateLimit{Requests: rateLimit.Requests, Period: rateLimit.Period.String()}
+}
+
+// exportStrings returns an empty slice instead of nil, so that an omitted list and an empty list are exported in the same way.
+func exportStrings(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func exportIPNets(ipNets []*net.IPNet) []string {
+	cidrs := make([]string, 0, len(ipNets))
+	for _, ipNet := range ipNets {
+		cidrs = append(cidrs, ipNet.String())
+	}
+	return cidrs
+}
@@ -0,0 +1,143 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const exportTokens = `[
+	{
+		"domain": "api.example.com",
+		"settings": {
+			"tokens": [
+				{"secret": "TOKEN1", "paths": ["^/foo/.*$", {"path": "^/bar/.*$", "methods": ["GET"]}], "valid_until": "2030-01-01T09:00:00+09:00"}
+			],
+			"users": [{"user": "user1", "password": "password1", "paths": ["^/piyo/.*$"], "max_body_size": 1024}],
+			"no_auths": {"paths": ["^/static/.*$"]},
+			"defaults": {"rate_limit": {"requests": 10, "period": "60s"}}
+		}
+	},
+	{
+		"host": "api.example.com",
+		"settings": {
+			"bearer_tokens": [],
+			"basic_auths": [],
+			"hmac_auths": [{"key_id": "key1", "secret": "secret1", "allowed_paths": ["^/hmac/.*$"]}],
+			"no_auths": {"allowed_paths": ["^/public/.*$"]},
+			"ip_rules": {"allow": ["10.0.0.1"]},
+			"cache": false
+		}
+	}
+]`
+
+const exportedTokens = `[
+	{
+		"host": "api.example.com",
+		"settings": {
+			"bearer_tokens": [
+				{
+					"token": "<redacted>",
+					"allowed_paths": ["^/foo/.*$", {"path": "^/bar/.*$", "methods": ["GET"]}],
+					"denied_paths": [],
+					"default_allow": false,
+					"label": "bearer_tokens[0]",
+					"valid_until": "2030-01-01T00:00:00Z",
+					"rate_limit": {"requests": 10, "period": "1m0s"}
+				}
+			],
+			"basic_auths": [
+				{
+					"username": "user1",
+					"password": "<redacted>",
+					"allowed_paths": ["^/piyo/.*$"],
+					"priority": 0,
+					"label": "basic_auths[0]",
+					"rate_limit": {"requests": 10, "period": "1m0s"},
+					"max_body_size": 1024
+				}
+			],
+			"hmac_auths": [{"key_id": "key1", "secret": "<redacted>", "signed_headers": [], "allowed_paths": ["^/hmac/.*$"]}],
+			"no_auths": {
+				"allowed_paths": ["^/static/.*$", "^/public/.*$"],
+				"match_query": false,
+				"denied_query_params": [],
+				"priority": 0,
+				"bypass_protections": false
+			},
+			"user_agent_allow": [],
+			"user_agent_deny": [],
+			"ip_rules": {"allow": ["10.0.0.1/32"], "deny": []},
+			"soft_deny": false,
+			"unknown_token_forbidden": false,
+			"method_override": false,
+			"match_query": false,
+			"cache": false,
+			"root_path": "rules"
+		},
+		"default": false
+	}
+]`
+
+func TestHolderExport(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, exportTokens)
+	holder := NewHolder()
+
+	t.Run("redact", func(t *testing.T) {
+		exported, err := holder.Export(ExportRedact)
+		assert.NoError(err)
+		assert.JSONEq(exportedTokens, string(exported), "the aliases, the defaults and the duplicate hosts are resolved")
+		for _, secret := range []string{"TOKEN1", "password1", "secret1"} {
+			assert.NotContains(string(exported), secret, "the secrets are redacted")
+		}
+		assert.True(Validate(exported).Valid, "the exported configurations can be loaded again")
+
+		again, _ := holder.Export(ExportRedact)
+		assert.Equal(exported, again, "the export is stable")
+	})
+
+	t.Run("hash", func(t *testing.T) {
+		exported, err := holder.Export(ExportHash)
+		assert.NoError(err)
+		sum := sha256.Sum256([]byte("TOKEN1"))
+		assert.Contains(string(exported), `"token": "sha256:`+hex.EncodeToString(sum[:])+`"`, "the token is hashed")
+		for _, secret := range []string{"TOKEN1", "password1", "secret1"} {
+			assert.NotContains(string(exported), secret, "the secrets are hashed")
+		}
+	})
+
+	t.Run("unknown secrets", func(t *testing.T) {
+		_, err := holder.Export("plain")
+		assert.EqualError(err, `secrets must be "redact" or "hash": "plain"`, "the secrets are never exported as they are")
+	})
+
+	t.Run("weak tokens refused", func(t *testing.T) {
+		os.Setenv(AuthTokensMinLength, "16")
+		os.Setenv(AuthTokensStrict, "true")
+		defer os.Unsetenv(AuthTokensMinLength)
+		defer os.Unsetenv(AuthTokensStrict)
+		exported, err := NewHolder().Export(ExportRedact)
+		assert.NoError(err)
+		assert.NotContains(string(exported), "bearer_tokens[0]", "the weak token refused by AUTH_TOKENS_STRICT is not exported")
+	})
+
+	t.Run("no configurations", func(t *testing.T) {
+		os.Setenv(AuthTokens, "invalid")
+		exported, err := NewHolder().Export(ExportRedact)
+		assert.NoError(err)
+		assert.Equal("[]", string(exported), "the holder which failed to be parsed has no hosts")
+	})
+}
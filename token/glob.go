@@ -0,0 +1,99 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+)
+
+/*
+PathMatchRegex : the paths of the host are regular expressions, which is the default of "path_match".
+*/
+const PathMatchRegex = "regex"
+
+/*
+PathMatchGlob : the paths of the host are globs like "/foo/*" and "/bar/**", which are anchored at both ends.
+	"*" and "?" match any characters and any character in a segment of the path, and "**" matches any characters including "/".
+*/
+const PathMatchGlob = "glob"
+
+// globToRegexp translates the glob into the regular expression which matches the same paths,
+// so that the glob paths are held and matched in the same way as the regex paths.
+func globToRegexp(glob string) string {
+	var b bytes.Buffer
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch {
+		case strings.HasPrefix(glob[i:], "**"):
+			b.WriteString(".*")
+			i++
+		case glob[i] == '*':
+			b.WriteString("[^/]*")
+		case glob[i] == '?':
+			b.WriteString("[^/]")
+		default:
+			b.WriteString(regexp.QuoteMeta(glob[i : i+1]))
+		}
+	}
+	b.WriteString("$")
+	return b.String()
+}
+
+func globsToRegexps(globs []string) []string {
+	if globs == nil {
+		return nil
+	}
+	sl := make([]string, 0, len(globs))
+	for _, glob := range globs {
+		sl = append(sl, globToRegexp(glob))
+	}
+	return sl
+}
+
+// withGlobPaths translates all paths of the settings from the globs, and the settings become the regex ones.
+func (t authTokens) withGlobPaths() authTokens {
+	t.BearerTokens = append([]bearerTokens{}, t.BearerTokens...)
+	for i := range t.BearerTokens {
+		t.BearerTokens[i].RawAllowedPaths = globsToRegexps(t.BearerTokens[i].RawAllowedPaths)
+		t.BearerTokens[i].RawDeniedPaths = globsToRegexps(t.BearerTokens[i].RawDeniedPaths)
+	}
+	t.BasicAuths = append([]basicAuths{}, t.BasicAuths...)
+	for i := range t.BasicAuths {
+		t.BasicAuths[i].RawAllowedPaths = globsToRegexps(t.BasicAuths[i].RawAllowedPaths)
+	}
+	t.HMACAuths = append([]hmacAuths{}, t.HMACAuths...)
+	for i := range t.HMACAuths {
+		t.HMACAuths[i].RawAllowedPaths = globsToRegexps(t.HMACAuths[i].RawAllowedPaths)
+	}
+	t.NoAuths.RawAllowedPaths = globsToRegexps(t.NoAuths.RawAllowedPaths)
+	if t.JWT != nil {
+		jwt := *t.JWT
+		jwt.RawAllowedPaths = globsToRegexps(jwt.RawAllowedPaths)
+		if jwt.RawClaimPaths != nil {
+			jwt.RawClaimPaths = map[string][]string{}
+			for claim, paths := range t.JWT.RawClaimPaths {
+				jwt.RawClaimPaths[claim] = globsToRegexps(paths)
+			}
+		}
+		t.JWT = &jwt
+	}
+	if t.Introspection != nil {
+		introspection := *t.Introspection
+		introspection.RawAllowedPaths = globsToRegexps(introspection.RawAllowedPaths)
+		if introspection.RawClaimPaths != nil {
+			introspection.RawClaimPaths = map[string][]string{}
+			for claim, paths := range t.Introspection.RawClaimPaths {
+				introspection.RawClaimPaths[claim] = globsToRegexps(paths)
+			}
+		}
+		t.Introspection = &introspection
+	}
+	t.PathMatch = PathMatchRegex
+	return t
+}
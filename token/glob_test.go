@@ -0,0 +1,88 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"encoding/json"
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobToRegexp(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		glob     string
+		expected string
+		matches  []string
+		others   []string
+	}{
+		{glob: "/foo/*", expected: "^/foo/[^/]*$", matches: []string{"/foo/", "/foo/1"}, others: []string{"/foo", "/foo/1/2", "/bar/foo/1"}},
+		{glob: "/bar/**", expected: "^/bar/.*$", matches: []string{"/bar/", "/bar/1", "/bar/1/2"}, others: []string{"/bar", "/barbaz/1"}},
+		{glob: "/baz/?/qux", expected: "^/baz/[^/]/qux$", matches: []string{"/baz/1/qux"}, others: []string{"/baz/12/qux", "/baz///qux"}},
+		{glob: "/v1.0/(id)+", expected: `^/v1\.0/\(id\)\+$`, matches: []string{"/v1.0/(id)+"}, others: []string{"/v1x0/id", "/v1.0/idid"}},
+		{glob: "**", expected: "^.*$", matches: []string{"/", "/a/b/c"}, others: []string{}},
+		{glob: "??", expected: "^[^/][^/]$", matches: []string{"ab"}, others: []string{"/a", "abc"}},
+	}
+	for _, c := range cases {
+		assert.Equal(c.expected, globToRegexp(c.glob), "glob: %s", c.glob)
+		re := regexp.MustCompile(globToRegexp(c.glob))
+		for _, path := range c.matches {
+			assert.True(re.MatchString(path), "glob %s matches %s", c.glob, path)
+		}
+		for _, path := range c.others {
+			assert.False(re.MatchString(path), "glob %s does not match %s", c.glob, path)
+		}
+	}
+}
+
+func TestNewHolderWithGlobPaths(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `[
+		{
+			"host": "glob.example.com",
+			"settings": {
+				"path_match": "glob",
+				"bearer_tokens": [
+					{"token": "TOKEN1", "allowed_paths": ["/foo/*", {"path": "/bar/**", "methods": ["GET"]}], "denied_paths": ["/foo/admin"]}
+				],
+				"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["/piyo/**"]}],
+				"no_auths": {"allowed_paths": ["/static/**"]}
+			}
+		}, {
+			"host": "regex.example.com",
+			"settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/[^/]*$"]}],
+				"basic_auths": [],
+				"no_auths": {}
+			}
+		}
+	]`)
+	holder := NewHolder()
+
+	host := "glob.example.com"
+	assert.Equal([]string{"^/foo/[^/]*$", "^/bar/.*$"}, patternStrings(holder.GetAllowedPaths(host, "TOKEN1")), "the globs are translated to the patterns")
+	bearerCredential, _ := holder.LookupBearer(host, "TOKEN1")
+	assert.Equal([]string{"^/foo/admin$"}, patternStrings(bearerCredential.DeniedPaths), "the denied paths are translated")
+	assert.Equal(map[string]map[string]string{"^/piyo/.*$": {"user1": "password1"}}, holder.GetBasicAuthConf(host), "the paths of basic_auths are translated")
+	assert.Equal([]string{"^/static/.*$"}, patternStrings(holder.GetNoAuthPaths(host)), "the paths of no_auths are translated")
+	assert.Equal([]string{"^/foo/[^/]*$"}, patternStrings(holder.GetAllowedPaths("regex.example.com", "TOKEN1")),
+		"the paths of the other host are still the patterns")
+	assert.Empty(holder.Errors(), "the globs are always valid patterns")
+
+	var settings authTokens
+	err := json.Unmarshal([]byte(`{"path_match": "prefix", "bearer_tokens": [], "basic_auths": [], "no_auths": {}}`), &settings)
+	if assert.Error(err, "the unknown path_match is an error") {
+		assert.Equal(`path_match must be "regex" or "glob": "prefix"`, err.Error(), "the error tells the modes")
+	}
+}
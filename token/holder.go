@@ -7,13 +7,21 @@ Package token : hold token configurations to check sing HTTP Header.
 package token
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
 	"github.com/fsnotify/fsnotify"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 /*
@@ -26,21 +34,112 @@ AuthTokensPath : AUTH_TOKENS_PATH is an environment vairable name to set the fil
 */
 const AuthTokensPath = "AUTH_TOKENS_PATH"
 
+/*
+AuthTokensRequireHosts : AUTH_TOKENS_REQUIRE_HOSTS is an environment vairable name to refuse starting when the token configurations have no hosts.
+*/
+const AuthTokensRequireHosts = "AUTH_TOKENS_REQUIRE_HOSTS"
+
+/*
+AuthTokensWatch : AUTH_TOKENS_WATCH is an environment variable name to watch the file of "AUTH_TOKENS_PATH" (default true).
+	When it is false, the file is loaded only once, for the file mounted read-only which never changes.
+*/
+const AuthTokensWatch = "AUTH_TOKENS_WATCH"
+
 /*
 Holder : a struct to hold token configurations.
 	Holder construct token configurations from "AUTH_TOKEN" environment variable.
 */
 type Holder struct {
-	hosts                   []string
-	bearerTokenAllowedPaths map[string]map[string][]*regexp.Regexp
-	bearerTokens            map[string][]string
-	basicAuthPaths          map[string]map[string]map[string]string
-	noAuthPaths             map[string][]string
+	config          atomic.Value
+	loadMutex       sync.Mutex
+	now             atomic.Value
+	reloadMutex     sync.Mutex
+	reloadCallbacks []func()
+	rawTokensPath   string
+	rawTokensDir    bool
+	maxAge          time.Duration
+	loadedAt        time.Time
+	done            chan struct{}
+	closeOnce       sync.Once
+	watchers        sync.WaitGroup
+}
+
+// holderConfig is an immutable snapshot of the token configurations.
+// A reload builds a new snapshot and swaps it, so the requests never see the configurations being changed.
+type holderConfig struct {
+	hosts                  []string
+	hostPatterns           []*regexp.Regexp
+	bearerTokenCredentials map[string]map[string]BearerCredential
+	bearerTokens           map[string][]string
+	noAuthPaths            map[string][]*regexp.Regexp
+	userAgentAllows        map[string][]*regexp.Regexp
+	userAgentDenies        map[string][]*regexp.Regexp
+	hmacAuths              map[string]map[string]HMACAuth
+	softDenies             map[string]bool
+	noAuthQueries          map[string]NoAuthQuery
+	basicAuthCredentials   map[string]map[string][]BasicCredential
+	basicAuthPriorities    map[string]map[*regexp.Regexp]int
+	noAuthPriorities       map[string]int
+	noAuthBypasses         map[string]bool
+	noAuthRateLimits       map[string]*RateLimit
+	unknownTokenForbiddens map[string]bool
+	warnings               []string
+	loadErrors             []string
+	compileErrors          []error
+	noAuthLabels           map[string]map[*regexp.Regexp]string
+	noAuthPathMethods      map[string]map[*regexp.Regexp][]string
+	ruleLabels             map[string][]string
+	methodOverrides        map[string]bool
+	matchQueries           map[string]bool
+	cacheDisabled          map[string]bool
+	rootPaths              map[string]string
+	realms                 map[string]string
+	ipRules                map[string]IPRules
+	jwtAuths               map[string]JWTAuth
+	introspectionAuths     map[string]IntrospectionAuth
+	rawTokens              []byte
+	defaultHost            string
+}
+
+/*
+NoAuthQuery : a struct to hold how the query string is handled when matching the paths without authentication.
+*/
+type NoAuthQuery struct {
+	MatchQuery        bool
+	DeniedQueryParams []string
+}
+
+/*
+HMACAuth : a struct to hold a configuration of HMAC signature authentication.
+*/
+type HMACAuth struct {
+	Secret        string
+	SignedHeaders []string
+	AllowedPaths  []*regexp.Regexp
+}
+
+/*
+Limits : a struct to hold request limitations applied to a bearer token or a basic authentication user.
+Limits is resolved from the rule's own settings and the "defaults" of its host when loading.
+*/
+type Limits struct {
+	RateLimit      *RateLimit
+	MaxBodySize    int64
+	AllowedMethods []string
+}
+
+/*
+RateLimit : a struct to hold the number of requests allowed in a period.
+*/
+type RateLimit struct {
+	Requests int
+	Period   time.Duration
 }
 
 type hostSettings struct {
 	Host       string     `json:"host"`
 	AuthTokens authTokens `json:"settings"`
+	Default    bool       `json:"default"`
 }
 
 /*
@@ -50,8 +149,13 @@ func (s *hostSettings) UnmarshalJSON(b []byte) error {
 	type hostSettingsP struct {
 		Host       *string     `json:"host"`
 		AuthTokens *authTokens `json:"settings"`
+		Default    *bool       `json:"default"`
 	}
 	var p hostSettingsP
+	b, err := resolveAliases(b, hostSettingsAliases)
+	if err != nil {
+		return err
+	}
 	if err := json.Unmarshal(b, &p); err != nil {
 		return err
 	}
@@ -63,13 +167,82 @@ func (s *hostSettings) UnmarshalJSON(b []byte) error {
 		return errors.New("seettings is required")
 	}
 	s.AuthTokens = *p.AuthTokens
+	if p.Default != nil {
+		s.Default = *p.Default
+	}
 	return nil
 }
 
+// aliases of the field names used by other gateways, resolved to the canonical names when unmarshalling.
+var hostSettingsAliases = map[string]string{"domain": "host"}
+
+/*
+RootPathRules : the root path "/" is decided by the rules like the other paths, which is the default of "root_path".
+*/
+const RootPathRules = "rules"
+
+/*
+RootPathDeny : the root path "/" is always rejected with 403 even if any broad pattern matches it.
+*/
+const RootPathDeny = "deny"
+
+/*
+RootPathAllow : the root path "/" is always allowed without authentication like the paths of "no_auths".
+*/
+const RootPathAllow = "allow"
+
+var authTokensAliases = map[string]string{"tokens": "bearer_tokens", "users": "basic_auths"}
+var bearerTokensAliases = map[string]string{"secret": "token", "paths": "allowed_paths", "expires_at": "valid_until"}
+var basicAuthsAliases = map[string]string{"user": "username", "paths": "allowed_paths"}
+var hmacAuthsAliases = map[string]string{"paths": "allowed_paths"}
+var noAuthsAliases = map[string]string{"paths": "allowed_paths"}
+
+// resolveAliases renames the alias fields of the JSON object to their canonical names.
+// It is an error that both an alias and its canonical name are given.
+func resolveAliases(b []byte, aliases map[string]string) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil || fields == nil {
+		// keep the original error of the caller
+		return b, nil
+	}
+	resolved := false
+	for alias, name := range aliases {
+		value, ok := fields[alias]
+		if !ok {
+			continue
+		}
+		if _, ok := fields[name]; ok {
+			return nil, fmt.Errorf("%s and its alias %s are both given", name, alias)
+		}
+		delete(fields, alias)
+		fields[name] = value
+		resolved = true
+	}
+	if !resolved {
+		return b, nil
+	}
+	return json.Marshal(fields)
+}
+
 type authTokens struct {
-	BearerTokens []bearerTokens `json:"bearer_tokens"`
-	BasicAuths   []basicAuths   `json:"basic_auths"`
-	NoAuths      noAuths        `json:"no_auths"`
+	BearerTokens          []bearerTokens         `json:"bearer_tokens"`
+	BasicAuths            []basicAuths           `json:"basic_auths"`
+	NoAuths               noAuths                `json:"no_auths"`
+	Defaults              limitSettings          `json:"defaults"`
+	UAAllows              []string               `json:"user_agent_allow"`
+	UADenies              []string               `json:"user_agent_deny"`
+	HMACAuths             []hmacAuths            `json:"hmac_auths"`
+	SoftDeny              bool                   `json:"soft_deny"`
+	UnknownTokenForbidden bool                   `json:"unknown_token_forbidden"`
+	MethodOverride        bool                   `json:"method_override"`
+	MatchQuery            bool                   `json:"match_query"`
+	JWT                   *jwtSettings           `json:"jwt"`
+	Introspection         *introspectionSettings `json:"introspection"`
+	Cache                 bool                   `json:"cache"`
+	RootPath              string                 `json:"root_path"`
+	IPRules               *IPRules               `json:"ip_rules"`
+	PathMatch             string                 `json:"path_match"`
+	Realm                 string                 `json:"realm"`
 }
 
 /*
@@ -77,11 +250,30 @@ UnmarshalJSON : Unmarshal AUTH_TOKENS and check required
 */
 func (t *authTokens) UnmarshalJSON(b []byte) error {
 	type authTokensP struct {
-		BearerTokens *[]bearerTokens `json:"bearer_tokens"`
-		BasicAuths   *[]basicAuths   `json:"basic_auths"`
-		NoAuths      *noAuths        `json:"no_auths"`
+		BearerTokens          *[]bearerTokens        `json:"bearer_tokens"`
+		BasicAuths            *[]basicAuths          `json:"basic_auths"`
+		NoAuths               *noAuths               `json:"no_auths"`
+		Defaults              *limitSettings         `json:"defaults"`
+		UAAllows              *[]string              `json:"user_agent_allow"`
+		UADenies              *[]string              `json:"user_agent_deny"`
+		HMACAuths             *[]hmacAuths           `json:"hmac_auths"`
+		SoftDeny              *bool                  `json:"soft_deny"`
+		UnknownTokenForbidden *bool                  `json:"unknown_token_forbidden"`
+		MethodOverride        *bool                  `json:"method_override"`
+		MatchQuery            *bool                  `json:"match_query"`
+		JWT                   *jwtSettings           `json:"jwt"`
+		Introspection         *introspectionSettings `json:"introspection"`
+		Cache                 *bool                  `json:"cache"`
+		RootPath              *string                `json:"root_path"`
+		IPRules               *IPRules               `json:"ip_rules"`
+		PathMatch             *string                `json:"path_match"`
+		Realm                 *string                `json:"realm"`
 	}
 	var p authTokensP
+	b, err := resolveAliases(b, authTokensAliases)
+	if err != nil {
+		return err
+	}
 	if err := json.Unmarshal(b, &p); err != nil {
 		return err
 	}
@@ -97,12 +289,122 @@ func (t *authTokens) UnmarshalJSON(b []byte) error {
 		return errors.New("no_auths is required")
 	}
 	t.NoAuths = *p.NoAuths
+	if p.Defaults != nil {
+		t.Defaults = *p.Defaults
+	}
+	if p.UAAllows != nil {
+		t.UAAllows = *p.UAAllows
+	}
+	if p.UADenies != nil {
+		t.UADenies = *p.UADenies
+	}
+	if p.HMACAuths != nil {
+		t.HMACAuths = *p.HMACAuths
+	}
+	if p.SoftDeny != nil {
+		t.SoftDeny = *p.SoftDeny
+	}
+	if p.UnknownTokenForbidden != nil {
+		t.UnknownTokenForbidden = *p.UnknownTokenForbidden
+	}
+	if p.MethodOverride != nil {
+		t.MethodOverride = *p.MethodOverride
+	}
+	if p.MatchQuery != nil {
+		t.MatchQuery = *p.MatchQuery
+	}
+	t.JWT = p.JWT
+	if p.JWT != nil && p.Introspection != nil {
+		return errors.New("jwt and introspection are both given")
+	}
+	t.Introspection = p.Introspection
+	if p.Realm != nil {
+		t.Realm = *p.Realm
+	}
+	// the decisions are cached unless disabled explicitly
+	t.Cache = p.Cache == nil || *p.Cache
+	t.IPRules = p.IPRules
+	t.RootPath = RootPathRules
+	if p.RootPath != nil {
+		switch *p.RootPath {
+		case RootPathRules, RootPathDeny, RootPathAllow:
+			t.RootPath = *p.RootPath
+		default:
+			return fmt.Errorf("root_path must be %q, %q or %q: %q", RootPathRules, RootPathDeny, RootPathAllow, *p.RootPath)
+		}
+	}
+	t.PathMatch = PathMatchRegex
+	if p.PathMatch != nil {
+		switch *p.PathMatch {
+		case PathMatchRegex:
+		case PathMatchGlob:
+			// the globs are translated here, so that the rest never knows the mode of the paths
+			*t = t.withGlobPaths()
+		default:
+			return fmt.Errorf("path_match must be %q or %q: %q", PathMatchRegex, PathMatchGlob, *p.PathMatch)
+		}
+	}
 	return nil
 }
 
 type bearerTokens struct {
-	Token           string   `json:"token"`
-	RawAllowedPaths []string `json:"allowed_paths"`
+	Token              string   `json:"token"`
+	RawAllowedPaths    []string `json:"allowed_paths"`
+	AllowedPathMethods [][]string
+	RawDeniedPaths     []string `json:"denied_paths"`
+	DefaultAllow       bool     `json:"default_allow"`
+	ExactHost          string   `json:"require_exact_host"`
+	Label              string   `json:"label"`
+	ValidUntil         time.Time
+	Limits             limitSettings
+}
+
+// allowedPath is an element of allowed_paths of bearer_tokens, which is a pattern string (all methods are allowed)
+// or an object like {"path": "^/foo/.*$", "methods": ["GET", "HEAD"]}.
+type allowedPath struct {
+	Path    string
+	Methods []string
+}
+
+// noAuthPath is an element of allowed_paths of no_auths, which has the same forms as allowedPath.
+type noAuthPath allowedPath
+
+/*
+UnmarshalJSON : Unmarshal an element of allowed_paths and check required
+*/
+func (a *allowedPath) UnmarshalJSON(b []byte) error {
+	return a.unmarshal(b, "bearer_tokens")
+}
+
+/*
+UnmarshalJSON : Unmarshal an element of allowed_paths of no_auths and check required
+*/
+func (a *noAuthPath) UnmarshalJSON(b []byte) error {
+	return (*allowedPath)(a).unmarshal(b, "no_auths")
+}
+
+func (a *allowedPath) unmarshal(b []byte, field string) error {
+	if err := json.Unmarshal(b, &a.Path); err == nil {
+		a.Methods = nil
+		return nil
+	}
+	type allowedPathP struct {
+		Path    *string   `json:"path"`
+		Methods *[]string `json:"methods"`
+	}
+	var p allowedPathP
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if p.Path == nil {
+		return fmt.Errorf("%s.allowed_paths.path is required", field)
+	}
+	a.Path = *p.Path
+	if p.Methods == nil {
+		return fmt.Errorf("%s.allowed_paths.methods is required", field)
+	}
+	a.Methods = *p.Methods
+	return nil
 }
 
 /*
@@ -110,10 +412,19 @@ UnmarshalJSON : Unmarshal AUTH_TOKENS and check required
 */
 func (t *bearerTokens) UnmarshalJSON(b []byte) error {
 	type bearerTokensP struct {
-		Token           *string   `json:"token"`
-		RawAllowedPaths *[]string `json:"allowed_paths"`
+		Token           *string        `json:"token"`
+		RawAllowedPaths *[]allowedPath `json:"allowed_paths"`
+		RawDeniedPaths  *[]string      `json:"denied_paths"`
+		DefaultAllow    *bool          `json:"default_allow"`
+		ExactHost       *string        `json:"require_exact_host"`
+		Label           *string        `json:"label"`
+		ValidUntil      *string        `json:"valid_until"`
 	}
 	var p bearerTokensP
+	b, err := resolveAliases(b, bearerTokensAliases)
+	if err != nil {
+		return err
+	}
 	if err := json.Unmarshal(b, &p); err != nil {
 		return err
 	}
@@ -124,14 +435,43 @@ func (t *bearerTokens) UnmarshalJSON(b []byte) error {
 	if p.RawAllowedPaths == nil {
 		return errors.New("bearer_tokens.allowed_paths is required")
 	}
-	t.RawAllowedPaths = *p.RawAllowedPaths
-	return nil
+	t.RawAllowedPaths = make([]string, 0, len(*p.RawAllowedPaths))
+	t.AllowedPathMethods = make([][]string, 0, len(*p.RawAllowedPaths))
+	for _, allowedPath := range *p.RawAllowedPaths {
+		t.RawAllowedPaths = append(t.RawAllowedPaths, allowedPath.Path)
+		t.AllowedPathMethods = append(t.AllowedPathMethods, allowedPath.Methods)
+	}
+	if p.RawDeniedPaths != nil {
+		t.RawDeniedPaths = *p.RawDeniedPaths
+	}
+	if p.DefaultAllow != nil {
+		t.DefaultAllow = *p.DefaultAllow
+	}
+	if p.ExactHost != nil {
+		t.ExactHost = normalizeExactHost(*p.ExactHost)
+	}
+	if p.Label != nil {
+		t.Label = *p.Label
+	}
+	if p.ValidUntil != nil {
+		validUntil, err := time.Parse(time.RFC3339, *p.ValidUntil)
+		if err != nil {
+			return err
+		}
+		t.ValidUntil = validUntil
+	}
+	return json.Unmarshal(b, &t.Limits)
 }
 
 type basicAuths struct {
 	Username        string   `json:"username"`
 	Password        string   `json:"password"`
+	PasswordHash    string   `json:"password_hash"`
 	RawAllowedPaths []string `json:"allowed_paths"`
+	Priority        int      `json:"priority"`
+	ExactHost       string   `json:"require_exact_host"`
+	Label           string   `json:"label"`
+	Limits          limitSettings
 }
 
 /*
@@ -141,9 +481,17 @@ func (a *basicAuths) UnmarshalJSON(b []byte) error {
 	type basicAuthsP struct {
 		Username        *string   `json:"username"`
 		Password        *string   `json:"password"`
+		PasswordHash    *string   `json:"password_hash"`
 		RawAllowedPaths *[]string `json:"allowed_paths"`
+		Priority        *int      `json:"priority"`
+		ExactHost       *string   `json:"require_exact_host"`
+		Label           *string   `json:"label"`
 	}
 	var p basicAuthsP
+	b, err := resolveAliases(b, basicAuthsAliases)
+	if err != nil {
+		return err
+	}
 	if err := json.Unmarshal(b, &p); err != nil {
 		return err
 	}
@@ -151,19 +499,101 @@ func (a *basicAuths) UnmarshalJSON(b []byte) error {
 		return errors.New("basic_auths.username is required")
 	}
 	a.Username = *p.Username
-	if p.Password == nil {
+	switch {
+	case p.Password != nil && p.PasswordHash != nil:
+		return errors.New("basic_auths.password and basic_auths.password_hash are both given")
+	case p.PasswordHash != nil:
+		if err := checkPasswordHash(*p.PasswordHash); err != nil {
+			return err
+		}
+		a.PasswordHash = *p.PasswordHash
+	case p.Password != nil:
+		a.Password = *p.Password
+	default:
 		return errors.New("basic_auths.password is required")
 	}
-	a.Password = *p.Password
 	if p.RawAllowedPaths == nil {
 		return errors.New("basic_auths.allowed_paths is required")
 	}
 	a.RawAllowedPaths = *p.RawAllowedPaths
+	if p.Priority != nil {
+		a.Priority = *p.Priority
+	}
+	if p.ExactHost != nil {
+		a.ExactHost = normalizeExactHost(*p.ExactHost)
+	}
+	if p.Label != nil {
+		a.Label = *p.Label
+	}
+	return json.Unmarshal(b, &a.Limits)
+}
+
+// ruleLabel returns the label of the rule, or its field and index when the label is not given.
+func ruleLabel(label string, field string, index int) string {
+	if len(label) > 0 {
+		return label
+	}
+	return fmt.Sprintf("%s[%d]", field, index)
+}
+
+// normalizeExactHost normalizes "require_exact_host" in the same way as the requested hosts are normalized when comparing them.
+func normalizeExactHost(exactHost string) string {
+	return strings.TrimSuffix(strings.ToLower(exactHost), ".")
+}
+
+type hmacAuths struct {
+	KeyID           string   `json:"key_id"`
+	Secret          string   `json:"secret"`
+	SignedHeaders   []string `json:"signed_headers"`
+	RawAllowedPaths []string `json:"allowed_paths"`
+}
+
+/*
+UnmarshalJSON : Unmarshal AUTH_TOKENS and check required
+*/
+func (a *hmacAuths) UnmarshalJSON(b []byte) error {
+	type hmacAuthsP struct {
+		KeyID           *string   `json:"key_id"`
+		Secret          *string   `json:"secret"`
+		SignedHeaders   *[]string `json:"signed_headers"`
+		RawAllowedPaths *[]string `json:"allowed_paths"`
+	}
+	var p hmacAuthsP
+	b, err := resolveAliases(b, hmacAuthsAliases)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if p.KeyID == nil {
+		return errors.New("hmac_auths.key_id is required")
+	}
+	a.KeyID = *p.KeyID
+	if p.Secret == nil {
+		return errors.New("hmac_auths.secret is required")
+	}
+	a.Secret = *p.Secret
+	if p.SignedHeaders == nil {
+		a.SignedHeaders = []string{}
+	} else {
+		a.SignedHeaders = *p.SignedHeaders
+	}
+	if p.RawAllowedPaths == nil {
+		return errors.New("hmac_auths.allowed_paths is required")
+	}
+	a.RawAllowedPaths = *p.RawAllowedPaths
 	return nil
 }
 
 type noAuths struct {
-	RawAllowedPaths []string `json:"allowed_paths"`
+	RawAllowedPaths    []string `json:"allowed_paths"`
+	AllowedPathMethods [][]string
+	MatchQuery         bool       `json:"match_query"`
+	DeniedQueryParams  []string   `json:"denied_query_params"`
+	Priority           int        `json:"priority"`
+	BypassProtections  bool       `json:"bypass_protections"`
+	RateLimit          *rateLimit `json:"rate_limit"`
 }
 
 /*
@@ -171,17 +601,126 @@ UnmarshalJSON : Unmarshal AUTH_TOKENS and check required
 */
 func (n *noAuths) UnmarshalJSON(b []byte) error {
 	type noAuthsP struct {
-		RawAllowedPaths *[]string `json:"allowed_paths"`
+		RawAllowedPaths   *[]noAuthPath `json:"allowed_paths"`
+		MatchQuery        *bool         `json:"match_query"`
+		DeniedQueryParams *[]string     `json:"denied_query_params"`
+		Priority          *int          `json:"priority"`
+		BypassProtections *bool         `json:"bypass_protections"`
+		RateLimit         *rateLimit    `json:"rate_limit"`
 	}
 	var p noAuthsP
+	b, err := resolveAliases(b, noAuthsAliases)
+	if err != nil {
+		return err
+	}
 	if err := json.Unmarshal(b, &p); err != nil {
 		return err
 	}
-	if p.RawAllowedPaths == nil {
-		n.RawAllowedPaths = []string{}
-	} else {
-		n.RawAllowedPaths = *p.RawAllowedPaths
+	n.RawAllowedPaths = []string{}
+	n.AllowedPathMethods = [][]string{}
+	if p.RawAllowedPaths != nil {
+		for _, noAuthPath := range *p.RawAllowedPaths {
+			n.RawAllowedPaths = append(n.RawAllowedPaths, noAuthPath.Path)
+			n.AllowedPathMethods = append(n.AllowedPathMethods, noAuthPath.Methods)
+		}
+	}
+	if p.MatchQuery != nil {
+		n.MatchQuery = *p.MatchQuery
+	}
+	if p.DeniedQueryParams != nil {
+		n.DeniedQueryParams = *p.DeniedQueryParams
+	}
+	if p.Priority != nil {
+		n.Priority = *p.Priority
+	}
+	if p.BypassProtections != nil {
+		n.BypassProtections = *p.BypassProtections
+	}
+	n.RateLimit = p.RateLimit
+	return nil
+}
+
+type limitSettings struct {
+	RateLimit      *rateLimit `json:"rate_limit"`
+	MaxBodySize    *int64     `json:"max_body_size"`
+	AllowedMethods *[]string  `json:"allowed_methods"`
+}
+
+/*
+UnmarshalJSON : Unmarshal AUTH_TOKENS and check the values of limitations
+*/
+func (l *limitSettings) UnmarshalJSON(b []byte) error {
+	type limitSettingsP limitSettings
+	var p limitSettingsP
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if p.MaxBodySize != nil && *p.MaxBodySize < 0 {
+		return errors.New("max_body_size must not be negative")
+	}
+	*l = limitSettings(p)
+	return nil
+}
+
+func (l limitSettings) inherit(defaults limitSettings) Limits {
+	if l.RateLimit == nil {
+		l.RateLimit = defaults.RateLimit
+	}
+	if l.MaxBodySize == nil {
+		l.MaxBodySize = defaults.MaxBodySize
+	}
+	if l.AllowedMethods == nil {
+		l.AllowedMethods = defaults.AllowedMethods
+	}
+
+	var limits Limits
+	if l.RateLimit != nil {
+		limits.RateLimit = &RateLimit{Requests: l.RateLimit.Requests, Period: l.RateLimit.Period}
+	}
+	if l.MaxBodySize != nil {
+		limits.MaxBodySize = *l.MaxBodySize
+	}
+	if l.AllowedMethods != nil {
+		limits.AllowedMethods = *l.AllowedMethods
+	}
+	return limits
+}
+
+type rateLimit struct {
+	Requests int
+	Period   time.Duration
+}
+
+/*
+UnmarshalJSON : Unmarshal AUTH_TOKENS and check required
+*/
+func (r *rateLimit) UnmarshalJSON(b []byte) error {
+	type rateLimitP struct {
+		Requests *int    `json:"requests"`
+		Period   *string `json:"period"`
+	}
+	var p rateLimitP
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if p.Requests == nil {
+		return errors.New("rate_limit.requests is required")
+	}
+	if *p.Requests < 1 {
+		return errors.New("rate_limit.requests must be positive")
+	}
+	r.Requests = *p.Requests
+	if p.Period == nil {
+		return errors.New("rate_limit.period is required")
+	}
+	period, err := time.ParseDuration(*p.Period)
+	if err != nil {
+		return err
+	}
+	if period <= 0 {
+		return errors.New("rate_limit.period must be positive")
 	}
+	r.Period = period
 	return nil
 }
 
@@ -190,32 +729,151 @@ NewHolder : a factory method to create Holder.
 */
 func NewHolder() *Holder {
 	var holder Holder
+	holder.now.Store(time.Now)
 	rawTokensPath := os.Getenv(AuthTokensPath)
+	if len(rawTokensPath) == 0 {
+		// the directory is held as the path, and loaded and watched as a whole
+		rawTokensPath = os.Getenv(AuthTokensDir)
+		holder.rawTokensDir = len(rawTokensPath) != 0
+	}
+	holder.rawTokensPath = rawTokensPath
+	holder.maxAge = getConfigMaxAge()
 	if len(rawTokensPath) != 0 {
 		loadFile(&holder, rawTokensPath)
-		go monitor(&holder, rawTokensPath)
 	} else {
 		loadEnv(&holder)
 	}
+	if len(holder.GetHosts()) == 0 && getRequireHosts() {
+		panic(fmt.Sprintf("%s is set, but %s", AuthTokensRequireHosts, noHostsSource(holder.pathVariable(), rawTokensPath)))
+	}
+	// CONFIG_MAX_AGE still reloads the file by force even if it is not watched
+	watch := getWatch()
+	if len(rawTokensPath) != 0 && (watch || holder.maxAge > 0) {
+		holder.done = make(chan struct{})
+		if watch {
+			holder.watchers.Add(1)
+			go monitor(&holder, rawTokensPath)
+		}
+		if holder.maxAge > 0 {
+			holder.watchers.Add(1)
+			go expire(&holder)
+		}
+	}
 	return &holder
 }
 
-func loadFile(holder *Holder, rawTokensPath string) {
-	rawTokens := []byte("[]")
+func getWatch() bool {
+	watch, err := strconv.ParseBool(os.Getenv(AuthTokensWatch))
+	return err != nil || watch
+}
+
+func getRequireHosts() bool {
+	requireHosts, err := strconv.ParseBool(os.Getenv(AuthTokensRequireHosts))
+	return err == nil && requireHosts
+}
+
+// pathVariable returns the name of the environment variable which gives rawTokensPath.
+func (holder *Holder) pathVariable() string {
+	if holder.rawTokensDir {
+		return AuthTokensDir
+	}
+	return AuthTokensPath
+}
+
+// noHostsSource describes why the token configurations have no hosts, distinguishing the unset variables from the empty ones.
+func noHostsSource(pathVariable string, rawTokensPath string) string {
 	if len(rawTokensPath) != 0 {
+		return fmt.Sprintf("%s (\"%s\") has no hosts", pathVariable, rawTokensPath)
+	}
+	rawTokensStr, tokensSet := os.LookupEnv(AuthTokens)
+	_, pathSet := os.LookupEnv(AuthTokensPath)
+	switch {
+	case !tokensSet && !pathSet:
+		return fmt.Sprintf("%s and %s are not set", AuthTokens, AuthTokensPath)
+	case !tokensSet:
+		return fmt.Sprintf("%s is set but empty and %s is not set", AuthTokensPath, AuthTokens)
+	case len(rawTokensStr) == 0 && pathSet:
+		return fmt.Sprintf("%s and %s are set but empty", AuthTokens, AuthTokensPath)
+	case len(rawTokensStr) == 0:
+		return fmt.Sprintf("%s is set but empty", AuthTokens)
+	default:
+		return fmt.Sprintf("%s has no hosts", AuthTokens)
+	}
+}
+
+// warnNoHosts records a prominent warning when the loaded token configurations have no hosts,
+// because all requests are denied then, which is almost always a misconfiguration.
+func warnNoHosts(holder *Holder, rawTokensPath string) {
+	holder.loadMutex.Lock()
+	defer holder.loadMutex.Unlock()
+
+	current := holder.load()
+	if len(current.hosts) != 0 {
+		return
+	}
+	warning := fmt.Sprintf("no hosts are configured, all requests are denied: %s", noHostsSource(holder.pathVariable(), rawTokensPath))
+	for _, w := range current.warnings {
+		if w == warning {
+			return
+		}
+	}
+	logging.Warn(warning)
+	// swap a new snapshot not to change the current one under the requests
+	config := *current
+	config.warnings = append(append([]string{}, current.warnings...), warning)
+	holder.config.Store(&config)
+}
+
+// recordLoadError records the error of loading which is found out of buildConfig, in the same way as warnNoHosts.
+func recordLoadError(holder *Holder, loadError string) {
+	holder.loadMutex.Lock()
+	defer holder.loadMutex.Unlock()
+
+	current := holder.load()
+	config := *current
+	config.loadErrors = append(append([]string{}, current.loadErrors...), loadError)
+	holder.config.Store(&config)
+}
+
+func loadFile(holder *Holder, rawTokensPath string) bool {
+	rawTokens := []byte("[]")
+	format := getTokensFormat(rawTokensPath)
+	read := false
+	if len(rawTokensPath) != 0 && holder.rawTokensDir {
+		// the files are converted to JSON one by one, because they may have different formats
+		format = formatJSON
+		dirTokens, err := readTokensDir(rawTokensPath)
+		if err == nil {
+			rawTokens = dirTokens
+			read = true
+		} else {
+			logging.Error("can not read AUTH_TOKENS_DIR", "path", rawTokensPath, "error", err)
+		}
+	} else if len(rawTokensPath) != 0 {
 		f, err := os.Open(rawTokensPath)
 		defer f.Close()
 		if err == nil {
-			log.Printf("read tokens from \"%s\"\n", rawTokensPath)
+			logging.Info("read tokens", "path", rawTokensPath)
 			rawTokens, err = ioutil.ReadAll(f)
+			read = err == nil
 		} else {
-			log.Printf("can not open AUTH_TOKENS_PATH: %s\n", rawTokensPath)
+			logging.Error("can not open AUTH_TOKENS_PATH", "path", rawTokensPath, "error", err)
 		}
 	} else {
-		log.Printf("empty AUTH_TOKENS_PATH\n")
+		logging.Info("empty AUTH_TOKENS_PATH")
+	}
+	// the raw configurations have the secrets, so only their size is logged
+	logging.Debug("raw tokens", "bytes", len(rawTokens))
+	changed := makeHolder(holder, decodeTokens(rawTokens, format))
+	if len(rawTokensPath) != 0 && !read {
+		recordLoadError(holder, fmt.Sprintf("can not read %s: %s", holder.pathVariable(), rawTokensPath))
 	}
-	log.Printf("rawTokens: \n%s\n--------\n", rawTokens)
-	makeHolder(holder, rawTokens)
+	// a snapshot which failed to be parsed does not hold rawTokens
+	if read && holder.load().rawTokens != nil {
+		holder.markLoaded()
+	}
+	warnNoHosts(holder, rawTokensPath)
+	return changed
 }
 
 func loadEnv(holder *Holder) {
@@ -223,126 +881,861 @@ func loadEnv(holder *Holder) {
 	if len(rawTokensStr) == 0 {
 		rawTokensStr = "[]"
 	}
-	log.Printf("%s: %v\n--------\n", AuthTokens, rawTokensStr)
-	makeHolder(holder, []byte(rawTokensStr))
+	logging.Debug("raw tokens", "bytes", len(rawTokensStr))
+	makeHolder(holder, decodeTokens([]byte(rawTokensStr), getTokensFormat("")))
+	warnNoHosts(holder, "")
+}
+
+// decodeTokens converts the token configurations to JSON. The configurations which can not be converted
+// are returned as they are, so that they fail to be parsed in the same way as an invalid JSON.
+func decodeTokens(rawTokens []byte, format string) []byte {
+	if format != formatYAML {
+		return rawTokens
+	}
+	converted, err := yamlToJSON(rawTokens)
+	if err != nil {
+		logging.Error("can not parse the token configurations as YAML", "error", err)
+		return rawTokens
+	}
+	return converted
 }
 
-func makeHolder(holder *Holder, rawTokens []byte) {
+// makeHolder constructs the token configurations, and returns true when the configurations are changed successfully.
+func makeHolder(holder *Holder, rawTokens []byte) bool {
+	holder.loadMutex.Lock()
+	defer holder.loadMutex.Unlock()
+
+	if current := holder.load(); current.rawTokens != nil && bytes.Equal(current.rawTokens, rawTokens) {
+		logging.Info("AUTH_TOKENS is not changed")
+		return false
+	}
+	config, err := buildConfig(rawTokens)
+	holder.config.Store(config)
+	return err == nil
+}
+
+// buildConfig constructs a new snapshot of the token configurations. When rawTokens can not be parsed,
+// it returns the error with an empty snapshot.
+func buildConfig(rawTokens []byte) (*holderConfig, error) {
 	var hostSettingsList []hostSettings
 
 	hosts := []string{}
-	bearerTokenAllowedPaths := map[string]map[string][]*regexp.Regexp{}
+	hostPatterns := []*regexp.Regexp{}
+	bearerTokenCredentials := map[string]map[string]BearerCredential{}
 	bearerTokens := map[string][]string{}
-	basicAuthPaths := map[string]map[string]map[string]string{}
-	noAuthPaths := map[string][]string{}
+	noAuthPaths := map[string][]*regexp.Regexp{}
+	userAgentAllows := map[string][]*regexp.Regexp{}
+	userAgentDenies := map[string][]*regexp.Regexp{}
+	hmacAuths := map[string]map[string]HMACAuth{}
+	softDenies := map[string]bool{}
+	noAuthQueries := map[string]NoAuthQuery{}
+	basicAuthCredentials := map[string]map[string][]BasicCredential{}
+	basicAuthPriorities := map[string]map[*regexp.Regexp]int{}
+	basicAuthPathRes := map[string]map[string]*regexp.Regexp{}
+	noAuthPriorities := map[string]int{}
+	noAuthBypasses := map[string]bool{}
+	noAuthRateLimits := map[string]*RateLimit{}
+	unknownTokenForbiddens := map[string]bool{}
+	warnings := []string{}
+	loadErrors := []string{}
+	compileErrors := []error{}
+	defaultHost := ""
+	noAuthLabels := map[string]map[*regexp.Regexp]string{}
+	noAuthPathMethods := map[string]map[*regexp.Regexp][]string{}
+	ruleLabels := map[string][]string{}
+	methodOverrides := map[string]bool{}
+	matchQueries := map[string]bool{}
+	cacheDisabled := map[string]bool{}
+	rootPaths := map[string]string{}
+	realms := map[string]string{}
+	ipRules := map[string]IPRules{}
+	jwtAuths := map[string]JWTAuth{}
+	introspectionAuths := map[string]IntrospectionAuth{}
+	policy := getTokenPolicy()
 
-	if err := json.Unmarshal(rawTokens, &hostSettingsList); err == nil {
+	err := json.Unmarshal(rawTokens, &hostSettingsList)
+	if err == nil {
+		hostSettingsList, err = mergeHosts(hostSettingsList, getDuplicateHosts())
+	}
+	if err == nil {
 		for _, hostSettings := range hostSettingsList {
+			// the invalid patterns are ignored when loading, so they are recorded to be surfaced
+			patternErrors, patternWarnings := invalidPatterns(hostSettings)
+			for _, patternErr := range append(patternErrors, patternWarnings...) {
+				logging.Warn("invalid pattern ignored", "error", patternErr)
+				compileErrors = append(compileErrors, patternErr)
+				loadErrors = append(loadErrors, patternErr.Error())
+			}
 			hosts = append(hosts, hostSettings.Host)
-			for _, bearerToken := range hostSettings.AuthTokens.BearerTokens {
+			// the default host is not matched by its pattern, so that it never wins over the other hosts
+			if hostSettings.Default {
+				defaultHost = hostSettings.Host
+			} else if hostRe, err := regexp.Compile(hostSettings.Host); err == nil {
+				hostPatterns = append(hostPatterns, hostRe)
+			}
+			for index, bearerToken := range hostSettings.AuthTokens.BearerTokens {
+				if !policy.allow(hostSettings.Host, bearerToken.Token, &warnings) {
+					continue
+				}
 				sl := make([]*regexp.Regexp, 0, 0)
-				for _, rawAllowedPath := range bearerToken.RawAllowedPaths {
+				pathMethods := map[*regexp.Regexp][]string{}
+				for i, rawAllowedPath := range bearerToken.RawAllowedPaths {
 					tokenRe, err := regexp.Compile(rawAllowedPath)
 					if err == nil && tokenRe != nil {
 						sl = append(sl, tokenRe)
+						if methods := bearerToken.AllowedPathMethods[i]; methods != nil {
+							pathMethods[tokenRe] = methods
+						}
 					}
 				}
-				if len(sl) > 0 {
-					if _, ok := bearerTokenAllowedPaths[hostSettings.Host]; !ok {
-						bearerTokenAllowedPaths[hostSettings.Host] = map[string][]*regexp.Regexp{}
-					}
-					bearerTokenAllowedPaths[hostSettings.Host][bearerToken.Token] = sl
+				// a default_allow token is held even if it has no allowed path
+				if len(sl) > 0 || bearerToken.DefaultAllow {
 					if _, ok := bearerTokens[hostSettings.Host]; !ok {
 						bearerTokens[hostSettings.Host] = []string{}
 					}
 					bearerTokens[hostSettings.Host] = append(bearerTokens[hostSettings.Host], bearerToken.Token)
+					if len(pathMethods) == 0 {
+						pathMethods = nil
+					}
+					deniedPaths := compilePaths(bearerToken.RawDeniedPaths)
+					if len(deniedPaths) == 0 {
+						deniedPaths = nil
+					}
+					label := ruleLabel(bearerToken.Label, "bearer_tokens", index)
+					if _, ok := bearerTokenCredentials[hostSettings.Host]; !ok {
+						bearerTokenCredentials[hostSettings.Host] = map[string]BearerCredential{}
+					}
+					bearerTokenCredentials[hostSettings.Host][bearerToken.Token] = BearerCredential{
+						AllowedPaths:       sl,
+						AllowedPathMethods: pathMethods,
+						DeniedPaths:        deniedPaths,
+						DefaultAllow:       bearerToken.DefaultAllow,
+						ExactHost:          bearerToken.ExactHost,
+						Label:              label,
+						ValidUntil:         bearerToken.ValidUntil,
+						Limits:             bearerToken.Limits.inherit(hostSettings.AuthTokens.Defaults),
+					}
+					ruleLabels[hostSettings.Host] = append(ruleLabels[hostSettings.Host], label)
 				}
 			}
 
-			for _, basicAuth := range hostSettings.AuthTokens.BasicAuths {
+			for index, basicAuth := range hostSettings.AuthTokens.BasicAuths {
+				if _, ok := basicAuthPriorities[hostSettings.Host]; !ok {
+					basicAuthPriorities[hostSettings.Host] = map[*regexp.Regexp]int{}
+					basicAuthPathRes[hostSettings.Host] = map[string]*regexp.Regexp{}
+				}
+				sl := make([]*regexp.Regexp, 0, 0)
 				for _, rawAllowedPath := range basicAuth.RawAllowedPaths {
-					if _, ok := basicAuthPaths[hostSettings.Host]; !ok {
-						basicAuthPaths[hostSettings.Host] = map[string]map[string]string{}
+					// the path shared by several users is compiled once, so that it has one priority
+					pathRe, ok := basicAuthPathRes[hostSettings.Host][rawAllowedPath]
+					if !ok {
+						var err error
+						if pathRe, err = regexp.Compile(rawAllowedPath); err != nil {
+							continue
+						}
+						basicAuthPathRes[hostSettings.Host][rawAllowedPath] = pathRe
+					}
+					sl = append(sl, pathRe)
+					// when several users share the path, the highest priority is used
+					if priority, ok := basicAuthPriorities[hostSettings.Host][pathRe]; !ok || priority < basicAuth.Priority {
+						basicAuthPriorities[hostSettings.Host][pathRe] = basicAuth.Priority
+					}
+				}
+				if _, ok := basicAuthCredentials[hostSettings.Host]; !ok {
+					basicAuthCredentials[hostSettings.Host] = map[string][]BasicCredential{}
+				}
+				label := ruleLabel(basicAuth.Label, "basic_auths", index)
+				basicAuthCredentials[hostSettings.Host][basicAuth.Username] = append(basicAuthCredentials[hostSettings.Host][basicAuth.Username], BasicCredential{
+					Password:     basicAuth.Password,
+					PasswordHash: basicAuth.PasswordHash,
+					AllowedPaths: sl,
+					ExactHost:    basicAuth.ExactHost,
+					Label:        label,
+					Limits:       basicAuth.Limits.inherit(hostSettings.AuthTokens.Defaults),
+				})
+				ruleLabels[hostSettings.Host] = append(ruleLabels[hostSettings.Host], label)
+			}
+			for _, hmacAuth := range hostSettings.AuthTokens.HMACAuths {
+				sl := make([]*regexp.Regexp, 0, 0)
+				for _, rawAllowedPath := range hmacAuth.RawAllowedPaths {
+					pathRe, err := regexp.Compile(rawAllowedPath)
+					if err == nil && pathRe != nil {
+						sl = append(sl, pathRe)
+					}
+				}
+				if _, ok := hmacAuths[hostSettings.Host]; !ok {
+					hmacAuths[hostSettings.Host] = map[string]HMACAuth{}
+				}
+				hmacAuths[hostSettings.Host][hmacAuth.KeyID] = HMACAuth{
+					Secret:        hmacAuth.Secret,
+					SignedHeaders: hmacAuth.SignedHeaders,
+					AllowedPaths:  sl,
+				}
+			}
+			if jwt := hostSettings.AuthTokens.JWT; jwt != nil {
+				claimPaths := map[string][]*regexp.Regexp{}
+				for value, rawPaths := range jwt.RawClaimPaths {
+					claimPaths[value] = compilePaths(rawPaths)
+				}
+				jwtAuths[hostSettings.Host] = JWTAuth{
+					Verifier:     NewJWTVerifierWithAudiences(jwt.Issuers, jwt.JWKSURL, jwt.Audiences),
+					AllowedPaths: compilePaths(jwt.RawAllowedPaths),
+					Claim:        jwt.Claim,
+					ClaimPaths:   claimPaths,
+					Limits:       jwt.Limits.inherit(hostSettings.AuthTokens.Defaults),
+				}
+			}
+			if introspection := hostSettings.AuthTokens.Introspection; introspection != nil {
+				claimPaths := map[string][]*regexp.Regexp{}
+				for value, rawPaths := range introspection.RawClaimPaths {
+					claimPaths[value] = compilePaths(rawPaths)
+				}
+				introspectionAuths[hostSettings.Host] = IntrospectionAuth{
+					Introspector: NewIntrospectorWithNegativeCache(introspection.URL, introspection.ClientID, introspection.ClientSecret, introspection.CacheTTL, introspection.NegativeCacheTTL),
+					AllowedPaths: compilePaths(introspection.RawAllowedPaths),
+					Claim:        introspection.Claim,
+					ClaimPaths:   claimPaths,
+					Limits:       introspection.Limits.inherit(hostSettings.AuthTokens.Defaults),
+				}
+			}
+
+			if len(hostSettings.AuthTokens.NoAuths.RawAllowedPaths) > 0 {
+				noAuthPaths[hostSettings.Host] = compilePaths(hostSettings.AuthTokens.NoAuths.RawAllowedPaths)
+				// the label is the index in the configuration, which does not change by the invalid patterns skipped
+				labels := map[*regexp.Regexp]string{}
+				pathMethods := map[*regexp.Regexp][]string{}
+				compiled := 0
+				for index, rawAllowedPath := range hostSettings.AuthTokens.NoAuths.RawAllowedPaths {
+					if _, err := regexp.Compile(rawAllowedPath); err != nil {
+						continue
 					}
-					if _, ok := basicAuthPaths[hostSettings.Host][rawAllowedPath]; !ok {
-						basicAuthPaths[hostSettings.Host][rawAllowedPath] = map[string]string{}
+					label := ruleLabel("", "no_auths.allowed_paths", index)
+					labels[noAuthPaths[hostSettings.Host][compiled]] = label
+					ruleLabels[hostSettings.Host] = append(ruleLabels[hostSettings.Host], label)
+					if methods := hostSettings.AuthTokens.NoAuths.AllowedPathMethods; index < len(methods) && methods[index] != nil {
+						pathMethods[noAuthPaths[hostSettings.Host][compiled]] = methods[index]
 					}
-					basicAuthPaths[hostSettings.Host][rawAllowedPath][basicAuth.Username] = basicAuth.Password
+					compiled++
+				}
+				noAuthLabels[hostSettings.Host] = labels
+				if len(pathMethods) > 0 {
+					noAuthPathMethods[hostSettings.Host] = pathMethods
+				}
+			}
+			noAuthPriorities[hostSettings.Host] = hostSettings.AuthTokens.NoAuths.Priority
+			if hostSettings.AuthTokens.NoAuths.BypassProtections {
+				noAuthBypasses[hostSettings.Host] = true
+			}
+			if rateLimit := hostSettings.AuthTokens.NoAuths.RateLimit; rateLimit != nil {
+				noAuthRateLimits[hostSettings.Host] = &RateLimit{Requests: rateLimit.Requests, Period: rateLimit.Period}
+			}
+			// match_query of the host applies to no_auths too
+			noAuthMatchQuery := hostSettings.AuthTokens.NoAuths.MatchQuery || hostSettings.AuthTokens.MatchQuery
+			if noAuthMatchQuery || len(hostSettings.AuthTokens.NoAuths.DeniedQueryParams) > 0 {
+				noAuthQueries[hostSettings.Host] = NoAuthQuery{
+					MatchQuery:        noAuthMatchQuery,
+					DeniedQueryParams: hostSettings.AuthTokens.NoAuths.DeniedQueryParams,
 				}
 			}
-			noAuthPaths[hostSettings.Host] = hostSettings.AuthTokens.NoAuths.RawAllowedPaths
+			if allows := compileUserAgents(hostSettings.AuthTokens.UAAllows); allows != nil {
+				userAgentAllows[hostSettings.Host] = allows
+			}
+			if denies := compileUserAgents(hostSettings.AuthTokens.UADenies); denies != nil {
+				userAgentDenies[hostSettings.Host] = denies
+			}
+			if hostSettings.AuthTokens.SoftDeny {
+				softDenies[hostSettings.Host] = true
+			}
+			if hostSettings.AuthTokens.UnknownTokenForbidden {
+				unknownTokenForbiddens[hostSettings.Host] = true
+			}
+			if hostSettings.AuthTokens.MethodOverride {
+				methodOverrides[hostSettings.Host] = true
+			}
+			if hostSettings.AuthTokens.MatchQuery {
+				matchQueries[hostSettings.Host] = true
+			}
+			if !hostSettings.AuthTokens.Cache {
+				cacheDisabled[hostSettings.Host] = true
+			}
+			if hostSettings.AuthTokens.RootPath != RootPathRules {
+				rootPaths[hostSettings.Host] = hostSettings.AuthTokens.RootPath
+			}
+			if len(hostSettings.AuthTokens.Realm) > 0 {
+				realms[hostSettings.Host] = hostSettings.AuthTokens.Realm
+			}
+			if hostSettings.AuthTokens.IPRules != nil {
+				ipRules[hostSettings.Host] = *hostSettings.AuthTokens.IPRules
+			}
 		}
 	} else {
-		log.Printf("AUTH_TOKENS parse failed: %v\n", err)
+		description := describeParseError(rawTokens, err)
+		// the description is a part of the message, so that the quoted text of the configurations can be read as it is
+		logging.Error("AUTH_TOKENS parse failed: " + description)
+		loadErrors = append(loadErrors, "parse failed: "+description)
 	}
 
-	log.Printf("hosts: %v\n--------\n", hosts)
-	log.Printf("bearerTokenAllowedPaths: %v\n--------\n", bearerTokenAllowedPaths)
-	log.Printf("basicAuthPaths, %v\n--------\n", basicAuthPaths)
-	log.Printf("noAuthPaths, %v\n--------\n", noAuthPaths)
+	config := &holderConfig{
+		hosts:                  hosts,
+		hostPatterns:           hostPatterns,
+		bearerTokenCredentials: bearerTokenCredentials,
+		bearerTokens:           bearerTokens,
+		noAuthPaths:            noAuthPaths,
+		userAgentAllows:        userAgentAllows,
+		userAgentDenies:        userAgentDenies,
+		hmacAuths:              hmacAuths,
+		softDenies:             softDenies,
+		noAuthQueries:          noAuthQueries,
+		basicAuthCredentials:   basicAuthCredentials,
+		basicAuthPriorities:    basicAuthPriorities,
+		noAuthPriorities:       noAuthPriorities,
+		noAuthBypasses:         noAuthBypasses,
+		noAuthRateLimits:       noAuthRateLimits,
+		unknownTokenForbiddens: unknownTokenForbiddens,
+		warnings:               warnings,
+		loadErrors:             loadErrors,
+		compileErrors:          compileErrors,
+		defaultHost:            defaultHost,
+		noAuthLabels:           noAuthLabels,
+		noAuthPathMethods:      noAuthPathMethods,
+		ruleLabels:             ruleLabels,
+		methodOverrides:        methodOverrides,
+		matchQueries:           matchQueries,
+		cacheDisabled:          cacheDisabled,
+		rootPaths:              rootPaths,
+		realms:                 realms,
+		ipRules:                ipRules,
+		jwtAuths:               jwtAuths,
+		introspectionAuths:     introspectionAuths,
+	}
+	if err == nil {
+		config.rawTokens = rawTokens
+	}
+	logHosts(config)
+	return config, err
+}
 
-	holder.hosts = hosts
-	holder.bearerTokenAllowedPaths = bearerTokenAllowedPaths
-	holder.bearerTokens = bearerTokens
-	holder.basicAuthPaths = basicAuthPaths
-	holder.noAuthPaths = noAuthPaths
+// logHosts logs how many rules each host has and their labels, which never reveal the tokens or the passwords.
+func logHosts(config *holderConfig) {
+	logging.Info("token configurations loaded", "hosts", strings.Join(config.hosts, ","))
+	for _, host := range config.hosts {
+		logging.Info("host loaded", "host", host,
+			"bearer_tokens", len(config.bearerTokens[host]),
+			"basic_auths", len(config.basicAuthCredentials[host]),
+			"hmac_auths", len(config.hmacAuths[host]),
+			"no_auth_paths", len(config.noAuthPaths[host]))
+		logging.Debug("rules loaded", "host", host, "rules", strings.Join(config.ruleLabels[host], ","))
+	}
 }
 
+/*
+ReplaceFromBytes : replace the whole token configurations with rawTokens at once, without "AUTH_TOKENS" or "AUTH_TOKENS_PATH".
+	rawTokens is validated in the same way as Validate, and the current configurations are kept when it is not valid.
+	The callbacks registered by OnReload are called when the configurations are changed.
+*/
+func (holder *Holder) ReplaceFromBytes(rawTokens []byte) error {
+	if report := Validate(rawTokens); !report.Valid {
+		return fmt.Errorf("invalid token configurations: %s", strings.Join(report.Errors, "; "))
+	}
+	if !makeHolder(holder, rawTokens) {
+		return nil
+	}
+	holder.notifyReload()
+	return nil
+}
+
+func compilePaths(rawPaths []string) []*regexp.Regexp {
+	sl := make([]*regexp.Regexp, 0, len(rawPaths))
+	for _, rawPath := range rawPaths {
+		pathRe, err := regexp.Compile(rawPath)
+		if err == nil && pathRe != nil {
+			sl = append(sl, pathRe)
+		}
+	}
+	return sl
+}
+
+func compileUserAgents(rawUserAgents []string) []*regexp.Regexp {
+	if len(rawUserAgents) == 0 {
+		return nil
+	}
+	// keep an empty (not nil) slice when all patterns are invalid, so that the rule is still enabled
+	sl := make([]*regexp.Regexp, 0, len(rawUserAgents))
+	for _, rawUserAgent := range rawUserAgents {
+		userAgentRe, err := regexp.Compile(rawUserAgent)
+		if err == nil && userAgentRe != nil {
+			sl = append(sl, userAgentRe)
+		}
+	}
+	return sl
+}
+
+// monitor watches the directory of the file instead of the file itself, because the file is often replaced by a rename,
+// like the atomic swap of the "..data" symlink of Kubernetes secret volumes, and a watch of the replaced file never reports the later changes.
+// The directory of "AUTH_TOKENS_DIR" is watched itself.
 func monitor(holder *Holder, rawTokensPath string) {
-	watcher, _ := fsnotify.NewWatcher()
+	defer holder.watchers.Done()
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		logging.Error("watcher failed", "error", err)
+		return
+	}
 	defer watcher.Close()
+	watched := filepath.Dir(rawTokensPath)
+	if holder.rawTokensDir {
+		watched = rawTokensPath
+	}
+	if err := watcher.Add(watched); err != nil {
+		logging.Error("watcher failed", "error", err)
+		return
+	}
 	for {
-		err := watcher.Add(rawTokensPath)
-		if err != nil {
-			log.Printf("watcher failed: %v\n", err)
+		select {
+		case <-holder.done:
 			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			if holder.rawTokensDir && !isTokensDirEvent(event, rawTokensPath) {
+				continue
+			}
+			if !holder.rawTokensDir && !isTokensEvent(event, rawTokensPath) {
+				continue
+			}
+			// the file is removed for a moment during the swap, and the configurations are kept until it appears again
+			if _, err := os.Stat(rawTokensPath); err != nil {
+				logging.Warn(holder.pathVariable()+" is not found, and the configurations are kept", "path", rawTokensPath)
+				continue
+			}
+			if loadFile(holder, rawTokensPath) {
+				holder.notifyReload()
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			logging.Error("watcher error", "error", err)
 		}
-		select {
-		case <-watcher.Events:
-			loadFile(holder, rawTokensPath)
+	}
+}
+
+// kubernetesDataLink is the symlink which Kubernetes swaps atomically to update all files of a secret or config map volume.
+const kubernetesDataLink = "..data"
+
+// isTokensEvent checks whether the event of the directory may change the file of rawTokensPath.
+func isTokensEvent(event fsnotify.Event, rawTokensPath string) bool {
+	if filepath.Clean(event.Name) == filepath.Clean(rawTokensPath) {
+		return event.Op&fsnotify.Chmod != event.Op
+	}
+	return filepath.Base(event.Name) == kubernetesDataLink && event.Op&(fsnotify.Create|fsnotify.Rename) != 0
+}
+
+/*
+Close : stop watching "AUTH_TOKENS_PATH" and wait for the watchers to exit.
+	The current configurations are kept, but the changes of the file are not applied any more.
+*/
+func (holder *Holder) Close() {
+	holder.closeOnce.Do(func() {
+		if holder.done != nil {
+			close(holder.done)
 		}
+	})
+	holder.watchers.Wait()
+}
+
+/*
+OnReload : register the callback which is called after each successful reload of "AUTH_TOKENS_PATH".
+	The callback is not called when the file is not changed or can not be parsed.
+*/
+func (holder *Holder) OnReload(callback func()) {
+	holder.reloadMutex.Lock()
+	defer holder.reloadMutex.Unlock()
+	holder.reloadCallbacks = append(holder.reloadCallbacks, callback)
+}
+
+func (holder *Holder) notifyReload() {
+	holder.reloadMutex.Lock()
+	callbacks := make([]func(), len(holder.reloadCallbacks))
+	copy(callbacks, holder.reloadCallbacks)
+	holder.reloadMutex.Unlock()
+	for _, callback := range callbacks {
+		callback()
+	}
+}
+
+// load returns the current snapshot of the token configurations, or an empty one before the first load.
+func (holder *Holder) load() *holderConfig {
+	if config, ok := holder.config.Load().(*holderConfig); ok {
+		return config
 	}
+	return &holderConfig{}
+}
+
+/*
+Snapshot : get a Holder pinned to the current token configurations, which are not changed by the later reloads.
+	A request should read all configurations from one snapshot not to mix the configurations before and after a reload.
+*/
+func (holder *Holder) Snapshot() *Holder {
+	snapshot := &Holder{}
+	snapshot.now.Store(holder.clockFunc())
+	snapshot.config.Store(holder.load())
+	return snapshot
+}
+
+/*
+IsReady : check whether the token configurations have been loaded successfully and have at least one host.
+	It is also false when the file of "AUTH_TOKENS_PATH" has not been loaded within "CONFIG_MAX_AGE".
+*/
+func (holder *Holder) IsReady() bool {
+	config := holder.load()
+	return config.rawTokens != nil && len(config.hosts) > 0 && !holder.isStale()
+}
+
+/*
+Warnings : get the warnings found when loading the token configurations, like weak bearer tokens.
+*/
+func (holder *Holder) Warnings() []string {
+	return holder.load().warnings
+}
+
+/*
+Errors : get the errors found when loading the token configurations, like a parse error and the invalid patterns which are ignored.
+	The configurations are still used even if they have errors, so check them before deploying.
+*/
+func (holder *Holder) Errors() []string {
+	return holder.load().loadErrors
+}
+
+/*
+CompileErrors : get the patterns which can not be compiled and are ignored when loading the token configurations.
+	Each error is a *PatternError, which has the host, the rule and the pattern.
+*/
+func (holder *Holder) CompileErrors() []error {
+	return holder.load().compileErrors
 }
 
 /*
 GetHosts : get all hosts held in this Hoder.
 */
 func (holder *Holder) GetHosts() []string {
-	return holder.hosts
+	return holder.load().hosts
+}
+
+/*
+GetHostPatterns : get the compiled patterns of all hosts held in this Holder, whose String() is the host.
+*/
+func (holder *Holder) GetHostPatterns() []*regexp.Regexp {
+	return holder.load().hostPatterns
+}
+
+/*
+GetDefaultHost : get the host which has "default", and false when no host has it.
+	The default host is used for the domains which match no other host, whatever its pattern is.
+*/
+func (holder *Holder) GetDefaultHost() (string, bool) {
+	defaultHost := holder.load().defaultHost
+	return defaultHost, len(defaultHost) > 0
+}
+
+/*
+MatchHost : get the host of the domain (the Host header, which may have a port) in the same way as the router matches the requests.
+	The first host matching the domain in the order of the configurations wins, and the default host is used when no host matches.
+*/
+func (holder *Holder) MatchHost(domain string) (string, bool) {
+	if matched := MatchHostPatterns(domain, holder.GetHostPatterns()); len(matched) > 0 {
+		return matched[0], true
+	}
+	return holder.GetDefaultHost()
+}
+
+/*
+HasHost : check whether the domain (the Host header, which may have a port) matches any host held in this Holder.
+	It is always true when a host has "default".
+*/
+func (holder *Holder) HasHost(domain string) bool {
+	_, ok := holder.MatchHost(domain)
+	return ok
+}
+
+/*
+MatchHostPatterns : get the patterns of hosts which match the domain in the order of the configurations.
+	The first one is the host of the domain, and the others tell that some patterns are broader than intended.
+*/
+func MatchHostPatterns(domain string, hostPatterns []*regexp.Regexp) []string {
+	var matched []string
+	for _, hostRe := range hostPatterns {
+		if hostRe.MatchString(domain) {
+			matched = append(matched, hostRe.String())
+		}
+	}
+	return matched
 }
 
 /*
 GetTokens : get all bearer tokens associated with the host.
 */
 func (holder *Holder) GetTokens(host string) []string {
-	return holder.bearerTokens[host]
+	return holder.load().bearerTokens[host]
 }
 
 /*
 HasToken : check whether the bearer token associated with the host is held in this Holder.
 */
 func (holder *Holder) HasToken(host string, token string) bool {
-	_, ok := holder.bearerTokenAllowedPaths[host][token]
-	return ok
+	config := holder.load()
+	bearerCredential, ok := config.bearerTokenCredentials[host][token]
+	return ok && holder.isValid(bearerCredential)
+}
+
+/*
+SetClock : replace the clock used to check "valid_until" of bearer tokens, mainly for tests.
+*/
+func (holder *Holder) SetClock(now func() time.Time) {
+	holder.now.Store(now)
+}
+
+// isValid checks that the bearer token does not pass its "valid_until".
+func (holder *Holder) isValid(bearerCredential BearerCredential) bool {
+	if bearerCredential.ValidUntil.IsZero() {
+		return true
+	}
+	return holder.clock().Before(bearerCredential.ValidUntil)
 }
 
 /*
 GetAllowedPaths : get all allowed paths associated with the bearer token.
 */
 func (holder *Holder) GetAllowedPaths(host string, token string) []*regexp.Regexp {
-	return holder.bearerTokenAllowedPaths[host][token]
+	return holder.load().bearerTokenCredentials[host][token].AllowedPaths
+}
+
+/*
+GetAllowedPathMethods : get the methods of the allowed paths which are scoped to methods. The other allowed paths allow all methods.
+*/
+func (holder *Holder) GetAllowedPathMethods(host string, token string) map[*regexp.Regexp][]string {
+	return holder.load().bearerTokenCredentials[host][token].AllowedPathMethods
 }
 
 /*
 GetBasicAuthConf : get all configurations of basic authentication associated with the host.
+	The value of each user is the password, or the hash of "password_hash", which IsPasswordHash tells.
+	It is built from the credentials of LookupBasic, which hold the compiled paths, so the invalid paths are skipped.
 */
 func (holder *Holder) GetBasicAuthConf(host string) map[string]map[string]string {
-	return holder.basicAuthPaths[host]
+	basicAuthCredentials, ok := holder.load().basicAuthCredentials[host]
+	if !ok {
+		return nil
+	}
+	basicAuthConf := map[string]map[string]string{}
+	for username, basicCredentials := range basicAuthCredentials {
+		for _, basicCredential := range basicCredentials {
+			for _, allowedPath := range basicCredential.AllowedPaths {
+				if _, ok := basicAuthConf[allowedPath.String()]; !ok {
+					basicAuthConf[allowedPath.String()] = map[string]string{}
+				}
+				basicAuthConf[allowedPath.String()][username] = basicCredential.secret()
+			}
+		}
+	}
+	return basicAuthConf
 }
 
 /*
 GetNoAuthPaths : get all allowed paths without authentication associated with the host.
 */
-func (holder *Holder) GetNoAuthPaths(host string) []string {
-	return holder.noAuthPaths[host]
+func (holder *Holder) GetNoAuthPaths(host string) []*regexp.Regexp {
+	return holder.load().noAuthPaths[host]
+}
+
+/*
+GetNoAuthPathMethods : get the methods of the paths without authentication which are scoped to methods. The other paths allow all methods.
+*/
+func (holder *Holder) GetNoAuthPathMethods(host string) map[*regexp.Regexp][]string {
+	return holder.load().noAuthPathMethods[host]
+}
+
+/*
+IsMethodOverride : check whether "X-HTTP-Method-Override" of POST requests to the host is used as the method for authorization.
+*/
+func (holder *Holder) IsMethodOverride(host string) bool {
+	return holder.load().methodOverrides[host]
+}
+
+/*
+IsMatchQuery : check whether the paths of all rules of the host are matched against the path and the query string like "/entities?type=Room".
+*/
+func (holder *Holder) IsMatchQuery(host string) bool {
+	return holder.load().matchQueries[host]
+}
+
+/*
+GetRuleLabels : get the labels of all bearer tokens, basic auth users and patterns of no_auths of the host.
+	A label is "label" of the rule, or its field and index like "bearer_tokens[0]", so that it never reveals the secrets.
+*/
+func (holder *Holder) GetRuleLabels(host string) []string {
+	return holder.load().ruleLabels[host]
+}
+
+/*
+GetNoAuthLabels : get the labels of the patterns of no_auths associated with the host.
+*/
+func (holder *Holder) GetNoAuthLabels(host string) map[*regexp.Regexp]string {
+	return holder.load().noAuthLabels[host]
+}
+
+/*
+IsCacheDisabled : check whether the decisions about the paths and the credentials of the host are evaluated every time without the caches.
+*/
+func (holder *Holder) IsCacheDisabled(host string) bool {
+	return holder.load().cacheDisabled[host]
+}
+
+/*
+GetRootPath : get the behavior of the root path "/" of the host, which is RootPathRules, RootPathDeny or RootPathAllow.
+*/
+func (holder *Holder) GetRootPath(host string) string {
+	if rootPath, ok := holder.load().rootPaths[host]; ok {
+		return rootPath
+	}
+	return RootPathRules
+}
+
+/*
+GetRealm : get the realm of the WWW-Authenticate headers of the host, and false when the host has no realm.
+*/
+func (holder *Holder) GetRealm(host string) (string, bool) {
+	realm, ok := holder.load().realms[host]
+	return realm, ok
+}
+
+/*
+IsUnknownTokenForbidden : check whether unknown bearer tokens to the host are rejected with 403 instead of 401.
+*/
+func (holder *Holder) IsUnknownTokenForbidden(host string) bool {
+	return holder.load().unknownTokenForbiddens[host]
+}
+
+/*
+IsNoAuthBypass : check whether the paths without authentication of the host bypass the protections like the User-Agent filter.
+*/
+func (holder *Holder) IsNoAuthBypass(host string) bool {
+	return holder.load().noAuthBypasses[host]
+}
+
+/*
+GetNoAuthRateLimit : get the rate limit per client IP of the paths without authentication associated with the host, or nil when it is not set.
+*/
+func (holder *Holder) GetNoAuthRateLimit(host string) *RateLimit {
+	return holder.load().noAuthRateLimits[host]
+}
+
+/*
+GetNoAuthPriority : get the priority of the paths without authentication associated with the host.
+*/
+func (holder *Holder) GetNoAuthPriority(host string) int {
+	return holder.load().noAuthPriorities[host]
+}
+
+/*
+GetBasicAuthPriorities : get the priorities of the paths of basic authentication associated with the host.
+*/
+func (holder *Holder) GetBasicAuthPriorities(host string) map[*regexp.Regexp]int {
+	return holder.load().basicAuthPriorities[host]
+}
+
+/*
+GetNoAuthQuery : get how the query string is handled when matching the paths without authentication associated with the host.
+*/
+func (holder *Holder) GetNoAuthQuery(host string) NoAuthQuery {
+	return holder.load().noAuthQueries[host]
+}
+
+/*
+GetTokenLimits : get the limitations associated with the bearer token.
+*/
+func (holder *Holder) GetTokenLimits(host string, token string) Limits {
+	return holder.load().bearerTokenCredentials[host][token].Limits
+}
+
+/*
+GetBasicAuthLimits : get the limitations associated with the user of basic authentication.
+	The user given with different passwords has the limitations of each credential, and the first one is returned.
+*/
+func (holder *Holder) GetBasicAuthLimits(host string, username string) Limits {
+	basicCredentials := holder.load().basicAuthCredentials[host][username]
+	if len(basicCredentials) == 0 {
+		return Limits{}
+	}
+	return basicCredentials[0].Limits
+}
+
+/*
+GetIPRules : get the CIDR ranges of the client IPs allowed and denied to access the host.
+	The empty rules allow all IPs.
+*/
+func (holder *Holder) GetIPRules(host string) IPRules {
+	return holder.load().ipRules[host]
+}
+
+/*
+GetUserAgentRules : get the allowed and denied User-Agent patterns associated with the host.
+	nil means that the rule is not configured.
+*/
+func (holder *Holder) GetUserAgentRules(host string) ([]*regexp.Regexp, []*regexp.Regexp) {
+	config := holder.load()
+	return config.userAgentAllows[host], config.userAgentDenies[host]
+}
+
+/*
+GetHMACAuth : get the configuration of HMAC signature authentication associated with the key id.
+*/
+func (holder *Holder) GetHMACAuth(host string, keyID string) (HMACAuth, bool) {
+	hmacAuth, ok := holder.load().hmacAuths[host][keyID]
+	return hmacAuth, ok
+}
+
+/*
+GetJWTAuth : get the configuration of JWT bearer tokens associated with the host.
+	The bearer tokens to the host are verified as JWTs instead of the literal tokens when it returns true.
+*/
+func (holder *Holder) GetJWTAuth(host string) (JWTAuth, bool) {
+	jwtAuth, ok := holder.load().jwtAuths[host]
+	return jwtAuth, ok
+}
+
+/*
+GetIntrospectionAuth : get the configuration of the bearer tokens checked by the introspection endpoint associated with the host.
+	The bearer tokens to the host are introspected instead of the literal tokens when it returns true.
+*/
+func (holder *Holder) GetIntrospectionAuth(host string) (IntrospectionAuth, bool) {
+	introspectionAuth, ok := holder.load().introspectionAuths[host]
+	return introspectionAuth, ok
+}
+
+/*
+IsSoftDeny : check whether the denied requests to the host are passed with a flag instead of being rejected.
+*/
+func (holder *Holder) IsSoftDeny(host string) bool {
+	return holder.load().softDenies[host]
+}
+
+/*
+LookupBearer : look up the bearer token associated with the host. Holder implements CredentialStore.
+*/
+func (holder *Holder) LookupBearer(host string, token string) (BearerCredential, bool) {
+	bearerCredential, ok := holder.load().bearerTokenCredentials[host][token]
+	if !ok || !holder.isValid(bearerCredential) {
+		return BearerCredential{}, false
+	}
+	return bearerCredential, true
+}
+
+/*
+LookupBasic : look up the user of basic authentication associated with the host. Holder implements CredentialStore.
+	The user given with different passwords has a credential for each of them.
+*/
+func (holder *Holder) LookupBasic(host string, username string) ([]BasicCredential, bool) {
+	basicCredentials, ok := holder.load().basicAuthCredentials[host][username]
+	return basicCredentials, ok
 }
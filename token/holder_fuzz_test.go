@@ -0,0 +1,56 @@
+//go:build go1.18
+// +build go1.18
+
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+func FuzzMakeHolder(f *testing.F) {
+	logging.SetOutput(ioutil.Discard)
+
+	seeds := []string{
+		``,
+		`[]`,
+		`{}`,
+		`null`,
+		`[{"host": "test.example.com"}]`,
+		`[{"host": "test.example.com", "settings": {}}]`,
+		`[{"host": "test.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`,
+		`[{"host": "(", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["(", "**", "??"]}], "basic_auths": [], "no_auths": {}}}]`,
+		`[{"host": "test.example.com", "settings": {"bearer_tokens": [{"token": "", "allowed_paths": [""]}], "basic_auths": [{"username": "", "password": "", "allowed_paths": ["("]}], "no_auths": {"allowed_paths": ["("]}}}]`,
+		`[{"host": "test.example.com", "settings": {"defaults": {"rate_limit": {"requests": 1, "period": "1s"}}, "bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`,
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, rawTokens []byte) {
+		var holder Holder
+		makeHolder(&holder, rawTokens)
+
+		if holder.GetHosts() == nil {
+			t.Fatalf("GetHosts() returns nil")
+		}
+		for _, host := range holder.GetHosts() {
+			for _, token := range holder.GetTokens(host) {
+				if !holder.HasToken(host, token) {
+					t.Fatalf("HasToken(%q, %q) returns false for a token returned by GetTokens()", host, token)
+				}
+				if len(holder.GetAllowedPaths(host, token)) == 0 {
+					t.Fatalf("GetAllowedPaths(%q, %q) returns empty slice for a held token", host, token)
+				}
+			}
+		}
+	})
+}
@@ -7,25 +7,38 @@ Package token : hold token configurations to check sing HTTP Header.
 package token
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"path/filepath"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
 )
 
 const tmpFilePrefix = "authtest__holder_*"
 
 func setUp(t *testing.T) (*[]string, func()) {
 	t.Helper()
-	log.SetOutput(ioutil.Discard)
+	logging.SetOutput(ioutil.Discard)
 	var tmpFiles []string
 	return &tmpFiles, func() {
 		os.Unsetenv(AuthTokens)
 		os.Unsetenv(AuthTokensPath)
+		os.Unsetenv(AuthTokensDir)
+		os.Unsetenv(AuthTokensMinLength)
+		os.Unsetenv(AuthTokensMinEntropy)
+		os.Unsetenv(AuthTokensStrict)
+		os.Unsetenv(AuthTokensRequireHosts)
+		os.Unsetenv(AuthTokensFormat)
+		os.Unsetenv(AuthTokensWatch)
+		os.Unsetenv(AuthTokensDuplicateHosts)
 
 		for _, tmpFile := range tmpFiles {
 			if err := os.Remove(tmpFile); err != nil {
@@ -47,6 +60,22 @@ func setUpTmpFile(t *testing.T, tmpFiles *[]string) (*os.File, func()) {
 	}
 }
 
+func patternStrings(patterns []*regexp.Regexp) []string {
+	sl := make([]string, 0, len(patterns))
+	for _, pattern := range patterns {
+		sl = append(sl, pattern.String())
+	}
+	return sl
+}
+
+func priorityStrings(priorities map[*regexp.Regexp]int) map[string]int {
+	m := map[string]int{}
+	for pattern, priority := range priorities {
+		m[pattern.String()] = priority
+	}
+	return m
+}
+
 func TestNewHolderEmptyENV(t *testing.T) {
 	assert := assert.New(t)
 	_, tearDown := setUp(t)
@@ -124,7 +153,7 @@ func TestNewHolderEmptyENV(t *testing.T) {
 		})
 
 		t.Run(fmt.Sprintf("GetNoAuthPaths():%s", envCase.name), func(t *testing.T) {
-			assert.Equal([]string(nil), holder.GetNoAuthPaths("127.0.0.1:8080"),
+			assert.Equal([]*regexp.Regexp(nil), holder.GetNoAuthPaths("127.0.0.1:8080"),
 				"GetNoAuthPaths() returns empty slice when %s", envCase.name)
 		})
 	}
@@ -567,23 +596,23 @@ func TestNewHolderWithValidENV(t *testing.T) {
 							t.Run("GetNoAuthPaths()", func(t *testing.T) {
 								assert.Len(holder.GetNoAuthPaths(host1), 0, `GetNoAuthPaths() returns empty slice`)
 								assert.Len(holder.GetNoAuthPaths(host2), 2, `GetNoAuthPaths() returns two slices`)
-								assert.Equal([]string{"^.*/static/.+$", "icon.png"}, holder.GetNoAuthPaths(host2))
+								assert.Equal([]string{"^.*/static/.+$", "icon.png"}, patternStrings(holder.GetNoAuthPaths(host2)))
 								assert.Len(holder.GetNoAuthPaths("invalid"), 0, `GetNoAuthPaths() returns empty slice`)
 							})
 						case "one":
 							t.Run("GetNoAuthPaths()", func(t *testing.T) {
 								assert.Len(holder.GetNoAuthPaths(host1), 1, `GetNoAuthPaths() returns a slice`)
-								assert.Equal([]string{"^.*/static/.+$"}, holder.GetNoAuthPaths(host1))
+								assert.Equal([]string{"^.*/static/.+$"}, patternStrings(holder.GetNoAuthPaths(host1)))
 								assert.Len(holder.GetNoAuthPaths(host2), 2, `GetNoAuthPaths() returns two slices`)
-								assert.Equal([]string{"^.*/static/.+$", "icon.png"}, holder.GetNoAuthPaths(host2))
+								assert.Equal([]string{"^.*/static/.+$", "icon.png"}, patternStrings(holder.GetNoAuthPaths(host2)))
 								assert.Len(holder.GetNoAuthPaths("invalid"), 0, `GetNoAuthPaths() returns empty slice`)
 							})
 						case "multi":
 							t.Run("GetNoAuthPaths()", func(t *testing.T) {
 								assert.Len(holder.GetNoAuthPaths(host1), 2, `GetNoAuthPaths() returns two slices`)
-								assert.Equal([]string{"^.*/static/.+$", "icon.png"}, holder.GetNoAuthPaths(host1))
+								assert.Equal([]string{"^.*/static/.+$", "icon.png"}, patternStrings(holder.GetNoAuthPaths(host1)))
 								assert.Len(holder.GetNoAuthPaths(host2), 2, `GetNoAuthPaths() returns two slices`)
-								assert.Equal([]string{"^.*/static/.+$", "icon.png"}, holder.GetNoAuthPaths(host2))
+								assert.Equal([]string{"^.*/static/.+$", "icon.png"}, patternStrings(holder.GetNoAuthPaths(host2)))
 								assert.Len(holder.GetNoAuthPaths("invalid"), 0, `GetNoAuthPaths() returns empty slice`)
 							})
 						}
@@ -1080,7 +1109,7 @@ func TestNewHolderWithInvalidENV(t *testing.T) {
 					assert.Len(holder.GetBasicAuthConf("test1.example.com"), 0, `GetBasicAuthConf() returns empty slice`)
 				})
 				t.Run("GetNoAuthPaths()", func(t *testing.T) {
-					assert.Equal([]string(nil), holder.GetNoAuthPaths("test1.example.com"), `GetNoAuthPaths() returns empty slice`)
+					assert.Equal([]*regexp.Regexp(nil), holder.GetNoAuthPaths("test1.example.com"), `GetNoAuthPaths() returns empty slice`)
 				})
 			})
 		}
@@ -1217,8 +1246,1759 @@ func TestNewHolderEffectiveENV(t *testing.T) {
 
 	t.Run("GetNoAuthPaths()", func(t *testing.T) {
 		assert.Len(holder.GetNoAuthPaths(host1), 2, `GetNoAuthPaths() returns a slice`)
-		assert.Equal([]string{"^.*/static/.+$", "icon.png"}, holder.GetNoAuthPaths(host1))
+		assert.Equal([]string{"^.*/static/.+$", "icon.png"}, patternStrings(holder.GetNoAuthPaths(host1)))
 		assert.Len(holder.GetNoAuthPaths(host2), 0, `GetNoAuthPaths() returns empty slice`)
-		assert.Equal([]string(nil), holder.GetNoAuthPaths(host2))
+		assert.Equal([]*regexp.Regexp(nil), holder.GetNoAuthPaths(host2))
+	})
+}
+
+func TestNewHolderWithLimits(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host1 := "test1.example.com"
+	host2 := "test2.example.com"
+
+	json := fmt.Sprintf(`
+		[
+			{
+				"host": "%s",
+				"settings": {
+					"defaults": {
+						"rate_limit": {"requests": 10, "period": "1s"},
+						"max_body_size": 1024,
+						"allowed_methods": ["GET", "HEAD"]
+					},
+					"bearer_tokens": [
+						{
+							"token": "TOKEN1",
+							"allowed_paths": ["^/foo/.*$"]
+						}, {
+							"token": "TOKEN2",
+							"allowed_paths": ["^/foo/.*$"],
+							"rate_limit": {"requests": 100, "period": "1m"},
+							"allowed_methods": ["POST"]
+						}, {
+							"token": "TOKEN3",
+							"allowed_paths": ["^/foo/.*$"],
+							"max_body_size": 0,
+							"allowed_methods": []
+						}
+					],
+					"basic_auths": [
+						{
+							"username": "user1",
+							"password": "password1",
+							"allowed_paths": ["/piyo/.+/"]
+						}, {
+							"username": "user2",
+							"password": "password2",
+							"allowed_paths": ["/piyo/.+/"],
+							"max_body_size": 2048
+						}
+					],
+					"no_auths": {}
+				}
+			},
+			{
+				"host": "%s",
+				"settings": {
+					"bearer_tokens": [
+						{
+							"token": "TOKEN1",
+							"allowed_paths": ["^/foo/.*$"]
+						}, {
+							"token": "TOKEN2",
+							"allowed_paths": ["^/foo/.*$"],
+							"rate_limit": {"requests": 5, "period": "10s"}
+						}
+					],
+					"basic_auths": [
+						{
+							"username": "user1",
+							"password": "password1",
+							"allowed_paths": ["/piyo/.+/"]
+						}
+					],
+					"no_auths": {}
+				}
+			}
+		]
+	`, host1, host2)
+	os.Setenv(AuthTokens, json)
+
+	holder := NewHolder()
+
+	t.Run("GetTokenLimits()", func(t *testing.T) {
+		assert.Equal(Limits{
+			RateLimit:      &RateLimit{Requests: 10, Period: time.Second},
+			MaxBodySize:    1024,
+			AllowedMethods: []string{"GET", "HEAD"},
+		}, holder.GetTokenLimits(host1, "TOKEN1"), `TOKEN1 inherits all defaults of host1`)
+		assert.Equal(Limits{
+			RateLimit:      &RateLimit{Requests: 100, Period: time.Minute},
+			MaxBodySize:    1024,
+			AllowedMethods: []string{"POST"},
+		}, holder.GetTokenLimits(host1, "TOKEN2"), `TOKEN2 overrides rate_limit and allowed_methods of host1`)
+		assert.Equal(Limits{
+			RateLimit:      &RateLimit{Requests: 10, Period: time.Second},
+			MaxBodySize:    0,
+			AllowedMethods: []string{},
+		}, holder.GetTokenLimits(host1, "TOKEN3"), `TOKEN3 overrides max_body_size and allowed_methods by empty values`)
+		assert.Equal(Limits{}, holder.GetTokenLimits(host2, "TOKEN1"), `TOKEN1 has no limitation on host2 which has no defaults`)
+		assert.Equal(Limits{
+			RateLimit: &RateLimit{Requests: 5, Period: 10 * time.Second},
+		}, holder.GetTokenLimits(host2, "TOKEN2"), `TOKEN2 has its own rate_limit on host2`)
+		assert.Equal(Limits{}, holder.GetTokenLimits("invalid", "TOKEN1"), `GetTokenLimits() returns no limitation on invalid host`)
+	})
+
+	t.Run("GetBasicAuthLimits()", func(t *testing.T) {
+		assert.Equal(Limits{
+			RateLimit:      &RateLimit{Requests: 10, Period: time.Second},
+			MaxBodySize:    1024,
+			AllowedMethods: []string{"GET", "HEAD"},
+		}, holder.GetBasicAuthLimits(host1, "user1"), `user1 inherits all defaults of host1`)
+		assert.Equal(Limits{
+			RateLimit:      &RateLimit{Requests: 10, Period: time.Second},
+			MaxBodySize:    2048,
+			AllowedMethods: []string{"GET", "HEAD"},
+		}, holder.GetBasicAuthLimits(host1, "user2"), `user2 overrides max_body_size of host1`)
+		assert.Equal(Limits{}, holder.GetBasicAuthLimits(host2, "user1"), `user1 has no limitation on host2 which has no defaults`)
+		assert.Equal(Limits{}, holder.GetBasicAuthLimits("invalid", "user1"), `GetBasicAuthLimits() returns no limitation on invalid host`)
+	})
+}
+
+func TestNewHolderWithInvalidLimits(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	cases := []struct {
+		name   string
+		limits string
+	}{
+		{name: "lostRateLimitRequests", limits: `"rate_limit": {"period": "1s"}`},
+		{name: "lostRateLimitPeriod", limits: `"rate_limit": {"requests": 1}`},
+		{name: "zeroRateLimitRequests", limits: `"rate_limit": {"requests": 0, "period": "1s"}`},
+		{name: "invalidRateLimitPeriod", limits: `"rate_limit": {"requests": 1, "period": "1x"}`},
+		{name: "negativeRateLimitPeriod", limits: `"rate_limit": {"requests": 1, "period": "-1s"}`},
+		{name: "negativeMaxBodySize", limits: `"max_body_size": -1`},
+		{name: "allowedMethodsIsNotList", limits: `"allowed_methods": "GET"`},
+	}
+
+	for _, c := range cases {
+		for _, place := range []string{"defaults", "bearer_tokens", "basic_auths"} {
+			var settings string
+			switch place {
+			case "defaults":
+				settings = fmt.Sprintf(`"defaults": {%s}, "bearer_tokens": [], "basic_auths": [], "no_auths": {}`, c.limits)
+			case "bearer_tokens":
+				settings = fmt.Sprintf(`"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": [], %s}], "basic_auths": [], "no_auths": {}`, c.limits)
+			case "basic_auths":
+				settings = fmt.Sprintf(`"bearer_tokens": [], "basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": [], %s}], "no_auths": {}`, c.limits)
+			}
+			os.Setenv(AuthTokens, fmt.Sprintf(`[{"host": "test.example.com", "settings": {%s}}]`, settings))
+
+			holder := NewHolder()
+
+			t.Run(fmt.Sprintf("%s in %s", c.name, place), func(t *testing.T) {
+				assert.Equal([]string{}, holder.GetHosts(), `GetHosts() returns empty slice when limitations are invalid`)
+			})
+		}
+	}
+}
+
+func TestNewHolderWithUserAgentRules(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host1 := "test1.example.com"
+	host2 := "test2.example.com"
+	host3 := "test3.example.com"
+
+	json := fmt.Sprintf(`
+		[
+			{
+				"host": "%s",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {},
+					"user_agent_allow": ["^Mozilla/", "("],
+					"user_agent_deny": ["(?i)bot"]
+				}
+			},
+			{
+				"host": "%s",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {},
+					"user_agent_allow": ["("],
+					"user_agent_deny": []
+				}
+			},
+			{
+				"host": "%s",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {}
+				}
+			}
+		]
+	`, host1, host2, host3)
+	os.Setenv(AuthTokens, json)
+
+	holder := NewHolder()
+
+	allows, denies := holder.GetUserAgentRules(host1)
+	assert.Equal([]*regexp.Regexp{regexp.MustCompile("^Mozilla/")}, allows, `invalid patterns are ignored`)
+	assert.Equal([]*regexp.Regexp{regexp.MustCompile("(?i)bot")}, denies, `GetUserAgentRules() returns the compiled patterns`)
+
+	allows, denies = holder.GetUserAgentRules(host2)
+	assert.NotNil(allows, `the allow rule is still enabled when all patterns are invalid`)
+	assert.Len(allows, 0, `the allow rule has no valid pattern`)
+	assert.Nil(denies, `the deny rule is not configured when the list is empty`)
+
+	allows, denies = holder.GetUserAgentRules(host3)
+	assert.Nil(allows, `the allow rule is not configured`)
+	assert.Nil(denies, `the deny rule is not configured`)
+}
+
+func TestNewHolderWithHMACAuths(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host1 := "test1.example.com"
+
+	t.Run("valid", func(t *testing.T) {
+		os.Setenv(AuthTokens, fmt.Sprintf(`
+			[
+				{
+					"host": "%s",
+					"settings": {
+						"bearer_tokens": [],
+						"basic_auths": [],
+						"no_auths": {},
+						"hmac_auths": [
+							{
+								"key_id": "key1",
+								"secret": "secret1",
+								"signed_headers": ["host", "date"],
+								"allowed_paths": ["^/foo/.*$", "("]
+							}, {
+								"key_id": "key2",
+								"secret": "secret2",
+								"allowed_paths": []
+							}
+						]
+					}
+				}
+			]
+		`, host1))
+		holder := NewHolder()
+
+		hmacAuth, ok := holder.GetHMACAuth(host1, "key1")
+		assert.True(ok, `GetHMACAuth() returns true when existing key id is given`)
+		assert.Equal(HMACAuth{
+			Secret:        "secret1",
+			SignedHeaders: []string{"host", "date"},
+			AllowedPaths:  []*regexp.Regexp{regexp.MustCompile("^/foo/.*$")},
+		}, hmacAuth, `GetHMACAuth() returns the configuration`)
+
+		hmacAuth, ok = holder.GetHMACAuth(host1, "key2")
+		assert.True(ok, `GetHMACAuth() returns true when existing key id is given`)
+		assert.Equal([]string{}, hmacAuth.SignedHeaders, `signed_headers is empty when it is not set`)
+
+		_, ok = holder.GetHMACAuth(host1, "key3")
+		assert.False(ok, `GetHMACAuth() returns false when not existing key id is given`)
+		_, ok = holder.GetHMACAuth("invalid", "key1")
+		assert.False(ok, `GetHMACAuth() returns false when invalid host is given`)
+	})
+
+	cases := []struct {
+		name     string
+		hmacAuth string
+	}{
+		{name: "lostKeyID", hmacAuth: `{"secret": "secret1", "allowed_paths": []}`},
+		{name: "lostSecret", hmacAuth: `{"key_id": "key1", "allowed_paths": []}`},
+		{name: "lostAllowedPaths", hmacAuth: `{"key_id": "key1", "secret": "secret1"}`},
+		{name: "signedHeadersIsNotList", hmacAuth: `{"key_id": "key1", "secret": "secret1", "signed_headers": "date", "allowed_paths": []}`},
+	}
+	for _, c := range cases {
+		os.Setenv(AuthTokens, fmt.Sprintf(`[{"host": "%s", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "hmac_auths": [%s]}}]`, host1, c.hmacAuth))
+		holder := NewHolder()
+
+		t.Run(c.name, func(t *testing.T) {
+			assert.Equal([]string{}, holder.GetHosts(), `GetHosts() returns empty slice when hmac_auths is invalid`)
+		})
+	}
+}
+
+func TestNewHolderWithSoftDeny(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "soft_deny": true}
+			}, {
+				"host": "test2.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "soft_deny": false}
+			}, {
+				"host": "test3.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.True(holder.IsSoftDeny("test1.example.com"), `IsSoftDeny() returns true when soft_deny is true`)
+	assert.False(holder.IsSoftDeny("test2.example.com"), `IsSoftDeny() returns false when soft_deny is false`)
+	assert.False(holder.IsSoftDeny("test3.example.com"), `IsSoftDeny() returns false when soft_deny is not set`)
+	assert.False(holder.IsSoftDeny("invalid"), `IsSoftDeny() returns false when invalid host is given`)
+
+	os.Setenv(AuthTokens, `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "soft_deny": "true"}}]`)
+	holder = NewHolder()
+	assert.Equal([]string{}, holder.GetHosts(), `GetHosts() returns empty slice when soft_deny is not bool`)
+}
+
+func TestNewHolderWithNoAuthQuery(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["^/static/.+$"], "match_query": true, "denied_query_params": ["token"]}}
+			}, {
+				"host": "test2.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["^/static/.+$"]}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.Equal(NoAuthQuery{MatchQuery: true, DeniedQueryParams: []string{"token"}}, holder.GetNoAuthQuery("test1.example.com"), `GetNoAuthQuery() returns the configuration`)
+	assert.Equal(NoAuthQuery{}, holder.GetNoAuthQuery("test2.example.com"), `GetNoAuthQuery() returns zero value when it is not set`)
+	assert.Equal(NoAuthQuery{}, holder.GetNoAuthQuery("invalid"), `GetNoAuthQuery() returns zero value when invalid host is given`)
+
+	os.Setenv(AuthTokens, `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"denied_query_params": "token"}}}]`)
+	holder = NewHolder()
+	assert.Equal([]string{}, holder.GetHosts(), `GetHosts() returns empty slice when denied_query_params is not list`)
+}
+
+func TestHolderAsCredentialStore(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host1 := "test1.example.com"
+	os.Setenv(AuthTokens, fmt.Sprintf(`
+		[
+			{
+				"host": "%s",
+				"settings": {
+					"defaults": {"allowed_methods": ["GET"]},
+					"bearer_tokens": [
+						{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}
+					],
+					"basic_auths": [
+						{"username": "user1", "password": "password1", "allowed_paths": ["^/piyo/.*$", "/hoge"]}
+					],
+					"no_auths": {}
+				}
+			}
+		]
+	`, host1))
+	var store CredentialStore = NewHolder()
+
+	bearerCredential, ok := store.LookupBearer(host1, "TOKEN1")
+	assert.True(ok, `LookupBearer() returns true when existing token is given`)
+	assert.Equal(BearerCredential{
+		AllowedPaths: []*regexp.Regexp{regexp.MustCompile("^/foo/.*$")},
+		Label:        "bearer_tokens[0]",
+		Limits:       Limits{AllowedMethods: []string{"GET"}},
+	}, bearerCredential, `LookupBearer() returns the allowed paths, the default label and the limitations`)
+	_, ok = store.LookupBearer(host1, "TOKEN2")
+	assert.False(ok, `LookupBearer() returns false when not existing token is given`)
+	_, ok = store.LookupBearer("invalid", "TOKEN1")
+	assert.False(ok, `LookupBearer() returns false when invalid host is given`)
+
+	basicCredentials, ok := store.LookupBasic(host1, "user1")
+	assert.True(ok, `LookupBasic() returns true when existing user is given`)
+	assert.Equal([]BasicCredential{{
+		Password:     "password1",
+		AllowedPaths: []*regexp.Regexp{regexp.MustCompile("^/piyo/.*$"), regexp.MustCompile("/hoge")},
+		Label:        "basic_auths[0]",
+		Limits:       Limits{AllowedMethods: []string{"GET"}},
+	}}, basicCredentials, `LookupBasic() returns the password, the allowed paths, the default label and the limitations`)
+	_, ok = store.LookupBasic(host1, "user2")
+	assert.False(ok, `LookupBasic() returns false when not existing user is given`)
+	_, ok = store.LookupBasic("invalid", "user1")
+	assert.False(ok, `LookupBasic() returns false when invalid host is given`)
+}
+
+func TestNewHolderWithExactHost(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host := ".*\\.example\\.com"
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": ".*\\.example\\.com",
+				"settings": {
+					"bearer_tokens": [
+						{"token": "TOKEN1", "allowed_paths": ["^/admin/.*$"], "require_exact_host": "Admin.Example.COM."},
+						{"token": "TOKEN2", "allowed_paths": ["^/foo/.*$"]}
+					],
+					"basic_auths": [
+						{"username": "user1", "password": "password1", "allowed_paths": ["^/admin/.*$"], "require_exact_host": "admin.example.com"},
+						{"username": "user2", "password": "password2", "allowed_paths": ["^/foo/.*$"]}
+					],
+					"no_auths": {}
+				}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	bearerCredential, _ := holder.LookupBearer(host, "TOKEN1")
+	assert.Equal("admin.example.com", bearerCredential.ExactHost, "require_exact_host of bearer_tokens is normalized")
+	bearerCredential, _ = holder.LookupBearer(host, "TOKEN2")
+	assert.Equal("", bearerCredential.ExactHost, "require_exact_host of bearer_tokens is empty when it is not set")
+	basicCredentials, _ := holder.LookupBasic(host, "user1")
+	assert.Equal("admin.example.com", basicCredentials[0].ExactHost, "require_exact_host of basic_auths is held")
+	basicCredentials, _ = holder.LookupBasic(host, "user2")
+	assert.Equal("", basicCredentials[0].ExactHost, "require_exact_host of basic_auths is empty when it is not set")
+}
+
+func TestNewHolderWithMethodScopedPaths(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host := "test.example.com"
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test.example.com",
+				"settings": {
+					"bearer_tokens": [
+						{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$", {"path": "^/bar/.*$", "methods": ["GET", "HEAD"]}]},
+						{"token": "TOKEN2", "allowed_paths": ["^/foo/.*$"]}
+					],
+					"basic_auths": [],
+					"no_auths": {}
+				}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	allowedPaths := holder.GetAllowedPaths(host, "TOKEN1")
+	assert.Equal([]string{"^/foo/.*$", "^/bar/.*$"}, patternStrings(allowedPaths), "both forms of allowed_paths are held in order")
+	pathMethods := holder.GetAllowedPathMethods(host, "TOKEN1")
+	assert.Equal(1, len(pathMethods), "only the method scoped path has methods")
+	assert.Equal([]string{"GET", "HEAD"}, pathMethods[allowedPaths[1]], "the methods are associated with the compiled path")
+	bearerCredential, _ := holder.LookupBearer(host, "TOKEN1")
+	assert.Equal(pathMethods, bearerCredential.AllowedPathMethods, "LookupBearer() returns the methods of the allowed paths")
+	assert.Nil(holder.GetAllowedPathMethods(host, "TOKEN2"), "the plain string paths have no methods")
+
+	var settings bearerTokens
+	assert.EqualError(json.Unmarshal([]byte(`{"token": "TOKEN1", "allowed_paths": [{"methods": ["GET"]}]}`), &settings),
+		"bearer_tokens.allowed_paths.path is required", "path is required")
+	assert.EqualError(json.Unmarshal([]byte(`{"token": "TOKEN1", "allowed_paths": [{"path": "^/foo/.*$"}]}`), &settings),
+		"bearer_tokens.allowed_paths.methods is required", "methods is required")
+}
+
+func TestNewHolderWithMethodScopedNoAuthPaths(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host := "test.example.com"
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test.example.com",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {"allowed_paths": ["^/public/.*$", "(", {"path": "^/static/.*$", "methods": ["GET", "HEAD"]}]}
+				}
+			},
+			{
+				"host": "other.example.com",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {"allowed_paths": ["^/public/.*$"]}
+				}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	noAuthPaths := holder.GetNoAuthPaths(host)
+	assert.Equal([]string{"^/public/.*$", "^/static/.*$"}, patternStrings(noAuthPaths), "both forms of allowed_paths are held in order")
+	pathMethods := holder.GetNoAuthPathMethods(host)
+	assert.Equal(1, len(pathMethods), "only the method scoped path has methods")
+	assert.Equal([]string{"GET", "HEAD"}, pathMethods[noAuthPaths[1]], "the methods are associated with the compiled path after the invalid pattern")
+	assert.Equal("no_auths.allowed_paths[2]", holder.GetNoAuthLabels(host)[noAuthPaths[1]], "the label of the method scoped path is its index")
+	assert.Nil(holder.GetNoAuthPathMethods("other.example.com"), "the plain string paths have no methods")
+
+	var settings noAuths
+	assert.EqualError(json.Unmarshal([]byte(`{"allowed_paths": [{"methods": ["GET"]}]}`), &settings),
+		"no_auths.allowed_paths.path is required", "path is required")
+	assert.EqualError(json.Unmarshal([]byte(`{"allowed_paths": [{"path": "^/static/.*$"}]}`), &settings),
+		"no_auths.allowed_paths.methods is required", "methods is required")
+}
+
+func TestNewHolderWithCacheDisabled(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "cached.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}, {
+				"host": "explicit.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "cache": true}
+			}, {
+				"host": "uncached.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "cache": false}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.False(holder.IsCacheDisabled("cached.example.com"), "the decisions are cached by default")
+	assert.False(holder.IsCacheDisabled("explicit.example.com"), "the decisions are cached when cache is true")
+	assert.True(holder.IsCacheDisabled("uncached.example.com"), "the decisions are not cached when cache is false")
+	assert.False(holder.IsCacheDisabled("unknown.example.com"), "IsCacheDisabled() returns false for an unknown host")
+}
+
+func TestNewHolderWithPriorities(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [
+						{"username": "user1", "password": "password1", "allowed_paths": ["^/foo/.*$", "^/bar/.*$"], "priority": 1},
+						{"username": "user2", "password": "password2", "allowed_paths": ["^/bar/.*$"], "priority": 3},
+						{"username": "user3", "password": "password3", "allowed_paths": ["^/baz/.*$"]}
+					],
+					"no_auths": {"allowed_paths": ["^/foo/.*$"], "priority": 2}
+				}
+			}, {
+				"host": "test2.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.Equal(2, holder.GetNoAuthPriority("test1.example.com"), `GetNoAuthPriority() returns the priority`)
+	assert.Equal(0, holder.GetNoAuthPriority("test2.example.com"), `GetNoAuthPriority() returns 0 when priority is not set`)
+	assert.Equal(0, holder.GetNoAuthPriority("invalid"), `GetNoAuthPriority() returns 0 when invalid host is given`)
+	assert.Equal(map[string]int{"^/foo/.*$": 1, "^/bar/.*$": 3, "^/baz/.*$": 0}, priorityStrings(holder.GetBasicAuthPriorities("test1.example.com")),
+		`GetBasicAuthPriorities() returns the highest priority of each path`)
+	assert.Len(holder.GetBasicAuthPriorities("test2.example.com"), 0, `GetBasicAuthPriorities() returns empty map when basic_auths is empty`)
+	user1, _ := holder.LookupBasic("test1.example.com", "user1")
+	user2, _ := holder.LookupBasic("test1.example.com", "user2")
+	assert.True(user1[0].AllowedPaths[1] == user2[0].AllowedPaths[0], `the path shared by the users is compiled once`)
+	_, ok := holder.GetBasicAuthPriorities("test1.example.com")[user2[0].AllowedPaths[0]]
+	assert.True(ok, `GetBasicAuthPriorities() has the compiled paths of the credentials`)
+
+	os.Setenv(AuthTokens, `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"priority": "high"}}}]`)
+	holder = NewHolder()
+	assert.Equal([]string{}, holder.GetHosts(), `GetHosts() returns empty slice when priority is not int`)
+}
+
+func TestNewHolderWithCompiledPatterns(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1\\.example\\.com",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [
+						{"username": "user1", "password": "password1", "allowed_paths": ["^/foo/.*$", "(invalid"]}
+					],
+					"no_auths": {"allowed_paths": ["^/static/.*$", "(invalid"]}
+				}
+			}, {
+				"host": "(invalid",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.Equal([]string{"test1\\.example\\.com", "(invalid"}, holder.GetHosts(), `GetHosts() returns all hosts`)
+	assert.Equal([]string{"test1\\.example\\.com"}, patternStrings(holder.GetHostPatterns()), `GetHostPatterns() skips the invalid patterns`)
+	assert.True(holder.GetHostPatterns()[0].MatchString("test1.example.com"), `GetHostPatterns() returns the compiled patterns`)
+	assert.Equal([]string{"^/static/.*$"}, patternStrings(holder.GetNoAuthPaths("test1\\.example\\.com")), `GetNoAuthPaths() skips the invalid patterns`)
+	assert.Equal(map[string]int{"^/foo/.*$": 0}, priorityStrings(holder.GetBasicAuthPriorities("test1\\.example\\.com")),
+		`GetBasicAuthPriorities() skips the invalid patterns`)
+}
+
+func TestNewHolderWithNoAuthRateLimit(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {"allowed_paths": ["^/static/.*$"], "rate_limit": {"requests": 10, "period": "1m"}}
+				}
+			}, {
+				"host": "test2.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.Equal(&RateLimit{Requests: 10, Period: time.Minute}, holder.GetNoAuthRateLimit("test1.example.com"), `GetNoAuthRateLimit() returns the rate limit`)
+	assert.Nil(holder.GetNoAuthRateLimit("test2.example.com"), `GetNoAuthRateLimit() returns nil when rate_limit is not set`)
+	assert.Nil(holder.GetNoAuthRateLimit("invalid"), `GetNoAuthRateLimit() returns nil when invalid host is given`)
+
+	os.Setenv(AuthTokens, `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"rate_limit": {"requests": 0, "period": "1m"}}}}]`)
+	holder = NewHolder()
+	assert.Equal([]string{}, holder.GetHosts(), `GetHosts() returns empty slice when rate_limit is invalid`)
+}
+
+func TestNewHolderWithUnknownTokenForbidden(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "unknown_token_forbidden": true}
+			}, {
+				"host": "test2.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.True(holder.IsUnknownTokenForbidden("test1.example.com"), `IsUnknownTokenForbidden() returns true when unknown_token_forbidden is true`)
+	assert.False(holder.IsUnknownTokenForbidden("test2.example.com"), `IsUnknownTokenForbidden() returns false when unknown_token_forbidden is not set`)
+	assert.False(holder.IsUnknownTokenForbidden("invalid"), `IsUnknownTokenForbidden() returns false when invalid host is given`)
+}
+
+func TestNewHolderNoHosts(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	json := `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+	envCases := []struct {
+		name    string
+		env     map[string]string
+		warning string
+	}{
+		{
+			name:    "AUTH_TOKENS and AUTH_TOKENS_PATH are not set",
+			env:     map[string]string{},
+			warning: "AUTH_TOKENS and AUTH_TOKENS_PATH are not set",
+		},
+		{
+			name:    "AUTH_TOKENS is empty and AUTH_TOKENS_PATH is not set",
+			env:     map[string]string{AuthTokens: ""},
+			warning: "AUTH_TOKENS is set but empty",
+		},
+		{
+			name:    "AUTH_TOKENS_PATH is empty and AUTH_TOKENS is not set",
+			env:     map[string]string{AuthTokensPath: ""},
+			warning: "AUTH_TOKENS_PATH is set but empty and AUTH_TOKENS is not set",
+		},
+		{
+			name:    "AUTH_TOKENS_PATH and AUTH_TOKENS are empty",
+			env:     map[string]string{AuthTokens: "", AuthTokensPath: ""},
+			warning: "AUTH_TOKENS and AUTH_TOKENS_PATH are set but empty",
+		},
+		{
+			name:    "AUTH_TOKENS has no hosts",
+			env:     map[string]string{AuthTokens: "[]"},
+			warning: "AUTH_TOKENS has no hosts",
+		},
+		{
+			name:    "AUTH_TOKENS_PATH does not exist",
+			env:     map[string]string{AuthTokensPath: "/xyz"},
+			warning: `AUTH_TOKENS_PATH ("/xyz") has no hosts`,
+		},
+		{
+			name:    "AUTH_TOKENS has a host",
+			env:     map[string]string{AuthTokens: json},
+			warning: "",
+		},
+	}
+
+	for _, envCase := range envCases {
+		t.Run(envCase.name, func(t *testing.T) {
+			for k, v := range envCase.env {
+				os.Setenv(k, v)
+			}
+			defer os.Unsetenv(AuthTokens)
+			defer os.Unsetenv(AuthTokensPath)
+
+			holder := NewHolder()
+			if len(envCase.warning) == 0 {
+				assert.Len(holder.Warnings(), 0, "Warnings() is empty when %s", envCase.name)
+			} else {
+				assert.Equal([]string{"no hosts are configured, all requests are denied: " + envCase.warning}, holder.Warnings(),
+					"Warnings() reports no hosts when %s", envCase.name)
+			}
+			assert.Equal(len(envCase.warning) == 0, holder.IsReady(), "IsReady() is true only when the configurations have a host")
+
+			os.Setenv(AuthTokensRequireHosts, "true")
+			defer os.Unsetenv(AuthTokensRequireHosts)
+			if len(envCase.warning) == 0 {
+				assert.NotPanics(func() { NewHolder() }, "NewHolder() does not panic when %s", envCase.name)
+			} else {
+				assert.PanicsWithValue("AUTH_TOKENS_REQUIRE_HOSTS is set, but "+envCase.warning, func() { NewHolder() },
+					"NewHolder() panics with AUTH_TOKENS_REQUIRE_HOSTS when %s", envCase.name)
+			}
+		})
+	}
+}
+
+func TestHolderIsReady(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `[{"host": "test.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`)
+	assert.True(NewHolder().IsReady(), "IsReady() returns true when the configurations are loaded")
+
+	os.Setenv(AuthTokens, `[{"host": "test.example.com", "settings": {"bearer_tokens": [], "basic_auths": []}}]`)
+	assert.False(NewHolder().IsReady(), "IsReady() returns false when the configurations can not be parsed")
+}
+
+func TestHolderOnReload(t *testing.T) {
+	assert := assert.New(t)
+	tmpFiles, tearDown := setUp(t)
+	defer tearDown()
+
+	json1 := `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+	json2 := `[{"host": "test2.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+
+	tmpFile, tearDownTmpFile := setUpTmpFile(t, tmpFiles)
+	defer tearDownTmpFile()
+	tmpFile.WriteString(json1)
+	os.Setenv(AuthTokensPath, tmpFile.Name())
+
+	holder := NewHolder()
+	reloaded := make(chan struct{}, 16)
+	holder.OnReload(func() {
+		reloaded <- struct{}{}
+	})
+
+	t.Run("fires on reload", func(t *testing.T) {
+		// the watcher is started asynchronously, so rewrite the file until the callback is called
+		timeout := time.After(3 * time.Second)
+	wait:
+		for {
+			ioutil.WriteFile(tmpFile.Name(), []byte(json2), 0644)
+			select {
+			case <-reloaded:
+				break wait
+			case <-time.After(100 * time.Millisecond):
+			case <-timeout:
+				t.Fatal("OnReload() callback is not called")
+			}
+		}
+		assert.Equal([]string{"test2.example.com"}, holder.GetHosts(), "the configurations are reloaded")
+	})
+
+	t.Run("does not fire on no-op reload", func(t *testing.T) {
+		for len(reloaded) > 0 {
+			<-reloaded
+		}
+		assert.False(loadFile(holder, tmpFile.Name()), "loadFile() returns false when the file is not changed")
+		assert.False(makeHolder(holder, []byte(json2)), "makeHolder() returns false when the configurations are not changed")
+		assert.Equal([]string{"test2.example.com"}, holder.GetHosts(), "the configurations are kept")
+		assert.Len(reloaded, 0, "OnReload() callback is not called")
+	})
+
+	t.Run("does not fire on parse failure", func(t *testing.T) {
+		assert.False(makeHolder(holder, []byte("invalid")), "makeHolder() returns false when the configurations can not be parsed")
+		assert.True(makeHolder(holder, []byte(json2)), "makeHolder() returns true when the configurations are restored")
+	})
+}
+
+// waitForHosts swaps the file until the holder has the hosts, because the watcher is started asynchronously.
+func waitForHosts(t *testing.T, holder *Holder, hosts []string, swap func()) {
+	t.Helper()
+	timeout := time.After(3 * time.Second)
+	for {
+		swap()
+		select {
+		case <-time.After(100 * time.Millisecond):
+			if assert.ObjectsAreEqual(hosts, holder.GetHosts()) {
+				return
+			}
+		case <-timeout:
+			t.Fatalf("the configurations are not reloaded: %v", holder.GetHosts())
+		}
+	}
+}
+
+func TestHolderMonitorAtomicRename(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	json1 := `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+	json2 := `[{"host": "test2.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+	json3 := `[{"host": "test3.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+
+	t.Run("the file is renamed over", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", tmpFilePrefix)
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(dir)
+		rawTokensPath := filepath.Join(dir, "auth-tokens.json")
+		ioutil.WriteFile(rawTokensPath, []byte(json1), 0644)
+		os.Setenv(AuthTokensPath, rawTokensPath)
+
+		holder := NewHolder()
+		assert.Equal([]string{"test1.example.com"}, holder.GetHosts(), "the first configurations are loaded")
+
+		replace := func(content string) func() {
+			return func() {
+				tmpPath := filepath.Join(dir, "auth-tokens.json.tmp")
+				ioutil.WriteFile(tmpPath, []byte(content), 0644)
+				os.Rename(tmpPath, rawTokensPath)
+			}
+		}
+		waitForHosts(t, holder, []string{"test2.example.com"}, replace(json2))
+		waitForHosts(t, holder, []string{"test3.example.com"}, replace(json3))
+		assert.Equal([]string{"test3.example.com"}, holder.GetHosts(), "the changes after the first rename are reloaded")
+
+		os.Remove(rawTokensPath)
+		time.Sleep(200 * time.Millisecond)
+		assert.Equal([]string{"test3.example.com"}, holder.GetHosts(), "the configurations are kept while the file is removed")
+		waitForHosts(t, holder, []string{"test1.example.com"}, replace(json1))
+	})
+
+	t.Run("the ..data symlink of a Kubernetes secret is swapped", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", tmpFilePrefix)
+		if err != nil {
+			panic(err)
+		}
+		defer os.RemoveAll(dir)
+		version := 0
+		// swap writes the content to a new versioned directory, and renames a new symlink over ..data like kubelet
+		swap := func(content string) func() {
+			return func() {
+				version++
+				versionDir := fmt.Sprintf("..%d", version)
+				os.Mkdir(filepath.Join(dir, versionDir), 0755)
+				ioutil.WriteFile(filepath.Join(dir, versionDir, "auth-tokens.json"), []byte(content), 0644)
+				os.Symlink(versionDir, filepath.Join(dir, "..data_tmp"))
+				os.Rename(filepath.Join(dir, "..data_tmp"), filepath.Join(dir, kubernetesDataLink))
+				if version > 1 {
+					os.RemoveAll(filepath.Join(dir, fmt.Sprintf("..%d", version-1)))
+				}
+			}
+		}
+		swap(json1)()
+		rawTokensPath := filepath.Join(dir, "auth-tokens.json")
+		os.Symlink(filepath.Join(kubernetesDataLink, "auth-tokens.json"), rawTokensPath)
+		os.Setenv(AuthTokensPath, rawTokensPath)
+
+		holder := NewHolder()
+		assert.Equal([]string{"test1.example.com"}, holder.GetHosts(), "the first configurations are loaded through the symlinks")
+
+		waitForHosts(t, holder, []string{"test2.example.com"}, swap(json2))
+		waitForHosts(t, holder, []string{"test3.example.com"}, swap(json3))
+		assert.Equal([]string{"test3.example.com"}, holder.GetHosts(), "the changes after the first swap are reloaded")
+	})
+}
+
+func TestHolderClose(t *testing.T) {
+	assert := assert.New(t)
+	tmpFiles, tearDown := setUp(t)
+	defer tearDown()
+
+	json1 := `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+	json2 := `[{"host": "test2.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+
+	tmpFile, tearDownTmpFile := setUpTmpFile(t, tmpFiles)
+	defer tearDownTmpFile()
+	tmpFile.WriteString(json1)
+	os.Setenv(AuthTokensPath, tmpFile.Name())
+	os.Setenv(ConfigMaxAge, "1h")
+	defer os.Unsetenv(ConfigMaxAge)
+
+	holder := NewHolder()
+	closed := make(chan struct{})
+	go func() {
+		holder.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Close() does not return")
+	}
+	holder.Close()
+
+	ioutil.WriteFile(tmpFile.Name(), []byte(json2), 0644)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal([]string{"test1.example.com"}, holder.GetHosts(), "the file is not watched after Close()")
+	holder.Snapshot().Close()
+	NewHolder().Close()
+}
+
+func TestNewHolderWithoutWatch(t *testing.T) {
+	assert := assert.New(t)
+	tmpFiles, tearDown := setUp(t)
+	defer tearDown()
+
+	json1 := `[{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+	json2 := `[{"host": "test2.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`
+
+	tmpFile, tearDownTmpFile := setUpTmpFile(t, tmpFiles)
+	defer tearDownTmpFile()
+	tmpFile.WriteString(json1)
+	os.Setenv(AuthTokensPath, tmpFile.Name())
+	os.Setenv(AuthTokensWatch, "false")
+
+	holder := NewHolder()
+	assert.Equal([]string{"test1.example.com"}, holder.GetHosts(), "the file is loaded once")
+	assert.Nil(holder.done, "no watcher is started when AUTH_TOKENS_WATCH is false")
+
+	ioutil.WriteFile(tmpFile.Name(), []byte(json2), 0644)
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal([]string{"test1.example.com"}, holder.GetHosts(), "the changes of the file are not applied when AUTH_TOKENS_WATCH is false")
+
+	os.Setenv(AuthTokensWatch, "invalid")
+	holder = NewHolder()
+	assert.NotNil(holder.done, "the watcher is started when AUTH_TOKENS_WATCH is invalid")
+	holder.Close()
+}
+
+func TestHolderConcurrentReload(t *testing.T) {
+	assert := assert.New(t)
+	tmpFiles, tearDown := setUp(t)
+	defer tearDown()
+
+	json1 := `[{"host": "test1.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}], "basic_auths": [], "no_auths": {}}}]`
+	json2 := `[{"host": "test2.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN2", "allowed_paths": ["^/bar/.*$"]}], "basic_auths": [], "no_auths": {}}}]`
+
+	tmpFile, tearDownTmpFile := setUpTmpFile(t, tmpFiles)
+	defer tearDownTmpFile()
+	tmpFile.WriteString(json1)
+	os.Setenv(AuthTokensPath, tmpFile.Name())
+
+	holder := NewHolder()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			// the file is replaced by renaming, because a half-written file is not a configuration of either
+			if i%2 == 0 {
+				ioutil.WriteFile(tmpFile.Name()+".new", []byte(json2), 0644)
+			} else {
+				ioutil.WriteFile(tmpFile.Name()+".new", []byte(json1), 0644)
+			}
+			os.Rename(tmpFile.Name()+".new", tmpFile.Name())
+			// reload directly as well, because the watcher may coalesce the events
+			loadFile(holder, tmpFile.Name())
+		}
+	}()
+
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		snapshot := holder.Snapshot()
+		hosts := snapshot.GetHosts()
+		if !assert.Len(hosts, 1, "GetHosts() returns one host of either configuration") {
+			return
+		}
+		tokens := snapshot.GetTokens(hosts[0])
+		if !assert.Len(tokens, 1, "GetTokens() returns the token of the same configuration as GetHosts()") {
+			return
+		}
+		assert.True(snapshot.HasToken(hosts[0], tokens[0]), "HasToken() reads the same configuration as GetTokens()")
+		assert.Len(snapshot.GetAllowedPaths(hosts[0], tokens[0]), 1, "GetAllowedPaths() reads the same configuration as GetTokens()")
+		holder.GetNoAuthPaths(hosts[0])
+		holder.GetBasicAuthConf(hosts[0])
+	}
+}
+
+func TestHolderReplaceFromBytes(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	json1 := `[{"host": "test1.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}], "basic_auths": [], "no_auths": {}}}]`
+	json2 := `[{"host": "test2.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN2", "allowed_paths": ["^/bar/.*$"]}], "basic_auths": [], "no_auths": {}}}]`
+	os.Setenv(AuthTokens, json1)
+
+	holder := NewHolder()
+	reloaded := 0
+	holder.OnReload(func() {
+		reloaded++
+	})
+
+	t.Run("valid", func(t *testing.T) {
+		assert.Nil(holder.ReplaceFromBytes([]byte(json2)), "ReplaceFromBytes() returns no error")
+		assert.Equal([]string{"test2.example.com"}, holder.GetHosts(), "the configurations are replaced")
+		assert.True(holder.HasToken("test2.example.com", "TOKEN2"), "the new token is held")
+		assert.False(holder.HasToken("test1.example.com", "TOKEN1"), "the old token is not held")
+		assert.Equal(1, reloaded, "OnReload() callback is called")
+	})
+
+	t.Run("not changed", func(t *testing.T) {
+		assert.Nil(holder.ReplaceFromBytes([]byte(json2)), "ReplaceFromBytes() returns no error")
+		assert.Equal(1, reloaded, "OnReload() callback is not called")
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		invalids := []string{
+			"invalid",
+			`[{"host": "test3.example.com"}]`,
+			`[{"host": "(", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`,
+			`[{"host": "test3.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["("]}}}]`,
+		}
+		for _, invalid := range invalids {
+			err := holder.ReplaceFromBytes([]byte(invalid))
+			if assert.Error(err, "ReplaceFromBytes() returns an error when %s is given", invalid) {
+				assert.Contains(err.Error(), "invalid token configurations", "the error tells the configurations are invalid")
+			}
+			assert.Equal([]string{"test2.example.com"}, holder.GetHosts(), "the current configurations are kept")
+			assert.True(holder.HasToken("test2.example.com", "TOKEN2"), "the current token is kept")
+		}
+		assert.Equal(1, reloaded, "OnReload() callback is not called")
+	})
+
+	t.Run("concurrent", func(t *testing.T) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for i := 0; i < 100; i++ {
+				if i%2 == 0 {
+					holder.ReplaceFromBytes([]byte(json1))
+				} else {
+					holder.ReplaceFromBytes([]byte(json2))
+				}
+			}
+		}()
+		for running := true; running; {
+			select {
+			case <-done:
+				running = false
+			default:
+			}
+			snapshot := holder.Snapshot()
+			hosts := snapshot.GetHosts()
+			if !assert.Len(hosts, 1, "GetHosts() returns one host of either configuration") {
+				return
+			}
+			tokens := snapshot.GetTokens(hosts[0])
+			if !assert.Len(tokens, 1, "GetTokens() returns the token of the same configuration as GetHosts()") {
+				return
+			}
+			assert.True(snapshot.HasToken(hosts[0], tokens[0]), "HasToken() reads the same configuration as GetTokens()")
+		}
+		assert.Equal(101, reloaded, "OnReload() callback is called on each replacement")
+	})
+}
+
+func TestNewHolderWithTokenPolicy(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host := "test.example.com"
+	shortToken := "abc123"
+	lowEntropyToken := "aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa"
+	strongToken := "Vq3xT9pLz7KmW2rYb8NcF4hJ6sDgE1uA"
+	json := fmt.Sprintf(`
+		[
+			{
+				"host": "%s",
+				"settings": {
+					"bearer_tokens": [
+						{"token": "%s", "allowed_paths": ["^/short/.*$"]},
+						{"token": "%s", "allowed_paths": ["^/low/.*$"]},
+						{"token": "%s", "allowed_paths": ["^/strong/.*$"]}
+					],
+					"basic_auths": [],
+					"no_auths": {}
+				}
+			}
+		]
+	`, host, shortToken, lowEntropyToken, strongToken)
+
+	cases := []struct {
+		name       string
+		minLength  string
+		minEntropy string
+		strict     string
+		warnings   int
+		tokens     []string
+	}{
+		{
+			name:     "no policy",
+			warnings: 0,
+			tokens:   []string{shortToken, lowEntropyToken, strongToken},
+		},
+		{
+			name:      "min length",
+			minLength: "16",
+			warnings:  1,
+			tokens:    []string{shortToken, lowEntropyToken, strongToken},
+		},
+		{
+			name:       "min length and min entropy",
+			minLength:  "16",
+			minEntropy: "64",
+			warnings:   2,
+			tokens:     []string{shortToken, lowEntropyToken, strongToken},
+		},
+		{
+			name:       "strict",
+			minLength:  "16",
+			minEntropy: "64",
+			strict:     "true",
+			warnings:   2,
+			tokens:     []string{strongToken},
+		},
+		{
+			name:       "invalid values",
+			minLength:  "abc",
+			minEntropy: "-1",
+			strict:     "abc",
+			warnings:   0,
+			tokens:     []string{shortToken, lowEntropyToken, strongToken},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			os.Setenv(AuthTokens, json)
+			os.Setenv(AuthTokensMinLength, c.minLength)
+			os.Setenv(AuthTokensMinEntropy, c.minEntropy)
+			os.Setenv(AuthTokensStrict, c.strict)
+
+			holder := NewHolder()
+
+			assert.Len(holder.Warnings(), c.warnings, "Warnings() returns the weak tokens")
+			assert.Equal(c.tokens, holder.GetTokens(host), "GetTokens() returns the loaded tokens")
+			for _, warning := range holder.Warnings() {
+				assert.NotContains(warning, shortToken, "Warnings() does not contain the token itself")
+				assert.NotContains(warning, lowEntropyToken, "Warnings() does not contain the token itself")
+			}
+		})
+	}
+}
+
+func TestNewHolderWithAliases(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"domain": "test1.example.com",
+				"settings": {
+					"tokens": [
+						{"secret": "TOKEN1", "paths": ["^/foo/.*$"], "allowed_methods": ["GET"]}
+					],
+					"users": [
+						{"user": "user1", "password": "password1", "paths": ["^/bar/.*$"]}
+					],
+					"no_auths": {"paths": ["^/static/.*$"]},
+					"hmac_auths": [
+						{"key_id": "key1", "secret": "SECRET1", "paths": ["^/baz/.*$"]}
+					]
+				}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.Equal([]string{"test1.example.com"}, holder.GetHosts(), `"domain" is an alias of "host"`)
+	assert.Equal([]string{"TOKEN1"}, holder.GetTokens("test1.example.com"), `"tokens" and "secret" are aliases of "bearer_tokens" and "token"`)
+	assert.Equal([]*regexp.Regexp{regexp.MustCompile("^/foo/.*$")}, holder.GetAllowedPaths("test1.example.com", "TOKEN1"),
+		`"paths" is an alias of "allowed_paths"`)
+	assert.Equal([]string{"GET"}, holder.GetTokenLimits("test1.example.com", "TOKEN1").AllowedMethods, `the limits are kept`)
+	assert.Equal(map[string]map[string]string{"^/bar/.*$": {"user1": "password1"}}, holder.GetBasicAuthConf("test1.example.com"),
+		`"users" and "user" are aliases of "basic_auths" and "username"`)
+	assert.Equal([]string{"^/static/.*$"}, patternStrings(holder.GetNoAuthPaths("test1.example.com")), `"paths" is an alias of "allowed_paths" in no_auths`)
+	hmacAuth, ok := holder.GetHMACAuth("test1.example.com", "key1")
+	assert.True(ok, `GetHMACAuth() returns true`)
+	assert.Equal("SECRET1", hmacAuth.Secret, `"secret" of hmac_auths is not an alias`)
+	assert.Equal([]*regexp.Regexp{regexp.MustCompile("^/baz/.*$")}, hmacAuth.AllowedPaths, `"paths" is an alias of "allowed_paths" in hmac_auths`)
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {
+					"bearer_tokens": [
+						{"token": "TOKEN1", "secret": "TOKEN2", "allowed_paths": ["^/foo/.*$"]}
+					],
+					"basic_auths": [],
+					"no_auths": {}
+				}
+			}
+		]
+	`)
+	holder = NewHolder()
+	assert.Equal([]string{}, holder.GetHosts(), `GetHosts() returns empty slice when both a field and its alias are given`)
+}
+
+func TestNewHolderWithValidUntil(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host := "test1.example.com"
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {
+					"bearer_tokens": [
+						{"token": "OLD_TOKEN", "allowed_paths": ["^/foo/.*$"], "valid_until": "2019-01-02T00:00:00Z"},
+						{"token": "NEW_TOKEN", "allowed_paths": ["^/foo/.*$"]},
+						{"token": "ALIAS_TOKEN", "allowed_paths": ["^/foo/.*$"], "expires_at": "2019-01-02T09:00:00+09:00"}
+					],
+					"basic_auths": [],
+					"no_auths": {}
+				}
+			}
+		]
+	`)
+	holder := NewHolder()
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	holder.SetClock(func() time.Time { return now })
+
+	t.Run("during the overlap", func(t *testing.T) {
+		for _, token := range []string{"OLD_TOKEN", "NEW_TOKEN", "ALIAS_TOKEN"} {
+			_, ok := holder.LookupBearer(host, token)
+			assert.True(ok, `LookupBearer() returns true for %s before valid_until`, token)
+			assert.True(holder.HasToken(host, token), `HasToken() returns true for %s before valid_until`, token)
+		}
+	})
+
+	t.Run("after valid_until", func(t *testing.T) {
+		now = time.Date(2019, 1, 2, 0, 0, 0, 0, time.UTC)
+		for _, token := range []string{"OLD_TOKEN", "ALIAS_TOKEN"} {
+			_, ok := holder.LookupBearer(host, token)
+			assert.False(ok, `LookupBearer() returns false for %s after valid_until`, token)
+			assert.False(holder.HasToken(host, token), `HasToken() returns false for %s after valid_until`, token)
+		}
+		_, ok := holder.LookupBearer(host, "NEW_TOKEN")
+		assert.True(ok, `LookupBearer() returns true for the token without valid_until`)
+	})
+
+	os.Setenv(AuthTokens, `[{"host": "test1.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": [], "valid_until": "tomorrow"}], "basic_auths": [], "no_auths": {}}}]`)
+	holder = NewHolder()
+	assert.Equal([]string{}, holder.GetHosts(), `GetHosts() returns empty slice when valid_until is not RFC3339`)
+}
+
+func TestHolderConcurrentSetClock(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `[{"host": "test1.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"], "valid_until": "2019-01-02T00:00:00Z"}], "basic_auths": [], "no_auths": {}}}]`)
+	holder := NewHolder()
+	before := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			holder.SetClock(func() time.Time { return before })
+		}
+	}()
+
+	// the clock is replaced while the requests take snapshots and check valid_until
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		holder.Snapshot().HasToken("test1.example.com", "TOKEN1")
+	}
+	assert.True(holder.Snapshot().HasToken("test1.example.com", "TOKEN1"), "the snapshot uses the clock set by SetClock()")
+}
+
+func TestNewHolderWithDefaultAllow(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host := "test1.example.com"
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {
+					"bearer_tokens": [
+						{"token": "TOKEN1", "allowed_paths": [], "default_allow": true, "denied_paths": ["^/admin/.*$", "("]},
+						{"token": "TOKEN2", "allowed_paths": ["^/foo/.*$"]},
+						{"token": "TOKEN3", "allowed_paths": []}
+					],
+					"basic_auths": [],
+					"no_auths": {}
+				}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	credential, ok := holder.LookupBearer(host, "TOKEN1")
+	assert.True(ok, `LookupBearer() returns true for the default_allow token without allowed_paths`)
+	assert.True(credential.DefaultAllow, `DefaultAllow is true`)
+	assert.Equal([]*regexp.Regexp{regexp.MustCompile("^/admin/.*$")}, credential.DeniedPaths, `DeniedPaths has the valid patterns`)
+
+	credential, ok = holder.LookupBearer(host, "TOKEN2")
+	assert.True(ok, `LookupBearer() returns true for TOKEN2`)
+	assert.False(credential.DefaultAllow, `DefaultAllow is false by default`)
+	assert.Len(credential.DeniedPaths, 0, `DeniedPaths is empty by default`)
+
+	_, ok = holder.LookupBearer(host, "TOKEN3")
+	assert.False(ok, `LookupBearer() returns false for the token without allowed_paths and default_allow`)
+}
+
+func TestNewHolderWithMethodOverride(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "method_override": true}
+			}, {
+				"host": "test2.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.True(holder.IsMethodOverride("test1.example.com"), `IsMethodOverride() returns true when method_override is true`)
+	assert.False(holder.IsMethodOverride("test2.example.com"), `IsMethodOverride() returns false when method_override is not set`)
+	assert.False(holder.IsMethodOverride("invalid"), `IsMethodOverride() returns false when invalid host is given`)
+}
+
+func TestNewHolderWithMatchQuery(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["^/static/.*$"]}, "match_query": true}
+			}, {
+				"host": "test2.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.True(holder.IsMatchQuery("test1.example.com"), `IsMatchQuery() returns true when match_query is true`)
+	assert.False(holder.IsMatchQuery("test2.example.com"), `IsMatchQuery() returns false when match_query is not set`)
+	assert.False(holder.IsMatchQuery("invalid"), `IsMatchQuery() returns false when invalid host is given`)
+	assert.True(holder.GetNoAuthQuery("test1.example.com").MatchQuery, `match_query of the host applies to no_auths`)
+	assert.False(holder.GetNoAuthQuery("test2.example.com").MatchQuery, `no_auths does not match the query when match_query is not set`)
+}
+
+func TestNewHolderWithNoAuthBypass(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test1.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["^/static/.*$"], "bypass_protections": true}}
+			}, {
+				"host": "test2.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {"allowed_paths": ["^/static/.*$"]}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.True(holder.IsNoAuthBypass("test1.example.com"), `IsNoAuthBypass() returns true when bypass_protections is true`)
+	assert.False(holder.IsNoAuthBypass("test2.example.com"), `IsNoAuthBypass() returns false when bypass_protections is not set`)
+	assert.False(holder.IsNoAuthBypass("invalid"), `IsNoAuthBypass() returns false when invalid host is given`)
+}
+
+func TestNewHolderWithRuleLabels(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "test.example.com",
+				"settings": {
+					"bearer_tokens": [
+						{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"], "label": "mobile-app"},
+						{"token": "TOKEN2", "allowed_paths": ["^/bar/.*$"]}
+					],
+					"basic_auths": [
+						{"username": "user1", "password": "password1", "allowed_paths": ["^/piyo/.*$"]},
+						{"username": "user2", "password": "password2", "allowed_paths": ["^/hoge/.*$"], "label": "operator"}
+					],
+					"no_auths": {"allowed_paths": ["^/static/.*$", "[invalid", "^/public/.*$"]}
+				}
+			}
+		]
+	`)
+	holder := NewHolder()
+	host := "test.example.com"
+
+	assert.Equal([]string{
+		"mobile-app", "bearer_tokens[1]", "basic_auths[0]", "operator", "no_auths.allowed_paths[0]", "no_auths.allowed_paths[2]",
+	}, holder.GetRuleLabels(host), "the labels are given, or the fields and the indices in the configuration")
+	assert.Nil(holder.GetRuleLabels("unknown.example.com"), "GetRuleLabels() returns nil for an unknown host")
+
+	bearerCredential, _ := holder.LookupBearer(host, "TOKEN1")
+	assert.Equal("mobile-app", bearerCredential.Label, "the label of the bearer token is looked up")
+	bearerCredential, _ = holder.LookupBearer(host, "TOKEN2")
+	assert.Equal("bearer_tokens[1]", bearerCredential.Label, "the index of the bearer token is looked up without label")
+	basicCredentials, _ := holder.LookupBasic(host, "user1")
+	assert.Equal("basic_auths[0]", basicCredentials[0].Label, "the index of the basic auth user is looked up without label")
+	basicCredentials, _ = holder.LookupBasic(host, "user2")
+	assert.Equal("operator", basicCredentials[0].Label, "the label of the basic auth user is looked up")
+
+	noAuthLabels := holder.GetNoAuthLabels(host)
+	noAuthPaths := holder.GetNoAuthPaths(host)
+	assert.Equal(2, len(noAuthLabels), "the invalid pattern of no_auths is not labeled")
+	assert.Equal("no_auths.allowed_paths[0]", noAuthLabels[noAuthPaths[0]], "the pattern of no_auths is labeled by the index")
+	assert.Equal("no_auths.allowed_paths[2]", noAuthLabels[noAuthPaths[1]], "the index skips the invalid pattern")
+}
+
+func TestNewHolderWithRootPath(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "default.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}, {
+				"host": "deny.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "root_path": "deny"}
+			}, {
+				"host": "allow.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "root_path": "allow"}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	assert.Equal(RootPathRules, holder.GetRootPath("default.example.com"), "the root path is decided by the rules by default")
+	assert.Equal(RootPathDeny, holder.GetRootPath("deny.example.com"), "the root path is denied when root_path is deny")
+	assert.Equal(RootPathAllow, holder.GetRootPath("allow.example.com"), "the root path is allowed when root_path is allow")
+	assert.Equal(RootPathRules, holder.GetRootPath("unknown.example.com"), "GetRootPath() returns rules for an unknown host")
+
+	var settings authTokens
+	assert.EqualError(json.Unmarshal([]byte(`{"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "root_path": "block"}`), &settings),
+		`root_path must be "rules", "deny" or "allow": "block"`, "an unknown root_path is refused")
+}
+
+func TestNewHolderWithRealm(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "default.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}, {
+				"host": "team.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "realm": "team-a"}
+			}, {
+				"host": "team.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "realm": "team-b"}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	_, ok := holder.GetRealm("default.example.com")
+	assert.False(ok, "the host has no realm by default")
+	realm, ok := holder.GetRealm("team.example.com")
+	assert.True(ok, "the host has the realm")
+	assert.Equal("team-b", realm, "the realm of the later entry wins")
+}
+
+func TestHolderErrors(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `[{"host": "api.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}], "basic_auths": [], "no_auths": {}}}]`)
+	assert.Equal([]string{}, NewHolder().Errors(), "Errors() is empty for the valid configurations")
+
+	os.Setenv(AuthTokens, `[{"host": "api.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$", "("]}], "basic_auths": [], "no_auths": {"allowed_paths": ["*"]}}}]`)
+	holder := NewHolder()
+	assert.Len(holder.Errors(), 2, "Errors() has the invalid patterns which are ignored")
+	assert.Equal([]string{"^/foo/.*$"}, patternStrings(holder.GetAllowedPaths("api.example.com", "TOKEN1")), "the valid patterns are still loaded")
+
+	os.Setenv(AuthTokens, `[{"host": "api.example.com"}]`)
+	loadErrors := NewHolder().Errors()
+	assert.Len(loadErrors, 1, "Errors() has the parse error")
+	assert.Contains(loadErrors[0], `parse failed: seettings is required in the element [0] (host "api.example.com")`, "the parse error has the location")
+
+	os.Unsetenv(AuthTokens)
+	os.Setenv(AuthTokensPath, "/nonexistent/tokens.json")
+	os.Setenv(AuthTokensWatch, "false")
+	assert.Equal([]string{"can not read AUTH_TOKENS_PATH: /nonexistent/tokens.json"}, NewHolder().Errors(), "Errors() has the file which can not be read")
+}
+
+func TestHolderHasHost(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `[
+		{"host": "api\\.example\\.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}},
+		{"host": "^exact\\.example\\.com$", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}},
+		{"host": "^127\\.0\\.0\\.1:[0-9]+$", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}},
+		{"host": ".*\\.wildcard\\.example\\.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}
+	]`)
+	holder := NewHolder()
+
+	cases := []struct {
+		domain string
+		expect bool
+		desc   string
+	}{
+		{domain: "api.example.com", expect: true, desc: "the domain matches the host"},
+		{domain: "api.example.com:8080", expect: true, desc: "the domain with a port matches the host without anchors"},
+		{domain: "exact.example.com", expect: true, desc: "the domain matches the anchored host"},
+		{domain: "exact.example.com:8080", expect: false, desc: "the domain with a port does not match the anchored host"},
+		{domain: "127.0.0.1:3000", expect: true, desc: "the domain with a port matches the host with a port"},
+		{domain: "127.0.0.1", expect: false, desc: "the domain without port does not match the host with a port"},
+		{domain: "foo.wildcard.example.com", expect: true, desc: "the domain matches the wildcard host"},
+		{domain: "unknown.example.org", expect: false, desc: "the unknown domain does not match"},
+		{domain: "", expect: false, desc: "the empty domain does not match"},
+	}
+	for _, c := range cases {
+		assert.Equal(c.expect, holder.HasHost(c.domain), c.desc)
+	}
+
+	assert.Equal([]string{"api\\.example\\.com", ".*\\.wildcard\\.example\\.com"}, MatchHostPatterns("api.example.com.wildcard.example.com", holder.GetHostPatterns()),
+		"all patterns matching the domain are returned in the order of the configurations")
+	assert.Nil(MatchHostPatterns("unknown.example.org", holder.GetHostPatterns()), "no pattern matches the unknown domain")
+}
+
+func TestHolderCompileErrors(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `[{"host": "api.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}], "basic_auths": [], "no_auths": {}}}]`)
+	assert.Equal([]error{}, NewHolder().CompileErrors(), "CompileErrors() is empty for the valid configurations")
+
+	os.Setenv(AuthTokens, `[
+		{
+			"host": "api.example.com",
+			"settings": {
+				"bearer_tokens": [
+					{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$", "("]},
+					{"token": "TOKEN2", "allowed_paths": ["**"], "label": "batch"}
+				],
+				"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["??"]}],
+				"no_auths": {}
+			}
+		}
+	]`)
+	holder := NewHolder()
+	compileErrors := holder.CompileErrors()
+	assert.Len(compileErrors, 3, "CompileErrors() has every invalid pattern")
+
+	expected := []PatternError{
+		{Field: "basic_auths.allowed_paths", Host: "api.example.com", Rule: "user1", Pattern: "??"},
+		{Field: "bearer_tokens.allowed_paths", Host: "api.example.com", Rule: "bearer_tokens[0]", Pattern: "("},
+		{Field: "bearer_tokens.allowed_paths", Host: "api.example.com", Rule: "batch", Pattern: "**"},
+	}
+	for i, e := range expected {
+		patternErr, ok := compileErrors[i].(*PatternError)
+		if !assert.True(ok, "the error is a *PatternError") {
+			continue
+		}
+		assert.Equal(e.Field, patternErr.Field, "the field of the pattern is reported")
+		assert.Equal(e.Host, patternErr.Host, "the host of the pattern is reported")
+		assert.Equal(e.Rule, patternErr.Rule, "the username or the label is reported instead of the token")
+		assert.Equal(e.Pattern, patternErr.Pattern, "the invalid pattern is reported")
+		assert.NotNil(patternErr.Err, "the compile error is kept")
+		assert.NotContains(patternErr.Error(), "TOKEN", "the token is never reported")
+	}
+	assert.Contains(compileErrors[1].Error(), `bearer_tokens.allowed_paths on api.example.com: invalid pattern "(" of bearer_tokens[0]: `, "the message has the host, the rule and the pattern")
+	assert.Equal(errorStrings(compileErrors), holder.Errors(), "Errors() has the same messages")
+	assert.Equal([]string{"^/foo/.*$"}, patternStrings(holder.GetAllowedPaths("api.example.com", "TOKEN1")), "the valid patterns are still loaded")
+}
+
+func TestHolderMatchHost(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `[
+		{"host": ".*\\.example\\.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}},
+		{"host": "api\\.example\\.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}
+	]`)
+	holder := NewHolder()
+	host, ok := holder.MatchHost("api.example.com")
+	assert.True(ok, "MatchHost() returns true when a host matches")
+	assert.Equal(".*\\.example\\.com", host, "the first host in the order of the configurations wins")
+	_, ok = holder.MatchHost("api.example.org")
+	assert.False(ok, "MatchHost() returns false when no host matches")
+	_, ok = holder.GetDefaultHost()
+	assert.False(ok, "GetDefaultHost() returns false when no host has default")
+
+	os.Setenv(AuthTokens, `[
+		{"host": "catch-all", "default": true, "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}},
+		{"host": "api\\.example\\.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}
+	]`)
+	holder = NewHolder()
+	defaultHost, ok := holder.GetDefaultHost()
+	assert.True(ok, "GetDefaultHost() returns true when a host has default")
+	assert.Equal("catch-all", defaultHost, "GetDefaultHost() returns the host which has default")
+	assert.Equal([]string{"api\\.example\\.com"}, patternStrings(holder.GetHostPatterns()), "the default host is not matched by its pattern")
+	host, _ = holder.MatchHost("api.example.com")
+	assert.Equal("api\\.example\\.com", host, "the matched host wins over the default host")
+	host, ok = holder.MatchHost("api.example.org")
+	assert.True(ok, "MatchHost() returns true for any domain when a host has default")
+	assert.Equal("catch-all", host, "the default host is used when no host matches")
+	assert.True(holder.HasHost(""), "HasHost() is always true when a host has default")
+
+	os.Setenv(AuthTokens, `[
+		{"host": "catch-all", "default": true, "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}},
+		{"host": "catch-all", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}
+	]`)
+	defaultHost, _ = NewHolder().GetDefaultHost()
+	assert.Equal("catch-all", defaultHost, "the entries of the default host are merged")
+
+	os.Setenv(AuthTokens, `[
+		{"host": "catch-all", "default": true, "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}},
+		{"host": "fallback", "default": true, "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}
+	]`)
+	holder = NewHolder()
+	assert.Empty(holder.GetHosts(), "the configurations which have several default hosts are refused")
+	if assert.Len(holder.Errors(), 1, "the default hosts are reported") {
+		assert.Contains(holder.Errors()[0], "default is given to both hosts catch-all and fallback", "the default hosts are reported")
+	}
+}
+
+func TestNewHolderLogsNoSecrets(t *testing.T) {
+	assert := assert.New(t)
+	tmpFiles, tearDown := setUp(t)
+	defer tearDown()
+
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(ioutil.Discard)
+	os.Setenv(logging.LogLevel, "debug")
+	logging.Configure()
+	defer logging.Configure()
+	defer os.Unsetenv(logging.LogLevel)
+
+	rawTokens := `[
+		{
+			"host": "api.example.com",
+			"settings": {
+				"bearer_tokens": [
+					{"token": "SECRET-TOKEN-1", "allowed_paths": ["^/foo/.*$"]},
+					{"token": "SECRET-TOKEN-2", "allowed_paths": ["^/bar/.*$"], "label": "batch"}
+				],
+				"basic_auths": [{"username": "user1", "password": "SECRET-PASSWORD-1", "allowed_paths": ["^/piyo/.*$"]}],
+				"hmac_auths": [{"key_id": "key1", "secret": "SECRET-HMAC-1", "allowed_paths": ["^/hmac/.*$"]}],
+				"no_auths": {"allowed_paths": ["^/static/.*$"]}
+			}
+		}
+	]`
+	secrets := []string{"SECRET-TOKEN-1", "SECRET-TOKEN-2", "SECRET-PASSWORD-1", "SECRET-HMAC-1"}
+
+	t.Run("AUTH_TOKENS", func(t *testing.T) {
+		buf.Reset()
+		os.Setenv(AuthTokens, rawTokens)
+		NewHolder()
+		for _, secret := range secrets {
+			assert.NotContains(buf.String(), secret, "the secret is not logged")
+		}
+		assert.Contains(buf.String(), "host=api.example.com bearer_tokens=2 basic_auths=1 hmac_auths=1 no_auth_paths=1", "the number of the rules is logged")
+		assert.Contains(buf.String(), "bearer_tokens[0],batch", "the labels of the rules are logged")
+	})
+
+	t.Run("AUTH_TOKENS_PATH", func(t *testing.T) {
+		buf.Reset()
+		os.Unsetenv(AuthTokens)
+		fp, closeFile := setUpTmpFile(t, tmpFiles)
+		fp.WriteString(rawTokens)
+		closeFile()
+		os.Setenv(AuthTokensPath, fp.Name())
+		holder := NewHolder()
+		defer holder.Close()
+		for _, secret := range secrets {
+			assert.NotContains(buf.String(), secret, "the secret is not logged")
+		}
+		assert.Contains(buf.String(), "bearer_tokens=2", "the number of the tokens is logged")
 	})
 }
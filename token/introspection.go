@@ -0,0 +1,353 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultIntrospectionCacheTTL = 60 * time.Second
+const introspectionCacheSize = 10000
+const introspectionTimeout = 10 * time.Second
+const introspectionSaveInterval = 10 * time.Second
+const maxIntrospectionResponseSize = 1 << 20
+
+type introspectionSettings struct {
+	URL              string              `json:"url"`
+	ClientID         string              `json:"client_id"`
+	ClientSecret     string              `json:"client_secret"`
+	CacheTTL         time.Duration       `json:"cache_ttl"`
+	NegativeCacheTTL time.Duration       `json:"negative_cache_ttl"`
+	RawAllowedPaths  []string            `json:"allowed_paths"`
+	Claim            string              `json:"claim"`
+	RawClaimPaths    map[string][]string `json:"claim_paths"`
+	Limits           limitSettings
+}
+
+/*
+UnmarshalJSON : Unmarshal AUTH_TOKENS and check required
+*/
+func (i *introspectionSettings) UnmarshalJSON(b []byte) error {
+	type introspectionSettingsP struct {
+		URL              *string              `json:"url"`
+		ClientID         *string              `json:"client_id"`
+		ClientSecret     *string              `json:"client_secret"`
+		CacheTTL         *string              `json:"cache_ttl"`
+		NegativeCacheTTL *string              `json:"negative_cache_ttl"`
+		RawAllowedPaths  *[]string            `json:"allowed_paths"`
+		Claim            *string              `json:"claim"`
+		RawClaimPaths    *map[string][]string `json:"claim_paths"`
+	}
+	var p introspectionSettingsP
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if p.URL == nil || len(*p.URL) == 0 {
+		return errors.New("introspection.url is required")
+	}
+	i.URL = *p.URL
+	if p.ClientID != nil {
+		i.ClientID = *p.ClientID
+	}
+	if p.ClientSecret != nil {
+		i.ClientSecret = *p.ClientSecret
+	}
+	i.CacheTTL = defaultIntrospectionCacheTTL
+	if p.CacheTTL != nil {
+		cacheTTL, err := time.ParseDuration(*p.CacheTTL)
+		if err != nil {
+			return err
+		}
+		if cacheTTL < 0 {
+			return errors.New("introspection.cache_ttl must not be negative")
+		}
+		i.CacheTTL = cacheTTL
+	}
+	if p.NegativeCacheTTL != nil {
+		negativeCacheTTL, err := time.ParseDuration(*p.NegativeCacheTTL)
+		if err != nil {
+			return err
+		}
+		if negativeCacheTTL < 0 {
+			return errors.New("introspection.negative_cache_ttl must not be negative")
+		}
+		i.NegativeCacheTTL = negativeCacheTTL
+	}
+	if p.RawAllowedPaths != nil {
+		i.RawAllowedPaths = *p.RawAllowedPaths
+	}
+	i.Claim = defaultJWTClaim
+	if p.Claim != nil {
+		i.Claim = *p.Claim
+	}
+	if p.RawClaimPaths != nil {
+		i.RawClaimPaths = *p.RawClaimPaths
+	}
+	return json.Unmarshal(b, &i.Limits)
+}
+
+/*
+IntrospectionAuth : a struct to hold a configuration of the opaque bearer tokens checked by an OAuth2 introspection endpoint (RFC 7662).
+	AllowedPaths are allowed for all active tokens, and ClaimPaths are allowed for the tokens which have the value in Claim like JWTAuth.
+*/
+type IntrospectionAuth struct {
+	Introspector *Introspector
+	AllowedPaths []*regexp.Regexp
+	Claim        string
+	ClaimPaths   map[string][]*regexp.Regexp
+	Limits       Limits
+}
+
+/*
+Paths : get the allowed paths of the active token, AllowedPaths followed by ClaimPaths of each value in Claim.
+*/
+func (introspectionAuth IntrospectionAuth) Paths(claims Claims) []*regexp.Regexp {
+	return JWTAuth{AllowedPaths: introspectionAuth.AllowedPaths, Claim: introspectionAuth.Claim, ClaimPaths: introspectionAuth.ClaimPaths}.Paths(claims)
+}
+
+/*
+Introspector : a struct to check opaque bearer tokens by an OAuth2 introspection endpoint.
+	The active tokens are cached for the TTL (and never after their "exp"), and the inactive ones for the negative TTL.
+	Both TTLs are shortened by "Cache-Control" or "Expires" of the response. With "BACKEND_CACHE_DIR",
+	the inactive ones are kept in the directory and reused after a restart until they expire.
+*/
+type Introspector struct {
+	url              string
+	clientID         string
+	clientSecret     string
+	cacheTTL         time.Duration
+	negativeCacheTTL time.Duration
+	client           *http.Client
+	now              func() time.Time
+	mutex            sync.Mutex
+	cache            map[string]cachedIntrospection
+	cacheDir         string
+	restored         bool
+	savedAt          time.Time
+}
+
+// cachedIntrospection is the result of a token, which has no claims when the token is not active.
+type cachedIntrospection struct {
+	claims    Claims
+	expiresAt time.Time
+}
+
+// cachedInactiveTokens are the inactive tokens kept in "BACKEND_CACHE_DIR" by their hashes with their expiries.
+type cachedInactiveTokens struct {
+	URL      string               `json:"url"`
+	Inactive map[string]time.Time `json:"inactive"`
+}
+
+/*
+NewIntrospector : a factory method to create Introspector. The client is authenticated by basic authentication when clientID is given.
+	The results are not cached when cacheTTL is 0, and the inactive tokens are asked every time.
+*/
+func NewIntrospector(introspectionURL string, clientID string, clientSecret string, cacheTTL time.Duration) *Introspector {
+	return NewIntrospectorWithNegativeCache(introspectionURL, clientID, clientSecret, cacheTTL, 0)
+}
+
+/*
+NewIntrospectorWithNegativeCache : a factory method to create Introspector which also caches the inactive tokens for negativeCacheTTL.
+*/
+func NewIntrospectorWithNegativeCache(introspectionURL string, clientID string, clientSecret string, cacheTTL time.Duration, negativeCacheTTL time.Duration) *Introspector {
+	return &Introspector{
+		url:              introspectionURL,
+		clientID:         clientID,
+		clientSecret:     clientSecret,
+		cacheTTL:         cacheTTL,
+		negativeCacheTTL: negativeCacheTTL,
+		client:           &http.Client{Timeout: introspectionTimeout},
+		now:              time.Now,
+		cache:            map[string]cachedIntrospection{},
+		cacheDir:         os.Getenv(BackendCacheDir),
+	}
+}
+
+/*
+SetClock : replace the clock used to expire the cached results and to check "exp", mainly for tests.
+*/
+func (introspector *Introspector) SetClock(now func() time.Time) {
+	introspector.now = now
+}
+
+/*
+SetCacheDir : replace the directory to keep the inactive tokens, which is "BACKEND_CACHE_DIR" by default. Nothing is kept when dir is empty.
+*/
+func (introspector *Introspector) SetCacheDir(dir string) {
+	introspector.mutex.Lock()
+	defer introspector.mutex.Unlock()
+	introspector.cacheDir = dir
+	introspector.restored = false
+}
+
+/*
+Introspect : check the token by the introspection endpoint, and get its claims when it is active.
+	A BackendError is returned when the endpoint is not available.
+*/
+func (introspector *Introspector) Introspect(token string) (Claims, error) {
+	// the tokens are not kept as they are in the cache
+	sum := sha256.Sum256([]byte(token))
+	key := hex.EncodeToString(sum[:])
+	if claims, ok := introspector.cached(key); ok {
+		if claims == nil {
+			return nil, errors.New("token is not active")
+		}
+		return claims, nil
+	}
+	claims, header, err := introspector.post(token)
+	if err != nil {
+		return nil, err
+	}
+	now := introspector.now()
+	if active, _ := claims["active"].(bool); !active {
+		introspector.store(key, cachedIntrospection{expiresAt: now.Add(cacheTTL(introspector.negativeCacheTTL, header, now))})
+		return nil, errors.New("token is not active")
+	}
+	expiresAt := now.Add(cacheTTL(introspector.cacheTTL, header, now))
+	if exp, ok := claims["exp"].(float64); ok {
+		if !now.Before(time.Unix(int64(exp), 0)) {
+			return nil, errors.New("token is expired")
+		}
+		if time.Unix(int64(exp), 0).Before(expiresAt) {
+			expiresAt = time.Unix(int64(exp), 0)
+		}
+	}
+	introspector.store(key, cachedIntrospection{claims: claims, expiresAt: expiresAt})
+	return claims, nil
+}
+
+// cacheTTL returns the configured TTL, shortened by "Cache-Control" or "Expires" of the response.
+func cacheTTL(configured time.Duration, header http.Header, now time.Time) time.Duration {
+	if lifetime, ok := cacheLifetime(header, now); ok && lifetime < configured {
+		return lifetime
+	}
+	return configured
+}
+
+func (introspector *Introspector) cached(key string) (Claims, bool) {
+	introspector.mutex.Lock()
+	defer introspector.mutex.Unlock()
+	if !introspector.restored {
+		introspector.restored = true
+		introspector.restoreInactive()
+	}
+	cached, ok := introspector.cache[key]
+	if !ok {
+		return nil, false
+	}
+	if !introspector.now().Before(cached.expiresAt) {
+		delete(introspector.cache, key)
+		return nil, false
+	}
+	return cached.claims, true
+}
+
+// store caches the result until it expires. When the cache is full, the expired results are dropped,
+// and all results are dropped if it is still full, not to grow without limit by many tokens.
+func (introspector *Introspector) store(key string, cached cachedIntrospection) {
+	now := introspector.now()
+	if !now.Before(cached.expiresAt) {
+		return
+	}
+	introspector.mutex.Lock()
+	if len(introspector.cache) >= introspectionCacheSize {
+		for k, v := range introspector.cache {
+			if !now.Before(v.expiresAt) {
+				delete(introspector.cache, k)
+			}
+		}
+		if len(introspector.cache) >= introspectionCacheSize {
+			introspector.cache = map[string]cachedIntrospection{}
+		}
+	}
+	introspector.cache[key] = cached
+	var path string
+	var inactive *cachedInactiveTokens
+	if cached.claims == nil {
+		path, inactive = introspector.inactiveTokens(now)
+	}
+	introspector.mutex.Unlock()
+	// the file is written outside the mutex not to block the other tokens by the disk
+	if inactive != nil {
+		writeCacheFile(path, inactive)
+	}
+}
+
+// restoreInactive reads the inactive tokens kept in "BACKEND_CACHE_DIR", which never outlive the current negative TTL.
+func (introspector *Introspector) restoreInactive() {
+	if introspector.negativeCacheTTL <= 0 {
+		return
+	}
+	var cached cachedInactiveTokens
+	if !readCacheFile(cacheFile(introspector.cacheDir, "introspection", introspector.url, introspector.clientID), &cached) || cached.URL != introspector.url {
+		return
+	}
+	now := introspector.now()
+	for key, expiresAt := range cached.Inactive {
+		if len(introspector.cache) >= introspectionCacheSize {
+			break
+		}
+		if now.Before(expiresAt) && !expiresAt.After(now.Add(introspector.negativeCacheTTL)) {
+			introspector.cache[key] = cachedIntrospection{expiresAt: expiresAt}
+		}
+	}
+}
+
+// inactiveTokens returns the file in "BACKEND_CACHE_DIR" and the inactive tokens to write to it, at most once every
+// introspectionSaveInterval not to write the file for every invalid token. It is called with the mutex locked.
+func (introspector *Introspector) inactiveTokens(now time.Time) (string, *cachedInactiveTokens) {
+	if len(introspector.cacheDir) == 0 || (!introspector.savedAt.IsZero() && now.Sub(introspector.savedAt) < introspectionSaveInterval) {
+		return "", nil
+	}
+	introspector.savedAt = now
+	cached := cachedInactiveTokens{URL: introspector.url, Inactive: map[string]time.Time{}}
+	for key, result := range introspector.cache {
+		if result.claims == nil && now.Before(result.expiresAt) {
+			cached.Inactive[key] = result.expiresAt
+		}
+	}
+	return cacheFile(introspector.cacheDir, "introspection", introspector.url, introspector.clientID), &cached
+}
+
+func (introspector *Introspector) post(token string) (Claims, http.Header, error) {
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	request, err := http.NewRequest(http.MethodPost, introspector.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, nil, &BackendError{Err: err}
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if len(introspector.clientID) > 0 {
+		request.SetBasicAuth(url.QueryEscape(introspector.clientID), url.QueryEscape(introspector.clientSecret))
+	}
+	response, err := introspector.client.Do(request)
+	if err != nil {
+		return nil, nil, &BackendError{Err: fmt.Errorf("introspection failed: %v", err)}
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, nil, &BackendError{Err: fmt.Errorf("introspection failed: %s", response.Status)}
+	}
+	var claims Claims
+	// the response is limited not to read a broken or hostile endpoint without limit
+	if err := json.NewDecoder(io.LimitReader(response.Body, maxIntrospectionResponseSize)).Decode(&claims); err != nil {
+		return nil, nil, &BackendError{Err: fmt.Errorf("introspection parse failed: %v", err)}
+	}
+	return claims, response.Header, nil
+}
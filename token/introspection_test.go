@@ -0,0 +1,263 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIntrospector(t *testing.T) {
+	assert := assert.New(t)
+
+	issued := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := issued
+	var mutex sync.Mutex
+	requested := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientID, clientSecret, _ := r.BasicAuth()
+		if r.Method != http.MethodPost || clientID != "client1" || clientSecret != "secret1" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		token := r.PostFormValue("token")
+		mutex.Lock()
+		requested[token]++
+		mutex.Unlock()
+		switch token {
+		case "ACTIVE":
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "user1", "scope": "openid read:foo"})
+		case "SHORT":
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "user2", "exp": issued.Add(10 * time.Second).Unix()})
+		case "EXPIRED":
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "user3", "exp": issued.Add(-time.Second).Unix()})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		}
+	}))
+	defer server.Close()
+	count := func(token string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requested[token]
+	}
+
+	introspector := NewIntrospector(server.URL, "client1", "secret1", time.Minute)
+	introspector.SetClock(func() time.Time { return now })
+
+	claims, err := introspector.Introspect("ACTIVE")
+	assert.Nil(err, "the active token is accepted")
+	assert.Equal("user1", claims.Subject(), "the claims are returned")
+	assert.Equal([]string{"openid", "read:foo"}, claims.Strings("scope"), "the scope is returned")
+	introspector.Introspect("ACTIVE")
+	assert.Equal(1, count("ACTIVE"), "the active token is cached")
+
+	_, err = introspector.Introspect("INACTIVE")
+	assert.EqualError(err, "token is not active", "the inactive token is refused")
+	introspector.Introspect("INACTIVE")
+	assert.Equal(2, count("INACTIVE"), "the inactive token is not cached")
+
+	_, err = introspector.Introspect("EXPIRED")
+	assert.EqualError(err, "token is expired", "the expired token is refused even if it is active")
+
+	_, err = introspector.Introspect("SHORT")
+	assert.Nil(err, "the active token with exp is accepted")
+	now = now.Add(30 * time.Second)
+	introspector.Introspect("ACTIVE")
+	assert.Equal(1, count("ACTIVE"), "the active token is cached for the TTL")
+	_, err = introspector.Introspect("SHORT")
+	assert.EqualError(err, "token is expired", "the cached result expires at exp")
+	assert.Equal(2, count("SHORT"), "the token is asked again after exp")
+	now = now.Add(time.Minute)
+	introspector.Introspect("ACTIVE")
+	assert.Equal(2, count("ACTIVE"), "the token is asked again after the TTL")
+
+	uncached := NewIntrospector(server.URL, "client1", "secret1", 0)
+	uncached.Introspect("ACTIVE")
+	uncached.Introspect("ACTIVE")
+	assert.Equal(4, count("ACTIVE"), "the results are not cached when the TTL is 0")
+
+	_, err = NewIntrospector(server.URL, "client1", "invalid", time.Minute).Introspect("ACTIVE")
+	assert.IsType(&BackendError{}, err, "the failure of the endpoint is a backend error")
+}
+
+func TestIntrospectorNegativeCache(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "introspection")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	var mutex sync.Mutex
+	requested := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := r.PostFormValue("token")
+		mutex.Lock()
+		requested[token]++
+		mutex.Unlock()
+		switch token {
+		case "ACTIVE":
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": "user1"})
+		case "NOSTORE":
+			w.Header().Set("Cache-Control", "no-store")
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		case "SHORT":
+			w.Header().Set("Cache-Control", "max-age=10")
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		}
+	}))
+	defer server.Close()
+	count := func(token string) int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return requested[token]
+	}
+	// restart creates an introspector sharing nothing with the previous one but the directory
+	restart := func(negativeCacheTTL time.Duration) *Introspector {
+		introspector := NewIntrospectorWithNegativeCache(server.URL, "", "", time.Minute, negativeCacheTTL)
+		introspector.SetClock(func() time.Time { return now })
+		introspector.SetCacheDir(dir)
+		return introspector
+	}
+
+	introspector := restart(time.Minute)
+	for _, token := range []string{"INACTIVE", "INACTIVE", "NOSTORE", "NOSTORE", "SHORT", "ACTIVE"} {
+		introspector.Introspect(token)
+	}
+	assert.Equal(1, count("INACTIVE"), "the inactive token is cached for the negative TTL")
+	assert.Equal(2, count("NOSTORE"), "the inactive token of no-store is not cached")
+	now = now.Add(20 * time.Second)
+	introspector.Introspect("SHORT")
+	assert.Equal(2, count("SHORT"), "the negative TTL is shortened by max-age")
+
+	now = now.Add(10 * time.Second)
+	introspector = restart(time.Minute)
+	_, err = introspector.Introspect("INACTIVE")
+	assert.EqualError(err, "token is not active", "the cached inactive token is refused after a restart")
+	assert.Equal(1, count("INACTIVE"), "the inactive token is not asked again after a restart")
+	claims, err := introspector.Introspect("ACTIVE")
+	assert.Nil(err, "the active token is accepted after a restart")
+	assert.Equal("user1", claims.Subject(), "the claims are returned")
+	assert.Equal(2, count("ACTIVE"), "the active tokens are not kept in the directory")
+
+	restart(0).Introspect("INACTIVE")
+	assert.Equal(2, count("INACTIVE"), "the inactive tokens are not reused when the negative TTL is 0")
+
+	now = now.Add(30 * time.Second)
+	restart(time.Minute).Introspect("INACTIVE")
+	assert.Equal(3, count("INACTIVE"), "the expired inactive token is asked again after a restart")
+
+	uncached := NewIntrospector(server.URL, "", "", time.Minute)
+	uncached.Introspect("INACTIVE")
+	uncached.Introspect("INACTIVE")
+	assert.Equal(5, count("INACTIVE"), "the inactive tokens are not cached by default")
+}
+
+func TestIntrospectorBackendError(t *testing.T) {
+	assert := assert.New(t)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json"))
+	}))
+	_, err := NewIntrospector(server.URL, "", "", time.Minute).Introspect("TOKEN1")
+	assert.IsType(&BackendError{}, err, "the invalid response is a backend error")
+	server.Close()
+
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"active": true, "sub": strings.Repeat("a", maxIntrospectionResponseSize)})
+	}))
+	_, err = NewIntrospector(server.URL, "", "", time.Minute).Introspect("TOKEN1")
+	assert.IsType(&BackendError{}, err, "the response larger than the limit is a backend error")
+	server.Close()
+
+	_, err = NewIntrospector(server.URL, "", "", time.Minute).Introspect("TOKEN1")
+	assert.IsType(&BackendError{}, err, "the endpoint not available is a backend error")
+}
+
+func TestNewHolderWithIntrospection(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "introspection.example.com",
+				"settings": {
+					"defaults": {"allowed_methods": ["GET"]},
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {},
+					"introspection": {
+						"url": "https://idp.example.com/introspect",
+						"client_id": "client1",
+						"client_secret": "secret1",
+						"cache_ttl": "30s",
+						"allowed_paths": ["^/public/.*$"],
+						"claim_paths": {"read:foo": ["^/foo/.*$"]}
+					}
+				}
+			}, {
+				"host": "literal.example.com",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {}
+				}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	introspectionAuth, ok := holder.GetIntrospectionAuth("introspection.example.com")
+	assert.True(ok, "GetIntrospectionAuth() returns true when introspection is set")
+	assert.NotNil(introspectionAuth.Introspector, "the introspector is created")
+	assert.Equal("scope", introspectionAuth.Claim, "the claim is scope by default")
+	assert.Equal(Limits{AllowedMethods: []string{"GET"}}, introspectionAuth.Limits, "the limitations inherit defaults")
+	assert.Equal([]string{"^/public/.*$"}, patternStrings(introspectionAuth.Paths(Claims{"active": true})), "allowed_paths are allowed for all active tokens")
+	assert.Equal([]string{"^/public/.*$", "^/foo/.*$"}, patternStrings(introspectionAuth.Paths(Claims{"active": true, "scope": "openid read:foo"})),
+		"claim_paths are allowed for the values of the scope")
+
+	_, ok = holder.GetIntrospectionAuth("literal.example.com")
+	assert.False(ok, "GetIntrospectionAuth() returns false when introspection is not set")
+
+	var settings introspectionSettings
+	assert.EqualError(json.Unmarshal([]byte(`{"client_id": "client1"}`), &settings), "introspection.url is required", "introspection.url is required")
+	assert.Nil(json.Unmarshal([]byte(`{"url": "https://idp.example.com/introspect"}`), &settings), "the other fields are optional")
+	assert.Equal(time.Minute, settings.CacheTTL, "cache_ttl is 60s by default")
+	assert.Error(json.Unmarshal([]byte(`{"url": "https://idp.example.com/introspect", "cache_ttl": "1 minute"}`), &settings), "an invalid cache_ttl is an error")
+	assert.EqualError(json.Unmarshal([]byte(`{"url": "https://idp.example.com/introspect", "cache_ttl": "-1s"}`), &settings),
+		"introspection.cache_ttl must not be negative", "a negative cache_ttl is an error")
+	assert.Equal(time.Duration(0), settings.NegativeCacheTTL, "negative_cache_ttl is 0s by default")
+	assert.Nil(json.Unmarshal([]byte(`{"url": "https://idp.example.com/introspect", "negative_cache_ttl": "10s"}`), &settings), "negative_cache_ttl is a duration")
+	assert.Equal(10*time.Second, settings.NegativeCacheTTL, "negative_cache_ttl is parsed")
+	assert.EqualError(json.Unmarshal([]byte(`{"url": "https://idp.example.com/introspect", "negative_cache_ttl": "-1s"}`), &settings),
+		"introspection.negative_cache_ttl must not be negative", "a negative negative_cache_ttl is an error")
+
+	var tokens authTokens
+	assert.EqualError(json.Unmarshal([]byte(`{
+		"bearer_tokens": [],
+		"basic_auths": [],
+		"no_auths": {},
+		"jwt": {"issuer": "https://issuer.example.com/", "jwks_url": "https://issuer.example.com/jwks"},
+		"introspection": {"url": "https://idp.example.com/introspect"}
+	}`), &tokens), "jwt and introspection are both given", "jwt and introspection are exclusive")
+}
@@ -0,0 +1,102 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+)
+
+/*
+IPRules : the CIDR ranges of the client IPs allowed and denied to access a host.
+	An IP in Allow is allowed, an IP in Deny is denied, and the other IPs are allowed only when Allow is empty.
+	So {"allow": ["10.0.0.0/8"], "deny": ["0.0.0.0/0"]} allows only the internal IPv4 addresses.
+*/
+type IPRules struct {
+	Allow []*net.IPNet
+	Deny  []*net.IPNet
+}
+
+/*
+UnmarshalJSON : Unmarshal ip_rules and check the CIDR ranges
+*/
+func (r *IPRules) UnmarshalJSON(b []byte) error {
+	type ipRulesP struct {
+		Allow []string `json:"allow"`
+		Deny  []string `json:"deny"`
+	}
+	var p ipRulesP
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	var err error
+	if r.Allow, err = ParseCIDRs(p.Allow); err != nil {
+		return fmt.Errorf("ip_rules has %v", err)
+	}
+	if r.Deny, err = ParseCIDRs(p.Deny); err != nil {
+		return fmt.Errorf("ip_rules has %v", err)
+	}
+	return nil
+}
+
+/*
+ParseCIDRs : parse the CIDR ranges, and a single IP address like "10.0.0.1" is a range of the address only.
+*/
+func ParseCIDRs(rawCIDRs []string) ([]*net.IPNet, error) {
+	var ipNets []*net.IPNet
+	for _, rawCIDR := range rawCIDRs {
+		if !strings.Contains(rawCIDR, "/") {
+			ip := net.ParseIP(rawCIDR)
+			if ip == nil {
+				return nil, fmt.Errorf("an invalid CIDR: %q", rawCIDR)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			ipNets = append(ipNets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(rawCIDR)
+		if err != nil {
+			return nil, fmt.Errorf("an invalid CIDR: %q", rawCIDR)
+		}
+		ipNets = append(ipNets, ipNet)
+	}
+	return ipNets, nil
+}
+
+/*
+Allows : check whether the client IP is allowed. An IP which can not be parsed is allowed only when no rule is configured.
+*/
+func (rules IPRules) Allows(clientIP string) bool {
+	if len(rules.Allow) == 0 && len(rules.Deny) == 0 {
+		return true
+	}
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	if containsIP(rules.Allow, ip) {
+		return true
+	}
+	if containsIP(rules.Deny, ip) {
+		return false
+	}
+	return len(rules.Allow) == 0
+}
+
+func containsIP(ipNets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range ipNets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
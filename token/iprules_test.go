@@ -0,0 +1,84 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewHolderWithIPRules(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "internal.example.com",
+				"settings": {
+					"bearer_tokens": [], "basic_auths": [], "no_auths": {},
+					"ip_rules": {"allow": ["10.0.0.0/8", "fd00::/8", "192.0.2.1"], "deny": ["0.0.0.0/0", "::/0"]}
+				}
+			}, {
+				"host": "public.example.com",
+				"settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	rules := holder.GetIPRules("internal.example.com")
+	assert.Len(rules.Allow, 3, "the allowed CIDR ranges are parsed")
+	assert.Len(rules.Deny, 2, "the denied CIDR ranges are parsed")
+	assert.Equal("192.0.2.1/32", rules.Allow[2].String(), "a single IP address is a range of the address only")
+	assert.Equal(IPRules{}, holder.GetIPRules("public.example.com"), "the rules are empty when ip_rules is not set")
+	assert.Equal(IPRules{}, holder.GetIPRules("unknown.example.com"), "the rules are empty for an unknown host")
+
+	for _, invalid := range []string{`{"allow": ["10.0.0.0/33"]}`, `{"deny": ["invalid"]}`} {
+		os.Setenv(AuthTokens, `[{"host": "internal.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}, "ip_rules": `+invalid+`}}]`)
+		assert.Equal([]string{}, NewHolder().GetHosts(), "the configurations are refused when ip_rules is %s", invalid)
+	}
+}
+
+func TestIPRulesAllows(t *testing.T) {
+	assert := assert.New(t)
+
+	rules := func(allow []string, deny []string) IPRules {
+		allows, _ := ParseCIDRs(allow)
+		denies, _ := ParseCIDRs(deny)
+		return IPRules{Allow: allows, Deny: denies}
+	}
+	internal := rules([]string{"10.0.0.0/8", "fd00::/8"}, []string{"0.0.0.0/0", "::/0"})
+	allowOnly := rules([]string{"10.0.0.0/8"}, nil)
+	denyOnly := rules(nil, []string{"203.0.113.0/24", "2001:db8::/32"})
+
+	cases := []struct {
+		rules    IPRules
+		clientIP string
+		allowed  bool
+		desc     string
+	}{
+		{rules: IPRules{}, clientIP: "203.0.113.1", allowed: true, desc: "the empty rules allow all IPs"},
+		{rules: IPRules{}, clientIP: "", allowed: true, desc: "the empty rules allow an unknown IP"},
+		{rules: internal, clientIP: "10.1.2.3", allowed: true, desc: "allow wins over deny"},
+		{rules: internal, clientIP: "fd12::1", allowed: true, desc: "an IPv6 address is allowed"},
+		{rules: internal, clientIP: "::ffff:10.1.2.3", allowed: true, desc: "an IPv4-mapped IPv6 address is allowed as IPv4"},
+		{rules: internal, clientIP: "203.0.113.1", allowed: false, desc: "an IPv4 address out of allow is denied"},
+		{rules: internal, clientIP: "2001:db8::1", allowed: false, desc: "an IPv6 address out of allow is denied"},
+		{rules: internal, clientIP: "", allowed: false, desc: "an unknown IP is denied"},
+		{rules: allowOnly, clientIP: "192.168.0.1", allowed: false, desc: "an IP out of allow is denied without deny"},
+		{rules: denyOnly, clientIP: "203.0.113.1", allowed: false, desc: "an IPv4 address in deny is denied"},
+		{rules: denyOnly, clientIP: "2001:db8::1", allowed: false, desc: "an IPv6 address in deny is denied"},
+		{rules: denyOnly, clientIP: "192.168.0.1", allowed: true, desc: "an IP out of deny is allowed without allow"},
+	}
+	for _, c := range cases {
+		assert.Equal(c.allowed, c.rules.Allows(c.clientIP), c.desc)
+	}
+}
@@ -0,0 +1,571 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+const defaultJWTClaim = "scope"
+const jwksCacheTTL = time.Hour
+const jwksMinRefreshInterval = time.Minute
+const jwksFetchTimeout = 10 * time.Second
+
+type jwtSettings struct {
+	Issuers         []string            `json:"issuer"`
+	JWKSURL         string              `json:"jwks_url"`
+	Audiences       []string            `json:"audience"`
+	RawAllowedPaths []string            `json:"allowed_paths"`
+	Claim           string              `json:"claim"`
+	RawClaimPaths   map[string][]string `json:"claim_paths"`
+	Limits          limitSettings
+}
+
+/*
+UnmarshalJSON : Unmarshal AUTH_TOKENS and check required
+*/
+func (j *jwtSettings) UnmarshalJSON(b []byte) error {
+	type jwtSettingsP struct {
+		Issuers         *jwtValues           `json:"issuer"`
+		JWKSURL         *string              `json:"jwks_url"`
+		Audiences       *jwtValues           `json:"audience"`
+		RawAllowedPaths *[]string            `json:"allowed_paths"`
+		Claim           *string              `json:"claim"`
+		RawClaimPaths   *map[string][]string `json:"claim_paths"`
+	}
+	var p jwtSettingsP
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	if p.Issuers == nil || len(*p.Issuers) == 0 {
+		return errors.New("jwt.issuer is required")
+	}
+	j.Issuers = *p.Issuers
+	if p.JWKSURL == nil {
+		return errors.New("jwt.jwks_url is required")
+	}
+	j.JWKSURL = *p.JWKSURL
+	if p.Audiences != nil {
+		j.Audiences = *p.Audiences
+	}
+	if p.RawAllowedPaths != nil {
+		j.RawAllowedPaths = *p.RawAllowedPaths
+	}
+	j.Claim = defaultJWTClaim
+	if p.Claim != nil {
+		j.Claim = *p.Claim
+	}
+	if p.RawClaimPaths != nil {
+		j.RawClaimPaths = *p.RawClaimPaths
+	}
+	return json.Unmarshal(b, &j.Limits)
+}
+
+// jwtValues is "issuer" or "audience" of jwt, which is a string or an array of strings
+// when a host accepts the tokens of several issuers or audiences.
+type jwtValues []string
+
+/*
+UnmarshalJSON : Unmarshal a string or an array of strings
+*/
+func (v *jwtValues) UnmarshalJSON(b []byte) error {
+	var value string
+	if err := json.Unmarshal(b, &value); err == nil {
+		*v = jwtValues{value}
+		return nil
+	}
+	var values []string
+	if err := json.Unmarshal(b, &values); err != nil {
+		return err
+	}
+	*v = values
+	return nil
+}
+
+/*
+JWTAuth : a struct to hold a configuration of JWT bearer tokens.
+	AllowedPaths are allowed for all verified tokens, and ClaimPaths are allowed for the tokens which have the value in Claim.
+*/
+type JWTAuth struct {
+	Verifier     *JWTVerifier
+	AllowedPaths []*regexp.Regexp
+	Claim        string
+	ClaimPaths   map[string][]*regexp.Regexp
+	Limits       Limits
+}
+
+/*
+Paths : get the allowed paths of the verified claims, AllowedPaths followed by ClaimPaths of each value in Claim.
+	The value of Claim can be a space separated string like "scope" or an array of strings like "roles".
+*/
+func (jwtAuth JWTAuth) Paths(claims Claims) []*regexp.Regexp {
+	paths := append([]*regexp.Regexp{}, jwtAuth.AllowedPaths...)
+	for _, value := range claims.Strings(jwtAuth.Claim) {
+		paths = append(paths, jwtAuth.ClaimPaths[value]...)
+	}
+	return paths
+}
+
+/*
+Claims : the claims of a verified JWT.
+*/
+type Claims map[string]interface{}
+
+/*
+Subject : get "sub" of the claims, or an empty string when it is not a string.
+*/
+func (claims Claims) Subject() string {
+	subject, _ := claims["sub"].(string)
+	return subject
+}
+
+/*
+Strings : get the values of the claim, splitting a string by spaces.
+*/
+func (claims Claims) Strings(name string) []string {
+	switch value := claims[name].(type) {
+	case string:
+		return strings.Fields(value)
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, v := range value {
+			if s, ok := v.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+/*
+JWTVerifier : a struct to verify the signature, "exp", "nbf", "iss" and "aud" of JWTs by the keys of a JWKS.
+	The keys are cached for "max-age" of "Cache-Control" or until "Expires" of the JWKS (an hour by default), and are fetched again
+	when a token is signed by an unknown key, at most once a minute not to flood the JWKS endpoint with invalid tokens.
+	With "BACKEND_CACHE_DIR", the JWKS is kept in the directory and its keys are reused after a restart until it expires.
+*/
+type JWTVerifier struct {
+	issuers     []string
+	jwksURL     string
+	audiences   []string
+	client      *http.Client
+	now         func() time.Time
+	mutex       sync.Mutex
+	keys        map[string]crypto.PublicKey
+	expiresAt   time.Time
+	attemptedAt time.Time
+	refreshing  chan struct{}
+	cacheDir    string
+	restored    bool
+}
+
+// cachedJWKS is the JWKS kept in "BACKEND_CACHE_DIR" with its expiry.
+type cachedJWKS struct {
+	URL       string          `json:"url"`
+	ExpiresAt time.Time       `json:"expires_at"`
+	JWKS      json.RawMessage `json:"jwks"`
+}
+
+/*
+NewJWTVerifier : a factory method to create JWTVerifier. audience is not checked when it is empty.
+*/
+func NewJWTVerifier(issuer string, jwksURL string, audience string) *JWTVerifier {
+	var audiences []string
+	if len(audience) > 0 {
+		audiences = []string{audience}
+	}
+	return NewJWTVerifierWithAudiences([]string{issuer}, jwksURL, audiences)
+}
+
+/*
+NewJWTVerifierWithAudiences : a factory method to create JWTVerifier which accepts any of the issuers and the audiences.
+	audiences are not checked when they are empty.
+*/
+func NewJWTVerifierWithAudiences(issuers []string, jwksURL string, audiences []string) *JWTVerifier {
+	return &JWTVerifier{
+		issuers:   issuers,
+		jwksURL:   jwksURL,
+		audiences: audiences,
+		client:    &http.Client{Timeout: jwksFetchTimeout},
+		now:       time.Now,
+		cacheDir:  os.Getenv(BackendCacheDir),
+	}
+}
+
+/*
+SetClock : replace the clock used to check "exp" and "nbf", mainly for tests.
+*/
+func (verifier *JWTVerifier) SetClock(now func() time.Time) {
+	verifier.now = now
+}
+
+/*
+SetCacheDir : replace the directory to keep the JWKS, which is "BACKEND_CACHE_DIR" by default. Nothing is kept when dir is empty.
+*/
+func (verifier *JWTVerifier) SetCacheDir(dir string) {
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+	verifier.cacheDir = dir
+	verifier.restored = false
+}
+
+/*
+BackendError : an error returned when a token can not be verified because its backend, like the JWKS endpoint, is not available.
+	It is distinguished from the tokens which are not valid, so that the caller can decide how to fail.
+*/
+type BackendError struct {
+	Err error
+}
+
+func (e *BackendError) Error() string {
+	return fmt.Sprintf("backend error: %v", e.Err)
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+/*
+Verify : verify the JWT and get its claims.
+*/
+func (verifier *JWTVerifier) Verify(token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed jwt")
+	}
+	var header jwtHeader
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed jwt header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("malformed jwt signature: %v", err)
+	}
+	if _, _, err := jwtHash(header.Alg); err != nil {
+		return nil, err
+	}
+	key, err := verifier.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyJWTSignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+	var claims Claims
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed jwt claims: %v", err)
+	}
+	if err := verifier.checkClaims(claims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	decoded, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(decoded, v)
+}
+
+func (verifier *JWTVerifier) checkClaims(claims Claims) error {
+	now := verifier.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok {
+		return errors.New("jwt exp is required")
+	}
+	if !now.Before(time.Unix(int64(exp), 0)) {
+		return errors.New("jwt is expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Before(time.Unix(int64(nbf), 0)) {
+		return errors.New("jwt is not valid yet")
+	}
+	if issuer, _ := claims["iss"].(string); !containsString(verifier.issuers, issuer) {
+		return fmt.Errorf("jwt iss mismatch: %q", issuer)
+	}
+	if len(verifier.audiences) > 0 {
+		for _, audience := range claims.Strings("aud") {
+			if containsString(verifier.audiences, audience) {
+				return nil
+			}
+		}
+		return errors.New("jwt aud mismatch")
+	}
+	return nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// jwtHash returns the hash of alg, refusing the unsupported one before the JWKS is looked up.
+func jwtHash(alg string) (hash.Hash, crypto.Hash, error) {
+	switch alg {
+	case "RS256", "ES256":
+		return sha256.New(), crypto.SHA256, nil
+	case "RS384", "ES384":
+		return sha512.New384(), crypto.SHA384, nil
+	case "RS512", "ES512":
+		return sha512.New(), crypto.SHA512, nil
+	}
+	// "none" and HMAC are refused, because the keys of a JWKS are public
+	return nil, 0, fmt.Errorf("unsupported jwt alg: %q", alg)
+}
+
+func verifyJWTSignature(alg string, key crypto.PublicKey, signingInput string, signature []byte) error {
+	h, hashID, err := jwtHash(alg)
+	if err != nil {
+		return err
+	}
+	h.Write([]byte(signingInput))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if !strings.HasPrefix(alg, "RS") {
+			return fmt.Errorf("jwt alg %s does not match the RSA key", alg)
+		}
+		if err := rsa.VerifyPKCS1v15(key, hashID, digest, signature); err != nil {
+			return errors.New("jwt signature mismatch")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if !strings.HasPrefix(alg, "ES") {
+			return fmt.Errorf("jwt alg %s does not match the EC key", alg)
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("jwt signature mismatch")
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return errors.New("jwt signature mismatch")
+		}
+		return nil
+	}
+	return errors.New("unsupported jwks key")
+}
+
+// key returns the key of kid, fetching the JWKS when the cache is expired or does not have the key.
+// A token without kid is accepted only when the JWKS has a single key.
+func (verifier *JWTVerifier) key(kid string) (crypto.PublicKey, error) {
+	verifier.mutex.Lock()
+	defer verifier.mutex.Unlock()
+
+	now := verifier.now()
+	if !verifier.restored {
+		verifier.restored = true
+		verifier.restoreKeys(now)
+	}
+	key, ok := verifier.cachedKey(kid)
+	expired := !now.Before(verifier.expiresAt)
+	throttled := !verifier.attemptedAt.IsZero() && now.Sub(verifier.attemptedAt) < jwksMinRefreshInterval
+	if (expired || !ok) && !throttled && verifier.refreshing == nil {
+		verifier.attemptedAt = now
+		if err := verifier.refresh(now); err != nil {
+			logging.Error("can not fetch the JWKS", "url", verifier.jwksURL, "error", err)
+			// keep using the cached keys while the JWKS endpoint is unavailable
+			if !ok {
+				return nil, &BackendError{Err: err}
+			}
+			return key, nil
+		}
+		key, ok = verifier.cachedKey(kid)
+	} else if !ok && verifier.refreshing != nil {
+		// the key may be brought by the fetch in flight, so it is waited for instead of being fetched again
+		verifier.waitRefresh()
+		key, ok = verifier.cachedKey(kid)
+	}
+	if !ok && verifier.keys == nil {
+		// the JWKS has never been fetched, so it is not known whether the key exists
+		return nil, &BackendError{Err: errors.New("jwks is not fetched yet")}
+	}
+	if !ok {
+		return nil, fmt.Errorf("unknown jwt kid: %q", kid)
+	}
+	return key, nil
+}
+
+// refresh fetches the JWKS and swaps the keys. It is called with the mutex locked, and unlocks it while fetching the JWKS
+// and writing the cache file, so that the tokens of the cached keys are not blocked by the JWKS endpoint.
+func (verifier *JWTVerifier) refresh(now time.Time) error {
+	refreshing := make(chan struct{})
+	verifier.refreshing = refreshing
+	verifier.mutex.Unlock()
+	rawJWKS, expiresAt, err := fetchJWKS(verifier.client, verifier.jwksURL, now)
+	var keys map[string]crypto.PublicKey
+	if err == nil {
+		keys, err = parseJWKS(rawJWKS)
+	}
+	if err == nil && now.Before(expiresAt) {
+		writeCacheFile(cacheFile(verifier.cacheDir, "jwks", verifier.jwksURL), cachedJWKS{URL: verifier.jwksURL, ExpiresAt: expiresAt, JWKS: rawJWKS})
+	}
+	verifier.mutex.Lock()
+	verifier.refreshing = nil
+	close(refreshing)
+	if err != nil {
+		return err
+	}
+	verifier.keys = keys
+	verifier.expiresAt = expiresAt
+	return nil
+}
+
+// waitRefresh waits for the fetch in flight. It is called with the mutex locked, and unlocks it while waiting.
+func (verifier *JWTVerifier) waitRefresh() {
+	refreshing := verifier.refreshing
+	verifier.mutex.Unlock()
+	<-refreshing
+	verifier.mutex.Lock()
+}
+
+// restoreKeys reads the JWKS kept in "BACKEND_CACHE_DIR" before the first fetch, unless it has expired.
+func (verifier *JWTVerifier) restoreKeys(now time.Time) {
+	path := cacheFile(verifier.cacheDir, "jwks", verifier.jwksURL)
+	var cached cachedJWKS
+	if !readCacheFile(path, &cached) || cached.URL != verifier.jwksURL || !now.Before(cached.ExpiresAt) {
+		return
+	}
+	keys, err := parseJWKS(cached.JWKS)
+	if err != nil {
+		logging.Warn("invalid backend cache ignored", "path", path, "error", err)
+		return
+	}
+	verifier.keys = keys
+	verifier.expiresAt = cached.ExpiresAt
+}
+
+func (verifier *JWTVerifier) cachedKey(kid string) (crypto.PublicKey, bool) {
+	if len(kid) == 0 && len(verifier.keys) == 1 {
+		for _, key := range verifier.keys {
+			return key, true
+		}
+	}
+	key, ok := verifier.keys[kid]
+	return key, ok
+}
+
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// fetchJWKS fetches the JWKS and returns it with its expiry, which is jwksCacheTTL later when the response does not tell it.
+func fetchJWKS(client *http.Client, jwksURL string, now time.Time) ([]byte, time.Time, error) {
+	response, err := client.Get(jwksURL)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("jwks fetch failed: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("jwks fetch failed: %s", response.Status)
+	}
+	rawJWKS, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return nil, time.Time{}, fmt.Errorf("jwks fetch failed: %v", err)
+	}
+	lifetime, ok := cacheLifetime(response.Header, now)
+	if !ok {
+		lifetime = jwksCacheTTL
+	}
+	return rawJWKS, now.Add(lifetime), nil
+}
+
+func parseJWKS(rawJWKS []byte) (map[string]crypto.PublicKey, error) {
+	var jwks struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(rawJWKS, &jwks); err != nil {
+		return nil, fmt.Errorf("jwks parse failed: %v", err)
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, k := range jwks.Keys {
+		if len(k.Use) > 0 && k.Use != "sig" {
+			continue
+		}
+		// the keys which can not be parsed are ignored like the invalid patterns
+		if key, err := k.publicKey(); err == nil {
+			keys[k.Kid] = key
+		}
+	}
+	return keys, nil
+}
+
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported jwk crv: %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("jwk point is not on the curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported jwk kty: %q", k.Kty)
+}
@@ -0,0 +1,439 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func encodeJWTPart(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func signRS256(key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signingInput := encodeJWTPart(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid}) + "." + encodeJWTPart(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func signES256(key *ecdsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	signingInput := encodeJWTPart(map[string]string{"alg": "ES256", "typ": "JWT", "kid": kid}) + "." + encodeJWTPart(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		panic(err)
+	}
+	signature := append(padBytes(r.Bytes(), 32), padBytes(s.Bytes(), 32)...)
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// padBytes pads b with leading zeros to size bytes, as the coordinates and the signatures of EC keys are fixed-size.
+func padBytes(b []byte, size int) []byte {
+	return append(make([]byte, size-len(b)), b...)
+}
+
+func rsaJWK(kid string, key *rsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "RSA",
+		"kid": kid,
+		"use": "sig",
+		"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PublicKey) map[string]string {
+	return map[string]string{
+		"kty": "EC",
+		"kid": kid,
+		"crv": "P-256",
+		"x":   base64.RawURLEncoding.EncodeToString(padBytes(key.X.Bytes(), 32)),
+		"y":   base64.RawURLEncoding.EncodeToString(padBytes(key.Y.Bytes(), 32)),
+	}
+}
+
+func TestJWTVerifier(t *testing.T) {
+	assert := assert.New(t)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	otherKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var mutex sync.Mutex
+	fetches := 0
+	jwks := map[string]interface{}{"keys": []interface{}{rsaJWK("rsa1", &rsaKey.PublicKey), ecJWK("ec1", &ecKey.PublicKey)}}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fetches++
+		json.NewEncoder(w).Encode(jwks)
+	}))
+	defer server.Close()
+	getFetches := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return fetches
+	}
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	verifier := NewJWTVerifier("https://issuer.example.com/", server.URL, "api")
+	verifier.SetClock(func() time.Time { return now })
+	claims := func(overrides map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss": "https://issuer.example.com/",
+			"aud": "api",
+			"sub": "user1",
+			"exp": now.Add(time.Minute).Unix(),
+		}
+		for k, v := range overrides {
+			if v == nil {
+				delete(c, k)
+			} else {
+				c[k] = v
+			}
+		}
+		return c
+	}
+
+	cases := []struct {
+		token string
+		err   string
+		desc  string
+	}{
+		{token: signRS256(rsaKey, "rsa1", claims(nil)), err: "", desc: "a valid RS256 token is verified"},
+		{token: signES256(ecKey, "ec1", claims(nil)), err: "", desc: "a valid ES256 token is verified"},
+		{token: signRS256(rsaKey, "rsa1", claims(map[string]interface{}{"aud": []string{"other", "api"}})), err: "", desc: "aud can be an array"},
+		{token: signRS256(otherKey, "rsa1", claims(nil)), err: "jwt signature mismatch", desc: "a token signed by another key is refused"},
+		{token: signRS256(rsaKey, "ec1", claims(nil)), err: "jwt alg RS256 does not match the EC key", desc: "a token whose alg does not match the key is refused"},
+		{token: signRS256(rsaKey, "rsa2", claims(nil)), err: `unknown jwt kid: "rsa2"`, desc: "a token signed by an unknown key is refused"},
+		{token: signRS256(rsaKey, "", claims(nil)), err: `unknown jwt kid: ""`, desc: "a token without kid is refused when the JWKS has several keys"},
+		{token: signRS256(rsaKey, "rsa1", claims(map[string]interface{}{"exp": now.Unix()})), err: "jwt is expired", desc: "an expired token is refused"},
+		{token: signRS256(rsaKey, "rsa1", claims(map[string]interface{}{"exp": nil})), err: "jwt exp is required", desc: "a token without exp is refused"},
+		{token: signRS256(rsaKey, "rsa1", claims(map[string]interface{}{"nbf": now.Add(time.Second).Unix()})), err: "jwt is not valid yet", desc: "a token before nbf is refused"},
+		{token: signRS256(rsaKey, "rsa1", claims(map[string]interface{}{"iss": "https://evil.example.com/"})), err: `jwt iss mismatch: "https://evil.example.com/"`, desc: "a token of another issuer is refused"},
+		{token: signRS256(rsaKey, "rsa1", claims(map[string]interface{}{"aud": "other"})), err: "jwt aud mismatch", desc: "a token for another audience is refused"},
+		{token: encodeJWTPart(map[string]string{"alg": "none"}) + "." + encodeJWTPart(claims(nil)) + ".", err: `unsupported jwt alg: "none"`, desc: "alg none is refused"},
+		{token: "TOKEN1", err: "malformed jwt", desc: "a literal token is refused"},
+	}
+	for _, c := range cases {
+		verified, err := verifier.Verify(c.token)
+		if len(c.err) == 0 {
+			assert.Nil(err, c.desc)
+			assert.Equal("user1", verified.Subject(), c.desc)
+		} else if assert.Error(err, c.desc) {
+			assert.Equal(c.err, err.Error(), c.desc)
+		}
+	}
+
+	t.Run("JWKS cache", func(t *testing.T) {
+		fetched := getFetches()
+		now = now.Add(jwksMinRefreshInterval)
+		verifier.Verify(signRS256(rsaKey, "rsa1", claims(nil)))
+		assert.Equal(fetched, getFetches(), "the cached keys are used for the known kid")
+
+		verifier.Verify(signRS256(rsaKey, "rsa2", claims(nil)))
+		verifier.Verify(signRS256(rsaKey, "rsa3", claims(nil)))
+		assert.Equal(fetched+1, getFetches(), "the JWKS is fetched at most once a minute for unknown kids")
+
+		mutex.Lock()
+		jwks = map[string]interface{}{"keys": []interface{}{rsaJWK("rsa2", &rsaKey.PublicKey)}}
+		mutex.Unlock()
+		now = now.Add(jwksMinRefreshInterval)
+		_, err := verifier.Verify(signRS256(rsaKey, "rsa2", claims(nil)))
+		assert.Nil(err, "the rotated key is fetched")
+		_, err = verifier.Verify(signRS256(rsaKey, "", claims(nil)))
+		assert.Nil(err, "a token without kid is verified when the JWKS has a single key")
+
+		now = now.Add(jwksCacheTTL)
+		server.Close()
+		_, err = verifier.Verify(signRS256(rsaKey, "rsa2", claims(nil)))
+		assert.Nil(err, "the cached keys are used while the JWKS endpoint is unavailable")
+	})
+}
+
+func TestJWTVerifierBackendError(t *testing.T) {
+	assert := assert.New(t)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer server.Close()
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	verifier := NewJWTVerifier("https://issuer.example.com/", server.URL, "")
+	verifier.SetClock(func() time.Time { return now })
+	signed := signRS256(rsaKey, "rsa1", map[string]interface{}{
+		"iss": "https://issuer.example.com/",
+		"exp": now.Add(time.Minute).Unix(),
+	})
+
+	_, err := verifier.Verify(signed)
+	assert.IsType(&BackendError{}, err, "the failure of the JWKS endpoint is a backend error")
+	_, err = verifier.Verify(signed)
+	assert.IsType(&BackendError{}, err, "the throttled fetch is still a backend error until the JWKS is fetched")
+	_, err = verifier.Verify("TOKEN1")
+	assert.EqualError(err, "malformed jwt", "a malformed token is not a backend error")
+}
+
+func TestJWTVerifierSlowJWKS(t *testing.T) {
+	assert := assert.New(t)
+
+	rsaKey1, _ := rsa.GenerateKey(rand.Reader, 2048)
+	rsaKey2, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var mutex sync.Mutex
+	fetches := 0
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		fetches++
+		first := fetches == 1
+		mutex.Unlock()
+		keys := []interface{}{rsaJWK("rsa1", &rsaKey1.PublicKey)}
+		if !first {
+			// the second fetch is slow, and brings the new key
+			close(started)
+			<-release
+			keys = append(keys, rsaJWK("rsa2", &rsaKey2.PublicKey))
+		}
+		w.Header().Set("Cache-Control", "max-age=60")
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": keys})
+	}))
+	defer server.Close()
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	verifier := NewJWTVerifier("https://issuer.example.com/", server.URL, "")
+	verifier.SetClock(func() time.Time { return now })
+	claims := map[string]interface{}{"iss": "https://issuer.example.com/", "exp": now.Add(time.Hour).Unix()}
+	signed1 := signRS256(rsaKey1, "rsa1", claims)
+	signed2 := signRS256(rsaKey2, "rsa2", claims)
+	_, err := verifier.Verify(signed1)
+	assert.Nil(err, "the key is fetched")
+
+	now = now.Add(2 * time.Minute)
+	verified := make(chan error, 2)
+	go func() {
+		_, err := verifier.Verify(signed2)
+		verified <- err
+	}()
+	<-started
+
+	done := make(chan error)
+	go func() {
+		_, err := verifier.Verify(signed1)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Nil(err, "the token of the cached key is verified while the JWKS is fetched")
+	case <-time.After(5 * time.Second):
+		close(release)
+		t.Fatal("the token of the cached key waits for the JWKS endpoint")
+	}
+
+	go func() {
+		_, err := verifier.Verify(signed2)
+		verified <- err
+	}()
+	close(release)
+	assert.Nil(<-verified, "the token of the new key is verified after the fetch")
+	assert.Nil(<-verified, "the token of the new key is verified after the fetch")
+	mutex.Lock()
+	defer mutex.Unlock()
+	assert.Equal(2, fetches, "the unknown key waits for the fetch in flight instead of fetching it again")
+}
+
+func TestJWTVerifierCacheDir(t *testing.T) {
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "jwks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	var mutex sync.Mutex
+	fetches := 0
+	cacheControl := "max-age=600"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		fetches++
+		w.Header().Set("Cache-Control", cacheControl)
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{rsaJWK("rsa1", &rsaKey.PublicKey)}})
+	}))
+	defer server.Close()
+	getFetches := func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return fetches
+	}
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	// restart creates a verifier sharing nothing with the previous one but the directory
+	restart := func() *JWTVerifier {
+		verifier := NewJWTVerifier("https://issuer.example.com/", server.URL, "")
+		verifier.SetClock(func() time.Time { return now })
+		verifier.SetCacheDir(dir)
+		return verifier
+	}
+	signed := func(kid string) string {
+		return signRS256(rsaKey, kid, map[string]interface{}{"iss": "https://issuer.example.com/", "exp": now.Add(time.Hour).Unix()})
+	}
+
+	_, err = restart().Verify(signed("rsa1"))
+	assert.Nil(err, "the token is verified by the fetched key")
+	assert.Equal(1, getFetches(), "the JWKS is fetched on the first start")
+
+	now = now.Add(5 * time.Minute)
+	verifier := restart()
+	_, err = verifier.Verify(signed("rsa1"))
+	assert.Nil(err, "the token is verified by the cached key after a restart")
+	assert.Equal(1, getFetches(), "the cached JWKS is reused without a fetch after a restart")
+	_, err = verifier.Verify(signed("rsa2"))
+	assert.EqualError(err, `unknown jwt kid: "rsa2"`, "an unknown kid is refused")
+	assert.Equal(2, getFetches(), "the JWKS is fetched for an unknown kid even if it is cached")
+
+	now = now.Add(10 * time.Minute)
+	_, err = restart().Verify(signed("rsa1"))
+	assert.Nil(err, "the token is verified by the key fetched again")
+	assert.Equal(3, getFetches(), "the expired JWKS is not reused after a restart")
+
+	mutex.Lock()
+	cacheControl = "no-store"
+	mutex.Unlock()
+	os.RemoveAll(dir)
+	restart().Verify(signed("rsa1"))
+	restart().Verify(signed("rsa1"))
+	assert.Equal(5, getFetches(), "the JWKS of no-store is not kept")
+}
+
+func TestJWTVerifierWithAudiences(t *testing.T) {
+	assert := assert.New(t)
+
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{rsaJWK("rsa1", &rsaKey.PublicKey)}})
+	}))
+	defer server.Close()
+
+	now := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	verifier := NewJWTVerifierWithAudiences([]string{"https://tenant-a.example.com/", "https://tenant-b.example.com/"}, server.URL, []string{"api-a", "api-b"})
+	verifier.SetClock(func() time.Time { return now })
+	claims := func(iss string, aud interface{}) map[string]interface{} {
+		return map[string]interface{}{"iss": iss, "aud": aud, "sub": "user1", "exp": now.Add(time.Minute).Unix()}
+	}
+
+	cases := []struct {
+		token string
+		err   string
+		desc  string
+	}{
+		{token: signRS256(rsaKey, "rsa1", claims("https://tenant-a.example.com/", "api-a")), err: "", desc: "the first issuer and audience are accepted"},
+		{token: signRS256(rsaKey, "rsa1", claims("https://tenant-b.example.com/", "api-b")), err: "", desc: "the second issuer and audience are accepted"},
+		{token: signRS256(rsaKey, "rsa1", claims("https://tenant-b.example.com/", []string{"other", "api-a"})), err: "", desc: "any of aud is accepted"},
+		{token: signRS256(rsaKey, "rsa1", claims("https://tenant-c.example.com/", "api-a")), err: `jwt iss mismatch: "https://tenant-c.example.com/"`, desc: "an unknown issuer is refused"},
+		{token: signRS256(rsaKey, "rsa1", claims("https://tenant-a.example.com/", "api-c")), err: "jwt aud mismatch", desc: "an unknown audience is refused"},
+	}
+	for _, c := range cases {
+		_, err := verifier.Verify(c.token)
+		if len(c.err) == 0 {
+			assert.Nil(err, c.desc)
+		} else {
+			assert.EqualError(err, c.err, c.desc)
+		}
+	}
+}
+
+func TestNewHolderWithJWT(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	os.Setenv(AuthTokens, `
+		[
+			{
+				"host": "jwt.example.com",
+				"settings": {
+					"defaults": {"allowed_methods": ["GET"]},
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {},
+					"jwt": {
+						"issuer": "https://issuer.example.com/",
+						"jwks_url": "https://issuer.example.com/.well-known/jwks.json",
+						"audience": "api",
+						"allowed_paths": ["^/public/.*$"],
+						"claim_paths": {
+							"read:foo": ["^/foo/.*$"],
+							"admin": ["^/admin/.*$"]
+						}
+					}
+				}
+			}, {
+				"host": "literal.example.com",
+				"settings": {
+					"bearer_tokens": [],
+					"basic_auths": [],
+					"no_auths": {}
+				}
+			}
+		]
+	`)
+	holder := NewHolder()
+
+	jwtAuth, ok := holder.GetJWTAuth("jwt.example.com")
+	assert.True(ok, "GetJWTAuth() returns true when jwt is set")
+	assert.Equal("scope", jwtAuth.Claim, "the claim is scope by default")
+	assert.Equal(Limits{AllowedMethods: []string{"GET"}}, jwtAuth.Limits, "the limitations inherit defaults")
+	assert.Equal([]string{"^/public/.*$"}, patternStrings(jwtAuth.Paths(Claims{})), "allowed_paths are allowed for all tokens")
+	assert.Equal([]string{"^/public/.*$", "^/foo/.*$"}, patternStrings(jwtAuth.Paths(Claims{"scope": "openid read:foo"})),
+		"claim_paths are allowed for the values of the space separated claim")
+	assert.Equal([]string{"^/public/.*$", "^/foo/.*$", "^/admin/.*$"}, patternStrings(jwtAuth.Paths(Claims{"scope": []interface{}{"read:foo", "admin"}})),
+		"claim_paths are allowed for the values of the array claim")
+
+	_, ok = holder.GetJWTAuth("literal.example.com")
+	assert.False(ok, "GetJWTAuth() returns false when jwt is not set")
+
+	var settings jwtSettings
+	assert.EqualError(json.Unmarshal([]byte(`{"jwks_url": "https://issuer.example.com/"}`), &settings), "jwt.issuer is required", "jwt.issuer is required")
+	assert.EqualError(json.Unmarshal([]byte(`{"issuer": "https://issuer.example.com/"}`), &settings), "jwt.jwks_url is required", "jwt.jwks_url is required")
+	assert.EqualError(json.Unmarshal([]byte(`{"issuer": [], "jwks_url": "https://issuer.example.com/"}`), &settings), "jwt.issuer is required", "jwt.issuer must not be empty")
+	assert.Nil(json.Unmarshal([]byte(`{"issuer": "https://a.example.com/", "jwks_url": "https://issuer.example.com/", "audience": "api"}`), &settings), "issuer and audience can be strings")
+	assert.Equal([]string{"https://a.example.com/"}, settings.Issuers, "a string issuer is a single issuer")
+	assert.Equal([]string{"api"}, settings.Audiences, "a string audience is a single audience")
+	assert.Nil(json.Unmarshal([]byte(`{"issuer": ["https://a.example.com/", "https://b.example.com/"], "jwks_url": "https://issuer.example.com/", "audience": ["api-a", "api-b"]}`), &settings),
+		"issuer and audience can be arrays")
+	assert.Equal([]string{"https://a.example.com/", "https://b.example.com/"}, settings.Issuers, "the issuers are parsed")
+	assert.Equal([]string{"api-a", "api-b"}, settings.Audiences, "the audiences are parsed")
+}
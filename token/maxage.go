@@ -0,0 +1,99 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"os"
+	"time"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+/*
+ConfigMaxAge : CONFIG_MAX_AGE is an environment variable name to set the maximum age of the token configurations loaded from "AUTH_TOKENS_PATH", like "1h".
+	When the file has not been loaded successfully within the age, it is reloaded by force,
+	and the holder is not ready until it is loaded again. It is a safety net against a stuck watcher.
+*/
+const ConfigMaxAge = "CONFIG_MAX_AGE"
+
+const minMaxAgeCheckInterval = time.Second
+
+func getConfigMaxAge() time.Duration {
+	rawMaxAge := os.Getenv(ConfigMaxAge)
+	if len(rawMaxAge) == 0 {
+		return 0
+	}
+	maxAge, err := time.ParseDuration(rawMaxAge)
+	if err != nil || maxAge <= 0 {
+		logging.Warn("invalid "+ConfigMaxAge+" ignored", "value", rawMaxAge)
+		return 0
+	}
+	return maxAge
+}
+
+func (holder *Holder) clock() time.Time {
+	return holder.clockFunc()()
+}
+
+// clockFunc returns the clock set by SetClock, which is replaced atomically not to race with the requests reading it.
+func (holder *Holder) clockFunc() func() time.Time {
+	if now, ok := holder.now.Load().(func() time.Time); ok && now != nil {
+		return now
+	}
+	return time.Now
+}
+
+// markLoaded records the time of the last successful load of the file.
+func (holder *Holder) markLoaded() {
+	holder.loadMutex.Lock()
+	defer holder.loadMutex.Unlock()
+	holder.loadedAt = holder.clock()
+}
+
+// isStale checks whether the file has not been loaded successfully within CONFIG_MAX_AGE.
+// The configurations of "AUTH_TOKENS" never get stale because they are never reloaded.
+func (holder *Holder) isStale() bool {
+	if holder.maxAge <= 0 || len(holder.rawTokensPath) == 0 {
+		return false
+	}
+	holder.loadMutex.Lock()
+	loadedAt := holder.loadedAt
+	holder.loadMutex.Unlock()
+	return holder.clock().Sub(loadedAt) >= holder.maxAge
+}
+
+// reloadIfStale reloads the file by force when it is stale, and returns true when the configurations are changed.
+func (holder *Holder) reloadIfStale() bool {
+	if !holder.isStale() {
+		return false
+	}
+	logging.Warn(holder.pathVariable()+" has not been loaded within "+ConfigMaxAge+", reload it by force", "path", holder.rawTokensPath, "max_age", holder.maxAge)
+	if !loadFile(holder, holder.rawTokensPath) {
+		return false
+	}
+	holder.notifyReload()
+	return true
+}
+
+// expire checks the age of the configurations periodically, independently of the watcher of the file.
+func expire(holder *Holder) {
+	defer holder.watchers.Done()
+	interval := holder.maxAge / 10
+	if interval < minMaxAgeCheckInterval {
+		interval = minMaxAgeCheckInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-holder.done:
+			return
+		case <-ticker.C:
+			holder.reloadIfStale()
+		}
+	}
+}
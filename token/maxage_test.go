@@ -0,0 +1,77 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetConfigMaxAge(t *testing.T) {
+	assert := assert.New(t)
+	defer os.Unsetenv(ConfigMaxAge)
+
+	cases := []struct {
+		value  string
+		maxAge time.Duration
+	}{
+		{value: "", maxAge: 0},
+		{value: "1h", maxAge: time.Hour},
+		{value: "0s", maxAge: 0},
+		{value: "-1m", maxAge: 0},
+		{value: "one hour", maxAge: 0},
+	}
+	for _, c := range cases {
+		os.Setenv(ConfigMaxAge, c.value)
+		assert.Equal(c.maxAge, getConfigMaxAge(), "CONFIG_MAX_AGE=%q", c.value)
+	}
+}
+
+func TestHolderConfigMaxAge(t *testing.T) {
+	assert := assert.New(t)
+	tmpFiles, tearDown := setUp(t)
+	defer tearDown()
+
+	tmpFile, tearDownTmpFile := setUpTmpFile(t, tmpFiles)
+	defer tearDownTmpFile()
+	tmpFile.WriteString(`[{"host": "test.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`)
+	tmpFile.Sync()
+	os.Setenv(AuthTokensPath, tmpFile.Name())
+
+	holder := NewHolder()
+	// set the max age directly not to start the periodic check against the fake clock
+	holder.maxAge = time.Hour
+	now := holder.loadedAt
+	holder.SetClock(func() time.Time { return now })
+
+	now = now.Add(59 * time.Minute)
+	assert.True(holder.IsReady(), "the holder is ready within the max age")
+	assert.False(holder.reloadIfStale(), "the file is not reloaded within the max age")
+
+	now = now.Add(time.Hour)
+	assert.False(holder.IsReady(), "the holder is not ready after the max age")
+	holder.reloadIfStale()
+	assert.Equal(now, holder.loadedAt, "the file is reloaded by force after the max age")
+	assert.True(holder.IsReady(), "the holder is ready again after the forced reload")
+
+	// an invalid file never reads the clock in the watcher, so the fake clock is not raced
+	ioutil.WriteFile(tmpFile.Name(), []byte(`[{`), 0644)
+	now = now.Add(2 * time.Hour)
+	holder.reloadIfStale()
+	assert.False(holder.IsReady(), "the holder is not ready while the file can not be reloaded")
+
+	os.Setenv(AuthTokens, `[{"host": "test.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}]`)
+	os.Unsetenv(AuthTokensPath)
+	envHolder := NewHolder()
+	envHolder.maxAge = time.Hour
+	envHolder.SetClock(func() time.Time { return now.Add(24 * time.Hour) })
+	assert.True(envHolder.IsReady(), "AUTH_TOKENS never gets stale")
+}
@@ -0,0 +1,244 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+/*
+AuthTokensDuplicateHosts : AUTH_TOKENS_DUPLICATE_HOSTS is an environment vairable name to decide how the entries of the same host are handled.
+	"merge" (default) merges them into one entry, and "error" refuses the whole configurations.
+*/
+const AuthTokensDuplicateHosts = "AUTH_TOKENS_DUPLICATE_HOSTS"
+
+/*
+DuplicateHostsMerge : the entries of the same host are merged into one entry, which is the default of "AUTH_TOKENS_DUPLICATE_HOSTS".
+*/
+const DuplicateHostsMerge = "merge"
+
+/*
+DuplicateHostsError : the configurations which have several entries of the same host are refused.
+*/
+const DuplicateHostsError = "error"
+
+func getDuplicateHosts() string {
+	if os.Getenv(AuthTokensDuplicateHosts) == DuplicateHostsError {
+		return DuplicateHostsError
+	}
+	return DuplicateHostsMerge
+}
+
+// mergeHosts merges the entries of the same host into the first entry of the host, so that each host appears once.
+// When duplicateHosts is "error", a host which appears several times is an error.
+func mergeHosts(hostSettingsList []hostSettings, duplicateHosts string) ([]hostSettings, error) {
+	merged := make([]hostSettings, 0, len(hostSettingsList))
+	indexes := map[string]int{}
+	for _, hostSettings := range hostSettingsList {
+		index, ok := indexes[hostSettings.Host]
+		if !ok {
+			indexes[hostSettings.Host] = len(merged)
+			hostSettings.AuthTokens = hostSettings.AuthTokens.uniteRules()
+			merged = append(merged, hostSettings)
+			continue
+		}
+		if duplicateHosts == DuplicateHostsError {
+			return nil, fmt.Errorf("host %s appears several times", hostSettings.Host)
+		}
+		merged[index].AuthTokens = mergeAuthTokens(merged[index].AuthTokens, hostSettings.AuthTokens)
+		merged[index].Default = merged[index].Default || hostSettings.Default
+	}
+	defaultHost := ""
+	for _, hostSettings := range merged {
+		if !hostSettings.Default {
+			continue
+		}
+		if len(defaultHost) > 0 {
+			return nil, fmt.Errorf("default is given to both hosts %s and %s", defaultHost, hostSettings.Host)
+		}
+		defaultHost = hostSettings.Host
+	}
+	return merged, nil
+}
+
+// mergeAuthTokens merges the settings of the later entry into the former one.
+// The rules are united (a bearer token, a basic authentication user or a HMAC key given in both gets the paths of both
+// and the other values of the later one), the protections are enabled when either enables them,
+// and the other values of the later entry win when they are given.
+func mergeAuthTokens(former authTokens, later authTokens) authTokens {
+	// "defaults" is applied to the rules of its own entry before the entries are merged
+	former = former.withDefaults()
+	later = later.withDefaults()
+	merged := former
+
+	merged.BearerTokens = append([]bearerTokens{}, former.BearerTokens...)
+	for _, bearerToken := range later.BearerTokens {
+		merged.BearerTokens = mergeBearerToken(merged.BearerTokens, bearerToken)
+	}
+	merged.BasicAuths = append([]basicAuths{}, former.BasicAuths...)
+	for _, basicAuth := range later.BasicAuths {
+		merged.BasicAuths = mergeBasicAuth(merged.BasicAuths, basicAuth)
+	}
+	merged.HMACAuths = append([]hmacAuths{}, former.HMACAuths...)
+	for _, hmacAuth := range later.HMACAuths {
+		merged.HMACAuths = mergeHMACAuth(merged.HMACAuths, hmacAuth)
+	}
+
+	merged.NoAuths.RawAllowedPaths = appendStrings(former.NoAuths.RawAllowedPaths, later.NoAuths.RawAllowedPaths)
+	merged.NoAuths.AllowedPathMethods = append(append([][]string{}, former.NoAuths.AllowedPathMethods...), later.NoAuths.AllowedPathMethods...)
+	merged.NoAuths.DeniedQueryParams = appendStrings(former.NoAuths.DeniedQueryParams, later.NoAuths.DeniedQueryParams)
+	merged.NoAuths.MatchQuery = former.NoAuths.MatchQuery || later.NoAuths.MatchQuery
+	merged.NoAuths.BypassProtections = former.NoAuths.BypassProtections || later.NoAuths.BypassProtections
+	if later.NoAuths.Priority != 0 {
+		merged.NoAuths.Priority = later.NoAuths.Priority
+	}
+	if later.NoAuths.RateLimit != nil {
+		merged.NoAuths.RateLimit = later.NoAuths.RateLimit
+	}
+
+	merged.UAAllows = appendStrings(former.UAAllows, later.UAAllows)
+	merged.UADenies = appendStrings(former.UADenies, later.UADenies)
+	if later.IPRules != nil {
+		if former.IPRules == nil {
+			merged.IPRules = later.IPRules
+		} else {
+			merged.IPRules = &IPRules{
+				Allow: append(append([]*net.IPNet{}, former.IPRules.Allow...), later.IPRules.Allow...),
+				Deny:  append(append([]*net.IPNet{}, former.IPRules.Deny...), later.IPRules.Deny...),
+			}
+		}
+	}
+	merged.SoftDeny = former.SoftDeny || later.SoftDeny
+	merged.UnknownTokenForbidden = former.UnknownTokenForbidden || later.UnknownTokenForbidden
+	merged.MethodOverride = former.MethodOverride || later.MethodOverride
+	merged.MatchQuery = former.MatchQuery || later.MatchQuery
+	// the decisions are not cached when either disables the cache
+	merged.Cache = former.Cache && later.Cache
+	// jwt and introspection are exclusive, so the later one replaces either of them
+	if later.JWT != nil {
+		merged.JWT = later.JWT
+		merged.Introspection = nil
+	}
+	if later.Introspection != nil {
+		merged.JWT = nil
+		merged.Introspection = later.Introspection
+	}
+	if later.RootPath != RootPathRules {
+		merged.RootPath = later.RootPath
+	}
+	if len(later.Realm) > 0 {
+		merged.Realm = later.Realm
+	}
+	return merged
+}
+
+// uniteRules unites the rules of the same bearer token, basic authentication user or HMAC key in an entry
+// in the same way as the rules of the duplicated hosts, so that all structures of the host hold them consistently.
+func (t authTokens) uniteRules() authTokens {
+	givenBearerTokens, givenBasicAuths, givenHMACAuths := t.BearerTokens, t.BasicAuths, t.HMACAuths
+	t.BearerTokens = make([]bearerTokens, 0, len(givenBearerTokens))
+	t.BasicAuths = make([]basicAuths, 0, len(givenBasicAuths))
+	t.HMACAuths = make([]hmacAuths, 0, len(givenHMACAuths))
+	for _, bearerToken := range givenBearerTokens {
+		t.BearerTokens = mergeBearerToken(t.BearerTokens, bearerToken)
+	}
+	for _, basicAuth := range givenBasicAuths {
+		t.BasicAuths = mergeBasicAuth(t.BasicAuths, basicAuth)
+	}
+	for _, hmacAuth := range givenHMACAuths {
+		t.HMACAuths = mergeHMACAuth(t.HMACAuths, hmacAuth)
+	}
+	return t
+}
+
+// withDefaults fills the limitations of the rules with "defaults", and clears "defaults" itself.
+func (t authTokens) withDefaults() authTokens {
+	t.BearerTokens = append([]bearerTokens{}, t.BearerTokens...)
+	for i := range t.BearerTokens {
+		t.BearerTokens[i].Limits = t.BearerTokens[i].Limits.withDefaults(t.Defaults)
+	}
+	t.BasicAuths = append([]basicAuths{}, t.BasicAuths...)
+	for i := range t.BasicAuths {
+		t.BasicAuths[i].Limits = t.BasicAuths[i].Limits.withDefaults(t.Defaults)
+	}
+	if t.JWT != nil {
+		jwt := *t.JWT
+		jwt.Limits = jwt.Limits.withDefaults(t.Defaults)
+		t.JWT = &jwt
+	}
+	if t.Introspection != nil {
+		introspection := *t.Introspection
+		introspection.Limits = introspection.Limits.withDefaults(t.Defaults)
+		t.Introspection = &introspection
+	}
+	t.Defaults = limitSettings{}
+	return t
+}
+
+func (l limitSettings) withDefaults(defaults limitSettings) limitSettings {
+	if l.RateLimit == nil {
+		l.RateLimit = defaults.RateLimit
+	}
+	if l.MaxBodySize == nil {
+		l.MaxBodySize = defaults.MaxBodySize
+	}
+	if l.AllowedMethods == nil {
+		l.AllowedMethods = defaults.AllowedMethods
+	}
+	return l
+}
+
+func mergeBearerToken(merged []bearerTokens, bearerToken bearerTokens) []bearerTokens {
+	for i, current := range merged {
+		if current.Token != bearerToken.Token {
+			continue
+		}
+		bearerToken.RawAllowedPaths = appendStrings(current.RawAllowedPaths, bearerToken.RawAllowedPaths)
+		bearerToken.AllowedPathMethods = append(append([][]string{}, current.AllowedPathMethods...), bearerToken.AllowedPathMethods...)
+		bearerToken.RawDeniedPaths = appendStrings(current.RawDeniedPaths, bearerToken.RawDeniedPaths)
+		bearerToken.DefaultAllow = current.DefaultAllow || bearerToken.DefaultAllow
+		merged[i] = bearerToken
+		return merged
+	}
+	return append(merged, bearerToken)
+}
+
+// mergeBasicAuth unites a user only when the password is the same. A user given with a different password is held
+// as another entry, so that each password opens only its own paths.
+func mergeBasicAuth(merged []basicAuths, basicAuth basicAuths) []basicAuths {
+	for i, current := range merged {
+		if current.Username != basicAuth.Username || current.Password != basicAuth.Password || current.PasswordHash != basicAuth.PasswordHash {
+			continue
+		}
+		basicAuth.RawAllowedPaths = appendStrings(current.RawAllowedPaths, basicAuth.RawAllowedPaths)
+		merged[i] = basicAuth
+		return merged
+	}
+	return append(merged, basicAuth)
+}
+
+func mergeHMACAuth(merged []hmacAuths, hmacAuth hmacAuths) []hmacAuths {
+	for i, current := range merged {
+		if current.KeyID != hmacAuth.KeyID {
+			continue
+		}
+		hmacAuth.RawAllowedPaths = appendStrings(current.RawAllowedPaths, hmacAuth.RawAllowedPaths)
+		merged[i] = hmacAuth
+		return merged
+	}
+	return append(merged, hmacAuth)
+}
+
+// appendStrings returns a new slice of both, and keeps nil when both are nil because nil means "not configured" for some fields.
+func appendStrings(former []string, later []string) []string {
+	if former == nil && later == nil {
+		return nil
+	}
+	return append(append([]string{}, former...), later...)
+}
@@ -0,0 +1,236 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"os"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const duplicateHostsTokens = `[
+	{
+		"host": "api.example.com",
+		"settings": {
+			"bearer_tokens": [
+				{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]},
+				{"token": "SHARED", "allowed_paths": ["^/shared/a/.*$"]}
+			],
+			"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["^/basic1/.*$"]}],
+			"no_auths": {"allowed_paths": ["^/public1/.*$"]},
+			"defaults": {"max_body_size": 100},
+			"ip_rules": {"deny": ["203.0.113.0/24"]}
+		}
+	}, {
+		"host": "other.example.com",
+		"settings": {"bearer_tokens": [{"token": "OTHER", "allowed_paths": ["^/.*$"]}], "basic_auths": [], "no_auths": {}}
+	}, {
+		"host": "api.example.com",
+		"settings": {
+			"bearer_tokens": [
+				{"token": "TOKEN2", "allowed_paths": ["^/bar/.*$"]},
+				{"token": "SHARED", "allowed_paths": ["^/shared/b/.*$"]}
+			],
+			"basic_auths": [{"username": "user2", "password": "password2", "allowed_paths": ["^/basic2/.*$"]}],
+			"no_auths": {"allowed_paths": ["^/public2/.*$"]},
+			"soft_deny": true,
+			"root_path": "deny",
+			"ip_rules": {"deny": ["2001:db8::/32"]}
+		}
+	}
+]`
+
+func TestNewHolderWithDuplicateHosts(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	t.Run("merge", func(t *testing.T) {
+		os.Setenv(AuthTokens, duplicateHostsTokens)
+		holder := NewHolder()
+
+		assert.Equal([]string{"api.example.com", "other.example.com"}, holder.GetHosts(), "the duplicated host appears once")
+		assert.Equal([]string{"TOKEN1", "SHARED", "TOKEN2"}, holder.GetTokens("api.example.com"), "the bearer tokens are united")
+		assert.Equal([]string{"OTHER"}, holder.GetTokens("other.example.com"), "the other host is not changed")
+
+		shared := []string{}
+		for _, re := range holder.GetAllowedPaths("api.example.com", "SHARED") {
+			shared = append(shared, re.String())
+		}
+		assert.Equal([]string{"^/shared/a/.*$", "^/shared/b/.*$"}, shared, "the token given in both entries gets the paths of both")
+
+		basicAuthConf := holder.GetBasicAuthConf("api.example.com")
+		assert.Equal(map[string]string{"user1": "password1"}, basicAuthConf["^/basic1/.*$"], "the basic auths of the former entry are kept")
+		assert.Equal(map[string]string{"user2": "password2"}, basicAuthConf["^/basic2/.*$"], "the basic auths of the later entry are added")
+
+		noAuthPaths := []string{}
+		for _, re := range holder.GetNoAuthPaths("api.example.com") {
+			noAuthPaths = append(noAuthPaths, re.String())
+		}
+		assert.Equal([]string{"^/public1/.*$", "^/public2/.*$"}, noAuthPaths, "the paths of no_auths are united")
+
+		assert.Equal(int64(100), holder.GetTokenLimits("api.example.com", "TOKEN1").MaxBodySize, "defaults applies to the rules of its own entry")
+		assert.Equal(int64(0), holder.GetTokenLimits("api.example.com", "TOKEN2").MaxBodySize, "defaults does not apply to the rules of the other entry")
+		assert.True(holder.IsSoftDeny("api.example.com"), "the protection enabled by either entry is enabled")
+		assert.Equal(RootPathDeny, holder.GetRootPath("api.example.com"), "the value given by the later entry wins")
+		assert.Len(holder.GetIPRules("api.example.com").Deny, 2, "the ip_rules are united")
+		assert.Equal(ValidationReport{Valid: true, Errors: []string{}, Warnings: []string{}, Hosts: 2}, Validate([]byte(duplicateHostsTokens)), "the duplicated host is valid")
+	})
+
+	t.Run("shared paths", func(t *testing.T) {
+		os.Setenv(AuthTokens, `[
+			{"host": "api.example.com", "settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+				"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["^/piyo/.*$"]}],
+				"no_auths": {"allowed_paths": ["^/public/.*$"]}
+			}},
+			{"host": "api.example.com", "settings": {
+				"bearer_tokens": [{"token": "TOKEN2", "allowed_paths": ["^/foo/.*$"]}],
+				"basic_auths": [{"username": "user2", "password": "password2", "allowed_paths": ["^/piyo/.*$"]}],
+				"no_auths": {"allowed_paths": ["^/public/.*$"]}
+			}},
+			{"host": "api.example.com", "settings": {
+				"bearer_tokens": [],
+				"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": []}],
+				"no_auths": {}
+			}}
+		]`)
+		holder := NewHolder()
+
+		assert.Equal([]string{"api.example.com"}, holder.GetHosts(), "the host given three times appears once")
+		assert.Equal([]string{"TOKEN1", "TOKEN2"}, holder.GetTokens("api.example.com"), "the bearer tokens of all entries are united")
+		assert.Equal(map[string]map[string]string{"^/piyo/.*$": {"user1": "password1", "user2": "password2"}}, holder.GetBasicAuthConf("api.example.com"),
+			"the users of the same path are merged into one map")
+		assert.Equal([]string{"^/public/.*$", "^/public/.*$"}, patternStrings(holder.GetNoAuthPaths("api.example.com")),
+			"the paths of no_auths are concatenated")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		os.Setenv(AuthTokensDuplicateHosts, DuplicateHostsError)
+		defer os.Unsetenv(AuthTokensDuplicateHosts)
+		os.Setenv(AuthTokens, duplicateHostsTokens)
+		holder := NewHolder()
+
+		assert.Equal([]string{}, holder.GetHosts(), "the configurations are refused")
+		report := Validate([]byte(duplicateHostsTokens))
+		assert.False(report.Valid, "the duplicated host is invalid")
+		assert.Equal([]string{"host api.example.com appears several times"}, report.Errors, "the duplicated host is reported")
+	})
+}
+
+func TestNewHolderWithDuplicateRules(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	patterns := func(res []*regexp.Regexp) []string {
+		raws := []string{}
+		for _, re := range res {
+			raws = append(raws, re.String())
+		}
+		return raws
+	}
+
+	t.Run("host duplicated across entries", func(t *testing.T) {
+		os.Setenv(AuthTokens, `[
+			{"host": "api.example.com", "settings": {
+				"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}],
+				"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["^/basic1/.*$"]}],
+				"no_auths": {"allowed_paths": ["^/public1/.*$"]}
+			}},
+			{"host": "api.example.com", "settings": {
+				"bearer_tokens": [{"token": "TOKEN2", "allowed_paths": ["^/bar/.*$"]}],
+				"basic_auths": [{"username": "user2", "password": "password2", "allowed_paths": ["^/basic2/.*$"]}],
+				"no_auths": {"allowed_paths": ["^/public2/.*$"]}
+			}}
+		]`)
+		holder := NewHolder()
+
+		assert.Equal([]string{"TOKEN1", "TOKEN2"}, holder.GetTokens("api.example.com"), "the bearer tokens of both entries are present")
+		assert.Equal([]string{"^/foo/.*$"}, patterns(holder.GetAllowedPaths("api.example.com", "TOKEN1")), "the allowed paths of the former token are present")
+		assert.Equal([]string{"^/bar/.*$"}, patterns(holder.GetAllowedPaths("api.example.com", "TOKEN2")), "the allowed paths of the later token are present")
+		assert.Len(holder.GetBasicAuthConf("api.example.com"), 2, "the basic auths of both entries are present")
+		assert.Equal([]string{"^/public1/.*$", "^/public2/.*$"}, patterns(holder.GetNoAuthPaths("api.example.com")), "the no-auth paths of both entries are present")
+	})
+
+	t.Run("rule duplicated in an entry", func(t *testing.T) {
+		os.Setenv(AuthTokens, `[
+			{"host": "api.example.com", "settings": {
+				"bearer_tokens": [
+					{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]},
+					{"token": "TOKEN1", "allowed_paths": ["^/bar/.*$"]}
+				],
+				"basic_auths": [
+					{"username": "user1", "password": "password1", "allowed_paths": ["^/basic1/.*$"]},
+					{"username": "user1", "password": "password1", "allowed_paths": ["^/basic2/.*$"]}
+				],
+				"no_auths": {}
+			}}
+		]`)
+		holder := NewHolder()
+
+		assert.Equal([]string{"TOKEN1"}, holder.GetTokens("api.example.com"), "the duplicated token is held once")
+		assert.Equal([]string{"^/foo/.*$", "^/bar/.*$"}, patterns(holder.GetAllowedPaths("api.example.com", "TOKEN1")), "the duplicated token gets the paths of both")
+		credentials, ok := holder.LookupBasic("api.example.com", "user1")
+		assert.True(ok, "the duplicated user is held")
+		assert.Len(credentials, 1, "the duplicated user is held once")
+		assert.Equal([]string{"^/basic1/.*$", "^/basic2/.*$"}, patterns(credentials[0].AllowedPaths), "the duplicated user gets the paths of both")
+	})
+
+	t.Run("user with different passwords", func(t *testing.T) {
+		cases := []struct {
+			tokens   string
+			expected map[string]map[string]string
+			desc     string
+		}{
+			{tokens: `[
+				{"host": "api.example.com", "settings": {
+					"bearer_tokens": [],
+					"basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["^/basic1/.*$"]}],
+					"no_auths": {}
+				}},
+				{"host": "api.example.com", "settings": {
+					"bearer_tokens": [],
+					"basic_auths": [{"username": "user1", "password": "password2", "allowed_paths": ["^/basic2/.*$"]}],
+					"no_auths": {}
+				}}
+			]`, expected: map[string]map[string]string{
+				"^/basic1/.*$": {"user1": "password1"},
+				"^/basic2/.*$": {"user1": "password2"},
+			}, desc: "across entries"},
+			{tokens: `[
+				{"host": "api.example.com", "settings": {
+					"bearer_tokens": [],
+					"basic_auths": [
+						{"username": "user1", "password": "password1", "allowed_paths": ["^/basic1/.*$"]},
+						{"username": "user1", "password_hash": "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy", "allowed_paths": ["^/basic2/.*$"]}
+					],
+					"no_auths": {}
+				}}
+			]`, expected: map[string]map[string]string{
+				"^/basic1/.*$": {"user1": "password1"},
+				"^/basic2/.*$": {"user1": "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy"},
+			}, desc: "in an entry"},
+		}
+		for _, c := range cases {
+			os.Setenv(AuthTokens, c.tokens)
+			holder := NewHolder()
+
+			assert.Equal([]string{"api.example.com"}, holder.GetHosts(), "the configurations are loaded "+c.desc)
+			assert.Equal(c.expected, holder.GetBasicAuthConf("api.example.com"), "each password keeps its own paths "+c.desc)
+			credentials, ok := holder.LookupBasic("api.example.com", "user1")
+			assert.True(ok, "the user is held "+c.desc)
+			assert.Len(credentials, 2, "the user has a credential for each password "+c.desc)
+			assert.Equal([]string{"^/basic1/.*$"}, patterns(credentials[0].AllowedPaths), "the first password opens its own paths "+c.desc)
+			assert.Equal([]string{"^/basic2/.*$"}, patterns(credentials[1].AllowedPaths), "the second password opens its own paths "+c.desc)
+			report := Validate([]byte(c.tokens))
+			assert.True(report.Valid, "the user with different passwords is valid "+c.desc)
+		}
+	})
+}
@@ -0,0 +1,133 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+const parseErrorSnippetLength = 80
+const redactedSnippet = "<redacted>"
+
+// secretValueRe matches the string values of the secrets, which may be broken like the rest of the configurations being parsed.
+var secretValueRe = regexp.MustCompile(`"(?:token|secret|password|password_hash|client_secret)"\s*:\s*"((?:[^"\\\n]|\\.)*)`)
+
+// describeParseError tells where rawTokens is broken, so that the broken entry of a large configuration is found quickly.
+// A syntax error has the line, column and text around its offset. The other errors (a missing field, a wrong type, ...)
+// have the element of the array which failed, because their offsets are relative to the nested objects.
+func describeParseError(rawTokens []byte, err error) string {
+	if syntaxErr, ok := err.(*json.SyntaxError); ok {
+		return fmt.Sprintf("%v at %s", err, describeOffset(rawTokens, syntaxErr.Offset))
+	}
+	var elements []json.RawMessage
+	if json.Unmarshal(rawTokens, &elements) != nil {
+		return err.Error()
+	}
+	cursor := 0
+	for index, element := range elements {
+		i := bytes.Index(rawTokens[cursor:], element)
+		if i < 0 {
+			break
+		}
+		start := cursor + i
+		cursor = start + len(element)
+		var settings hostSettings
+		if json.Unmarshal(element, &settings) == nil {
+			continue
+		}
+		var host struct {
+			Host string `json:"host"`
+		}
+		json.Unmarshal(element, &host)
+		return fmt.Sprintf("%v in the element [%d] (host %q) at %s", err, index, host.Host, describeOffset(rawTokens, int64(start+1)))
+	}
+	return err.Error()
+}
+
+// describeOffset returns the line and column (both start from 1) of the byte just read at the offset, and the text around it.
+// The text is a window of the line centered on the offset, because AUTH_TOKENS is often a long single line.
+func describeOffset(rawTokens []byte, offset int64) string {
+	position := int(offset) - 1
+	if position < 0 {
+		position = 0
+	}
+	if position > len(rawTokens) {
+		position = len(rawTokens)
+	}
+	lineStart := bytes.LastIndexByte(rawTokens[:position], '\n') + 1
+	lineEnd := len(rawTokens)
+	if i := bytes.IndexByte(rawTokens[lineStart:], '\n'); i >= 0 {
+		lineEnd = lineStart + i
+	}
+	line := bytes.Count(rawTokens[:position], []byte{'\n'}) + 1
+	column := position - lineStart + 1
+	// the text is logged, so the secrets are redacted like the other logs of the configurations
+	redacted, redactedPosition := redactSecrets(rawTokens, position)
+	lineStart = bytes.LastIndexByte(redacted[:redactedPosition], '\n') + 1
+	lineEnd = len(redacted)
+	if i := bytes.IndexByte(redacted[lineStart:], '\n'); i >= 0 {
+		lineEnd = lineStart + i
+	}
+	return fmt.Sprintf("line %d, column %d (offset %d): %q", line, column, offset, snippetAround(redacted[lineStart:lineEnd], redactedPosition-lineStart))
+}
+
+// redactSecrets replaces the values of the secrets with "<redacted>", and moves the position to the same text in the result.
+// A position in a secret moves to the start of "<redacted>".
+func redactSecrets(rawTokens []byte, position int) ([]byte, int) {
+	var redacted bytes.Buffer
+	redactedPosition := position
+	cursor := 0
+	for _, match := range secretValueRe.FindAllSubmatchIndex(rawTokens, -1) {
+		valueStart, valueEnd := match[2], match[3]
+		redacted.Write(rawTokens[cursor:valueStart])
+		if valueStart <= position && position < valueEnd {
+			redactedPosition = redacted.Len()
+		}
+		redacted.WriteString(redactedSnippet)
+		if valueEnd <= position {
+			redactedPosition += len(redactedSnippet) - (valueEnd - valueStart)
+		}
+		cursor = valueEnd
+	}
+	redacted.Write(rawTokens[cursor:])
+	return redacted.Bytes(), redactedPosition
+}
+
+// snippetAround returns the text of the line around the position, marking the omitted text on both sides with "...".
+func snippetAround(line []byte, position int) string {
+	start := position - parseErrorSnippetLength/2
+	if start < 0 {
+		start = 0
+	}
+	end := start + parseErrorSnippetLength
+	if end > len(line) {
+		end = len(line)
+		if start = end - parseErrorSnippetLength; start < 0 {
+			start = 0
+		}
+	}
+	// never split a multi-byte character
+	for start > 0 && !utf8.RuneStart(line[start]) {
+		start--
+	}
+	for end < len(line) && !utf8.RuneStart(line[end]) {
+		end++
+	}
+	snippet := strings.TrimSpace(string(line[start:end]))
+	if start > 0 {
+		snippet = "..." + snippet
+	}
+	if end < len(line) {
+		snippet += "..."
+	}
+	return snippet
+}
@@ -0,0 +1,113 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+func TestNewHolderParseErrorLocation(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	var buf bytes.Buffer
+	logging.SetOutput(&buf)
+	defer logging.SetOutput(ioutil.Discard)
+
+	t.Run("brokenJson", func(t *testing.T) {
+		buf.Reset()
+		os.Setenv(AuthTokens, `
+[
+	{
+		"host": "test1.example.com",
+		"settings": {
+			"bearer_tokens": [
+				{
+					"token": "TOKEN1",
+					"allowed_paths": ["^/bar/.*$"]
+				}
+			]
+			"basic_auths": [
+				{
+					"username": "user1",
+					"password": "password1",
+					"allowed_paths": ["/piyo/piyo/"]
+				}
+			],
+			"no_auths": {
+				"allowd_paths": []
+			}
+		}
+	}
+]`)
+		holder := NewHolder()
+
+		assert.Equal([]string{}, holder.GetHosts(), "the broken configurations are not loaded")
+		assert.Contains(buf.String(), "AUTH_TOKENS parse failed: invalid character", "the syntax error is logged")
+		assert.Contains(buf.String(), `at line 12, column 4 (offset 156): "\"basic_auths\": ["`, "the line, column, offset and text of the syntax error are logged")
+	})
+
+	t.Run("invalid element", func(t *testing.T) {
+		buf.Reset()
+		os.Setenv(AuthTokens, `[
+	{"host": "test1.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}},
+	{"host": "test2.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": ""}}
+]`)
+		holder := NewHolder()
+
+		assert.Equal([]string{}, holder.GetHosts(), "the invalid configurations are not loaded")
+		assert.Contains(buf.String(), `in the element [1] (host "test2.example.com") at line 3, column 2`, "the element which failed is logged")
+	})
+
+	t.Run("long single line", func(t *testing.T) {
+		buf.Reset()
+		entry := `{"host": "test%d.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}`
+		entries := []string{}
+		for i := 0; i < 5; i++ {
+			entries = append(entries, fmt.Sprintf(entry, i))
+		}
+		entries = append(entries, `{"host": "broken.example.com", "settings": {"bearer_tokens": [] "basic_auths": [], "no_auths": {}}}`)
+		rawTokens := "[" + strings.Join(entries, ", ") + "]"
+		offset := strings.Index(rawTokens, `[] "basic_auths"`) + 4
+		os.Setenv(AuthTokens, rawTokens)
+		NewHolder()
+
+		assert.Contains(buf.String(), fmt.Sprintf("at line 1, column %d (offset %d)", offset, offset), "the column of the single line is logged")
+		assert.Contains(buf.String(), `: "...`, "the text before the window is omitted")
+		assert.Contains(buf.String(), `\"settings\": {\"bearer_tokens\": [] \"basic_auths\"`, "the text around the error is logged")
+		assert.NotContains(buf.String(), "test0.example.com", "the beginning of the line is not logged")
+	})
+
+	t.Run("secrets", func(t *testing.T) {
+		buf.Reset()
+		os.Setenv(AuthTokens, `[{"host": "test1.example.com", "settings": {"bearer_tokens": [{"token": "SECRETTOKEN1" "allowed_paths": []}], `+
+			`"basic_auths": [{"username": "user1", "password": "SECRETPASSWORD1", "allowed_paths": []}], "no_auths": {}}}]`)
+		NewHolder()
+
+		assert.Contains(buf.String(), `at line 1, column 88 (offset 88)`, "the location in the original configurations is logged")
+		assert.Contains(buf.String(), `{\"token\": \"<redacted>\" \"allowed_paths\"`, "the secret is redacted in the text around the error")
+		assert.NotContains(buf.String(), "SECRETTOKEN1", "the bearer token is never logged")
+		assert.NotContains(buf.String(), "SECRETPASSWORD1", "the password is never logged")
+
+		buf.Reset()
+		os.Setenv(AuthTokens, `[{"host": "test1.example.com", "settings": {"bearer_tokens": [{"token": "SECRETTOKEN1\u00zz", "allowed_paths": []}]}}]`)
+		NewHolder()
+
+		assert.Contains(buf.String(), "AUTH_TOKENS parse failed", "the syntax error in the secret is logged")
+		assert.NotContains(buf.String(), "SECRETTOKEN1", "the broken secret is never logged")
+	})
+}
@@ -0,0 +1,107 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+var bcryptPrefixes = []string{"$2a$", "$2b$", "$2y$"}
+
+type argon2idHash struct {
+	memory  uint32
+	time    uint32
+	threads uint8
+	salt    []byte
+	key     []byte
+}
+
+/*
+IsPasswordHash : check whether the value has the prefix of the hashes accepted by "password_hash" of basic_auths,
+	which is "$2a$", "$2b$" or "$2y$" for bcrypt and "$argon2id$" for argon2id.
+*/
+func IsPasswordHash(value string) bool {
+	return isBcryptHash(value) || strings.HasPrefix(value, argon2idPrefix)
+}
+
+/*
+ComparePasswordHash : check whether the password matches the hash of "password_hash".
+*/
+func ComparePasswordHash(hash string, password string) bool {
+	if isBcryptHash(hash) {
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	}
+	parsed, err := parseArgon2idHash(hash)
+	if err != nil {
+		return false
+	}
+	key := argon2.IDKey([]byte(password), parsed.salt, parsed.time, parsed.memory, parsed.threads, uint32(len(parsed.key)))
+	return subtle.ConstantTimeCompare(key, parsed.key) == 1
+}
+
+// checkPasswordHash checks the hash of "password_hash" when loading, so that a broken hash is refused instead of rejecting the user.
+func checkPasswordHash(hash string) error {
+	switch {
+	case isBcryptHash(hash):
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return fmt.Errorf("basic_auths.password_hash is not a valid bcrypt hash: %v", err)
+		}
+		return nil
+	case strings.HasPrefix(hash, argon2idPrefix):
+		if _, err := parseArgon2idHash(hash); err != nil {
+			return fmt.Errorf("basic_auths.password_hash is not a valid argon2id hash: %v", err)
+		}
+		return nil
+	}
+	return errors.New("basic_auths.password_hash must be a bcrypt ($2a$, $2b$ or $2y$) or argon2id ($argon2id$) hash")
+}
+
+func isBcryptHash(value string) bool {
+	for _, prefix := range bcryptPrefixes {
+		if strings.HasPrefix(value, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseArgon2idHash parses the PHC string format like "$argon2id$v=19$m=65536,t=3,p=4$<salt>$<key>",
+// whose salt and key are base64 without padding.
+func parseArgon2idHash(hash string) (argon2idHash, error) {
+	var parsed argon2idHash
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return parsed, errors.New("the format must be $argon2id$v=19$m=<memory>,t=<time>,p=<threads>$<salt>$<key>")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return parsed, fmt.Errorf("the version must be v=%d: %s", argon2.Version, parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &parsed.memory, &parsed.time, &parsed.threads); err != nil {
+		return parsed, fmt.Errorf("the parameters must be m=<memory>,t=<time>,p=<threads>: %s", parts[3])
+	}
+	if parsed.time < 1 || parsed.threads < 1 {
+		return parsed, fmt.Errorf("t and p must be positive: %s", parts[3])
+	}
+	var err error
+	if parsed.salt, err = base64.RawStdEncoding.DecodeString(parts[4]); err != nil {
+		return parsed, fmt.Errorf("the salt is not base64: %v", err)
+	}
+	if parsed.key, err = base64.RawStdEncoding.DecodeString(parts[5]); err != nil || len(parsed.key) == 0 {
+		return parsed, errors.New("the key is not base64")
+	}
+	return parsed, nil
+}
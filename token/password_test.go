@@ -0,0 +1,103 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the hashes of "password1" (bcrypt with the minimum cost) and "password2" (argon2id with small parameters)
+const testBcryptHash = "$2a$04$Xkj1WVHjJUDrWkDxa0DiZu06PVDgfK4eVOZhn2BgQeYOsoc8cSr6S"
+const testArgon2idHash = "$argon2id$v=19$m=64,t=1,p=1$c29tZXNhbHQxMjM0NTY3OA$w8tgnTyjYgojBv/+Md2bfQGGv038frrIImycZ/rdwBc"
+
+func TestComparePasswordHash(t *testing.T) {
+	assert := assert.New(t)
+
+	cases := []struct {
+		hash     string
+		password string
+		expect   bool
+		desc     string
+	}{
+		{hash: testBcryptHash, password: "password1", expect: true, desc: "the password matches the bcrypt hash"},
+		{hash: testBcryptHash, password: "password2", expect: false, desc: "the wrong password does not match the bcrypt hash"},
+		{hash: testBcryptHash, password: "", expect: false, desc: "the empty password does not match the bcrypt hash"},
+		{hash: "$2a$10$XajjQvNhvvRt5GSeFk1xFeyqRrsxkhBkUiQeg0dt.wU1qD4aFDcga", password: "allmine", expect: true, desc: "the known bcrypt hash is verified"},
+		{hash: testArgon2idHash, password: "password2", expect: true, desc: "the password matches the argon2id hash"},
+		{hash: testArgon2idHash, password: "password1", expect: false, desc: "the wrong password does not match the argon2id hash"},
+		{hash: "$argon2id$v=19$m=64,t=1,p=1$broken", password: "password2", expect: false, desc: "the broken argon2id hash never matches"},
+		{hash: "password1", password: "password1", expect: false, desc: "the plain password is not a hash"},
+	}
+	for _, c := range cases {
+		assert.Equal(c.expect, ComparePasswordHash(c.hash, c.password), c.desc)
+	}
+
+	assert.True(IsPasswordHash(testBcryptHash), "the bcrypt hash is a password hash")
+	assert.True(IsPasswordHash("$2y$04$Xkj1WVHjJUDrWkDxa0DiZu06PVDgfK4eVOZhn2BgQeYOsoc8cSr6S"), "$2y$ is a bcrypt hash")
+	assert.True(IsPasswordHash(testArgon2idHash), "the argon2id hash is a password hash")
+	assert.False(IsPasswordHash("password1"), "the plain password is not a password hash")
+}
+
+func TestNewHolderWithPasswordHash(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	host := "api.example.com"
+	os.Setenv(AuthTokens, fmt.Sprintf(`[
+		{
+			"host": "%s",
+			"settings": {
+				"bearer_tokens": [],
+				"basic_auths": [
+					{"username": "user1", "password_hash": %q, "allowed_paths": ["^/piyo/.*$"]},
+					{"username": "user2", "password_hash": %q, "allowed_paths": ["^/piyo/.*$"]},
+					{"username": "user3", "password": "password3", "allowed_paths": ["^/piyo/.*$"]}
+				],
+				"no_auths": {}
+			}
+		}
+	]`, host, testBcryptHash, testArgon2idHash))
+	holder := NewHolder()
+
+	basicCredentials, ok := holder.LookupBasic(host, "user1")
+	assert.True(ok, "the user with password_hash is held")
+	assert.Equal(testBcryptHash, basicCredentials[0].PasswordHash, "the hash is held")
+	assert.Empty(basicCredentials[0].Password, "the user with password_hash has no password")
+	basicCredentials, _ = holder.LookupBasic(host, "user3")
+	assert.Equal("password3", basicCredentials[0].Password, "the plain password is still held")
+	assert.Empty(basicCredentials[0].PasswordHash, "the user with password has no hash")
+
+	assert.Equal(map[string]map[string]string{"^/piyo/.*$": {"user1": testBcryptHash, "user2": testArgon2idHash, "user3": "password3"}}, holder.GetBasicAuthConf(host),
+		"GetBasicAuthConf() has the hashes")
+	for user, value := range holder.GetBasicAuthConf(host)["^/piyo/.*$"] {
+		assert.Equal(user != "user3", IsPasswordHash(value), "IsPasswordHash() tells whether the value of %s is a hash", user)
+	}
+
+	cases := []struct {
+		basicAuth string
+		err       string
+	}{
+		{basicAuth: `{"username": "user1", "password": "password1", "password_hash": "` + testBcryptHash + `", "allowed_paths": []}`, err: "basic_auths.password and basic_auths.password_hash are both given"},
+		{basicAuth: `{"username": "user1", "password_hash": "{SHA}password1", "allowed_paths": []}`, err: "basic_auths.password_hash must be a bcrypt ($2a$, $2b$ or $2y$) or argon2id ($argon2id$) hash"},
+		{basicAuth: `{"username": "user1", "password_hash": "$2a$04$short", "allowed_paths": []}`, err: "basic_auths.password_hash is not a valid bcrypt hash"},
+		{basicAuth: `{"username": "user1", "password_hash": "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5", "allowed_paths": []}`, err: "basic_auths.password_hash is not a valid argon2id hash: the version must be v=19"},
+		{basicAuth: `{"username": "user1", "allowed_paths": []}`, err: "basic_auths.password is required"},
+	}
+	for _, c := range cases {
+		var basicAuth basicAuths
+		err := json.Unmarshal([]byte(c.basicAuth), &basicAuth)
+		if assert.Error(err, c.basicAuth) {
+			assert.Contains(err.Error(), c.err, c.basicAuth)
+		}
+	}
+}
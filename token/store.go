@@ -0,0 +1,67 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"regexp"
+	"time"
+)
+
+/*
+CredentialStore : an interface to look up credentials.
+	Holder is the default in-memory implementation, and a store backed by a database or a secret manager can be used instead.
+	host is the "host" of the configuration which matches the request, not the request host itself.
+	Lookup methods return false when the credential does not exist or can not be looked up.
+	LookupBasic returns all credentials of the username, because the same username can be given with different passwords
+	which open different paths.
+*/
+type CredentialStore interface {
+	LookupBearer(host string, token string) (BearerCredential, bool)
+	LookupBasic(host string, username string) ([]BasicCredential, bool)
+}
+
+/*
+BearerCredential : a struct to hold the allowed paths and the limitations of a bearer token.
+	AllowedPathMethods holds the methods of the allowed paths scoped to methods, and the other allowed paths allow all methods.
+	DeniedPaths are denied even if they match AllowedPaths, and all other paths are allowed when DefaultAllow is true.
+	ValidUntil is zero when the token does not expire.
+	ExactHost is the host which the requested host must equal exactly, or empty when it is not required.
+	Label identifies the rule in the statistics without revealing the token, or is empty when it is unknown.
+*/
+type BearerCredential struct {
+	AllowedPaths       []*regexp.Regexp
+	AllowedPathMethods map[*regexp.Regexp][]string
+	DeniedPaths        []*regexp.Regexp
+	DefaultAllow       bool
+	ExactHost          string
+	Label              string
+	ValidUntil         time.Time
+	Limits             Limits
+}
+
+/*
+BasicCredential : a struct to hold the password, the allowed paths and the limitations of a basic authentication user.
+	ExactHost is the host which the requested host must equal exactly, or empty when it is not required.
+	Label identifies the rule in the statistics, or is empty when it is unknown.
+	PasswordHash is the bcrypt or argon2id hash of "password_hash", which is compared instead of Password when it is given.
+*/
+type BasicCredential struct {
+	Password     string
+	PasswordHash string
+	AllowedPaths []*regexp.Regexp
+	ExactHost    string
+	Label        string
+	Limits       Limits
+}
+
+// secret returns the hash of password_hash when it is given, or the password.
+func (c BasicCredential) secret() string {
+	if len(c.PasswordHash) > 0 {
+		return c.PasswordHash
+	}
+	return c.Password
+}
@@ -0,0 +1,106 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+/*
+AuthTokensMinLength : AUTH_TOKENS_MIN_LENGTH is an environment vairable name to set the minimum length of bearer tokens.
+	The check is disabled when it is not set or 0.
+*/
+const AuthTokensMinLength = "AUTH_TOKENS_MIN_LENGTH"
+
+/*
+AuthTokensMinEntropy : AUTH_TOKENS_MIN_ENTROPY is an environment vairable name to set the minimum entropy (bits) of bearer tokens.
+	The check is disabled when it is not set or 0.
+*/
+const AuthTokensMinEntropy = "AUTH_TOKENS_MIN_ENTROPY"
+
+/*
+AuthTokensStrict : AUTH_TOKENS_STRICT is an environment vairable name to refuse weak bearer tokens instead of warning them.
+*/
+const AuthTokensStrict = "AUTH_TOKENS_STRICT"
+
+type tokenPolicy struct {
+	minLength  int
+	minEntropy float64
+	strict     bool
+}
+
+func getTokenPolicy() tokenPolicy {
+	var policy tokenPolicy
+	if minLength, err := strconv.Atoi(os.Getenv(AuthTokensMinLength)); err == nil && minLength > 0 {
+		policy.minLength = minLength
+	}
+	if minEntropy, err := strconv.ParseFloat(os.Getenv(AuthTokensMinEntropy), 64); err == nil && minEntropy > 0 {
+		policy.minEntropy = minEntropy
+	}
+	if strict, err := strconv.ParseBool(os.Getenv(AuthTokensStrict)); err == nil {
+		policy.strict = strict
+	}
+	return policy
+}
+
+// check returns the reason why the token is weak, or an empty string when the token is strong enough.
+func (policy tokenPolicy) check(host string, token string) string {
+	if len(token) < policy.minLength {
+		return fmt.Sprintf("bearer token %s on %s is shorter than %d characters", maskToken(token), host, policy.minLength)
+	}
+	if entropy := tokenEntropy(token); entropy < policy.minEntropy {
+		return fmt.Sprintf("bearer token %s on %s has low entropy (%.1f bits < %.1f bits)", maskToken(token), host, entropy, policy.minEntropy)
+	}
+	return ""
+}
+
+// allow reports whether the token can be loaded, and records the warning of a weak token.
+func (policy tokenPolicy) allow(host string, token string, warnings *[]string) bool {
+	warning := policy.check(host, token)
+	if len(warning) == 0 {
+		return true
+	}
+	*warnings = append(*warnings, warning)
+	if policy.strict {
+		logging.Warn("weak token refused", "warning", warning)
+		return false
+	}
+	logging.Warn("weak token", "warning", warning)
+	return true
+}
+
+// tokenEntropy estimates the entropy (bits) of the token by the Shannon entropy of its characters.
+func tokenEntropy(token string) float64 {
+	if len(token) == 0 {
+		return 0
+	}
+	counts := map[rune]int{}
+	length := 0
+	for _, c := range token {
+		counts[c]++
+		length++
+	}
+	var perChar float64
+	for _, count := range counts {
+		p := float64(count) / float64(length)
+		perChar -= p * math.Log2(p)
+	}
+	return perChar * float64(length)
+}
+
+// maskToken hides the token except the first characters not to write secrets to the log.
+func maskToken(token string) string {
+	if len(token) < 8 {
+		return `"***"`
+	}
+	return fmt.Sprintf(`"%s***"`, token[:2])
+}
@@ -0,0 +1,133 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+)
+
+/*
+ValidationReport : a struct to hold the result of validating candidate token configurations.
+*/
+type ValidationReport struct {
+	Valid    bool     `json:"valid"`
+	Errors   []string `json:"errors"`
+	Warnings []string `json:"warnings"`
+	Hosts    int      `json:"hosts"`
+}
+
+/*
+Validate : validate candidate token configurations without applying them.
+	The configurations are parsed and loaded into a new Holder in the same way as "AUTH_TOKENS",
+	so the warnings include the patterns ignored when loading and the weak bearer tokens.
+*/
+func Validate(rawTokens []byte) ValidationReport {
+	report := ValidationReport{Errors: []string{}, Warnings: []string{}}
+	var hostSettingsList []hostSettings
+	if err := json.Unmarshal(rawTokens, &hostSettingsList); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+		return report
+	}
+	if _, err := mergeHosts(hostSettingsList, getDuplicateHosts()); err != nil {
+		report.Errors = append(report.Errors, err.Error())
+	}
+	for _, hostSettings := range hostSettingsList {
+		errors, warnings := invalidPatterns(hostSettings)
+		report.Errors = append(report.Errors, errorStrings(errors)...)
+		report.Warnings = append(report.Warnings, errorStrings(warnings)...)
+	}
+
+	// build a candidate snapshot to collect the warnings, the live Holder is never touched
+	candidate, _ := buildConfig(rawTokens)
+	report.Warnings = append(report.Warnings, candidate.warnings...)
+	report.Hosts = len(candidate.hosts)
+	report.Valid = len(report.Errors) == 0
+	return report
+}
+
+/*
+PatternError : an error of a pattern which can not be compiled and is ignored when loading the token configurations.
+	Rule is the label of the bearer token, the username of basic_auths, the key_id of hmac_auths or the claim value of jwt.claim_paths,
+	and empty for the fields of the host. The bearer token itself is never held.
+*/
+type PatternError struct {
+	Field   string
+	Host    string
+	Rule    string
+	Pattern string
+	Err     error
+}
+
+func (e *PatternError) Error() string {
+	if len(e.Rule) > 0 {
+		return fmt.Sprintf("%s on %s: invalid pattern %q of %s: %v", e.Field, e.Host, e.Pattern, e.Rule, e.Err)
+	}
+	return fmt.Sprintf("%s on %s: invalid pattern %q: %v", e.Field, e.Host, e.Pattern, e.Err)
+}
+
+// invalidPatterns reports the invalid patterns of the host. The invalid patterns of the host, basic_auths and no_auths
+// are errors because ignoring them changes which rule applies, and the others are warnings.
+func invalidPatterns(hostSettings hostSettings) ([]error, []error) {
+	var errors, warnings []error
+	check := func(reports *[]error, field string, rule string, rawPatterns []string) {
+		for _, rawPattern := range rawPatterns {
+			if _, err := regexp.Compile(rawPattern); err != nil {
+				*reports = append(*reports, &PatternError{Field: field, Host: hostSettings.Host, Rule: rule, Pattern: rawPattern, Err: err})
+			}
+		}
+	}
+	settings := hostSettings.AuthTokens
+	check(&errors, "host", "", []string{hostSettings.Host})
+	for _, basicAuth := range settings.BasicAuths {
+		check(&errors, "basic_auths.allowed_paths", basicAuth.Username, basicAuth.RawAllowedPaths)
+	}
+	check(&errors, "no_auths.allowed_paths", "", settings.NoAuths.RawAllowedPaths)
+	for index, bearerToken := range settings.BearerTokens {
+		label := ruleLabel(bearerToken.Label, "bearer_tokens", index)
+		check(&warnings, "bearer_tokens.allowed_paths", label, bearerToken.RawAllowedPaths)
+		check(&warnings, "bearer_tokens.denied_paths", label, bearerToken.RawDeniedPaths)
+	}
+	for _, hmacAuth := range settings.HMACAuths {
+		check(&warnings, "hmac_auths.allowed_paths", hmacAuth.KeyID, hmacAuth.RawAllowedPaths)
+	}
+	if settings.JWT != nil {
+		check(&warnings, "jwt.allowed_paths", "", settings.JWT.RawAllowedPaths)
+		values := make([]string, 0, len(settings.JWT.RawClaimPaths))
+		for value := range settings.JWT.RawClaimPaths {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			check(&warnings, "jwt.claim_paths", value, settings.JWT.RawClaimPaths[value])
+		}
+	}
+	if settings.Introspection != nil {
+		check(&warnings, "introspection.allowed_paths", "", settings.Introspection.RawAllowedPaths)
+		values := make([]string, 0, len(settings.Introspection.RawClaimPaths))
+		for value := range settings.Introspection.RawClaimPaths {
+			values = append(values, value)
+		}
+		sort.Strings(values)
+		for _, value := range values {
+			check(&warnings, "introspection.claim_paths", value, settings.Introspection.RawClaimPaths[value])
+		}
+	}
+	check(&warnings, "user_agent_allow", "", settings.UAAllows)
+	check(&warnings, "user_agent_deny", "", settings.UADenies)
+	return errors, warnings
+}
+
+func errorStrings(errs []error) []string {
+	messages := make([]string, 0, len(errs))
+	for _, err := range errs {
+		messages = append(messages, err.Error())
+	}
+	return messages
+}
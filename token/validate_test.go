@@ -0,0 +1,58 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	_, tearDown := setUp(t)
+	defer tearDown()
+
+	t.Run("valid configurations", func(t *testing.T) {
+		report := Validate([]byte(`[
+			{"host": "test1.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$"]}], "basic_auths": [], "no_auths": {}}},
+			{"host": "test2.example.com", "settings": {"bearer_tokens": [], "basic_auths": [], "no_auths": {}}}
+		]`))
+		assert.Equal(ValidationReport{Valid: true, Errors: []string{}, Warnings: []string{}, Hosts: 2}, report, "the configurations are valid")
+	})
+
+	t.Run("warnings", func(t *testing.T) {
+		os.Setenv(AuthTokensMinLength, "16")
+		defer os.Unsetenv(AuthTokensMinLength)
+		report := Validate([]byte(`[
+			{"host": "test1.example.com", "settings": {"bearer_tokens": [{"token": "TOKEN1", "allowed_paths": ["^/foo/.*$", "("]}], "basic_auths": [], "no_auths": {}}}
+		]`))
+		assert.True(report.Valid, "the configurations are valid with warnings")
+		assert.Len(report.Warnings, 2, "the ignored pattern and the weak token are warned")
+		assert.Contains(report.Warnings[0], `bearer_tokens.allowed_paths on test1.example.com: invalid pattern "("`, "the ignored pattern is warned")
+		assert.Contains(report.Warnings[1], "shorter than 16 characters", "the weak token is warned")
+		assert.Equal(1, report.Hosts, "the number of hosts is reported")
+	})
+
+	t.Run("invalid patterns", func(t *testing.T) {
+		report := Validate([]byte(`[
+			{"host": "(", "settings": {"bearer_tokens": [], "basic_auths": [{"username": "user1", "password": "password1", "allowed_paths": ["["]}], "no_auths": {"allowed_paths": ["*"]}}}
+		]`))
+		assert.False(report.Valid, "the configurations are invalid")
+		assert.Len(report.Errors, 3, "the patterns compiled when matching requests are errors")
+	})
+
+	t.Run("invalid json", func(t *testing.T) {
+		for _, rawTokens := range []string{`invalid`, `[{"host": "test1.example.com"}]`, `[{"host": "test1.example.com", "settings": {"basic_auths": [], "no_auths": {}}}]`} {
+			report := Validate([]byte(rawTokens))
+			assert.False(report.Valid, "the configurations are invalid: %s", rawTokens)
+			assert.Len(report.Errors, 1, "the parse error is reported: %s", rawTokens)
+			assert.Equal(0, report.Hosts, "no host is counted: %s", rawTokens)
+		}
+	})
+}
@@ -0,0 +1,93 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+
+	"github.com/RoboticBase/fiware-ambassador-auth/logging"
+)
+
+/*
+AuthTokensFormat : AUTH_TOKENS_FORMAT is an environment variable name to set the format of token configurations, "json" or "yaml".
+	When it is not set, the file of "AUTH_TOKENS_PATH" whose extension is ".yaml" or ".yml" is YAML, and the others are JSON.
+*/
+const AuthTokensFormat = "AUTH_TOKENS_FORMAT"
+
+const formatJSON = "json"
+const formatYAML = "yaml"
+
+// getTokensFormat returns the format of the token configurations read from rawTokensPath, or from "AUTH_TOKENS" when it is empty.
+func getTokensFormat(rawTokensPath string) string {
+	switch format := strings.ToLower(os.Getenv(AuthTokensFormat)); format {
+	case formatJSON, formatYAML:
+		return format
+	case "yml":
+		return formatYAML
+	case "":
+	default:
+		logging.Warn("unknown "+AuthTokensFormat+" ignored", "value", format)
+	}
+	switch strings.ToLower(filepath.Ext(rawTokensPath)) {
+	case ".yaml", ".yml":
+		return formatYAML
+	default:
+		return formatJSON
+	}
+}
+
+// yamlToJSON converts the YAML token configurations to JSON, so that they are parsed and checked
+// by the same UnmarshalJSON as the JSON ones.
+func yamlToJSON(rawTokens []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(rawTokens, &document); err != nil {
+		return nil, err
+	}
+	converted, err := convertYAML(document)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(converted)
+}
+
+// convertYAML replaces the maps decoded from YAML, whose keys can be any type, with the maps of string keys.
+func convertYAML(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			k, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("yaml key must be a string: %v", key)
+			}
+			converted, err := convertYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			m[k] = converted
+		}
+		return m, nil
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, item := range v {
+			converted, err := convertYAML(item)
+			if err != nil {
+				return nil, err
+			}
+			l[i] = converted
+		}
+		return l, nil
+	default:
+		return v, nil
+	}
+}
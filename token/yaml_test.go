@@ -0,0 +1,197 @@
+/*
+Package token : hold token configurations to check sing HTTP Header.
+
+	license: Apache license 2.0
+	copyright: Nobuyuki Matsui <nobuyuki.matsui@gmail.com>
+*/
+package token
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const validYAML = `
+- host: test\.example\.com
+  settings:
+    bearer_tokens:
+      - token: TOKEN1
+        allowed_paths: ['^/foo/\d+/.*$', '^/bar/.*$']
+        allowed_methods: [GET]
+      - token: TOKEN2
+        allowed_paths:
+          - path: ^/baz/.*$
+            methods: [GET, HEAD]
+    basic_auths:
+      - username: user1
+        password: password1
+        allowed_paths: [/piyo/.+/]
+    no_auths:
+      allowed_paths: ['^.*/static/.+$']
+`
+
+func setUpYAMLFile(t *testing.T, tmpFiles *[]string, ext string, content string) string {
+	t.Helper()
+	fp, err := ioutil.TempFile("", tmpFilePrefix+ext)
+	if err != nil {
+		panic(err)
+	}
+	*tmpFiles = append(*tmpFiles, fp.Name())
+	defer fp.Close()
+	if _, err := fp.WriteString(content); err != nil {
+		panic(err)
+	}
+	return fp.Name()
+}
+
+func assertValidYAML(t *testing.T, holder *Holder) {
+	t.Helper()
+	assert := assert.New(t)
+	host := `test\.example\.com`
+
+	assert.Equal([]string{host}, holder.GetHosts(), "the hosts are loaded from YAML")
+	assert.Equal([]string{"TOKEN1", "TOKEN2"}, holder.GetTokens(host), "the bearer tokens are loaded from YAML")
+	assert.Equal([]string{`^/foo/\d+/.*$`, "^/bar/.*$"}, patternStrings(holder.GetAllowedPaths(host, "TOKEN1")),
+		"the allowed paths are loaded from YAML")
+	assert.Equal(Limits{AllowedMethods: []string{"GET"}}, holder.GetTokenLimits(host, "TOKEN1"), "the limitations are loaded from YAML")
+	allowedPaths := holder.GetAllowedPaths(host, "TOKEN2")
+	assert.Equal([]string{"GET", "HEAD"}, holder.GetAllowedPathMethods(host, "TOKEN2")[allowedPaths[0]],
+		"the method scoped paths are loaded from YAML")
+	assert.Equal(map[string]map[string]string{"/piyo/.+/": {"user1": "password1"}}, holder.GetBasicAuthConf(host),
+		"the basic auths are loaded from YAML")
+	assert.Equal([]string{"^.*/static/.+$"}, patternStrings(holder.GetNoAuthPaths(host)), "the no auths are loaded from YAML")
+}
+
+func TestNewHolderWithYAML(t *testing.T) {
+	t.Run("AUTH_TOKENS_PATH has .yaml extension", func(t *testing.T) {
+		tmpFiles, tearDown := setUp(t)
+		defer tearDown()
+		os.Setenv(AuthTokensPath, setUpYAMLFile(t, tmpFiles, ".yaml", validYAML))
+		assertValidYAML(t, NewHolder())
+	})
+
+	t.Run("AUTH_TOKENS_PATH has .yml extension", func(t *testing.T) {
+		tmpFiles, tearDown := setUp(t)
+		defer tearDown()
+		os.Setenv(AuthTokensPath, setUpYAMLFile(t, tmpFiles, ".yml", validYAML))
+		assertValidYAML(t, NewHolder())
+	})
+
+	t.Run("AUTH_TOKENS_FORMAT is yaml", func(t *testing.T) {
+		tmpFiles, tearDown := setUp(t)
+		defer tearDown()
+		os.Setenv(AuthTokensFormat, "yaml")
+		os.Setenv(AuthTokensPath, setUpYAMLFile(t, tmpFiles, ".conf", validYAML))
+		assertValidYAML(t, NewHolder())
+	})
+
+	t.Run("AUTH_TOKENS_FORMAT is yaml for AUTH_TOKENS", func(t *testing.T) {
+		_, tearDown := setUp(t)
+		defer tearDown()
+		os.Setenv(AuthTokensFormat, "YAML")
+		os.Setenv(AuthTokens, validYAML)
+		assertValidYAML(t, NewHolder())
+	})
+
+	t.Run("AUTH_TOKENS_FORMAT is json", func(t *testing.T) {
+		tmpFiles, tearDown := setUp(t)
+		defer tearDown()
+		os.Setenv(AuthTokensFormat, "json")
+		os.Setenv(AuthTokensPath, setUpYAMLFile(t, tmpFiles, ".yaml", validYAML))
+		assert.Equal(t, []string{}, NewHolder().GetHosts(), "the .yaml file is parsed as JSON when AUTH_TOKENS_FORMAT is json")
+	})
+
+	t.Run("AUTH_TOKENS is JSON by default", func(t *testing.T) {
+		_, tearDown := setUp(t)
+		defer tearDown()
+		os.Setenv(AuthTokens, validYAML)
+		assert.Equal(t, []string{}, NewHolder().GetHosts(), "AUTH_TOKENS is parsed as JSON by default")
+	})
+}
+
+func TestNewHolderWithInvalidYAML(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		name string
+		yaml string
+	}{
+		{name: "lostHost", yaml: `
+- settings:
+    bearer_tokens: []
+    basic_auths: []
+    no_auths: {}
+`},
+		{name: "lostSettings", yaml: `
+- host: test.example.com
+`},
+		{name: "lostBearerTokens", yaml: `
+- host: test.example.com
+  settings:
+    basic_auths: []
+    no_auths: {}
+`},
+		{name: "lostBearerToken", yaml: `
+- host: test.example.com
+  settings:
+    bearer_tokens:
+      - allowed_paths: [^/bar/.*$]
+    basic_auths: []
+    no_auths: {}
+`},
+		{name: "lostBearerAllowedPaths", yaml: `
+- host: test.example.com
+  settings:
+    bearer_tokens:
+      - token: TOKEN1
+    basic_auths: []
+    no_auths: {}
+`},
+		{name: "lostBasicAuths", yaml: `
+- host: test.example.com
+  settings:
+    bearer_tokens: []
+    no_auths: {}
+`},
+		{name: "lostBasicPassword", yaml: `
+- host: test.example.com
+  settings:
+    bearer_tokens: []
+    basic_auths:
+      - username: user1
+        allowed_paths: [/piyo/piyo/]
+    no_auths: {}
+`},
+		{name: "lostNoAuths", yaml: `
+- host: test.example.com
+  settings:
+    bearer_tokens: []
+    basic_auths: []
+`},
+		{name: "malformed", yaml: `
+- host: test.example.com
+  settings: [
+`},
+		{name: "nonStringKey", yaml: `
+- host: test.example.com
+  settings:
+    bearer_tokens: []
+    basic_auths: []
+    no_auths: {}
+    1: invalid
+`},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			tmpFiles, tearDown := setUp(t)
+			defer tearDown()
+			os.Setenv(AuthTokensPath, setUpYAMLFile(t, tmpFiles, ".yaml", testCase.yaml))
+			holder := NewHolder()
+			assert.Equal([]string{}, holder.GetHosts(), "GetHosts() returns empty slice when %s", testCase.name)
+		})
+	}
+}